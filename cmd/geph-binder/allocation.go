@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abh/geoip"
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/patrickmn/go-cache"
+)
+
+// bridgesPerRequest is how many bridges a single request gets at most.
+const bridgesPerRequest = 8
+
+// maxLearnedBridges is how many distinct bridges a single identity can learn within learnedWindow.
+const maxLearnedBridges = 24
+
+const learnedWindow = time.Hour * 24 * 30
+
+// maxPerASN is how many bridges in the same autonomous system a single request gets at most.
+const maxPerASN = 2
+
+// allocSecret keys the rendezvous hashing, so that nobody else can predict which bridges an identity gets.
+var allocSecret string
+
+var asnDB *geoip.GeoIP
+
+func init() {
+	var e error
+	asnDB, e = geoip.Open("/usr/share/GeoIP/GeoIPASNum.dat")
+	if e != nil {
+		log.Println("cannot open ASN database, ASN diversity disabled:", e)
+		asnDB = nil
+	}
+}
+
+// bridgeASN returns the autonomous system of a bridge host, or "" if unknown.
+func bridgeASN(host string) string {
+	if asnDB == nil {
+		return ""
+	}
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return ""
+	}
+	name, _ := asnDB.GetName(h)
+	return strings.Split(name, " ")[0]
+}
+
+// lookupASN is how allocate finds the ASN of a bridge host. Tests replace it.
+var lookupASN = bridgeASN
+
+// identity cache: string => *learnedSet
+var learnedCache = cache.New(learnedWindow, time.Hour)
+
+// learnedSet is the set of bridges an identity has learned about. Guarded by allocLock.
+type learnedSet struct {
+	cookies map[string]time.Time
+}
+
+// getLearnedSet returns the learned set of an identity, creating it if needed. The caller must hold allocLock.
+func getLearnedSet(id string) *learnedSet {
+	if v, ok := learnedCache.Get(id); ok {
+		return v.(*learnedSet)
+	}
+	ls := &learnedSet{cookies: make(map[string]time.Time)}
+	learnedCache.SetDefault(id, ls)
+	return ls
+}
+
+// knows returns whether the bridge was learned within learnedWindow.
+func (ls *learnedSet) knows(cookie string) bool {
+	t, ok := ls.cookies[cookie]
+	return ok && time.Since(t) < learnedWindow
+}
+
+// count returns the number of bridges learned within learnedWindow, forgetting older ones.
+func (ls *learnedSet) count() int {
+	for k, t := range ls.cookies {
+		if time.Since(t) >= learnedWindow {
+			delete(ls.cookies, k)
+		}
+	}
+	return len(ls.cookies)
+}
+
+// requestor identifies who is asking for bridges.
+type requestor struct {
+	// stable is the identity used to pick a stable subset: the user ID when known, otherwise the IP prefix.
+	stable string
+	// capped are the identities whose learned bridges are capped.
+	capped  []string
+	country string
+}
+
+// ipPrefix returns the /24 (IPv4) or /48 (IPv6) network of an address.
+func ipPrefix(addr string) string {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return "invalid"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+func getRequestor(r *http.Request) (rq requestor) {
+	cinfo := getClientInfo(r)
+	rq.country = cinfo.Country
+	prefix := "net:" + ipPrefix(cinfo.Address)
+	rq.stable = prefix
+	rq.capped = []string{prefix}
+	// goodIPCache remembers which user last got a ticket from this IP
+	if uid, ok := goodIPCache.Get(cinfo.Address); ok {
+		rq.stable = fmt.Sprintf("uid:%v", uid)
+		rq.capped = append(rq.capped, rq.stable)
+	}
+	return
+}
+
+var allocLock sync.Mutex
+
+// allocate picks the bridges to give to a requestor. Bridges are ranked by rendezvous hashing on the requestor's stable identity, so the same requestor keeps getting the same bridges. Already-learned bridges are preferred, new ones are only handed out while every capped identity is below maxLearnedBridges, and at most one bridge per allocation group and maxPerASN per ASN are returned. Bridges that fail probes or look blocked in the requestor's country are skipped.
+func allocate(rq requestor) (toret []bridgeInfo) {
+	var candidates []bridgeInfo
+	for _, item := range bridgeCache.Items() {
+		bi := item.Object.(bridgeInfo)
+		if !isHealthy(bi.Cookie) || isBadIn(bi.Cookie, rq.country) {
+			continue
+		}
+		candidates = append(candidates, bi)
+	}
+	scores := make(map[string][32]byte)
+	for _, bi := range candidates {
+		scores[string(bi.Cookie)] = sha256.Sum256([]byte(allocSecret + rq.stable + string(bi.Cookie)))
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		si := scores[string(candidates[i].Cookie)]
+		sj := scores[string(candidates[j].Cookie)]
+		return string(si[:]) < string(sj[:])
+	})
+
+	allocLock.Lock()
+	defer allocLock.Unlock()
+	var sets []*learnedSet
+	for _, id := range rq.capped {
+		sets = append(sets, getLearnedSet(id))
+	}
+	known := func(cookie string) bool {
+		for _, ls := range sets {
+			if ls.knows(cookie) {
+				return true
+			}
+		}
+		return false
+	}
+	canLearn := func() bool {
+		for _, ls := range sets {
+			if ls.count() >= maxLearnedBridges {
+				return false
+			}
+		}
+		return true
+	}
+	seenAGs := make(map[string]bool)
+	seenASNs := make(map[string]int)
+	pick := func(bi bridgeInfo) {
+		if len(toret) >= bridgesPerRequest || seenAGs[bi.AllocGroup] {
+			return
+		}
+		asn := lookupASN(bi.Host)
+		if asn != "" && seenASNs[asn] >= maxPerASN {
+			return
+		}
+		if !known(string(bi.Cookie)) {
+			if !canLearn() {
+				return
+			}
+			for _, ls := range sets {
+				ls.cookies[string(bi.Cookie)] = time.Now()
+			}
+		}
+		seenAGs[bi.AllocGroup] = true
+		seenASNs[asn]++
+		toret = append(toret, bi)
+	}
+	// first the bridges they already know, then new ones
+	for _, bi := range candidates {
+		if known(string(bi.Cookie)) {
+			pick(bi)
+		}
+	}
+	for _, bi := range candidates {
+		pick(bi)
+	}
+	return
+}
+
+// reportedCache remembers who reported on which bridge, so that one identity gets one vote per bridge per reportInterval. string => bool
+var reportedCache = cache.New(reportInterval, time.Minute)
+
+const reportInterval = time.Minute * 10
+
+// reportReachability records client reachability reports. Only bridges the requestor actually learned about count, so that nobody can smear bridges they don't know.
+func reportReachability(rq requestor, reports []bdclient.BridgeReport) {
+	allocLock.Lock()
+	defer allocLock.Unlock()
+	for _, rep := range reports {
+		for _, id := range rq.capped {
+			if getLearnedSet(id).knows(string(rep.Cookie)) {
+				if reportedCache.Add(id+"/"+string(rep.Cookie), true, cache.DefaultExpiration) == nil {
+					recordReachability(rep.Cookie, rq.country, rep.Reachable)
+				}
+				break
+			}
+		}
+	}
+}
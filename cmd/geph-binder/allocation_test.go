@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+)
+
+// resetAllocation forgets all bridges and everything learned about them.
+func resetAllocation() {
+	bridgeCache.Flush()
+	learnedCache.Flush()
+	healthCache.Flush()
+	reputationCache.Flush()
+	reportedCache.Flush()
+	lookupASN = bridgeASN
+}
+
+// addTestBridges adds n bridges, each in its own allocation group and ASN.
+func addTestBridges(n int) {
+	for i := 0; i < n; i++ {
+		addBridge(bridgeInfo{
+			Cookie:     []byte(fmt.Sprintf("cookie-%v", i)),
+			Host:       fmt.Sprintf("10.0.%v.1:2389", i),
+			AllocGroup: fmt.Sprintf("ag-%v", i),
+		})
+	}
+}
+
+func testRequestor(id string) requestor {
+	return requestor{stable: id, capped: []string{id}, country: "CN"}
+}
+
+func cookieSet(bridges []bridgeInfo) map[string]bool {
+	toret := make(map[string]bool)
+	for _, bi := range bridges {
+		toret[string(bi.Cookie)] = true
+	}
+	return toret
+}
+
+func TestAllocateStable(t *testing.T) {
+	resetAllocation()
+	defer resetAllocation()
+	addTestBridges(100)
+	first := allocate(testRequestor("alice"))
+	if len(first) != bridgesPerRequest {
+		t.Fatal("wrong number of bridges", len(first))
+	}
+	again := cookieSet(allocate(testRequestor("alice")))
+	for _, bi := range first {
+		if !again[string(bi.Cookie)] {
+			t.Fatal("same identity got different bridges")
+		}
+	}
+	other := cookieSet(allocate(testRequestor("bob")))
+	same := 0
+	for _, bi := range first {
+		if other[string(bi.Cookie)] {
+			same++
+		}
+	}
+	if same == len(first) {
+		t.Fatal("different identities got the same bridges")
+	}
+}
+
+func TestAllocateCapped(t *testing.T) {
+	resetAllocation()
+	defer resetAllocation()
+	addTestBridges(100)
+	learned := make(map[string]bool)
+	// the same network, asking under ever-changing stable identities, while every bridge it learns about dies
+	for i := 0; i < 20; i++ {
+		rq := requestor{stable: fmt.Sprintf("uid:%v", i), capped: []string{"net:10.0.0.0/24"}}
+		for _, bi := range allocate(rq) {
+			learned[string(bi.Cookie)] = true
+			for j := 0; j < maxConsecFails; j++ {
+				recordProbe(bi.Cookie, 0, false)
+			}
+		}
+	}
+	if len(learned) != maxLearnedBridges {
+		t.Fatal("learned", len(learned), "bridges")
+	}
+	// another network isn't affected
+	if len(allocate(testRequestor("net:10.0.1.0/24"))) != bridgesPerRequest {
+		t.Fatal("cap applied to the wrong identity")
+	}
+}
+
+func TestAllocateDiversity(t *testing.T) {
+	resetAllocation()
+	defer resetAllocation()
+	// 20 bridges in 4 allocation groups and 10 ASNs
+	for i := 0; i < 20; i++ {
+		addBridge(bridgeInfo{
+			Cookie:     []byte(fmt.Sprintf("cookie-%v", i)),
+			Host:       fmt.Sprintf("10.0.%v.1:2389", i),
+			AllocGroup: fmt.Sprintf("ag-%v", i%4),
+		})
+	}
+	toret := allocate(testRequestor("alice"))
+	if len(toret) != 4 {
+		t.Fatal("wrong number of bridges", len(toret))
+	}
+	seen := make(map[string]bool)
+	for _, bi := range toret {
+		if seen[bi.AllocGroup] {
+			t.Fatal("two bridges from", bi.AllocGroup)
+		}
+		seen[bi.AllocGroup] = true
+	}
+
+	resetAllocation()
+	addTestBridges(20)
+	lookupASN = func(host string) string {
+		var a, b, c, d, port int
+		fmt.Sscanf(host, "%d.%d.%d.%d:%d", &a, &b, &c, &d, &port)
+		return fmt.Sprintf("AS%v", c%3)
+	}
+	perASN := make(map[string]int)
+	for _, bi := range allocate(testRequestor("alice")) {
+		perASN[lookupASN(bi.Host)]++
+	}
+	if len(perASN) != 3 {
+		t.Fatal("bridges from", len(perASN), "ASNs")
+	}
+	for asn, n := range perASN {
+		if n > maxPerASN {
+			t.Fatal(n, "bridges from", asn)
+		}
+	}
+}
+
+func TestAllocateSkipsBad(t *testing.T) {
+	resetAllocation()
+	defer resetAllocation()
+	addTestBridges(10)
+	for i := 0; i < 6; i++ {
+		recordProbe([]byte("cookie-0"), 0, false)
+		recordReachability([]byte("cookie-1"), "CN", false)
+	}
+	for _, rq := range []requestor{testRequestor("alice"), testRequestor("bob")} {
+		for _, bi := range allocate(rq) {
+			if c := string(bi.Cookie); c == "cookie-0" || c == "cookie-1" {
+				t.Fatal("handed out", c)
+			}
+		}
+	}
+	// blocked in China isn't blocked elsewhere
+	found := false
+	for i := 0; i < 20 && !found; i++ {
+		rq := testRequestor(fmt.Sprintf("carol-%v", i))
+		rq.country = "IR"
+		found = cookieSet(allocate(rq))["cookie-1"]
+	}
+	if !found {
+		t.Fatal("bridge bad in one country never handed out in another")
+	}
+}
+
+func TestReportNeedsLearned(t *testing.T) {
+	resetAllocation()
+	defer resetAllocation()
+	addTestBridges(100)
+	rq := testRequestor("alice")
+	got := cookieSet(allocate(rq))
+	var reports []bdclient.BridgeReport
+	for i := 0; i < 100; i++ {
+		reports = append(reports, bdclient.BridgeReport{Cookie: []byte(fmt.Sprintf("cookie-%v", i))})
+	}
+	// the same requestor reporting again and again only counts once
+	for i := 0; i < 10; i++ {
+		reportReachability(rq, reports)
+	}
+	for i := 0; i < 100; i++ {
+		cookie := fmt.Sprintf("cookie-%v", i)
+		re, ok := reputationCache.Get(cookie + "/CN")
+		if !got[cookie] {
+			if ok {
+				t.Fatal("report about an unknown bridge counted")
+			}
+			continue
+		}
+		if !ok || re.(*repEntry).bad != 1 {
+			t.Fatal("report about a learned bridge not counted once")
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ed25519"
+)
+
+// masterSK is the master identity, used to sign v3 responses.
+var masterSK ed25519.PrivateKey
+
+var errBadAuth = &bdclient.APIError{Code: bdclient.CodeBadAuth}
+
+// apiError converts any error into a typed API error. Errors that aren't already typed are internal.
+func apiError(err error) *bdclient.APIError {
+	if aerr, ok := err.(*bdclient.APIError); ok {
+		return aerr
+	}
+	return &bdclient.APIError{Code: bdclient.CodeInternal}
+}
+
+func badRequest(err error) error {
+	return &bdclient.APIError{Code: bdclient.CodeBadRequest, Message: err.Error()}
+}
+
+// v3Method is a v3 API method. It takes the raw JSON request body.
+type v3Method func(r *http.Request, body []byte) (resp interface{}, err error)
+
+var v3Methods = map[string]v3Method{
+	"client-info":        v3ClientInfo,
+	"warpfronts":         v3Warpfronts,
+	"get-ticket-key":     v3GetTicketKey,
+	"get-tier":           v3GetTier,
+	"get-ticket":         v3GetTicket,
+	"redeem-ticket":      v3RedeemTicket,
+	"get-bridges":        v3GetBridges,
+	"add-bridge":         v3AddBridge,
+	"report-bridges":     v3ReportBridges,
+	"exit-cookie":        v3ExitCookie,
+	"warpfront-tokens":   v3WarpfrontTokens,
+	"warpfront-carriers": v3WarpfrontCarriers,
+}
+
+// callV3 runs a v3 method, returning the response body and the HTTP status.
+func callV3(method string, r *http.Request, body []byte) (respBts []byte, status int) {
+	var resp interface{}
+	var err error
+	if f, ok := v3Methods[method]; ok {
+		resp, err = f(r, body)
+	} else {
+		err = &bdclient.APIError{Code: bdclient.CodeNotFound, Message: method}
+	}
+	status = http.StatusOK
+	if err != nil {
+		if _, ok := err.(*bdclient.APIError); !ok {
+			log.Printf("v3 %v failed: %v", method, err)
+		}
+		aerr := apiError(err)
+		status = aerr.HTTPStatus()
+		resp = bdclient.ErrorResp{Error: aerr}
+	}
+	respBts, err = json.Marshal(resp)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+func handleV3(w http.ResponseWriter, r *http.Request) {
+	countUserAgent(r)
+	method := mux.Vars(r)["method"]
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 65536))
+	var respBts []byte
+	var status int
+	if err != nil {
+		status = http.StatusBadRequest
+		respBts, _ = json.Marshal(bdclient.ErrorResp{Error: &bdclient.APIError{Code: bdclient.CodeBadRequest}})
+	} else {
+		respBts, status = callV3(method, r, body)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Header().Set(bdclient.VersionHeader, strconv.Itoa(bdclient.APIVersion))
+	w.Header().Set(bdclient.SignatureHeader,
+		hex.EncodeToString(ed25519.Sign(masterSK, bdclient.SignedMessage(method, body, r.Header.Get(bdclient.NonceHeader), respBts))))
+	w.WriteHeader(status)
+	w.Write(respBts)
+}
+
+func v3ClientInfo(r *http.Request, body []byte) (resp interface{}, err error) {
+	resp = getClientInfo(r)
+	return
+}
+
+func v3Warpfronts(r *http.Request, body []byte) (resp interface{}, err error) {
+	resp, err = getWarpfronts()
+	return
+}
+
+func v3GetTicketKey(r *http.Request, body []byte) (resp interface{}, err error) {
+	var req bdclient.TicketKeyReq
+	if err = json.Unmarshal(body, &req); err != nil {
+		err = badRequest(err)
+		return
+	}
+	key, err := getTicketIdentity(req.Tier)
+	if err != nil {
+		return
+	}
+	resp = bdclient.TicketKeyResp{Key: x509.MarshalPKCS1PublicKey(&key.PublicKey)}
+	return
+}
+
+func v3GetTier(r *http.Request, body []byte) (resp interface{}, err error) {
+	var req bdclient.AuthReq
+	if err = json.Unmarshal(body, &req); err != nil {
+		err = badRequest(err)
+		return
+	}
+	uid, expiry, _, err := verifyUser(req.Username, req.Password)
+	if err != nil {
+		return
+	}
+	if uid < 0 {
+		err = errBadAuth
+		return
+	}
+	tier := "free"
+	if expiry.After(time.Now()) {
+		tier = "paid"
+	}
+	resp = bdclient.TierResp{Tier: tier}
+	return
+}
+
+func v3GetTicket(r *http.Request, body []byte) (resp interface{}, err error) {
+	var req bdclient.GetTicketReq
+	if err = json.Unmarshal(body, &req); err != nil {
+		err = badRequest(err)
+		return
+	}
+	resp, err = issueTicket(r, req.Username, req.Password, req.Blinded)
+	return
+}
+
+func v3RedeemTicket(r *http.Request, body []byte) (resp interface{}, err error) {
+	var req bdclient.TicketReq
+	if err = json.Unmarshal(body, &req); err != nil {
+		err = badRequest(err)
+		return
+	}
+	err = verifyTicket(req.Tier, req.UbMsg, req.UbSig)
+	resp = struct{}{}
+	return
+}
+
+func v3GetBridges(r *http.Request, body []byte) (resp interface{}, err error) {
+	var req bdclient.GetBridgesReq
+	if err = json.Unmarshal(body, &req); err != nil {
+		err = badRequest(err)
+		return
+	}
+	if req.Ephemeral {
+		err = &bdclient.APIError{Code: bdclient.CodeBadRequest, Message: "ephemeral bridges not supported"}
+		return
+	}
+	bridges := allocBridges(getRequestor(r))
+	if bridges == nil {
+		bridges = make([]bridgeInfo, 0)
+	}
+	resp = bridges
+	return
+}
+
+func v3AddBridge(r *http.Request, body []byte) (resp interface{}, err error) {
+	var req bdclient.AddBridgeReq
+	if err = json.Unmarshal(body, &req); err != nil {
+		err = badRequest(err)
+		return
+	}
+	bi := bridgeInfo{
+		Cookie:     req.Cookie,
+		Host:       req.Host,
+		LastSeen:   time.Now(),
+		AllocGroup: req.AllocGroup,
+	}
+	var toret bdclient.AddBridgeResp
+	if req.Signed != nil {
+		// this also refuses descriptors that stay valid for too long
+		desc, e := req.Signed.Open(time.Now())
+		if e != nil {
+			err = badRequest(e)
+			return
+		}
+		signed := *req.Signed
+		signed.Countersign(masterSK)
+		bi.Cookie = desc.Cookie
+		bi.Host = desc.Host
+		bi.AllocGroup = desc.AllocGroup
+		bi.Descriptor = &signed
+		bi.PublicKey = desc.PublicKey
+		toret.Countersigned = &signed
+	}
+	err = registerBridge(req.Secret, bi)
+	resp = toret
+	return
+}
+
+func v3ReportBridges(r *http.Request, body []byte) (resp interface{}, err error) {
+	var req bdclient.ReportBridgesReq
+	if err = json.Unmarshal(body, &req); err != nil {
+		err = badRequest(err)
+		return
+	}
+	reportReachability(getRequestor(r), req.Reports)
+	resp = struct{}{}
+	return
+}
@@ -1,19 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bdclient"
 	"github.com/geph-official/geph2/libs/cshirt2"
 	"github.com/patrickmn/go-cache"
 )
@@ -26,52 +26,14 @@ type bridgeInfo struct {
 	Host       string
 	LastSeen   time.Time
 	AllocGroup string
+	Descriptor *bdclient.SignedDescriptor `json:",omitempty"`
+	PublicKey  []byte                     `json:"-"`
 }
 
 func addBridge(nfo bridgeInfo) {
 	bridgeCache.SetDefault(string(nfo.Cookie), nfo)
 }
 
-// cache of bridge *mappings*. string => []string
-var bridgeMapCache = cache.New(time.Hour, time.Hour)
-
-func getBridges(id string) []string {
-	if mapping, ok := bridgeMapCache.Get(id); ok {
-		return mapping.([]string)
-	}
-	itms := bridgeCache.Items()
-	seed := fmt.Sprintf("%v-%v", id, time.Now())
-	probability := 10.0 / float64(len(itms))
-	candidates := make([][]string, 10)
-	candidateWeights := make([]int, 10)
-	// try 10 times
-	for i := 0; i < 10; i++ {
-		for k := range itms {
-			h := sha256.Sum256([]byte(k + seed))
-			num := binary.BigEndian.Uint32(h[:4])
-			if float64(num) < probability*float64(4294967295) || true {
-				candidates[i] = append(candidates[i], k)
-			}
-			//TODO diversity
-			candidateWeights[i] = len(candidates[i])
-		}
-	}
-	var toret []string
-	trweight := -1
-	for i := 0; i < 10; i++ {
-		if candidateWeights[i] > trweight {
-			trweight = candidateWeights[i]
-			toret = candidates[i]
-		}
-	}
-	// shuffle
-	rand.Shuffle(len(toret), func(i, j int) {
-		toret[i], toret[j] = toret[j], toret[i]
-	})
-	bridgeMapCache.SetDefault(id, toret)
-	return toret
-}
-
 func handleGetWarpfronts(w http.ResponseWriter, r *http.Request) {
 	countUserAgent(r)
 	host2front, err := getWarpfronts()
@@ -103,39 +65,28 @@ func handleGetBridges(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// TODO validate the ticket
-	bridges := getBridges(id)
 	w.Header().Set("content-type", "application/json")
 	idhash := sha256.Sum256([]byte(id))
 	w.Header().Set("X-Requestor-ID", hex.EncodeToString(idhash[:]))
-	seenAGs := make(map[string]bool)
-	var laboo []bridgeInfo
-	vacate := func() {
-		bridgeMapCache.Delete(id)
-	}
-	for _, str := range bridges {
-		vali, ok := bridgeCache.Get(str)
-		if ok {
-			val := vali.(bridgeInfo)
-			if !seenAGs[val.AllocGroup] {
-				seenAGs[val.AllocGroup] = true
-				hostPort := strings.Split(val.Host, ":")
-				if len(hostPort) == 2 {
-					val.Host = fmt.Sprintf("%v.sslip.io:%v", strings.Replace(hostPort[0], ".", "-", -1), hostPort[1])
-					laboo = append(laboo, val)
-				}
-			}
-		} else {
-			vacate()
-			return
-		}
-	}
+	laboo := allocBridges(getRequestor(r))
 	if len(laboo) == 0 {
-		vacate()
 		return
 	}
 	json.NewEncoder(w).Encode(laboo)
 }
 
+// allocBridges returns the bridges handed out to the given requestor, with hosts rewritten to sslip.io names.
+func allocBridges(rq requestor) (laboo []bridgeInfo) {
+	for _, val := range allocate(rq) {
+		hostPort := strings.Split(val.Host, ":")
+		if len(hostPort) == 2 {
+			val.Host = fmt.Sprintf("%v.sslip.io:%v", strings.Replace(hostPort[0], ".", "-", -1), hostPort[1])
+			laboo = append(laboo, val)
+		}
+	}
+	return
+}
+
 func handleAddBridge(w http.ResponseWriter, r *http.Request) {
 	countUserAgent(r)
 	// first get the cookie
@@ -145,27 +96,44 @@ func handleAddBridge(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	// check the cookie
 	_, pwd, _ := r.BasicAuth()
-	ok, err := checkBridgeKey(pwd)
+	err = registerBridge(pwd, bridgeInfo{
+		Cookie:     cookie,
+		Host:       r.FormValue("host"),
+		LastSeen:   time.Now(),
+		AllocGroup: r.FormValue("allocGroup"),
+	})
+	if err != nil {
+		w.WriteHeader(apiError(err).HTTPStatus())
+		return
+	}
+}
+
+// registerBridge checks the bridge key and adds the bridge.
+func registerBridge(secret string, bi bridgeInfo) (err error) {
+	// check the cookie
+	ok, err := checkBridgeKey(secret)
 	if err != nil {
 		log.Println("can't add bridge (bad DB)")
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	if !ok {
-		log.Printf("can't add bridge (bad bridge key %v)", pwd)
-		w.WriteHeader(http.StatusForbidden)
+		log.Printf("can't add bridge (bad bridge key %v)", secret)
+		err = errBadAuth
 		return
 	}
-	bi := bridgeInfo{
-		Cookie:     cookie,
-		Host:       r.FormValue("host"),
-		LastSeen:   time.Now(),
-		AllocGroup: r.FormValue("allocGroup"),
+	// a signed bridge can't be replaced by another identity
+	if old, ok := bridgeCache.Get(string(bi.Cookie)); ok {
+		oldPK := old.(bridgeInfo).PublicKey
+		if oldPK != nil && !bytes.Equal(oldPK, bi.PublicKey) {
+			log.Printf("can't add bridge (identity of %v changed)", bi.Host)
+			err = errBadAuth
+			return
+		}
 	}
 	// add the bridge
 	addBridge(bi)
+	return
 }
 
 func testBridge(bi bridgeInfo) bool {
@@ -175,7 +143,7 @@ func testBridge(bi bridgeInfo) bool {
 		return false
 	}
 	defer rawconn.Close()
-	realconn, err := cshirt2.ClientLegacy(bi.Cookie, rawconn)
+	realconn, err := cshirt2.Client(bi.Cookie, rawconn)
 	if err != nil {
 		log.Println("bridge test failed for", bi.Host, err)
 		return false
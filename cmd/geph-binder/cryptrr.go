@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/cryptrr"
+)
+
+// handleCryptrr dispatches a decrypted CryptRR request to the corresponding v3 method. The request carries the JSON body as its only argument; the response carries the HTTP status and the JSON body.
+func handleCryptrr(r *http.Request, req cryptrr.PlainMsg) cryptrr.PlainMsg {
+	countUserAgent(r)
+	var args struct {
+		Body []byte
+	}
+	if err := rlp.DecodeBytes(req.Args, &args); err != nil {
+		return cryptrr.NewPlainMsg(req.Cmd, uint(http.StatusBadRequest), []byte("{}"))
+	}
+	respBts, status := callV3(req.Cmd, r, args.Body)
+	return cryptrr.NewPlainMsg(req.Cmd, uint(status), respBts)
+}
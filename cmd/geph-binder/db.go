@@ -6,6 +6,7 @@ import (
 	"crypto/x509"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -15,6 +16,22 @@ import (
 
 var pgDB *sql.DB
 
+// migrations bring an existing database up to date with the tables and columns this binder uses. Each is idempotent, so all of them run at every start.
+var migrations = []string{
+	"create table if not exists exitcookies (hostname text primary key, cookie bytea not null, published bool not null default false)",
+	"alter table warpfronts add column if not exists carriers text",
+}
+
+// migrateDB applies the migrations.
+func migrateDB() error {
+	for _, m := range migrations {
+		if _, err := pgDB.Exec(m); err != nil {
+			return fmt.Errorf("%v: %w", m, err)
+		}
+	}
+	return nil
+}
+
 // getWarpfronts gets all the warpfront-based bridges registered in the database.
 func getWarpfronts() (host2front map[string]string, err error) {
 	tx, err := pgDB.Begin()
@@ -40,6 +57,27 @@ func getWarpfronts() (host2front map[string]string, err error) {
 	return
 }
 
+// getWarpfrontCarriers gets which carriers each warpfront bridge's front passes through, from the comma-separated carriers column of the warpfronts table. Fronts with no carriers listed are only polled.
+func getWarpfrontCarriers() (host2carriers map[string][]string, err error) {
+	rows, err := pgDB.Query("select host,carriers from warpfronts where carriers is not null")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	host2carriers = make(map[string][]string)
+	for rows.Next() {
+		host := ""
+		carriers := ""
+		err = rows.Scan(&host, &carriers)
+		if err != nil {
+			return
+		}
+		host2carriers[host] = strings.Split(carriers, ",")
+	}
+	err = rows.Err()
+	return
+}
+
 // checkBridgeKey checks whether a bridge cookie is allowed.
 func checkBridgeKey(key string) (ok bool, err error) {
 	tx, err := pgDB.Begin()
@@ -163,3 +201,29 @@ func createUser(uname, pwd string) (err error) {
 	err = tx.Commit()
 	return
 }
+
+// getExitCookie returns the cshirt2 cookie of an exit, and whether clients should use it yet. It lives in the exitcookies table, which migrateDB creates.
+func getExitCookie(hostname string) (cookie []byte, published bool, err error) {
+	err = pgDB.QueryRow("select cookie, published from exitcookies where hostname = $1",
+		hostname).Scan(&cookie, &published)
+	return
+}
+
+// ensureExitCookie creates an unpublished cookie for an exit if it doesn't have one, returning its cookie.
+func ensureExitCookie(hostname string) (cookie []byte, err error) {
+	fresh := make([]byte, 32)
+	rand.Read(fresh)
+	_, err = pgDB.Exec("insert into exitcookies (hostname, cookie, published) values ($1, $2, false) on conflict (hostname) do nothing",
+		hostname, fresh)
+	if err != nil {
+		return
+	}
+	cookie, _, err = getExitCookie(hostname)
+	return
+}
+
+// publishExitCookie starts handing out an exit's cookie to clients.
+func publishExitCookie(hostname string) (err error) {
+	_, err = pgDB.Exec("update exitcookies set published = true where hostname = $1", hostname)
+	return
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+)
+
+// Exits accept cshirt2 on their direct port, with a per-exit cookie that the binder hands out. Rolling it out to an exit goes:
+//
+//  1. /exit-cookie?host=<exit> creates the cookie, without publishing it.
+//  2. The exit is restarted with -cookie, accepting both cshirt2 and plain TinySS.
+//  3. /exit-cookie?host=<exit>&publish=1 makes clients use cshirt2.
+//  4. Once old clients are gone, the exit is restarted with -requireCshirt2.
+
+// handleExitCookie creates, returns and optionally publishes an exit's cookie.
+func handleExitCookie(w http.ResponseWriter, r *http.Request) {
+	host := r.FormValue("host")
+	if host == "" {
+		http.Error(w, "host is required", http.StatusBadRequest)
+		return
+	}
+	cookie, err := ensureExitCookie(host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("publish") == "1" {
+		if err := publishExitCookie(host); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	fmt.Fprintln(w, hex.EncodeToString(cookie))
+}
+
+func v3ExitCookie(r *http.Request, body []byte) (resp interface{}, err error) {
+	var req bdclient.ExitCookieReq
+	if err = json.Unmarshal(body, &req); err != nil {
+		err = badRequest(err)
+		return
+	}
+	cookie, published, err := getExitCookie(req.Exit)
+	if err == sql.ErrNoRows || (err == nil && !published) {
+		err = &bdclient.APIError{Code: bdclient.CodeNotFound, Message: req.Exit}
+		return
+	}
+	if err != nil {
+		return
+	}
+	resp = bdclient.ExitCookieResp{Cookie: cookie}
+	return
+}
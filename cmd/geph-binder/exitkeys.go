@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/geph-official/geph2/libs/tinyss"
+	"golang.org/x/crypto/ed25519"
+)
+
+// defaultExitKeyDays is how long exit keys are certified for unless asked otherwise.
+const defaultExitKeyDays = 30
+
+// handleSignExitKey certifies an exit's key with the master identity, so that clients pinning the master key trust it. Exits load the result with -keyChain.
+func handleSignExitKey(w http.ResponseWriter, r *http.Request) {
+	pk, err := hex.DecodeString(r.FormValue("pk"))
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		http.Error(w, "pk must be a hex-encoded ed25519 public key", http.StatusBadRequest)
+		return
+	}
+	days := defaultExitKeyDays
+	if d := r.FormValue("days"); d != "" {
+		days, err = strconv.Atoi(d)
+		if err != nil || days <= 0 {
+			http.Error(w, "bad days", http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now()
+	chain := tinyss.KeyChain{tinyss.SignKey(masterSK, pk, now.Add(-time.Hour), now.Add(time.Hour*24*time.Duration(days)))}
+	fmt.Fprintln(w, chain.String())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// probeInterval is how often every bridge gets probed.
+const probeInterval = time.Minute * 2
+
+// maxConsecFails is how many probes in a row a bridge may fail before it's no longer handed out.
+const maxConsecFails = 3
+
+// health cache: cookie => *bridgeHealth
+var healthCache = cache.New(time.Hour, time.Hour)
+
+var healthLock sync.Mutex
+
+// bridgeHealth is what the prober knows about a bridge.
+type bridgeHealth struct {
+	LastProbe   time.Time
+	LastOK      time.Time
+	ConsecFails int
+	RTT         time.Duration
+}
+
+func getHealth(cookie []byte) (bh bridgeHealth, ok bool) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	v, ok := healthCache.Get(string(cookie))
+	if ok {
+		bh = *v.(*bridgeHealth)
+	}
+	return
+}
+
+// isHealthy returns whether a bridge should be handed out. Bridges that haven't been probed yet get the benefit of the doubt.
+func isHealthy(cookie []byte) bool {
+	bh, ok := getHealth(cookie)
+	return !ok || bh.ConsecFails < maxConsecFails
+}
+
+// isAlive returns whether a bridge recently passed a probe.
+func isAlive(cookie []byte) bool {
+	bh, ok := getHealth(cookie)
+	return ok && bh.ConsecFails == 0 && time.Since(bh.LastOK) < probeInterval*3
+}
+
+func recordProbe(cookie []byte, rtt time.Duration, ok bool) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	bh := &bridgeHealth{}
+	if v, found := healthCache.Get(string(cookie)); found {
+		bh = v.(*bridgeHealth)
+	}
+	bh.LastProbe = time.Now()
+	if ok {
+		bh.LastOK = bh.LastProbe
+		bh.ConsecFails = 0
+		bh.RTT = rtt
+	} else {
+		bh.ConsecFails++
+	}
+	healthCache.SetDefault(string(cookie), bh)
+}
+
+// probeLoop periodically probes every bridge in bridgeCache.
+func probeLoop() {
+	sem := make(chan bool, 32)
+	for {
+		var wg sync.WaitGroup
+		for _, item := range bridgeCache.Items() {
+			bi := item.Object.(bridgeInfo)
+			wg.Add(1)
+			sem <- true
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				start := time.Now()
+				ok := testBridge(bi)
+				recordProbe(bi.Cookie, time.Since(start), ok)
+			}()
+		}
+		wg.Wait()
+		time.Sleep(probeInterval)
+	}
+}
+
+// bridgeStatus is the health of a bridge as shown on the admin endpoint.
+type bridgeStatus struct {
+	Cookie     string
+	Host       string
+	AllocGroup string
+	LastSeen   time.Time
+	Probed     bool
+	Health     bridgeHealth
+	Healthy    bool
+	Countries  map[string]countryReputation
+}
+
+func handleBridgeHealth(w http.ResponseWriter, r *http.Request) {
+	var toret []bridgeStatus
+	for _, item := range bridgeCache.Items() {
+		bi := item.Object.(bridgeInfo)
+		bh, probed := getHealth(bi.Cookie)
+		toret = append(toret, bridgeStatus{
+			Cookie:     hex.EncodeToString(bi.Cookie),
+			Host:       bi.Host,
+			AllocGroup: bi.AllocGroup,
+			LastSeen:   bi.LastSeen,
+			Probed:     probed,
+			Health:     bh,
+			Healthy:    isHealthy(bi.Cookie),
+			Countries:  getReputation(bi.Cookie),
+		})
+	}
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(toret); err != nil {
+		log.Println("cannot write bridge health:", err)
+	}
+}
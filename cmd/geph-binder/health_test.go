@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	resetAllocation()
+	defer resetAllocation()
+	cookie := []byte("cookie")
+	if !isHealthy(cookie) || isAlive(cookie) {
+		t.Fatal("unprobed bridge should be healthy but not alive")
+	}
+	recordProbe(cookie, time.Millisecond, true)
+	if !isHealthy(cookie) || !isAlive(cookie) {
+		t.Fatal("bridge that passed a probe should be alive")
+	}
+	for i := 1; i < maxConsecFails; i++ {
+		recordProbe(cookie, 0, false)
+		if !isHealthy(cookie) {
+			t.Fatal("unhealthy after", i, "failures")
+		}
+		if isAlive(cookie) {
+			t.Fatal("alive after a failure")
+		}
+	}
+	recordProbe(cookie, 0, false)
+	if isHealthy(cookie) {
+		t.Fatal("healthy after", maxConsecFails, "failures")
+	}
+	recordProbe(cookie, time.Millisecond, true)
+	if !isHealthy(cookie) || !isAlive(cookie) {
+		t.Fatal("passing a probe didn't reset the failures")
+	}
+	// a pass long ago doesn't count
+	v, _ := healthCache.Get(string(cookie))
+	v.(*bridgeHealth).LastOK = time.Now().Add(-probeInterval * 3)
+	if isAlive(cookie) {
+		t.Fatal("alive with no recent probe")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/abh/geoip"
+	"github.com/geph-official/geph2/libs/bdclient"
 )
 
 var db *geoip.GeoIP
@@ -20,14 +21,15 @@ func init() {
 
 func handleClientInfo(w http.ResponseWriter, r *http.Request) {
 	countUserAgent(r)
-	var cinfo struct {
-		Address string
-		Country string
-	}
+	w.Header().Add("content-type", "application/json")
+	json.NewEncoder(w).Encode(getClientInfo(r))
+}
+
+// getClientInfo looks up the address and country of the requestor.
+func getClientInfo(r *http.Request) (cinfo bdclient.ClientInfo) {
 	addrs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
 	addr := addrs[0]
 	cinfo.Address = addr
-	w.Header().Add("content-type", "application/json")
 
 	country, _ := db.GetCountry(addr)
 	cinfo.Country = country
@@ -37,5 +39,5 @@ func handleClientInfo(w http.ResponseWriter, r *http.Request) {
 	if len(cinfo.Country) != 2 {
 		cinfo.Country = "CN"
 	}
-	json.NewEncoder(w).Encode(cinfo)
+	return
 }
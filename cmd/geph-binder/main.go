@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -9,6 +11,8 @@ import (
 	"time"
 
 	statsd "github.com/etsy/statsd/examples/go"
+	"github.com/geph-official/geph2/libs/c25519"
+	"github.com/geph-official/geph2/libs/cryptrr"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 )
@@ -52,13 +56,19 @@ func main() {
 		log.Fatal("cannot connect to database:", err)
 	}
 	pgDB.SetMaxOpenConns(50)
-	sk, err := getMasterIdentity()
+	if err := migrateDB(); err != nil {
+		log.Fatal("cannot migrate database:", err)
+	}
+	masterSK, err = getMasterIdentity()
 	if err != nil {
 		log.Fatal("cannot obtain master identity:", err)
 	}
+	allocSecret = fmt.Sprintf("%x", sha256.Sum256(append([]byte("bridge-alloc"), masterSK.Seed()...)))
 	go rotateTickets()
+	go probeLoop()
 	log.Printf("Geph2 binder started")
-	log.Printf("MPK      = %x", sk.Public())
+	log.Printf("MPK      = %x", masterSK.Public())
+	log.Printf("CryptRR  = %x", c25519.ToPK(c25519.FromEd25519SK(masterSK)))
 
 	r := mux.NewRouter()
 	r.HandleFunc("/get-ticket", handleGetTicket)
@@ -71,7 +81,19 @@ func main() {
 	r.HandleFunc("/captcha", handleCaptcha)
 	r.HandleFunc("/register", handleRegister)
 	r.HandleFunc("/warpfronts", handleGetWarpfronts)
-	//r.HandleFunc("/cryptrr", handleCryptrr)
+	r.HandleFunc("/v3/{method}", handleV3).Methods("POST")
+	r.Handle("/cryptrr", cryptrr.NewHandler(c25519.FromEd25519SK(masterSK), handleCryptrr)).Methods("POST")
+	// admin endpoints are only reachable locally
+	admin := mux.NewRouter()
+	admin.HandleFunc("/bridge-health", handleBridgeHealth)
+	admin.HandleFunc("/sign-exit-key", handleSignExitKey)
+	admin.HandleFunc("/exit-cookie", handleExitCookie)
+	admin.HandleFunc("/warpfront-secret", handleWarpfrontSecret)
+	go func() {
+		if err := http.ListenAndServe("127.0.0.1:9081", admin); err != nil {
+			panic(err)
+		}
+	}()
 	if err := http.ListenAndServe(":9080", r); err != nil {
 		panic(err)
 	}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// reputationHalfLife is how quickly old reachability reports stop mattering.
+const reputationHalfLife = time.Hour * 6
+
+// reputation cache: cookie + country => *repEntry
+var reputationCache = cache.New(time.Hour*24*7, time.Hour)
+
+// repEntry tracks decaying counts of successes and failures to reach a bridge from a country.
+type repEntry struct {
+	lock    sync.Mutex
+	good    float64
+	bad     float64
+	updated time.Time
+}
+
+func (re *repEntry) decay() {
+	factor := math.Pow(0.5, time.Since(re.updated).Seconds()/reputationHalfLife.Seconds())
+	re.good *= factor
+	re.bad *= factor
+	re.updated = time.Now()
+}
+
+var repLock sync.Mutex
+
+// getRepEntry returns the reputation entry of a bridge in a country, creating it if needed.
+func getRepEntry(cookie []byte, country string) *repEntry {
+	repLock.Lock()
+	defer repLock.Unlock()
+	key := string(cookie) + "/" + country
+	if v, ok := reputationCache.Get(key); ok {
+		return v.(*repEntry)
+	}
+	re := &repEntry{updated: time.Now()}
+	reputationCache.SetDefault(key, re)
+	return re
+}
+
+// recordReachability records whether a bridge could be reached from a country.
+func recordReachability(cookie []byte, country string, reachable bool) {
+	re := getRepEntry(cookie, country)
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	re.decay()
+	if reachable {
+		re.good++
+	} else {
+		re.bad++
+	}
+}
+
+// isBadIn returns whether a bridge has a bad reputation in a country: enough recent failures that clearly outweigh the successes.
+func isBadIn(cookie []byte, country string) bool {
+	v, ok := reputationCache.Get(string(cookie) + "/" + country)
+	if !ok {
+		return false
+	}
+	re := v.(*repEntry)
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	re.decay()
+	return re.bad >= 5 && re.bad > 3*re.good
+}
+
+// isBlockedIn returns whether a bridge is alive according to our prober, yet clients in the country can't reach it.
+func isBlockedIn(cookie []byte, country string) bool {
+	return isAlive(cookie) && isBadIn(cookie, country)
+}
+
+// countryReputation is the reachability of a bridge from one country.
+type countryReputation struct {
+	Good    float64
+	Bad     float64
+	Blocked bool
+}
+
+// getReputation returns the per-country reachability of a bridge.
+func getReputation(cookie []byte) map[string]countryReputation {
+	toret := make(map[string]countryReputation)
+	prefix := string(cookie) + "/"
+	for k, v := range reputationCache.Items() {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		country := k[len(prefix):]
+		re := v.Object.(*repEntry)
+		re.lock.Lock()
+		re.decay()
+		toret[country] = countryReputation{
+			Good: re.good,
+			Bad:  re.bad,
+		}
+		re.lock.Unlock()
+	}
+	for country, cr := range toret {
+		cr.Blocked = isBlockedIn(cookie, country)
+		toret[country] = cr
+	}
+	return toret
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestReputationDecay(t *testing.T) {
+	resetAllocation()
+	defer resetAllocation()
+	cookie := []byte("cookie")
+	for i := 0; i < 8; i++ {
+		recordReachability(cookie, "CN", false)
+	}
+	recordReachability(cookie, "CN", true)
+	if !isBadIn(cookie, "CN") || isBadIn(cookie, "IR") {
+		t.Fatal("bad reputation in the wrong country")
+	}
+	// one half-life later, the failures are down to 4
+	re := getRepEntry(cookie, "CN")
+	re.lock.Lock()
+	re.updated = re.updated.Add(-reputationHalfLife)
+	re.lock.Unlock()
+	rep := getReputation(cookie)["CN"]
+	if math.Abs(rep.Bad-4) > 0.01 || math.Abs(rep.Good-0.5) > 0.01 {
+		t.Fatal("wrong decay", rep.Bad, rep.Good)
+	}
+	if isBadIn(cookie, "CN") {
+		t.Fatal("still bad after decaying")
+	}
+}
+
+func TestReputationOutweighed(t *testing.T) {
+	resetAllocation()
+	defer resetAllocation()
+	cookie := []byte("cookie")
+	for i := 0; i < 10; i++ {
+		recordReachability(cookie, "CN", false)
+	}
+	for i := 0; i < 4; i++ {
+		recordReachability(cookie, "CN", true)
+	}
+	if isBadIn(cookie, "CN") {
+		t.Fatal("bad although the successes aren't clearly outweighed")
+	}
+	// blocked means clients can't reach it while our prober can
+	for i := 0; i < 10; i++ {
+		recordReachability(cookie, "IR", false)
+	}
+	if isBlockedIn(cookie, "IR") {
+		t.Fatal("blocked without having been probed")
+	}
+	recordProbe(cookie, time.Millisecond, true)
+	if !isBlockedIn(cookie, "IR") || !getReputation(cookie)["IR"].Blocked {
+		t.Fatal("not blocked")
+	}
+}
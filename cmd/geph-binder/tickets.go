@@ -56,51 +56,63 @@ var goodIPCache = cache.New(time.Hour, time.Minute)
 
 func handleGetTicket(w http.ResponseWriter, r *http.Request) {
 	countUserAgent(r)
+	blinded, err := base64.RawStdEncoding.DecodeString(r.FormValue("blinded"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	toWrite, err := issueTicket(r, r.FormValue("user"), r.FormValue("pwd"), blinded)
+	if err != nil {
+		w.WriteHeader(apiError(err).HTTPStatus())
+		return
+	}
+	b, err := json.Marshal(toWrite)
+	if err != nil {
+		panic(err)
+	}
+	w.Write([]byte(b))
+}
+
+// issueTicket authenticates a user and blind-signs a ticket for them.
+func issueTicket(r *http.Request, user, pwd string, blinded []byte) (toWrite bdclient.TicketResp, err error) {
 	// first authenticate
-	uid, expiry, paytx, err := verifyUser(r.FormValue("user"), r.FormValue("pwd"))
+	uid, expiry, paytx, err := verifyUser(user, pwd)
 	if err != nil {
 		log.Println("cannot verify user:", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	if uid < 0 {
-		log.Println("cannot log in user:", r.FormValue("user"))
-		w.WriteHeader(http.StatusForbidden)
+		log.Println("cannot log in user:", user)
+		err = errBadAuth
 		return
 	}
 	// ticketLimiter, _ := limiterCache.LoadOrStore(uid, rate.NewLimiter(rate.Every(time.Minute*4), 100))
 	// if !ticketLimiter.(*rate.Limiter).Allow() {
-	// 	log.Println("*** VIOLATED LIMIT ", r.FormValue("user"))
+	// 	log.Println("*** VIOLATED LIMIT ", user)
 	// 	time.Sleep(time.Second * 10)
 	// 	w.WriteHeader(http.StatusTooManyRequests)
 	// 	return
 	// }
-	log.Println("verified", r.FormValue("user"))
-	//log.Println("get-ticket: verified user", r.FormValue("user"), "as expiry", expiry)
+	log.Println("verified", user)
+	//log.Println("get-ticket: verified user", user, "as expiry", expiry)
 	var tier string
 	if expiry.After(time.Now()) {
 		tier = "paid"
 	} else {
 		tier = "free"
 	}
-	blinded, err := base64.RawStdEncoding.DecodeString(r.FormValue("blinded"))
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	//log.Println("get-ticket: user", r.FormValue("user"), "sent us blinded of length", len(blinded))
+	//log.Println("get-ticket: user", user, "sent us blinded of length", len(blinded))
 	// get the key
 	key, err := getTicketIdentity(tier)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	// issue the ticket. TODO rate limit this
 	ticket, err := rsablind.BlindSign(key, blinded)
 	if err != nil {
-		panic(err)
+		err = &bdclient.APIError{Code: bdclient.CodeBadRequest, Message: err.Error()}
+		return
 	}
-	var toWrite bdclient.TicketResp
 	toWrite.Tier = tier
 	toWrite.Ticket = ticket
 	toWrite.PaidExpiry = expiry
@@ -115,29 +127,13 @@ func handleGetTicket(w http.ResponseWriter, r *http.Request) {
 			return toWrite.Transactions[i].Date.After(toWrite.Transactions[j].Date)
 		})
 	}
-	b, err := json.Marshal(toWrite)
-	if err != nil {
-		panic(err)
-	}
-	w.Write([]byte(b))
 	id := strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0]
 	goodIPCache.SetDefault(id, uid)
+	return
 }
 
 func handleRedeemTicket(w http.ResponseWriter, r *http.Request) {
 	countUserAgent(r)
-	// check type
-	if tier := r.FormValue("tier"); tier != "free" && tier != "paid" {
-		log.Println("bad tier:", tier)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	// obtain key
-	key, err := getTicketIdentity(r.FormValue("tier"))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
 	// obtain values
 	ubmsg, err := base64.RawStdEncoding.DecodeString(r.FormValue("ubmsg"))
 	if err != nil {
@@ -149,10 +145,28 @@ func handleRedeemTicket(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	// verify
-	if err := rsablind.VerifyBlindSignature(&key.PublicKey, ubmsg, ubsig); err != nil {
-		w.WriteHeader(http.StatusForbidden)
+	if err := verifyTicket(r.FormValue("tier"), ubmsg, ubsig); err != nil {
+		w.WriteHeader(apiError(err).HTTPStatus())
 		return
 	}
+}
+
+// verifyTicket checks an unblinded ticket against the key of its tier.
+func verifyTicket(tier string, ubmsg, ubsig []byte) (err error) {
+	// check type
+	if tier != "free" && tier != "paid" {
+		log.Println("bad tier:", tier)
+		err = &bdclient.APIError{Code: bdclient.CodeBadRequest, Message: "bad tier"}
+		return
+	}
+	// obtain key
+	key, err := getTicketIdentity(tier)
+	if err != nil {
+		return
+	}
+	// verify
+	if rsablind.VerifyBlindSignature(&key.PublicKey, ubmsg, ubsig) != nil {
+		err = errBadAuth
+	}
 	return
 }
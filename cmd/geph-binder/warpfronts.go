@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/geph-official/geph2/libs/warpfront"
+)
+
+// warpfrontSecret derives the secret a warpfront bridge authenticates registrations with, so that we can hand out tokens without storing anything.
+func warpfrontSecret(host string) []byte {
+	h := sha256.Sum256(append([]byte("warpfront-secret:"+host+"\n"), masterSK.Seed()...))
+	return h[:]
+}
+
+// handleWarpfrontSecret gives the secret for a warpfront bridge, for its -wfSecret.
+func handleWarpfrontSecret(w http.ResponseWriter, r *http.Request) {
+	host := r.FormValue("host")
+	if host == "" {
+		http.Error(w, "host is required", http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintln(w, hex.EncodeToString(warpfrontSecret(host)))
+}
+
+func v3WarpfrontTokens(r *http.Request, body []byte) (resp interface{}, err error) {
+	host2front, err := getWarpfronts()
+	if err != nil {
+		return
+	}
+	host2token := make(map[string]string)
+	now := time.Now()
+	for host := range host2front {
+		host2token[host] = warpfront.Token(warpfrontSecret(host), now)
+	}
+	resp = host2token
+	return
+}
+
+func v3WarpfrontCarriers(r *http.Request, body []byte) (resp interface{}, err error) {
+	resp, err = getWarpfrontCarriers()
+	return
+}
@@ -39,29 +39,20 @@ func handle(client net.Conn) {
 			if noLegacyUDP {
 				return
 			}
-			var host string
-			err = dec.Decode(&host)
-			if err != nil {
-				return
-			}
-			if !exitMatcher.MatchString(host) {
-				err = fmt.Errorf("bad pattern: %v", host)
-				return
-			}
-			var cookie []byte
-			err = dec.Decode(&cookie)
-			if err != nil {
-				return
-			}
-			port, err := e2enat(fmt.Sprintf("%v:2399", host), cookie)
+			port, err := e2eConfig.Handle(client, dec)
 			if err != nil {
 				log.Println("cannot e2enat:", err)
 				return
 			}
-			log.Printf("created e2enat at port %v (%x)", port, cookie[:10])
-			rlp.Encode(client, uint(port))
+			log.Printf("created e2enat at port %v", port)
 			time.Sleep(time.Second * 20)
 			return
+		case "conn/urtcp":
+			log.Println(client.RemoteAddr(), "==> URTCP")
+			if err := urtcpConfig.Handle(client, dec); err != nil {
+				log.Println("cannot relay URTCP:", err)
+			}
+			return
 		case "ping":
 			rlp.Encode(client, "ping")
 			time.Sleep(time.Second)
@@ -109,9 +100,10 @@ func handle(client net.Conn) {
 						case <-time.After(time.Millisecond * time.Duration(mrand.ExpFloat64()*3000)):
 							c, ok := client.(*kcp.UDPSession)
 							if ok {
-								btlBw, latency, _ := c.FlowStats()
-								statClient.Timing(allocGroup+".clientLatency", int64(latency))
-								statClient.Timing(allocGroup+".btlBw", int64(btlBw))
+								stats := c.Stats()
+								statClient.Timing(allocGroup+".clientLatency", int64(stats.MinRTT))
+								statClient.Timing(allocGroup+".btlBw", int64(stats.DeliveryRate))
+								statClient.Timing(allocGroup+".clientLossPct", int64(10000*stats.Loss))
 							}
 						}
 					}
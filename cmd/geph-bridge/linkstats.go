@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/geph-official/geph2/libs/kcp-go"
+)
+
+// kcpStatsHandler serves snapshots of all KCP sessions as JSON.
+func kcpStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := kcp.AllStats()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].RemoteAddr < stats[j].RemoteAddr
+	})
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(stats)
+}
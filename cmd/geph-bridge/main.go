@@ -3,9 +3,12 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -17,8 +20,13 @@ import (
 	"github.com/geph-official/geph2/libs/cshirt2"
 	"github.com/geph-official/geph2/libs/erand"
 	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/geph-official/geph2/libs/replay"
+	"github.com/geph-official/geph2/libs/shaper"
+	"github.com/geph-official/geph2/libs/tlscamo"
 	"github.com/google/gops/agent"
 	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/time/rate"
 )
 
@@ -30,11 +38,27 @@ var statsdAddr string
 var allocGroup string
 var speedLimit int
 var noLegacyUDP bool
+var shapingProfile string
 var compatibility bool
+var legacyCutoff string
+var decoyAddr string
+var replayFile string
+var tlsUpstream string
+var tlsCertFile string
+var tlsKeyFile string
+var tlsCert tls.Certificate
+var replaySocket string
 var wfAddr string
+var wfSecret string
 var listenAddr string
 var bclient *bdclient.Client
 var dummy bool
+var keyfile string
+var descriptorFile string
+var debugAddr string
+
+var seckey ed25519.PrivateKey
+var bridgeID string
 
 var limiter *rate.Limiter
 
@@ -52,21 +76,67 @@ func main() {
 	flag.StringVar(&listenAddr, "listenAddr", ":", "listen address")
 	flag.BoolVar(&noLegacyUDP, "noLegacyUDP", false, "reject legacy UDP (e2enat) attempts")
 	flag.BoolVar(&compatibility, "compatibility", false, "retain compatibility with old cshirt2")
+	flag.StringVar(&legacyCutoff, "legacyCutoff", "", "if set, reject old cshirt2 clients from this date (YYYY-MM-DD) on, even with -compatibility")
+	flag.StringVar(&decoyAddr, "decoy", "", "if set, hand connections that fail the cshirt2 handshake to this TCP service (for example a local web server), so that probers see that service")
+	flag.StringVar(&replayFile, "replayFile", "", "if set, keep the handshake replay filter in this file, so that it survives restarts")
+	flag.StringVar(&replaySocket, "replaySocket", "", "if set, share the handshake replay filter with other bridges on this host through this Unix socket, in a directory only this user can access")
+	flag.StringVar(&tlsUpstream, "tlsUpstream", "", "if set, also accept cshirt2 inside TLS 1.3 on the same ports, proxying unauthenticated TLS connections to this real site (host:443)")
+	flag.StringVar(&tlsCertFile, "tlsCert", "", "PEM certificate for TLS connections; a self-signed one is generated if unset")
+	flag.StringVar(&tlsKeyFile, "tlsKey", "", "PEM private key for -tlsCert")
 	flag.StringVar(&wfAddr, "wfAddr", "", "if set, listen for plain HTTP warpfront connections on this port. Prevents contacting the binder --- warpfront bridges are manually provisioned!")
+	flag.StringVar(&wfSecret, "wfSecret", "", "hex-encoded secret that warpfront registrations must be authenticated with, from the binder's /warpfront-secret")
 	flag.IntVar(&speedLimit, "speedLimit", -1, "speed limit in KB/s")
 	flag.BoolVar(&dummy, "dummy", false, "dummy mode")
+	flag.StringVar(&keyfile, "keyfile", "bridgekey.bin", "location of the bridge's ed25519 identity")
+	flag.StringVar(&descriptorFile, "descriptorFile", "", "if set, write the binder-countersigned bridge descriptor here, for out-of-band distribution")
+	flag.StringVar(&debugAddr, "debugAddr", "localhost:6060", "if set, serve per-client KCP link statistics at /debug/kcp and replayed handshakes by source prefix at /debug/probes on this address")
+	flag.StringVar(&shapingProfile, "shapingProfile", "none", "traffic shaping profile for obfuscated connections ("+strings.Join(shaper.Names(), ", ")+")")
 	flag.Parse()
+	if _, err := shaper.Get(shapingProfile); err != nil {
+		log.Fatal("bad shaping profile: ", shapingProfile)
+	}
+	cshirt2.ShapingProfile = shapingProfile
+	if legacyCutoff != "" {
+		cutoff, err := time.Parse("2006-01-02", legacyCutoff)
+		if err != nil {
+			log.Fatal("bad legacy cutoff: ", legacyCutoff)
+		}
+		cshirt2.LegacyCutoff = cutoff
+	}
+	niaucchi4.ShapingProfile = shapingProfile
+	setupReplayFilter()
+	if tlsUpstream != "" {
+		var err error
+		if tlsCertFile != "" {
+			tlsCert, err = tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		} else {
+			tlsCert, err = tlscamo.SelfSigned(strings.Split(tlsUpstream, ":")[0])
+		}
+		if err != nil {
+			log.Fatal("cannot set up TLS certificate: ", err)
+		}
+	}
+	loadKey()
 	startupTime = time.Now()
 	if speedLimit > 0 {
 		limiter = rate.NewLimiter(rate.Limit(speedLimit*1024), 1000*1000)
 	} else {
 		limiter = rate.NewLimiter(rate.Inf, 1000*1000)
 	}
+	e2eConfig = newE2EConfig()
+	urtcpConfig = newURTCPConfig()
 	go func() {
 		if err := agent.Listen(agent.Options{}); err != nil {
 			log.Fatal(err)
 		}
 	}()
+	if debugAddr != "" {
+		http.HandleFunc("/debug/kcp", kcpStatsHandler)
+		http.HandleFunc("/debug/probes", probesHandler)
+		go func() {
+			log.Println(http.ListenAndServe(debugAddr, nil))
+		}()
+	}
 	if allocGroup == "" {
 		log.Fatal("must specify an allocation group")
 	}
@@ -125,9 +195,12 @@ func listenLoop(deadline time.Duration) {
 	go func() {
 		for deadline < 0 || time.Now().Before(end.Add(-time.Minute*5)) {
 			myAddr := fmt.Sprintf("%v:%v", guessIP(), listeners[0].Addr().(*net.TCPAddr).Port)
-			e := bclient.AddBridge(binderKey, cookie, myAddr, allocGroup)
-			if e != nil {
-				log.Println("error adding bridge:", e)
+			if e := addSignedBridge(cookie, myAddr); e != nil {
+				log.Println("cannot add signed bridge, falling back:", e)
+				e = bclient.AddBridge(binderKey, cookie, myAddr, allocGroup)
+				if e != nil {
+					log.Println("error adding bridge:", e)
+				}
 			}
 			time.Sleep(time.Minute)
 		}
@@ -158,14 +231,48 @@ func listenLoop(deadline time.Duration) {
 						log.Println(rawClient.RemoteAddr(), "dummy, rejecting", out)
 						return
 					}
-					rawClient.SetDeadline(time.Now().Add(time.Minute).Add(time.Second * time.Duration(15+erand.Int(10))))
-					client, err := cshirt2.Server(cookie, compatibility, rawClient)
-					rawClient.SetDeadline(time.Now().Add(time.Hour * 24))
+					var wire net.Conn = rawClient
+					var dc *cshirt2.DecoyConn
+					if decoyAddr != "" {
+						dc = cshirt2.NewDecoyConn(rawClient)
+						wire = dc
+					}
+					deadline := time.Now().Add(time.Minute).Add(time.Second * time.Duration(15+erand.Int(10)))
+					wire.SetDeadline(deadline)
+					if tlsUpstream != "" {
+						sniffed, isTLS, err := tlscamo.Sniff(wire)
+						if err != nil {
+							if dc != nil {
+								dc.Decoy(decoyAddr)
+							}
+							return
+						}
+						wire = sniffed
+						if isTLS {
+							if dc != nil {
+								dc.HandshakeDone()
+							}
+							handleTLS(rawClient, wire, cookie, deadline)
+							return
+						}
+					}
+					client, err := cshirt2.Server(cookie, compatibility, wire, deadline)
 					if err != nil {
 						log.Println(rawClient.RemoteAddr(), "cshirt2 failed", err)
+						if errors.Is(err, cshirt2.ErrAttackDetected) {
+							countProbe(rawClient.RemoteAddr())
+						}
+						if dc != nil {
+							dc.Decoy(decoyAddr)
+						}
 						return
 					}
+					if dc != nil {
+						dc.HandshakeDone()
+					}
+					wire.SetDeadline(time.Now().Add(time.Hour * 24))
 					rawClient.(*net.TCPConn).SetKeepAlive(false)
+					countHandshake(client)
 					//log.Println("Accepted TCP from", rawClient.RemoteAddr())
 					handle(client)
 				}()
@@ -174,6 +281,35 @@ func listenLoop(deadline time.Duration) {
 	}
 }
 
+// handleTLS serves cshirt2 inside TLS. Unauthenticated TLS connections are proxied to tlsUpstream instead of the decoy, so that they see a site matching their SNI.
+func handleTLS(rawClient net.Conn, wire net.Conn, cookie []byte, deadline time.Time) {
+	tlsConn, err := tlscamo.Server(wire, cookie, tlscamo.ServerConfig{Certificate: tlsCert, Upstream: tlsUpstream})
+	if err != nil {
+		log.Println(rawClient.RemoteAddr(), "TLS failed", err)
+		return
+	}
+	client, err := cshirt2.Server(cookie, false, tlsConn, deadline)
+	if err != nil {
+		log.Println(rawClient.RemoteAddr(), "cshirt2 inside TLS failed", err)
+		return
+	}
+	tlsConn.SetDeadline(time.Now().Add(time.Hour * 24))
+	rawClient.(*net.TCPConn).SetKeepAlive(false)
+	countHandshake(client)
+	handle(client)
+}
+
+// countHandshake counts clients by cshirt2 version, so we know when legacy clients can be cut off.
+func countHandshake(client net.Conn) {
+	version := cshirt2.Version(client)
+	if version == cshirt2.VersionLegacy {
+		log.Println(client.RemoteAddr(), "is a legacy cshirt2 client")
+	}
+	if statClient != nil {
+		statClient.Increment(fmt.Sprintf("%v.cshirt2.%v.v%v", allocGroup, bridgeID, version))
+	}
+}
+
 func guessIP() string {
 retry:
 	resp, err := http.Get("https://checkip.amazonaws.com")
@@ -187,3 +323,62 @@ retry:
 	myip := strings.Trim(string(buf.Bytes()), "\n ")
 	return myip
 }
+
+// descriptorValidity is how long a bridge descriptor stays valid. It's long enough to hand out descriptors out of band, and, with the hour of slack before, within bdclient.MaxDescriptorLifetime.
+const descriptorValidity = time.Hour * 24 * 7
+
+// addSignedBridge registers a signed descriptor with the binder, writing the countersigned version to descriptorFile.
+func addSignedBridge(cookie []byte, myAddr string) error {
+	now := time.Now()
+	sd := bdclient.BridgeDescriptor{
+		Cookie:     cookie,
+		Host:       myAddr,
+		AllocGroup: allocGroup,
+		Transports: []string{"cshirt2"},
+		ValidFrom:  uint64(now.Add(-time.Hour).Unix()),
+		ValidUntil: uint64(now.Add(descriptorValidity).Unix()),
+	}.Sign(seckey)
+	countersigned, err := bclient.AddBridgeSigned(binderKey, sd)
+	if err != nil {
+		return err
+	}
+	if descriptorFile != "" {
+		return ioutil.WriteFile(descriptorFile, []byte(countersigned.String()+"\n"), 0644)
+	}
+	return nil
+}
+
+func loadKey() {
+retry:
+	bts, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		// genkey
+		_, key, _ := ed25519.GenerateKey(nil)
+		ioutil.WriteFile(keyfile, key, 0600)
+		goto retry
+	}
+	seckey = bts
+	bridgeID = fmt.Sprintf("%x", seckey.Public())[:16]
+	log.Printf("bridge identity = %x", seckey.Public())
+}
+
+func setupReplayFilter() {
+	var filter replay.Filter = replay.NewBloom(replay.DefaultCapacity)
+	if replayFile != "" {
+		bl, err := replay.OpenBloom(replayFile, replay.DefaultCapacity)
+		if err != nil {
+			log.Fatal("cannot open replay filter: ", err)
+		}
+		filter = bl
+	}
+	if replaySocket != "" {
+		var err error
+		filter, err = replay.Share(replaySocket, filter)
+		if err != nil {
+			log.Fatal("cannot share replay filter: ", err)
+		}
+	}
+	cshirt2.ReplayFilter = filter
+	niaucchi4.ReplayFilter = filter
+	tlscamo.ReplayFilter = filter
+}
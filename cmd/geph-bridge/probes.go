@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// probeCounts counts replayed handshakes, which only active probers send, by source prefix. Prefixes are forgotten a day after their last probe, and at most maxProbePrefixes are tracked, since probers choose their addresses. string => int
+var probeCounts = cache.New(time.Hour*24, time.Hour)
+
+var probeLock sync.Mutex
+
+const maxProbePrefixes = 65536
+
+// sourcePrefix returns the /24 of IPv4 addresses and the /48 of IPv6 ones, since probers tend to come from many addresses in a few networks.
+func sourcePrefix(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: tcpAddr.IP.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+func countProbe(addr net.Addr) {
+	prefix := sourcePrefix(addr)
+	probeLock.Lock()
+	if v, ok := probeCounts.Get(prefix); ok {
+		probeCounts.SetDefault(prefix, v.(int)+1)
+	} else if probeCounts.ItemCount() < maxProbePrefixes {
+		probeCounts.SetDefault(prefix, 1)
+	}
+	probeLock.Unlock()
+	if statClient != nil {
+		statClient.Increment(allocGroup + ".replayProbes")
+	}
+}
+
+type probeCount struct {
+	Prefix string
+	Count  int
+}
+
+// probesHandler serves the replayed handshakes seen from every source prefix as JSON, most first.
+func probesHandler(w http.ResponseWriter, r *http.Request) {
+	var toret []probeCount
+	for prefix, item := range probeCounts.Items() {
+		toret = append(toret, probeCount{prefix, item.Object.(int)})
+	}
+	sort.Slice(toret, func(i, j int) bool {
+		return toret[i].Count > toret[j].Count
+	})
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(toret)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"math/rand"
+	"regexp"
+
+	"github.com/geph-official/geph2/libs/urtcprelay"
+)
+
+// newURTCPConfig sets up conn/urtcp for the exits matching exitRegex, reporting to StatsD.
+func newURTCPConfig() *urtcprelay.Config {
+	exitMatcher := regexp.MustCompile(exitRegex)
+	return &urtcprelay.Config{
+		AllowExit: exitMatcher.MatchString,
+		Limiter:   limiter,
+		OnUp: func(n int) {
+			if statClient != nil && rand.Int()%100000 < n {
+				statClient.Increment(allocGroup + ".e2eup")
+			}
+		},
+		OnDown: func(n int) {
+			if statClient != nil && rand.Int()%100000 < n {
+				statClient.Increment(allocGroup + ".e2edown")
+			}
+		},
+	}
+}
+
+var urtcpConfig *urtcprelay.Config
@@ -1,25 +1,67 @@
 package main
 
 import (
+	"encoding/hex"
+	"io"
+	"log"
 	"net/http"
+	"time"
 
 	"github.com/geph-official/geph2/libs/warpfront"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func wfLoop() {
-	wfs := warpfront.NewServer()
+	var secret []byte
+	if wfSecret != "" {
+		var err error
+		secret, err = hex.DecodeString(wfSecret)
+		if err != nil {
+			log.Fatal("bad warpfront secret: ", err)
+		}
+	} else {
+		log.Println("warpfront sessions are NOT authenticated; pass -wfSecret from the binder's /warpfront-secret")
+	}
+	wfs := warpfront.NewServer(warpfront.ServerConfig{Secret: secret})
+	// h2c, so that fronts can carry sessions over HTTP/2 streams without TLS to us
 	server := &http.Server{
 		Addr:    wfAddr,
-		Handler: wfs,
+		Handler: h2c.NewHandler(wfs, &http2.Server{}),
 	}
 	go func() {
-		panic(server.ListenAndServe())
+		log.Fatal(server.ListenAndServe())
 	}()
+	go reportWarpfront(wfs)
 	for {
 		client, err := wfs.Accept()
 		if err != nil {
-			panic(err)
+			if err == io.ErrClosedPipe {
+				return
+			}
+			log.Println("warpfront accept failed:", err)
+			time.Sleep(time.Millisecond * 100)
+			continue
 		}
 		go handle(client)
 	}
 }
+
+// reportWarpfront sends the warpfront server's counters to StatsD.
+func reportWarpfront(wfs *warpfront.Server) {
+	var last warpfront.Stats
+	for {
+		time.Sleep(time.Second * 10)
+		s := wfs.Stats()
+		if statClient != nil {
+			statClient.Timing(allocGroup+".warpfront.sessions", int64(s.Sessions))
+			statClient.IncrementByValue(allocGroup+".warpfront.registered", int(s.Registered-last.Registered))
+			statClient.IncrementByValue(allocGroup+".warpfront.rejected", int(s.Rejected-last.Rejected))
+			statClient.IncrementByValue(allocGroup+".warpfront.bytesUp", int(s.BytesUp-last.BytesUp))
+			statClient.IncrementByValue(allocGroup+".warpfront.bytesDown", int(s.BytesDown-last.BytesDown))
+			statClient.IncrementByValue(allocGroup+".warpfront.polls", int(s.Polls-last.Polls))
+			statClient.IncrementByValue(allocGroup+".warpfront.posts", int(s.Posts-last.Posts))
+		}
+		last = s
+	}
+}
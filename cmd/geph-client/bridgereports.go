@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	log "github.com/sirupsen/logrus"
+)
+
+var bridgeReports struct {
+	pending map[string]bool
+	lock    sync.Mutex
+}
+
+// reportBridge remembers whether we could reach a bridge, to tell the binder later.
+func reportBridge(cookie []byte, reachable bool) {
+	bridgeReports.lock.Lock()
+	defer bridgeReports.lock.Unlock()
+	if bridgeReports.pending == nil {
+		bridgeReports.pending = make(map[string]bool)
+	}
+	bridgeReports.pending[string(cookie)] = reachable
+}
+
+// bridgeReportLoop periodically uploads bridge reachability reports to the binder.
+func bridgeReportLoop() {
+	for {
+		time.Sleep(time.Minute * 5)
+		bridgeReports.lock.Lock()
+		pending := bridgeReports.pending
+		bridgeReports.pending = nil
+		bridgeReports.lock.Unlock()
+		// if we couldn't reach any bridge, our own network is probably down, so don't blame the bridges
+		anyGood := false
+		for _, reachable := range pending {
+			anyGood = anyGood || reachable
+		}
+		if !anyGood {
+			continue
+		}
+		var reports []bdclient.BridgeReport
+		for cookie, reachable := range pending {
+			reports = append(reports, bdclient.BridgeReport{Cookie: []byte(cookie), Reachable: reachable})
+		}
+		err := binders.Do(func(b *bdclient.Client) error {
+			return b.ReportBridges(reports)
+		})
+		if err != nil {
+			log.Debugln("cannot report bridges:", err)
+		}
+	}
+}
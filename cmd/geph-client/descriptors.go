@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"time"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+)
+
+// binderPK is the pinned binder master key, if any.
+var binderPK ed25519.PublicKey
+
+// verifyBridges keeps only the bridges whose descriptors are countersigned by the binder, replacing their info with the signed one.
+func verifyBridges(bridges []bdclient.BridgeInfo) (verified []bdclient.BridgeInfo) {
+	for _, bi := range bridges {
+		if bi.Descriptor == nil {
+			log.Warnf("dropping unsigned bridge %v", bi.Host)
+			continue
+		}
+		desc, err := bi.Descriptor.Verify(binderPK, time.Now())
+		if err != nil {
+			log.Warnf("dropping bridge %v: %v", bi.Host, err)
+			continue
+		}
+		nbi := desc.Info()
+		nbi.Descriptor = bi.Descriptor
+		verified = append(verified, nbi)
+	}
+	return
+}
+
+// readDescriptorFile reads out-of-band bridge descriptors, one per line.
+func readDescriptorFile(fname string) (bridges []bdclient.BridgeInfo) {
+	if binderPK == nil {
+		log.Warnln("ignoring bridge descriptors, since binderMPK isn't set")
+		return
+	}
+	file, err := os.Open(fname)
+	if err != nil {
+		log.Warnln("cannot open bridge descriptor file:", err)
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 65536), 65536)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		sd, err := bdclient.ParseDescriptor(scanner.Text())
+		if err != nil {
+			log.Warnln("cannot parse bridge descriptor:", err)
+			continue
+		}
+		bridges = append(bridges, bdclient.BridgeInfo{Descriptor: &sd})
+	}
+	return verifyBridges(bridges)
+}
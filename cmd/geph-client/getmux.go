@@ -18,28 +18,43 @@ import (
 	"github.com/geph-official/geph2/libs/bdclient"
 	"github.com/geph-official/geph2/libs/cshirt2"
 	"github.com/geph-official/geph2/libs/tinyss"
+	"github.com/geph-official/geph2/libs/tlscamo"
 )
 
 func negotiateTinySS(greeting *[2][]byte, rawConn net.Conn, pk []byte, nextProto byte) (cryptConn *tinyss.Socket, err error) {
 	rawConn.SetDeadline(time.Now().Add(time.Second * 20))
-	cryptConn, err = tinyss.Handshake(rawConn, nextProto)
-	if err != nil {
-		err = fmt.Errorf("tinyss handshake failed: %w", err)
-		rawConn.Close()
-		return
-	}
-	// verify the actual msg
-	var sssig []byte
-	err = rlp.Decode(cryptConn, &sssig)
-	if err != nil {
-		err = fmt.Errorf("cannot decode sssig: %w", err)
-		rawConn.Close()
-		return
-	}
-	if !ed25519.Verify(pk, cryptConn.SharedSec(), sssig) {
-		err = errors.New("man in the middle")
-		rawConn.Close()
-		return
+	if authHandshake {
+		// the handshake itself authenticates the exit
+		cryptConn, err = tinyss.Client(rawConn, tinyss.Config{
+			NextProt:   nextProto,
+			MasterKey:  binderPK,
+			PinnedKeys: []ed25519.PublicKey{pk},
+		})
+		if err != nil {
+			err = fmt.Errorf("tinyss handshake failed: %w", err)
+			rawConn.Close()
+			return
+		}
+	} else {
+		cryptConn, err = tinyss.Handshake(rawConn, nextProto)
+		if err != nil {
+			err = fmt.Errorf("tinyss handshake failed: %w", err)
+			rawConn.Close()
+			return
+		}
+		// verify the actual msg
+		var sssig []byte
+		err = rlp.Decode(cryptConn, &sssig)
+		if err != nil {
+			err = fmt.Errorf("cannot decode sssig: %w", err)
+			rawConn.Close()
+			return
+		}
+		if !ed25519.Verify(pk, cryptConn.SharedSec(), sssig) {
+			err = errors.New("man in the middle")
+			rawConn.Close()
+			return
+		}
 	}
 	if greeting != nil {
 		// send the greeting
@@ -74,6 +89,16 @@ func dialBridge(host string, cookie []byte) (net.Conn, error) {
 		return nil, err
 	}
 	conn.(*net.TCPConn).SetKeepAlive(false)
+	if tlsSNI != "" {
+		conn.SetDeadline(time.Now().Add(time.Second * 15))
+		tlsConn, err := tlscamo.Client(conn, cookie, tlsSNI, tlsProfile)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
 	return cshirt2.Client(cookie, conn)
 }
 
@@ -138,7 +163,13 @@ func getBridges(ubmsg, ubsig []byte) ([]bdclient.BridgeInfo, error) {
 		bridges, err = b.GetBridges(ubmsg, ubsig)
 		return err
 	})
-	if e != nil {
+	if binderPK != nil {
+		bridges = verifyBridges(bridges)
+	}
+	if bridgeDescriptors != "" {
+		bridges = append(bridges, readDescriptorFile(bridgeDescriptors)...)
+	}
+	if e != nil && len(bridges) == 0 {
 		return nil, e
 	}
 	if additionalBridges != "" {
@@ -162,3 +193,35 @@ func getBridges(ubmsg, ubsig []byte) ([]bdclient.BridgeInfo, error) {
 	bridgesCache.bridges, bridgesCache.expires = bridges, time.Now().Add(time.Minute)
 	return bridges, nil
 }
+
+var exitCookieCache struct {
+	cookie  []byte
+	expires time.Time
+	lock    sync.Mutex
+}
+
+// getExitCookie returns the cshirt2 cookie of the exit, or nil if it only speaks plain TinySS.
+func getExitCookie() []byte {
+	exitCookieCache.lock.Lock()
+	defer exitCookieCache.lock.Unlock()
+	if time.Now().Before(exitCookieCache.expires) {
+		return exitCookieCache.cookie
+	}
+	var cookie []byte
+	err := binders.Do(func(b *bdclient.Client) error {
+		var err error
+		cookie, err = b.GetExitCookie(exitName)
+		// a missing cookie isn't the binder's fault
+		var aerr *bdclient.APIError
+		if errors.As(err, &aerr) && aerr.Code == bdclient.CodeNotFound {
+			err = nil
+		}
+		return err
+	})
+	if err != nil {
+		log.Debugln("no cshirt2 cookie for", exitName, err)
+		cookie = nil
+	}
+	exitCookieCache.cookie, exitCookieCache.expires = cookie, time.Now().Add(time.Hour)
+	return cookie
+}
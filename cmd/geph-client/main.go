@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"math/rand"
@@ -21,6 +22,11 @@ import (
 	"github.com/acarl005/stripansi"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/cshirt2"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/geph-official/geph2/libs/shaper"
+	"github.com/geph-official/geph2/libs/tlscamo"
+	"golang.org/x/crypto/ed25519"
 	"golang.org/x/net/proxy"
 
 	log "github.com/sirupsen/logrus"
@@ -31,6 +37,7 @@ var password string
 var ticketFile string
 var binderFront string
 var binderHost string
+var binderMPK string
 var exitName string
 var exitKey string
 var forceBridges bool
@@ -50,7 +57,16 @@ var bypassChinese bool
 var singleHop string
 var upstreamProxy string
 var additionalBridges string
+var bridgeDescriptors string
 var forceWarpfront bool
+var directTransport string
+var multipath bool
+var urtcp bool
+var shapingProfile string
+var authHandshake bool
+var tlsSNI string
+var tlsProfileName string
+var tlsProfile tlscamo.Profile
 
 var sWrap *multipool
 
@@ -77,6 +93,15 @@ func binderRace() {
 	for i := 0; i < len(fronts); i++ {
 		i := i
 		bdc := bdclient.NewClient(fronts[i], hosts[i], fmt.Sprintf("geph_client/%v", GitVersion))
+		if binderMPK != "" {
+			mpk, err := hex.DecodeString(binderMPK)
+			if err != nil || len(mpk) != ed25519.PublicKeySize {
+				panic("binderMPK must be a hex-encoded ed25519 public key")
+			}
+			bdc.SetMasterKey(mpk)
+			binderPK = mpk
+			bdc.EnableCryptrr()
+		}
 		bbb = append(bbb, bdc)
 	}
 	binders = bdclient.NewMulticlient(bbb)
@@ -116,6 +141,7 @@ func main() {
 	flag.StringVar(&ticketFile, "ticketFile", "", "location for caching auth tickets")
 	flag.StringVar(&binderFront, "binderFront", "https://www.cdn77.com/v2,https://netlify.com/v2,https://ajax.aspnetcdn.com/v2", "binder domain-fronting hosts, comma separated")
 	flag.StringVar(&binderHost, "binderHost", "1680337695.rsc.cdn77.org,loving-bell-981479.netlify.app,gephbinder-vzn.azureedge.net", "real hostname of the binder, comma separated")
+	flag.StringVar(&binderMPK, "binderMPK", "", "hex-encoded ed25519 master key of the binder; if set, all binder calls are end-to-end encrypted to it")
 	flag.StringVar(&exitName, "exitName", "us-sfo-01.exits.geph.io", "qualified name of the exit node selected")
 	flag.StringVar(&exitKey, "exitKey", "2f8571e4795032433098af285c0ce9e43c973ac3ad71bf178e4f2aaa39794aec", "ed25519 pubkey of the selected exit")
 	flag.BoolVar(&forceBridges, "forceBridges", false, "force the use of obfuscated bridges")
@@ -129,10 +155,28 @@ func main() {
 	// flag.StringVar(&cachePath, "cachePath", os.TempDir()+"/geph-cache.db", "location of state cache")
 	flag.StringVar(&upstreamProxy, "upstreamProxy", "", "upstream SOCKS5 proxy")
 	flag.StringVar(&additionalBridges, "additionalBridges", "", "additional bridges, in the form of cookie1@host1;cookie2@host2 etc")
+	flag.StringVar(&bridgeDescriptors, "bridgeDescriptors", "", "file of out-of-band bridge descriptors, one per line; requires binderMPK")
 	flag.StringVar(&singleHop, "singleHop", "", "if set in form pk@host:port, location of a single-hop server. OVERRIDES BINDER AND AUTHENTICATION!")
 	flag.BoolVar(&bypassChinese, "bypassChinese", false, "bypass proxy for Chinese domains")
 	flag.BoolVar(&forceWarpfront, "forceWarpfront", false, "force use of warpfront")
+	flag.BoolVar(&multipath, "multipath", false, "use e2e UDP paths through several bridges at once instead of a single TCP bridge connection, falling back to TCP when UDP is blocked")
+	flag.BoolVar(&urtcp, "urtcp", false, "reach the exit over KCP on URTCP through a bridge, rather than a byte stream relayed by it, for networks where only TCP gets through; needs an exit with a published cookie, falling back to TCP without one")
+	flag.StringVar(&directTransport, "directTransport", "tcp", "transport for direct connections to the exit (tcp, kcp or kcppp); UDP transports don't go through upstreamProxy")
+	flag.StringVar(&shapingProfile, "shapingProfile", "none", "traffic shaping profile for obfuscated connections ("+strings.Join(shaper.Names(), ", ")+")")
+	flag.BoolVar(&authHandshake, "authHandshake", false, "use the authenticated TinySS-3 handshake, trusting exitKey or exit keys certified by binderMPK; fails against exits that don't support it")
+	flag.StringVar(&tlsSNI, "tlsSNI", "", "if set, wrap bridge connections in TLS 1.3 with this server name; needs bridges started with -tlsUpstream")
+	flag.StringVar(&tlsProfileName, "tlsProfile", "h2", "ALPN profile for -tlsSNI; ClientHellos otherwise look like Go's, not a browser's ("+strings.Join(tlscamo.Names(), ", ")+")")
 	iniflags.Parse()
+	if _, err := shaper.Get(shapingProfile); err != nil {
+		log.Fatalln("bad shaping profile:", shapingProfile)
+	}
+	if p, err := tlscamo.GetProfile(tlsProfileName); err != nil {
+		log.Fatalln("bad TLS profile:", tlsProfileName)
+	} else {
+		tlsProfile = p
+	}
+	cshirt2.ShapingProfile = shapingProfile
+	niaucchi4.ShapingProfile = shapingProfile
 	hackDNS()
 	if dnsAddr != "" {
 		go doDNS()
@@ -227,6 +271,9 @@ func main() {
 			direct = false
 		}
 	}
+	if singleHop == "" && !direct {
+		go bridgeReportLoop()
+	}
 	sWrap = newMultipool()
 
 	// confirm we are connected
@@ -47,8 +47,10 @@ func getSingleTCP(bridges []bdclient.BridgeInfo) (conn net.Conn, err error) {
 			bridgeConn, err := dialBridge(bi.Host, bi.Cookie)
 			if err != nil {
 				log.Debugln("dialing to", bi.Host, "failed!", err)
+				reportBridge(bi.Cookie, false)
 				return
 			}
+			reportBridge(bi.Cookie, true)
 			<-syncer
 			realConn, err := connThroughBridge(bridgeConn)
 			if err != nil {
@@ -72,10 +74,10 @@ func getSingleTCP(bridges []bdclient.BridgeInfo) (conn net.Conn, err error) {
 	return
 }
 
-func getWarpfront(host2front map[string]string) (conn net.Conn, err error) {
+func getWarpfront(host2front map[string]string, host2token map[string]string, host2carriers map[string][]string) (conn net.Conn, err error) {
 	for host, front := range host2front {
-		log.Println("> WF", host, front)
-		rc, e := warpfront.Connect(cleanHTTPClient, front, host)
+		log.Println("> WF", host, front, host2carriers[host])
+		rc, e := warpfront.Dial(cleanHTTPClient, front, host, host2token[host], host2carriers[host])
 		if e != nil {
 			err = e
 			log.Debugf("WF failed 1/2 %v", e)
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	log "github.com/sirupsen/logrus"
+)
+
+const multipathRefresh = time.Second * 30
+
+// how long we stick to TCP after e2e UDP failed to reach the exit
+const udpBlockedBackoff = time.Minute * 10
+
+var udpBlocked struct {
+	until time.Time
+	lock  sync.Mutex
+}
+
+// e2eAllowed returns whether it's worth trying e2e UDP, i.e. whether UDP didn't recently turn out to be blocked.
+func e2eAllowed() bool {
+	udpBlocked.lock.Lock()
+	defer udpBlocked.lock.Unlock()
+	return time.Now().After(udpBlocked.until)
+}
+
+// markUDPBlocked makes us use TCP for a while.
+func markUDPBlocked() {
+	udpBlocked.lock.Lock()
+	defer udpBlocked.lock.Unlock()
+	log.Warnln("e2e UDP seems to be blocked, using TCP for the next", udpBlockedBackoff)
+	udpBlocked.until = time.Now().Add(udpBlockedBackoff)
+}
+
+// dialMultipath, dialURTCP and dialSingleTCP are how dialBridges connects. Tests replace them.
+var dialMultipath = getMultipath
+var dialURTCP = getURTCP
+var dialSingleTCP = getSingleTCP
+
+// dialBridges connects through bridges: over multipath e2e UDP if enabled and not recently blocked, then over URTCP if enabled, and otherwise or failing those over a single TCP bridge.
+func dialBridges(bridges []bdclient.BridgeInfo) (conn net.Conn, err error) {
+	if multipath && e2eAllowed() {
+		conn, err = dialMultipath(bridges)
+		if err == nil {
+			return
+		}
+		log.Warnf("can't use multipath (%v), falling back to a single bridge", err)
+	}
+	if urtcp {
+		conn, err = dialURTCP(bridges)
+		if err == nil {
+			return
+		}
+		log.Warnf("can't use URTCP (%v), falling back to a single bridge", err)
+	}
+	conn, err = dialSingleTCP(bridges)
+	return
+}
+
+// negotiationFailed is called when the handshake with the exit fails over conn. Bridges happily hand out e2e ports even when UDP can't get through, so this is where we find out.
+func negotiationFailed(conn net.Conn) {
+	if _, ok := conn.(*mpConn); ok {
+		markUDPBlocked()
+	}
+}
+
+// mpConn is a KCP session to the exit running over e2e paths through several bridges at once.
+type mpConn struct {
+	*kcp.UDPSession
+	e2e    *niaucchi4.E2EConn
+	sid    niaucchi4.SessionAddr
+	cookie []byte
+
+	lock  sync.Mutex
+	paths map[string]net.Addr // bridge host => e2e path through it
+
+	once sync.Once
+	dead chan struct{}
+}
+
+// getMultipath establishes e2e paths through as many bridges as possible and runs one KCP session over all of them.
+func getMultipath(bridges []bdclient.BridgeInfo) (conn net.Conn, err error) {
+	udpsock, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return
+	}
+	cookie := make([]byte, 32)
+	rand.Read(cookie)
+	mc := &mpConn{
+		e2e:    niaucchi4.NewE2EConn(niaucchi4.ObfsListen(cookie, udpsock, false)),
+		sid:    niaucchi4.NewSessAddr(),
+		cookie: cookie,
+		paths:  make(map[string]net.Addr),
+		dead:   make(chan struct{}),
+	}
+	mc.refresh(bridges)
+	if mc.pathCount() == 0 {
+		mc.e2e.Close()
+		err = errors.New("no bridge gave us an e2e path")
+		return
+	}
+	kcpConn, err := kcp.NewConn2(mc.sid, nil, 16, 16, mc.e2e)
+	if err != nil {
+		mc.e2e.Close()
+		return
+	}
+	kcpConn.SetWindowSize(10000, 10000)
+	kcpConn.SetNoDelay(0, 100, 32, 0)
+	kcpConn.SetStreamMode(true)
+	kcpConn.SetMtu(1300)
+	mc.UDPSession = kcpConn
+	go mc.maintain()
+	conn = mc
+	return
+}
+
+// Close closes the KCP session and every path.
+func (mc *mpConn) Close() error {
+	mc.once.Do(func() {
+		close(mc.dead)
+		mc.UDPSession.Close()
+		mc.e2e.Close()
+	})
+	return nil
+}
+
+func (mc *mpConn) pathCount() int {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return len(mc.paths)
+}
+
+// maintain adds paths through new bridges and drops paths through bridges that are gone or dead.
+func (mc *mpConn) maintain() {
+	for {
+		select {
+		case <-mc.dead:
+			return
+		case <-time.After(multipathRefresh):
+		}
+		ubmsg, ubsig, err := getGreeting()
+		if err != nil {
+			continue
+		}
+		bridges, err := getBridges(ubmsg, ubsig)
+		if err != nil {
+			log.Warnln("multipath can't refresh bridges:", err)
+			continue
+		}
+		mc.refresh(bridges)
+	}
+}
+
+func (mc *mpConn) refresh(bridges []bdclient.BridgeInfo) {
+	alive := make(map[string]bool)
+	for _, sess := range mc.e2e.DebugInfo() {
+		for _, li := range sess {
+			if li.Alive {
+				alive[li.RemoteIP] = true
+			}
+		}
+	}
+	current := make(map[string]bool)
+	for _, bi := range bridges {
+		current[bi.Host] = true
+	}
+	mc.lock.Lock()
+	for host, path := range mc.paths {
+		if !current[host] || !alive[path.(*net.UDPAddr).IP.String()] {
+			log.Debugln("multipath dropping path through", host)
+			mc.e2e.RemoveSessPath(mc.sid, path)
+			delete(mc.paths, host)
+		}
+	}
+	var toAdd []bdclient.BridgeInfo
+	for _, bi := range bridges {
+		if _, ok := mc.paths[bi.Host]; !ok {
+			toAdd = append(toAdd, bi)
+		}
+	}
+	mc.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, bi := range toAdd {
+		bi := bi
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := requestE2E(bi, mc.cookie)
+			if err != nil {
+				log.Debugln("multipath can't get a path through", bi.Host, err)
+				return
+			}
+			log.Debugln("multipath adding path through", bi.Host, "at", path)
+			mc.lock.Lock()
+			mc.paths[bi.Host] = path
+			mc.lock.Unlock()
+			mc.e2e.SetSessPath(mc.sid, path)
+		}()
+	}
+	wg.Wait()
+}
+
+// requestE2E asks a bridge to open an e2e NAT to the exit, returning the path's UDP address.
+func requestE2E(bi bdclient.BridgeInfo, cookie []byte) (path net.Addr, err error) {
+	bridgeConn, err := dialBridge(bi.Host, bi.Cookie)
+	if err != nil {
+		reportBridge(bi.Cookie, false)
+		return
+	}
+	reportBridge(bi.Cookie, true)
+	defer bridgeConn.Close()
+	bridgeConn.SetDeadline(time.Now().Add(time.Second * 10))
+	rlp.Encode(bridgeConn, "conn/e2e")
+	rlp.Encode(bridgeConn, exitName)
+	rlp.Encode(bridgeConn, cookie)
+	var port uint
+	err = rlp.Decode(bridgeConn, &port)
+	if err != nil {
+		return
+	}
+	return net.ResolveUDPAddr("udp", fmt.Sprintf("%v:%v", strings.Split(bi.Host, ":")[0], port))
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/cshirt2"
+	"github.com/geph-official/geph2/libs/e2enat"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/urtcprelay"
+)
+
+// fallbackTest replaces the dialers for a test, counting how often each is called.
+type fallbackTest struct {
+	mpConn        net.Conn
+	mpErr         error
+	mpDials       int
+	tcpDials      int
+	oldMultipath  bool
+	oldMP, oldTCP func([]bdclient.BridgeInfo) (net.Conn, error)
+}
+
+func newFallbackTest(mpConn net.Conn, mpErr error) *fallbackTest {
+	ft := &fallbackTest{mpConn: mpConn, mpErr: mpErr, oldMultipath: multipath, oldMP: dialMultipath, oldTCP: dialSingleTCP}
+	multipath = true
+	dialMultipath = func([]bdclient.BridgeInfo) (net.Conn, error) {
+		ft.mpDials++
+		return ft.mpConn, ft.mpErr
+	}
+	dialSingleTCP = func([]bdclient.BridgeInfo) (net.Conn, error) {
+		ft.tcpDials++
+		c, _ := net.Pipe()
+		return c, nil
+	}
+	udpBlocked.until = time.Time{}
+	return ft
+}
+
+func (ft *fallbackTest) restore() {
+	multipath = ft.oldMultipath
+	dialMultipath = ft.oldMP
+	dialSingleTCP = ft.oldTCP
+	udpBlocked.until = time.Time{}
+}
+
+func TestFallbackWhenMultipathFails(t *testing.T) {
+	ft := newFallbackTest(nil, errors.New("no paths"))
+	defer ft.restore()
+	conn, err := dialBridges(nil)
+	if err != nil || conn == nil {
+		t.Fatal("didn't fall back to TCP", err)
+	}
+	if ft.mpDials != 1 || ft.tcpDials != 1 {
+		t.Fatal("wrong dials", ft.mpDials, ft.tcpDials)
+	}
+	// failing to set up paths isn't a sign of UDP being blocked
+	if !e2eAllowed() {
+		t.Fatal("UDP marked blocked")
+	}
+}
+
+func TestFallbackWhenUDPBlocked(t *testing.T) {
+	ft := newFallbackTest(&mpConn{}, nil)
+	defer ft.restore()
+	conn, _ := dialBridges(nil)
+	if _, ok := conn.(*mpConn); !ok || ft.tcpDials != 0 {
+		t.Fatal("didn't use multipath")
+	}
+	// the handshake over multipath fails, as when UDP is blocked
+	negotiationFailed(conn)
+	if e2eAllowed() {
+		t.Fatal("UDP not marked blocked")
+	}
+	for i := 0; i < 3; i++ {
+		conn, _ = dialBridges(nil)
+		if _, ok := conn.(*mpConn); ok {
+			t.Fatal("used multipath while UDP is blocked")
+		}
+	}
+	if ft.mpDials != 1 || ft.tcpDials != 3 {
+		t.Fatal("wrong dials", ft.mpDials, ft.tcpDials)
+	}
+	// after the backoff, UDP gets another try
+	udpBlocked.until = time.Now().Add(-time.Second)
+	conn, _ = dialBridges(nil)
+	if _, ok := conn.(*mpConn); !ok {
+		t.Fatal("didn't retry multipath after the backoff")
+	}
+}
+
+func TestFailureOverTCP(t *testing.T) {
+	ft := newFallbackTest(&mpConn{}, nil)
+	defer ft.restore()
+	multipath = false
+	conn, _ := dialBridges(nil)
+	if ft.mpDials != 0 || ft.tcpDials != 1 {
+		t.Fatal("used multipath while disabled")
+	}
+	// a failed handshake over TCP says nothing about UDP
+	negotiationFailed(conn)
+	if !e2eAllowed() {
+		t.Fatal("UDP marked blocked")
+	}
+}
+
+// loopbackExit serves e2e on 127.0.0.1 like geph-exit's e2elisten, echoing every session.
+func loopbackExit(t *testing.T) net.PacketConn {
+	sock, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go e2enat.ServeExit(sock, func(rc *kcp.UDPSession) {
+		defer rc.Close()
+		io.Copy(rc, rc)
+	})
+	return sock
+}
+
+// loopbackBridge listens on 127.0.0.1, on the ports its cookie gives like geph-bridge's listenLoop, and hands every command to serve.
+func loopbackBridge(t *testing.T, serve func(command string, client net.Conn, dec *rlp.Stream)) (bi bdclient.BridgeInfo, listeners []net.Listener) {
+	for attempt := 0; listeners == nil; attempt++ {
+		if attempt == 20 {
+			t.Fatal("no cookie whose ports are all free")
+		}
+		cookie := make([]byte, 32)
+		rand.Read(cookie)
+		portrng := cshirt2.NewRNG(cookie)
+		for i := 0; i < 16; i++ {
+			port := portrng() % 65536
+			l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+			if port < 1024 || err != nil {
+				if l != nil {
+					l.Close()
+				}
+				for _, l := range listeners {
+					l.Close()
+				}
+				listeners = nil
+				break
+			}
+			listeners = append(listeners, l)
+		}
+		if listeners != nil {
+			bi = bdclient.BridgeInfo{Host: listeners[0].Addr().String(), Cookie: cookie}
+		}
+	}
+	for _, l := range listeners {
+		l := l
+		go func() {
+			for {
+				raw, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer raw.Close()
+					deadline := time.Now().Add(time.Second * 10)
+					raw.SetDeadline(deadline)
+					client, err := cshirt2.Server(bi.Cookie, false, raw, deadline)
+					if err != nil {
+						return
+					}
+					dec := rlp.NewStream(client, 100000)
+					var command string
+					if dec.Decode(&command) != nil {
+						return
+					}
+					serve(command, client, dec)
+				}()
+			}
+		}()
+	}
+	return
+}
+
+func echoThrough(t *testing.T, conn net.Conn) {
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	go conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 20))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("echo failed:", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo doesn't match")
+	}
+}
+
+func TestMultipathLoopback(t *testing.T) {
+	oldMultipath, oldExitName := multipath, exitName
+	defer func() {
+		multipath, exitName = oldMultipath, oldExitName
+		udpBlocked.until = time.Time{}
+	}()
+	multipath, exitName = true, "127.0.0.1"
+	udpBlocked.until = time.Time{}
+
+	exit := loopbackExit(t)
+	defer exit.Close()
+	cfg := &e2enat.Config{
+		AllowExit: func(host string) bool { return host == "127.0.0.1" },
+		ExitPort:  exit.LocalAddr().(*net.UDPAddr).Port,
+	}
+	serve := func(command string, client net.Conn, dec *rlp.Stream) {
+		if command != "conn/e2e" {
+			return
+		}
+		if _, err := cfg.Handle(client, dec); err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, client)
+	}
+	var bridges []bdclient.BridgeInfo
+	for i := 0; i < 2; i++ {
+		bi, listeners := loopbackBridge(t, serve)
+		for _, l := range listeners {
+			defer l.Close()
+		}
+		bridges = append(bridges, bi)
+	}
+
+	conn, err := dialBridges(bridges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mc, ok := conn.(*mpConn)
+	if !ok {
+		t.Fatal("didn't use multipath")
+	}
+	if mc.pathCount() != 2 {
+		t.Fatal("paths through", mc.pathCount(), "bridges")
+	}
+	echoThrough(t, conn)
+
+	// a bridge going away takes its path with it, and the session carries on over the other
+	mc.refresh(bridges[:1])
+	if mc.pathCount() != 1 {
+		t.Fatal("paths through", mc.pathCount(), "bridges")
+	}
+	echoThrough(t, conn)
+}
+
+func TestURTCPLoopback(t *testing.T) {
+	oldURTCP, oldExitName := urtcp, exitName
+	exitCookieCache.lock.Lock()
+	oldCookie, oldExpires := exitCookieCache.cookie, exitCookieCache.expires
+	exitCookieCache.lock.Unlock()
+	defer func() {
+		urtcp, exitName = oldURTCP, oldExitName
+		exitCookieCache.lock.Lock()
+		exitCookieCache.cookie, exitCookieCache.expires = oldCookie, oldExpires
+		exitCookieCache.lock.Unlock()
+	}()
+	exitCookie := make([]byte, 32)
+	rand.Read(exitCookie)
+	urtcp, exitName = true, "127.0.0.1"
+	exitCookieCache.lock.Lock()
+	exitCookieCache.cookie, exitCookieCache.expires = exitCookie, time.Now().Add(time.Hour)
+	exitCookieCache.lock.Unlock()
+
+	// the exit, like geph-exit's urtcpListen
+	exit, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exit.Close()
+	go urtcprelay.ServeExit(exit, exitCookie, func(rc *kcp.UDPSession) {
+		defer rc.Close()
+		io.Copy(rc, rc)
+	})
+	cfg := &urtcprelay.Config{
+		AllowExit: func(host string) bool { return host == "127.0.0.1" },
+		ExitPort:  exit.Addr().(*net.TCPAddr).Port,
+	}
+	bi, listeners := loopbackBridge(t, func(command string, client net.Conn, dec *rlp.Stream) {
+		if command == "conn/urtcp" {
+			cfg.Handle(client, dec)
+		}
+	})
+	for _, l := range listeners {
+		defer l.Close()
+	}
+
+	conn, err := dialBridges([]bdclient.BridgeInfo{bi})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*kcp.UDPSession); !ok {
+		t.Fatal("didn't use URTCP")
+	}
+	echoThrough(t, conn)
+
+	// the exit only speaks URTCP to bridges that know its cookie
+	exitCookieCache.lock.Lock()
+	exitCookieCache.cookie = make([]byte, 32)
+	exitCookieCache.lock.Unlock()
+	if conn, err := getURTCP([]bdclient.BridgeInfo{bi}); err == nil {
+		conn.Close()
+		t.Fatal("exit accepted the wrong cookie")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/geph-official/geph2/libs/backedtcp"
 	"github.com/geph-official/geph2/libs/bdclient"
 	"github.com/geph-official/geph2/libs/cshirt2"
+	"github.com/geph-official/geph2/libs/niaucchi4"
 	"github.com/geph-official/geph2/libs/tinysocks"
 	log "github.com/sirupsen/logrus"
 	"github.com/xtaci/smux"
@@ -182,27 +183,51 @@ func getCleanConn() (conn net.Conn, err error) {
 				return
 			}
 		} else {
-			rawConn, err = net.DialTimeout("tcp", exitName+":2389", time.Second*5)
+			switch directTransport {
+			case "kcp":
+				rawConn, err = niaucchi4.DialKCP(exitName+":2389", make([]byte, 32))
+			case "kcppp":
+				rawConn, err = niaucchi4.DialKCPPP(exitName+":2389", make([]byte, 32))
+			default:
+				rawConn, err = net.DialTimeout("tcp", exitName+":2389", time.Second*5)
+			}
 			if err != nil {
-				log.Warnln("failed to connect to exit server: %v", err)
+				log.Warnln("failed to connect to exit server:", err)
 				return
 			}
 		}
-		if err == nil {
-			rawConn.(*net.TCPConn).SetKeepAlive(false)
+		if tcpConn, ok := rawConn.(*net.TCPConn); ok {
+			tcpConn.SetKeepAlive(false)
+			// exits with a published cookie get cshirt2, so that direct connections look like bridged ones
+			if cookie := getExitCookie(); cookie != nil {
+				tcpConn.SetDeadline(time.Now().Add(time.Second * 10))
+				rawConn, err = cshirt2.Client(cookie, tcpConn)
+				if err != nil {
+					tcpConn.Close()
+					log.Warnln("failed cshirt2 handshake with exit server:", err)
+					return
+				}
+			}
 		}
 	} else {
 		getWarpfrontCon := func() (warpConn net.Conn, err error) {
-			var wfstuff map[string]string
+			var wfstuff, tokens map[string]string
+			var carriers map[string][]string
 			binders.Do(func(client *bdclient.Client) error {
 				wfstuff, err = client.GetWarpfronts()
+				if err == nil {
+					// older binders don't hand out tokens, and their bridges don't need them
+					tokens, _ = client.GetWarpfrontTokens()
+					// nor do they know carriers, so we just poll
+					carriers, _ = client.GetWarpfrontCarriers()
+				}
 				return err
 			})
 			if err != nil {
 				log.Warnln("can't get warp front:", err)
 				return
 			}
-			warpConn, err = getWarpfront(wfstuff)
+			warpConn, err = getWarpfront(wfstuff, tokens, carriers)
 			return
 		}
 		if forceWarpfront {
@@ -217,7 +242,7 @@ func getCleanConn() (conn net.Conn, err error) {
 				log.Warnln("getting bridges failed, retrying", err)
 				return
 			}
-			rawConn, err = getSingleTCP(bridges)
+			rawConn, err = dialBridges(bridges)
 			if err != nil {
 				log.Warnf("can't connect to bridges (%v); time to W A R P F R O N T", err)
 				rawConn, err = getWarpfrontCon()
@@ -231,6 +256,7 @@ func getCleanConn() (conn net.Conn, err error) {
 	cryptConn, err := negotiateTinySS(&[2][]byte{ubsig, ubmsg}, rawConn, exitPK(), 'N')
 	if err != nil {
 		log.Println("error while negotiating cryptConn", err)
+		negotiationFailed(rawConn)
 		return
 	}
 	rawConn.SetDeadline(time.Time{})
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"net"
+
+	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/niaucchi5"
+	"github.com/geph-official/geph2/libs/urtcprelay"
+	log "github.com/sirupsen/logrus"
+)
+
+// getURTCP runs a KCP session to the exit over URTCP, through the first bridge that relays it.
+func getURTCP(bridges []bdclient.BridgeInfo) (conn net.Conn, err error) {
+	exitCookie := getExitCookie()
+	if exitCookie == nil {
+		err = errors.New("exit has no published cookie")
+		return
+	}
+	results := make(chan net.PacketConn, len(bridges))
+	for _, bi := range bridges {
+		bi := bi
+		go func() {
+			bridgeConn, err := dialBridge(bi.Host, bi.Cookie)
+			if err != nil {
+				reportBridge(bi.Cookie, false)
+				results <- nil
+				return
+			}
+			reportBridge(bi.Cookie, true)
+			wire, err := urtcprelay.Dial(bridgeConn, exitName, exitCookie)
+			if err != nil {
+				log.Debugln("URTCP through", bi.Host, "failed!", err)
+				bridgeConn.Close()
+				results <- nil
+				return
+			}
+			results <- wire
+		}()
+	}
+	for i := range bridges {
+		wire := <-results
+		if wire == nil {
+			continue
+		}
+		// slower bridges lose the race
+		go func(left int) {
+			for ; left > 0; left-- {
+				if wire := <-results; wire != nil {
+					wire.Close()
+				}
+			}
+		}(len(bridges) - i - 1)
+		kcpConn, e := kcp.NewConn2(niaucchi5.StandardAddr, nil, 16, 16, wire)
+		if e != nil {
+			wire.Close()
+			err = e
+			return
+		}
+		kcpConn.SetWindowSize(10000, 10000)
+		kcpConn.SetNoDelay(0, 100, 32, 0)
+		kcpConn.SetStreamMode(true)
+		kcpConn.SetMtu(1300)
+		conn = kcpConn
+		return
+	}
+	err = errors.New("no bridge relayed URTCP")
+	return
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"github.com/geph-official/geph2/libs/cshirt2"
+	log "github.com/sirupsen/logrus"
+)
+
+// tinyssMagic starts every plain TinySS handshake. cshirt2 handshakes start with random bytes, which match it with negligible probability.
+var tinyssMagic = []byte("TinySS-")
+
+// handleDirect serves a direct TCP connection. With a cookie, it can be either cshirt2 or, unless requireCshirt2 is set, plain TinySS from clients that predate exit cookies.
+func handleDirect(rawClient net.Conn) {
+	if directCookie == nil {
+		handle(rawClient)
+		return
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	rawClient.SetDeadline(deadline)
+	start := make([]byte, len(tinyssMagic))
+	n, err := io.ReadFull(rawClient, start)
+	if err != nil {
+		rawClient.Close()
+		return
+	}
+	wire := &prefixConn{Conn: rawClient, prefix: start[:n]}
+	if bytes.Equal(start, tinyssMagic) {
+		if requireCshirt2 {
+			log.Debugln("rejecting plain TinySS from", rawClient.RemoteAddr())
+			rawClient.Close()
+			return
+		}
+		rawClient.SetDeadline(time.Time{})
+		handle(wire)
+		return
+	}
+	client, err := cshirt2.Server(directCookie, false, wire, deadline)
+	if err != nil {
+		log.Debugln("cshirt2 failed with", rawClient.RemoteAddr(), err)
+		rawClient.Close()
+		return
+	}
+	rawClient.SetDeadline(time.Time{})
+	handle(client)
+}
+
+// prefixConn is a connection that first returns bytes read from it earlier.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (pc *prefixConn) Read(p []byte) (n int, err error) {
+	if len(pc.prefix) > 0 {
+		n = copy(p, pc.prefix)
+		pc.prefix = pc.prefix[n:]
+		return
+	}
+	return pc.Conn.Read(p)
+}
@@ -80,17 +80,19 @@ func init() {
 func handle(rawClient net.Conn) {
 	log.Println("handle called with", rawClient.RemoteAddr())
 	rawClient.SetDeadline(time.Now().Add(time.Second * 30))
-	tssClient, err := tinyss.Handshake(rawClient, 0)
+	tssClient, err := tinyss.Server(rawClient, tinyss.Config{StaticKey: seckey, KeyChain: keyChain})
 	if err != nil {
 		rawClient.Close()
 		return
 	}
-	log.Println("tssClient with prot", tssClient.NextProt())
+	log.Println("tssClient with prot", tssClient.NextProt(), "version", tssClient.Version())
 	// HACK: it's bridged if the remote address has a dot in it
 	//isBridged := strings.Contains(rawClient.RemoteAddr().String(), ".")
-	// sign the shared secret
-	ssSignature := ed25519.Sign(seckey, tssClient.SharedSec())
-	rlp.Encode(tssClient, &ssSignature)
+	if tssClient.Version() < 3 {
+		// legacy clients authenticate us by a signature on the shared secret
+		ssSignature := ed25519.Sign(seckey, tssClient.SharedSec())
+		rlp.Encode(tssClient, &ssSignature)
+	}
 	var limiter *rate.Limiter
 	limiter = infiniteLimit
 	slowLimit := false
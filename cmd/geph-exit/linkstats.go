@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/geph-official/geph2/libs/kcp-go"
+)
+
+// kcpStatsHandler serves snapshots of all KCP sessions as JSON.
+func kcpStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := kcp.AllStats()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].RemoteAddr < stats[j].RemoteAddr
+	})
+	w.Header().Set("content-type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(stats)
+}
+
+// reportLinkQuality periodically reports the RTT and recent loss of every KCP client to statsd.
+func reportLinkQuality() {
+	last := make(map[string]kcp.Snmp)
+	for {
+		time.Sleep(time.Second * 10)
+		seen := make(map[string]kcp.Snmp)
+		for _, s := range kcp.AllStats() {
+			seen[s.RemoteAddr] = s.Snmp
+			prev := last[s.RemoteAddr]
+			deltaTotal := float64(s.OutSegs - prev.OutSegs)
+			deltaRetrans := float64(s.RetransSegs - prev.RetransSegs)
+			if deltaTotal+deltaRetrans < 100 {
+				continue
+			}
+			statClient.Timing(hostname+".clientLossPct", int64(10000*deltaRetrans/(deltaRetrans+deltaTotal)))
+			statClient.Timing(hostname+".clientLatency", int64(s.SRTT))
+		}
+		last = seen
+	}
+}
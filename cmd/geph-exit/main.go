@@ -2,21 +2,29 @@ package main
 
 import (
 	"crypto/ed25519"
+	"encoding/hex"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	_ "net/http/pprof"
 
 	statsd "github.com/etsy/statsd/examples/go"
 	"github.com/geph-official/geph2/libs/bdclient"
+	"github.com/geph-official/geph2/libs/e2enat"
 	"github.com/geph-official/geph2/libs/fastudp"
 	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/kcppp"
 	"github.com/geph-official/geph2/libs/niaucchi4"
 	"github.com/geph-official/geph2/libs/pseudotcp"
+	"github.com/geph-official/geph2/libs/shaper"
+	"github.com/geph-official/geph2/libs/tinyss"
+	"github.com/geph-official/geph2/libs/urtcprelay"
 	"github.com/patrickmn/go-cache"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
@@ -25,6 +33,8 @@ import (
 var keyfile string
 var pubkey ed25519.PublicKey
 var seckey ed25519.PrivateKey
+var keyChainFile string
+var keyChain tinyss.KeyChain
 var onlyPaid bool
 
 var singleHop string
@@ -34,6 +44,12 @@ var binderReal string
 var bclient *bdclient.Client
 var hostname string
 var statsdAddr string
+var congestionControl string
+var udpTransport string
+var shapingProfile string
+var directCookieHex string
+var directCookie []byte
+var requireCshirt2 bool
 
 var infiniteLimit = rate.NewLimiter(rate.Inf, 1000)
 var listenHost string
@@ -50,6 +66,7 @@ func main() {
 	})
 	log.SetLevel(log.DebugLevel)
 	flag.StringVar(&keyfile, "keyfile", "keyfile.bin", "location of key file")
+	flag.StringVar(&keyChainFile, "keyChain", "", "file with the binder-signed key chain for the exit's key, from the binder's /sign-exit-key")
 	flag.StringVar(&binderFront, "binderFront", "https://binder.geph.io/v2", "binder domain-fronting host")
 	flag.StringVar(&binderReal, "binderReal", "binder.geph.io", "real hostname of the binder")
 	flag.StringVar(&statsdAddr, "statsdAddr", "c2.geph.io:8125", "address of StatsD for gathering statistics")
@@ -57,7 +74,13 @@ func main() {
 	flag.StringVar(&singleHop, "singleHop", "", "if supplied, runs in single-hop mode. (for example, -singleHop :5000 would listen on port 5000)")
 	flag.StringVar(&listenHost, "listenHost", "", "specify the specific host to listen on")
 	flag.StringVar(&hostname, "hostname", "", "force the use of a particular hostname")
+	flag.StringVar(&congestionControl, "congestionControl", "BIC", "congestion control algorithm for KCP sessions (BIC, CUBIC, VGS, LOL or BBR)")
+	flag.StringVar(&udpTransport, "udpTransport", "kcp", "reliable transport for the UDP listener (kcp or kcppp); URTCP always uses kcp")
+	flag.StringVar(&shapingProfile, "shapingProfile", "none", "traffic shaping profile for obfuscated connections ("+strings.Join(shaper.Names(), ", ")+")")
+	flag.StringVar(&directCookieHex, "cookie", "", "hex-encoded cshirt2 cookie for direct TCP connections on port 2389 and URTCP on port 2390, from the binder's /exit-cookie; without it, URTCP isn't served")
+	flag.BoolVar(&requireCshirt2, "requireCshirt2", false, "reject direct TCP connections that don't use cshirt2; needs -cookie")
 	flag.Parse()
+	http.HandleFunc("/debug/kcp", kcpStatsHandler)
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
@@ -70,8 +93,25 @@ func main() {
 		}
 	}
 
+	if _, err := kcp.NewCongestionController(congestionControl); err != nil {
+		log.Fatalln("bad congestion control algorithm:", err)
+	}
+	if udpTransport != "kcp" && udpTransport != "kcppp" {
+		log.Fatalln("bad UDP transport:", udpTransport)
+	}
+	if _, err := shaper.Get(shapingProfile); err != nil {
+		log.Fatalln("bad shaping profile:", shapingProfile)
+	}
+	niaucchi4.ShapingProfile = shapingProfile
+	if directCookieHex != "" {
+		directCookie, err = hex.DecodeString(directCookieHex)
+		if err != nil {
+			log.Fatalln("bad cookie:", err)
+		}
+	} else if requireCshirt2 {
+		log.Fatalln("-requireCshirt2 needs -cookie")
+	}
 	// load the key
-	kcp.CongestionControl = "BIC"
 	loadKey()
 	if singleHop != "" {
 		mainSingleHop()
@@ -84,6 +124,7 @@ func main() {
 			panic(e)
 		}
 		statClient = statsd.New(z.IP.String(), z.Port)
+		go reportLinkQuality()
 	}
 	bclient = bdclient.NewClient(binderFront, binderReal, "geph_exit")
 
@@ -101,7 +142,7 @@ func main() {
 				continue
 			}
 			rawClient.(*net.TCPConn).SetKeepAlive(false)
-			go handle(rawClient)
+			go handleDirect(rawClient)
 		}
 	}()
 	go func() {
@@ -120,6 +161,9 @@ func main() {
 		}
 	}()
 	go e2elisten()
+	if directCookie != nil {
+		go urtcpListen()
+	}
 	udpsock, err := net.ListenPacket("udp4", listenHost+":2389")
 	if err != nil {
 		panic(err)
@@ -127,6 +171,11 @@ func main() {
 	udpsock.(*net.UDPConn).SetWriteBuffer(100 * 1024 * 1024)
 	udpsock.(*net.UDPConn).SetReadBuffer(100 * 1024 * 1024)
 	obfs := niaucchi4.ObfsListen(make([]byte, 32), udpsock, false)
+	if udpTransport == "kcppp" {
+		log.Infoln("Listen on UDP 2389 (KCP++)")
+		listenKCPPP(obfs)
+		return
+	}
 	kcpListener := niaucchi4.ListenKCP(obfs)
 	log.Infoln("Listen on UDP 2389")
 	for {
@@ -136,6 +185,7 @@ func main() {
 		}
 		rc.SetWindowSize(10000, 10000)
 		rc.SetNoDelay(0, 100, 32, 0)
+		setCongestionController(rc)
 		rc.SetStreamMode(true)
 		rc.SetMtu(1300)
 		go handle(rc)
@@ -143,30 +193,54 @@ func main() {
 }
 
 func e2elisten() {
-	udpsock, err := net.ListenPacket("udp4", listenHost+":2399")
+	udpsock, err := net.ListenPacket("udp4", fmt.Sprintf("%v:%v", listenHost, e2enat.ExitPort))
 	if err != nil {
 		panic(err)
 	}
 	fastsock := fastudp.NewConn(udpsock.(*net.UDPConn))
 	udpsock.(*net.UDPConn).SetWriteBuffer(100 * 1024 * 1024)
 	udpsock.(*net.UDPConn).SetReadBuffer(100 * 1024 * 1024)
-	log.Infoln("e2elisten on UDP 2399")
-	e2e := niaucchi4.NewE2EConn(fastsock)
-	kcpListener := niaucchi4.ListenKCP(e2e)
+	log.Infoln("e2elisten on UDP", e2enat.ExitPort)
+	err = e2enat.ServeExit(fastsock, func(rc *kcp.UDPSession) {
+		setCongestionController(rc)
+		handle(rc)
+	})
+	log.Println("error while accepting E2E:", err)
+}
+
+// urtcpListen serves KCP over URTCP, which bridges relay for clients whose paths only let TCP through. Connections must open with a cshirt2 handshake with our cookie.
+func urtcpListen() {
+	tcpListener, err := net.Listen("tcp", fmt.Sprintf("%v:%v", listenHost, urtcprelay.ExitPort))
+	if err != nil {
+		panic(err)
+	}
+	log.Infoln("urtcpListen on TCP", urtcprelay.ExitPort)
+	err = urtcprelay.ServeExit(tcpListener, directCookie, func(rc *kcp.UDPSession) {
+		setCongestionController(rc)
+		handle(rc)
+	})
+	log.Println("error while accepting URTCP:", err)
+}
+
+// listenKCPPP serves KCP++ connections over sock.
+func listenKCPPP(sock net.PacketConn) {
+	listener := kcppp.Listen(sock)
 	for {
-		rc, err := kcpListener.Accept()
+		rc, err := listener.Accept()
 		if err != nil {
-			log.Println("error while accepting E2E:", err)
-			continue
+			log.Println("error while accepting KCP++:", err)
+			return
 		}
-		rc.SetWindowSize(10000, 10000)
-		rc.SetNoDelay(0, 100, 32, 0)
-		rc.SetStreamMode(true)
-		rc.SetMtu(1300)
 		go handle(rc)
 	}
 }
 
+// setCongestionController gives a session its own controller running the configured algorithm.
+func setCongestionController(rc *kcp.UDPSession) {
+	cc, _ := kcp.NewCongestionController(congestionControl)
+	rc.SetCongestionController(cc)
+}
+
 func loadKey() {
 retry:
 	bts, err := ioutil.ReadFile(keyfile)
@@ -178,4 +252,17 @@ retry:
 	}
 	seckey = bts
 	pubkey = seckey.Public().(ed25519.PublicKey)
+	if keyChainFile != "" {
+		bts, err := ioutil.ReadFile(keyChainFile)
+		if err != nil {
+			log.Fatalln("cannot read key chain:", err)
+		}
+		keyChain, err = tinyss.ParseKeyChain(string(bts))
+		if err != nil {
+			log.Fatalln("cannot parse key chain:", err)
+		}
+		if time.Until(keyChain.Expiry()) < time.Hour*24*7 {
+			log.Warnln("key chain expires at", keyChain.Expiry())
+		}
+	}
 }
@@ -33,8 +33,9 @@ func shTCP() {
 		}
 		log.Debugln("SH client [TCP] @", rawClient.RemoteAddr())
 		go func() {
-			rawClient.SetDeadline(time.Now().Add(time.Second * 10))
-			client, err := cshirt2.Server(pubkey, false, rawClient)
+			deadline := time.Now().Add(time.Second * 10)
+			rawClient.SetDeadline(deadline)
+			client, err := cshirt2.Server(pubkey, false, rawClient, deadline)
 			if err != nil {
 				rawClient.Close()
 				return
@@ -54,6 +55,10 @@ func shUDP() {
 	udpsock.(*net.UDPConn).SetReadBuffer(10 * 1024 * 1024)
 	obfs := niaucchi4.ObfsListen(pubkey, udpsock, false)
 	log.Infoln("... UDP on", obfs.LocalAddr())
+	if udpTransport == "kcppp" {
+		listenKCPPP(obfs)
+		return
+	}
 	kcpListener := niaucchi4.ListenKCP(obfs)
 	for {
 		rc, err := kcpListener.Accept()
@@ -62,6 +67,7 @@ func shUDP() {
 			continue
 		}
 		log.Debugln("SH client [UDP roaming] @", rc.RemoteAddr())
+		setCongestionController(rc)
 		go handle(rc)
 	}
 }
@@ -0,0 +1,292 @@
+package bdclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/c25519"
+	"github.com/geph-official/geph2/libs/cryptrr"
+	"golang.org/x/crypto/ed25519"
+)
+
+// APIVersion is the version of the binder API implemented by this package.
+const APIVersion = 3
+
+// VersionHeader carries the API version on both requests and responses.
+const VersionHeader = "X-Geph-Api-Version"
+
+// SignatureHeader carries the hex-encoded ed25519 signature of a v3 response.
+const SignatureHeader = "X-Geph-Signature"
+
+// NonceHeader carries a random nonce from the client. The binder's signature covers it, along with the request, so that a signed response can't be replayed to another request.
+const NonceHeader = "X-Geph-Nonce"
+
+// Error codes returned in APIError.Code.
+const (
+	CodeBadRequest  = "bad-request"
+	CodeBadAuth     = "bad-auth"
+	CodeNotFound    = "not-found"
+	CodeRateLimited = "rate-limited"
+	CodeInternal    = "internal"
+)
+
+// APIError is the typed error object returned by v3 endpoints.
+type APIError struct {
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return "binder: " + e.Code
+	}
+	return fmt.Sprintf("binder: %v (%v)", e.Code, e.Message)
+}
+
+// Is makes bad-auth errors match ErrBadAuth.
+func (e *APIError) Is(target error) bool {
+	return target == ErrBadAuth && e.Code == CodeBadAuth
+}
+
+// HTTPStatus returns the HTTP status code that goes with the error code.
+func (e *APIError) HTTPStatus() int {
+	switch e.Code {
+	case CodeBadRequest:
+		return http.StatusBadRequest
+	case CodeBadAuth:
+		return http.StatusForbidden
+	case CodeNotFound:
+		return http.StatusNotFound
+	case CodeRateLimited:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ErrorResp is the body of a failed v3 call.
+type ErrorResp struct {
+	Error *APIError
+}
+
+// SignedMessage returns what the binder signs for a response to the given method, request body and nonce.
+func SignedMessage(method string, req []byte, nonce string, body []byte) []byte {
+	reqHash := sha256.Sum256(req)
+	var buf bytes.Buffer
+	buf.WriteString("geph-binder-v3\n")
+	buf.WriteString(method)
+	buf.WriteString("\n")
+	buf.WriteString(hex.EncodeToString(reqHash[:]))
+	buf.WriteString("\n")
+	buf.WriteString(nonce)
+	buf.WriteString("\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// AuthReq authenticates a user.
+type AuthReq struct {
+	Username string
+	Password string
+}
+
+// GetTicketReq requests a blind-signed ticket.
+type GetTicketReq struct {
+	AuthReq
+	Blinded []byte
+}
+
+// TicketKeyReq requests the ticket key of a tier.
+type TicketKeyReq struct {
+	Tier string
+}
+
+// TicketKeyResp carries a PKCS#1-encoded RSA public key.
+type TicketKeyResp struct {
+	Key []byte
+}
+
+// TierResp carries the tier of a user.
+type TierResp struct {
+	Tier string
+}
+
+// TicketReq carries an unblinded ticket.
+type TicketReq struct {
+	Tier  string
+	UbMsg []byte
+	UbSig []byte
+}
+
+// GetBridgesReq requests bridges.
+type GetBridgesReq struct {
+	TicketReq
+	Ephemeral bool
+	Exit      string
+}
+
+// BridgeReport says whether a client could reach a bridge.
+type BridgeReport struct {
+	Cookie    []byte
+	Reachable bool
+}
+
+// ReportBridgesReq uploads bridge reachability reports.
+type ReportBridgesReq struct {
+	Reports []BridgeReport
+}
+
+// AddBridgeReq uploads bridge info. If Signed is given, the other fields are taken from it.
+type AddBridgeReq struct {
+	Secret     string
+	Cookie     []byte
+	Host       string
+	AllocGroup string
+	Signed     *SignedDescriptor
+}
+
+// AddBridgeResp returns the countersigned descriptor, if one was uploaded.
+type AddBridgeResp struct {
+	Countersigned *SignedDescriptor
+}
+
+// ExitCookieReq asks for the cshirt2 cookie of an exit.
+type ExitCookieReq struct {
+	Exit string
+}
+
+// ExitCookieResp carries an exit's cshirt2 cookie.
+type ExitCookieResp struct {
+	Cookie []byte
+}
+
+// errNoV3 means that the binder doesn't speak v3 and we should fall back.
+var errNoV3 = errors.New("binder does not support API v3")
+
+// SetMasterKey pins the binder's master public key. v3 responses that aren't signed by it are rejected, and there is no fallback to v2.
+func (cl *Client) SetMasterKey(mpk ed25519.PublicKey) {
+	cl.masterPK = mpk
+}
+
+func (cl *Client) useV3() bool {
+	return atomic.LoadInt32(&cl.noV3) == 0
+}
+
+// EnableCryptrr tunnels all v3 calls through the binder's end-to-end encrypted CryptRR endpoint, so that the fronting CDN sees nothing. SetMasterKey must be called first.
+func (cl *Client) EnableCryptrr() {
+	if cl.masterPK == nil {
+		panic("EnableCryptrr called without a master key")
+	}
+	cl.cryptrr = &cryptrr.DomainFrontClient{
+		Endpoint:  fmt.Sprintf("%v/cryptrr", cl.frontDomain),
+		RealHost:  cl.realDomain,
+		UserAgent: cl.useragent,
+	}
+}
+
+// callV3 calls a v3 method. A nil req sends an empty object.
+func (cl *Client) callV3(method string, req interface{}, resp interface{}) (err error) {
+	if req == nil {
+		req = struct{}{}
+	}
+	reqBts, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	var status int
+	var body []byte
+	if cl.cryptrr != nil {
+		status, body, err = cl.tunnelV3(method, reqBts)
+	} else {
+		status, body, err = cl.postV3(method, reqBts)
+	}
+	if err != nil {
+		return
+	}
+	if status != http.StatusOK {
+		var eresp ErrorResp
+		if json.Unmarshal(body, &eresp) != nil || eresp.Error == nil {
+			err = badStatusCode(status)
+			return
+		}
+		err = eresp.Error
+		return
+	}
+	if resp != nil {
+		err = json.Unmarshal(body, resp)
+	}
+	return
+}
+
+// postV3 sends a v3 request as a plain POST, checking the response signature if we have a master key.
+func (cl *Client) postV3(method string, reqBts []byte) (status int, body []byte, err error) {
+	hreq, _ := http.NewRequest("POST", fmt.Sprintf("%v/v3/%v", cl.frontDomain, method), bytes.NewReader(reqBts))
+	hreq.Host = cl.realDomain
+	hreq.Header.Set("user-agent", cl.useragent)
+	hreq.Header.Set("content-type", "application/json")
+	hreq.Header.Set(VersionHeader, strconv.Itoa(APIVersion))
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	hreq.Header.Set(NonceHeader, hex.EncodeToString(nonce))
+	hresp, err := cl.hclient.Do(hreq)
+	if err != nil {
+		return
+	}
+	defer hresp.Body.Close()
+	if hresp.Header.Get(VersionHeader) == "" {
+		// with a pinned key, falling back to unsigned v2 responses would defeat the point
+		if cl.masterPK == nil &&
+			(hresp.StatusCode == http.StatusNotFound || hresp.StatusCode == http.StatusMethodNotAllowed) {
+			atomic.StoreInt32(&cl.noV3, 1)
+			err = errNoV3
+			return
+		}
+		err = badStatusCode(hresp.StatusCode)
+		return
+	}
+	body, err = ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return
+	}
+	if cl.masterPK != nil {
+		sig, _ := hex.DecodeString(hresp.Header.Get(SignatureHeader))
+		if !ed25519.Verify(cl.masterPK, SignedMessage(method, reqBts, hreq.Header.Get(NonceHeader), body), sig) {
+			err = fmt.Errorf("bad binder signature on %v", method)
+			return
+		}
+	}
+	status = hresp.StatusCode
+	return
+}
+
+// tunnelV3 sends a v3 request through CryptRR. The request is the method name with the JSON body as its only argument; the response carries the status and the JSON body.
+func (cl *Client) tunnelV3(method string, reqBts []byte) (status int, body []byte, err error) {
+	binderPK, err := c25519.FromEd25519PK(cl.masterPK)
+	if err != nil {
+		return
+	}
+	resp, err := cryptrr.Call(cl.cryptrr, binderPK, cryptrr.NewPlainMsg(method, reqBts))
+	if err != nil {
+		return
+	}
+	var args struct {
+		Status uint
+		Body   []byte
+	}
+	if err = rlp.DecodeBytes(resp.Args, &args); err != nil {
+		return
+	}
+	status = int(args.Status)
+	body = args.Body
+	return
+}
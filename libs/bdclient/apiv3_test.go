@@ -0,0 +1,162 @@
+package bdclient
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/geph-official/geph2/libs/c25519"
+	"github.com/geph-official/geph2/libs/cryptrr"
+	"golang.org/x/crypto/ed25519"
+)
+
+func v3Server(sk ed25519.PrivateKey) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.TrimPrefix(r.URL.Path, "/v3/")
+		req, _ := ioutil.ReadAll(r.Body)
+		var resp interface{}
+		status := http.StatusOK
+		switch method {
+		case "client-info":
+			resp = ClientInfo{Address: "1.2.3.4", Country: "CA"}
+		case "get-tier":
+			resp = ErrorResp{Error: &APIError{Code: CodeBadAuth}}
+			status = http.StatusForbidden
+		}
+		b, _ := json.Marshal(resp)
+		w.Header().Set(VersionHeader, strconv.Itoa(APIVersion))
+		w.Header().Set(SignatureHeader, hex.EncodeToString(ed25519.Sign(sk, SignedMessage(method, req, r.Header.Get(NonceHeader), b))))
+		w.WriteHeader(status)
+		w.Write(b)
+	}))
+}
+
+func TestV3Signed(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	srv := v3Server(sk)
+	defer srv.Close()
+	cl := NewClient(srv.URL, "binder.test", "test")
+	cl.SetMasterKey(pk)
+	cinfo, err := cl.GetClientInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cinfo.Country != "CA" {
+		t.Fatal("wrong country", cinfo.Country)
+	}
+	_, err = cl.GetTier("user", "pwd")
+	if !errors.Is(err, ErrBadAuth) {
+		t.Fatal("expected ErrBadAuth, got", err)
+	}
+	// a different pinned key must reject the response
+	otherPK, _, _ := ed25519.GenerateKey(nil)
+	cl.SetMasterKey(otherPK)
+	if _, err := cl.GetClientInfo(); err == nil {
+		t.Fatal("accepted response signed by the wrong key")
+	}
+}
+
+func TestV2Fallback(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get-tier", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.RawQuery != "" {
+			t.Error("credentials sent in the URL")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(body), "pwd=pwd") {
+			t.Error("credentials missing from the body")
+		}
+		w.Write([]byte("free"))
+	})
+	mux.HandleFunc("/client-info", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	cl := NewClient(srv.URL, "binder.test", "test")
+	tier, err := cl.GetTier("user", "pwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tier != "free" {
+		t.Fatal("wrong tier", tier)
+	}
+	if _, err := cl.GetClientInfo(); err == nil {
+		t.Fatal("bad status code not reported")
+	}
+	// pinned clients never fall back
+	pk, _, _ := ed25519.GenerateKey(nil)
+	pinned := NewClient(srv.URL, "binder.test", "test")
+	pinned.SetMasterKey(pk)
+	if _, err := pinned.GetTier("user", "pwd"); err == nil {
+		t.Fatal("pinned client fell back to v2")
+	}
+}
+
+func TestCryptrrTunnel(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	mux := http.NewServeMux()
+	mux.Handle("/cryptrr", cryptrr.NewHandler(c25519.FromEd25519SK(sk), func(r *http.Request, req cryptrr.PlainMsg) cryptrr.PlainMsg {
+		if req.Cmd != "client-info" {
+			return cryptrr.NewPlainMsg(req.Cmd, uint(http.StatusNotFound), []byte("{}"))
+		}
+		b, _ := json.Marshal(ClientInfo{Country: "CA"})
+		return cryptrr.NewPlainMsg(req.Cmd, uint(http.StatusOK), b)
+	}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	cl := NewClient(srv.URL, "binder.test", "test")
+	cl.SetMasterKey(pk)
+	cl.EnableCryptrr()
+	cinfo, err := cl.GetClientInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cinfo.Country != "CA" {
+		t.Fatal("wrong country", cinfo.Country)
+	}
+	if _, err := cl.GetWarpfronts(); err == nil {
+		t.Fatal("expected an error for an unknown method")
+	}
+}
+
+func TestV3RejectsReplayedResponses(t *testing.T) {
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	real := v3Server(sk)
+	defer real.Close()
+	// a middlebox that answers every request with the first response it saw
+	var sig string
+	var saved []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if saved == nil {
+			req, _ := http.NewRequest("POST", real.URL+r.URL.Path, r.Body)
+			req.Header = r.Header
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			saved, _ = ioutil.ReadAll(resp.Body)
+			sig = resp.Header.Get(SignatureHeader)
+		}
+		w.Header().Set(VersionHeader, strconv.Itoa(APIVersion))
+		w.Header().Set(SignatureHeader, sig)
+		w.Write(saved)
+	}))
+	defer srv.Close()
+	cl := NewClient(srv.URL, "binder.test", "test")
+	cl.SetMasterKey(pk)
+	if _, err := cl.GetClientInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.GetClientInfo(); err == nil {
+		t.Fatal("accepted a replayed response")
+	}
+}
@@ -12,10 +12,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/cryptoballot/rsablind"
+	"github.com/geph-official/geph2/libs/cryptrr"
+	"golang.org/x/crypto/ed25519"
 )
 
 // Multiclient wraps around mutliple clients, R/R-ing between them until something works.
@@ -45,6 +48,9 @@ type Client struct {
 	frontDomain string
 	realDomain  string
 	useragent   string
+	masterPK    ed25519.PublicKey
+	noV3        int32
+	cryptrr     *cryptrr.DomainFrontClient
 }
 
 // NewClient creates a new domain-fronting binder client with the given frontDomain and realDomain. frontDomain should start with `https://`.
@@ -75,6 +81,12 @@ type ClientInfo struct {
 
 // GetClientInfo checks user info
 func (cl *Client) GetClientInfo() (ui ClientInfo, err error) {
+	if cl.useV3() {
+		err = cl.callV3("client-info", nil, &ui)
+		if err != errNoV3 {
+			return
+		}
+	}
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/client-info", cl.frontDomain), bytes.NewReader(nil))
 	req.Host = cl.realDomain
 	req.Header.Set("user-agent", cl.useragent)
@@ -85,6 +97,7 @@ func (cl *Client) GetClientInfo() (ui ClientInfo, err error) {
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		err = badStatusCode(resp.StatusCode)
+		return
 	}
 	err = json.NewDecoder(resp.Body).Decode(&ui)
 	return
@@ -92,6 +105,12 @@ func (cl *Client) GetClientInfo() (ui ClientInfo, err error) {
 
 // GetWarpfronts gets warpfront bridges
 func (cl *Client) GetWarpfronts() (host2front map[string]string, err error) {
+	if cl.useV3() {
+		err = cl.callV3("warpfronts", nil, &host2front)
+		if err != errNoV3 {
+			return
+		}
+	}
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/warpfronts", cl.frontDomain), bytes.NewReader(nil))
 	req.Host = cl.realDomain
 	req.Header.Set("user-agent", cl.useragent)
@@ -102,13 +121,45 @@ func (cl *Client) GetWarpfronts() (host2front map[string]string, err error) {
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		err = badStatusCode(resp.StatusCode)
+		return
 	}
 	err = json.NewDecoder(resp.Body).Decode(&host2front)
 	return
 }
 
+// GetWarpfrontTokens gets the tokens that warpfront bridges need to register sessions, by host. Only v3 binders hand out tokens.
+func (cl *Client) GetWarpfrontTokens() (host2token map[string]string, err error) {
+	if !cl.useV3() {
+		err = errNoV3
+		return
+	}
+	err = cl.callV3("warpfront-tokens", nil, &host2token)
+	return
+}
+
+// GetWarpfrontCarriers gets which carriers the fronts of warpfront bridges support, by host, as warpfront.Dial takes them. Only v3 binders know.
+func (cl *Client) GetWarpfrontCarriers() (host2carriers map[string][]string, err error) {
+	if !cl.useV3() {
+		err = errNoV3
+		return
+	}
+	err = cl.callV3("warpfront-carriers", nil, &host2carriers)
+	return
+}
+
 // AddBridge uploads some bridge info.
 func (cl *Client) AddBridge(secret string, cookie []byte, host string, allocGroup string) (err error) {
+	if cl.useV3() {
+		err = cl.callV3("add-bridge", AddBridgeReq{
+			Secret:     secret,
+			Cookie:     cookie,
+			Host:       host,
+			AllocGroup: allocGroup,
+		}, nil)
+		if err != errNoV3 {
+			return
+		}
+	}
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/add-bridge?cookie=%x&host=%v&allocGroup=%v", cl.frontDomain, cookie, host, allocGroup), bytes.NewReader(nil))
 	req.Header.Set("user-agent", cl.useragent)
 	req.Host = cl.realDomain
@@ -124,9 +175,38 @@ func (cl *Client) AddBridge(secret string, cookie []byte, host string, allocGrou
 	return
 }
 
+// AddBridgeSigned uploads a signed bridge descriptor, returning it countersigned by the binder. Only v3 binders accept descriptors.
+func (cl *Client) AddBridgeSigned(secret string, sd SignedDescriptor) (countersigned SignedDescriptor, err error) {
+	if !cl.useV3() {
+		err = errNoV3
+		return
+	}
+	var resp AddBridgeResp
+	err = cl.callV3("add-bridge", AddBridgeReq{Secret: secret, Signed: &sd}, &resp)
+	if err != nil {
+		return
+	}
+	if resp.Countersigned == nil {
+		err = ErrBadDescriptor
+		return
+	}
+	countersigned = *resp.Countersigned
+	return
+}
+
 // GetTicketKey obtains the remote ticketing key.
 // TODO caching, gossip?
 func (cl *Client) GetTicketKey(tier string) (tkey *rsa.PublicKey, err error) {
+	if cl.useV3() {
+		var resp TicketKeyResp
+		err = cl.callV3("get-ticket-key", TicketKeyReq{Tier: tier}, &resp)
+		if err == nil {
+			tkey, err = x509.ParsePKCS1PublicKey(resp.Key)
+		}
+		if err != errNoV3 {
+			return
+		}
+	}
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-ticket-key?tier=%v", cl.frontDomain, tier), bytes.NewReader(nil))
 	req.Host = cl.realDomain
 	req.Header.Set("user-agent", cl.useragent)
@@ -153,17 +233,27 @@ func (cl *Client) GetTicketKey(tier string) (tkey *rsa.PublicKey, err error) {
 
 // GetTier gets the tier of a user.
 func (cl *Client) GetTier(username, password string) (tier string, err error) {
+	if cl.useV3() {
+		var resp TierResp
+		err = cl.callV3("get-tier", AuthReq{username, password}, &resp)
+		tier = resp.Tier
+		if err != errNoV3 {
+			return
+		}
+	}
 	v := url.Values{}
 	v.Set("user", username)
 	v.Set("pwd", password)
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-tier?%v", cl.frontDomain, v.Encode()), bytes.NewReader(nil))
-	req.Host = cl.realDomain
-	req.Header.Set("user-agent", cl.useragent)
+	req := cl.newFormRequest("get-tier", v)
 	resp, err := cl.hclient.Do(req)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
+		return
+	}
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return
@@ -219,13 +309,29 @@ func (cl *Client) GetTicket(username, password string) (ubmsg, ubsig []byte, det
 		panic(err)
 	}
 	// Obtain the ticket
+	respDec, err := cl.getBlindTicket(username, password, blinded)
+	if err != nil {
+		return
+	}
+	// unblind the ticket
+	ubsig = rsablind.Unblind(tkey, respDec.Ticket, unblinder)
+	ubmsg = unblinded
+	details = respDec
+	return
+}
+
+func (cl *Client) getBlindTicket(username, password string, blinded []byte) (respDec TicketResp, err error) {
+	if cl.useV3() {
+		err = cl.callV3("get-ticket", GetTicketReq{AuthReq{username, password}, blinded}, &respDec)
+		if err != errNoV3 {
+			return
+		}
+	}
 	v := url.Values{}
 	v.Set("user", username)
 	v.Set("pwd", password)
 	v.Set("blinded", base64.RawStdEncoding.EncodeToString(blinded))
-	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-ticket?%v", cl.frontDomain, v.Encode()), bytes.NewReader(nil))
-	req.Host = cl.realDomain
-	req.Header.Set("user-agent", cl.useragent)
+	req := cl.newFormRequest("get-ticket", v)
 	resp, err := cl.hclient.Do(req)
 	if err != nil {
 		return
@@ -235,27 +341,39 @@ func (cl *Client) GetTicket(username, password string) (ubmsg, ubsig []byte, det
 		err = ErrBadAuth
 		return
 	}
-	var respDec TicketResp
-	err = json.NewDecoder(resp.Body).Decode(&respDec)
-	if err != nil {
+	if resp.StatusCode != 200 {
+		err = badStatusCode(resp.StatusCode)
 		return
 	}
-	// unblind the ticket
-	ubsig = rsablind.Unblind(tkey, respDec.Ticket, unblinder)
-	ubmsg = unblinded
-	details = respDec
+	err = json.NewDecoder(resp.Body).Decode(&respDec)
 	return
 }
 
+// newFormRequest builds a v2 request that carries its parameters in a POST body, so that they don't end up in access logs.
+func (cl *Client) newFormRequest(path string, v url.Values) *http.Request {
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%v/%v", cl.frontDomain, path), strings.NewReader(v.Encode()))
+	req.Host = cl.realDomain
+	req.Header.Set("user-agent", cl.useragent)
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	return req
+}
+
 // BridgeInfo describes a bridge
 type BridgeInfo struct {
-	Cookie   []byte
-	Host     string
-	LastSeen time.Time
+	Cookie     []byte
+	Host       string
+	LastSeen   time.Time
+	Descriptor *SignedDescriptor `json:",omitempty"`
 }
 
 // GetBridges obtains a set of bridges.
 func (cl *Client) GetBridges(ubmsg, ubsig []byte) (bridges []BridgeInfo, err error) {
+	if cl.useV3() {
+		err = cl.callV3("get-bridges", GetBridgesReq{TicketReq: TicketReq{UbMsg: ubmsg, UbSig: ubsig}}, &bridges)
+		if err != errNoV3 {
+			return
+		}
+	}
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-bridges", cl.frontDomain), bytes.NewReader(nil))
 	req.Host = cl.realDomain
 	req.Header.Set("user-agent", cl.useragent)
@@ -274,6 +392,16 @@ func (cl *Client) GetBridges(ubmsg, ubsig []byte) (bridges []BridgeInfo, err err
 
 // GetEphBridges obtains a set of ephemeral e2e bridges.
 func (cl *Client) GetEphBridges(ubmsg []byte, ubsig []byte, exit string) (bridges []BridgeInfo, err error) {
+	if cl.useV3() {
+		err = cl.callV3("get-bridges", GetBridgesReq{
+			TicketReq: TicketReq{UbMsg: ubmsg, UbSig: ubsig},
+			Ephemeral: true,
+			Exit:      exit,
+		}, &bridges)
+		if err != errNoV3 {
+			return
+		}
+	}
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/get-bridges?type=ephemeral&exit=%v", cl.frontDomain, exit), bytes.NewReader(nil))
 	req.Host = cl.realDomain
 	req.Header.Set("user-agent", cl.useragent)
@@ -292,15 +420,20 @@ func (cl *Client) GetEphBridges(ubmsg []byte, ubsig []byte, exit string) (bridge
 
 // RedeemTicket redeems a ticket.
 func (cl *Client) RedeemTicket(tier string, ubmsg, ubsig []byte) (err error) {
-	// Obtain the ticket
+	if cl.useV3() {
+		err = cl.callV3("redeem-ticket", TicketReq{tier, ubmsg, ubsig}, nil)
+		if err != errNoV3 {
+			return
+		}
+	}
 	v := url.Values{}
 	v.Set("ubmsg", base64.RawStdEncoding.EncodeToString(ubmsg))
 	v.Set("ubsig", base64.RawStdEncoding.EncodeToString(ubsig))
 	v.Set("tier", tier)
 	req, _ := http.NewRequest("GET", fmt.Sprintf("%v/redeem-ticket?%v", cl.frontDomain, v.Encode()), bytes.NewReader(nil))
 	req.Host = cl.realDomain
-	resp, err := cl.hclient.Do(req)
 	req.Header.Set("user-agent", cl.useragent)
+	resp, err := cl.hclient.Do(req)
 	if err != nil {
 		return
 	}
@@ -311,3 +444,23 @@ func (cl *Client) RedeemTicket(tier string, ubmsg, ubsig []byte) (err error) {
 	}
 	return
 }
+
+// ReportBridges tells the binder which bridges we could and couldn't reach. Only v3 binders accept reports.
+func (cl *Client) ReportBridges(reports []BridgeReport) (err error) {
+	if !cl.useV3() {
+		return errNoV3
+	}
+	return cl.callV3("report-bridges", ReportBridgesReq{reports}, nil)
+}
+
+// GetExitCookie obtains the cshirt2 cookie that the exit accepts on its direct port. Exits that don't have one yet give a not-found error, and should be dialed without cshirt2. Only v3 binders publish cookies.
+func (cl *Client) GetExitCookie(exit string) (cookie []byte, err error) {
+	if !cl.useV3() {
+		err = errNoV3
+		return
+	}
+	var resp ExitCookieResp
+	err = cl.callV3("exit-cookie", ExitCookieReq{exit}, &resp)
+	cookie = resp.Cookie
+	return
+}
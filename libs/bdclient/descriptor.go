@@ -0,0 +1,133 @@
+package bdclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"golang.org/x/crypto/ed25519"
+)
+
+// BridgeDescriptor is everything a client needs to know to use a bridge.
+type BridgeDescriptor struct {
+	PublicKey  []byte // ed25519 identity of the bridge
+	Cookie     []byte
+	Host       string
+	AllocGroup string
+	Transports []string
+	ValidFrom  uint64 // Unix seconds
+	ValidUntil uint64 // Unix seconds
+}
+
+// SignedDescriptor is a BridgeDescriptor signed by the bridge and countersigned by the binder.
+type SignedDescriptor struct {
+	Descriptor []byte // RLP-encoded BridgeDescriptor
+	BridgeSig  []byte
+	BinderSig  []byte
+}
+
+// ErrBadDescriptor is returned for descriptors that are malformed, expired or not properly signed.
+var ErrBadDescriptor = errors.New("bad bridge descriptor")
+
+// MaxDescriptorLifetime is the longest a descriptor may be valid for. Longer-lived descriptors are refused, so that the binder never countersigns one that practically never expires.
+const MaxDescriptorLifetime = 8 * 24 * time.Hour
+
+// descriptorPrefix starts the text encoding of a SignedDescriptor.
+const descriptorPrefix = "geph-bridge:"
+
+func bridgeSigMsg(desc []byte) []byte {
+	return append([]byte("geph-bridge-descriptor\n"), desc...)
+}
+
+func binderSigMsg(desc []byte, bridgeSig []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("geph-binder-countersign\n")
+	buf.Write(desc)
+	buf.Write(bridgeSig)
+	return buf.Bytes()
+}
+
+// Sign encodes the descriptor and signs it with the bridge's identity.
+func (bd BridgeDescriptor) Sign(sk ed25519.PrivateKey) SignedDescriptor {
+	bd.PublicKey = sk.Public().(ed25519.PublicKey)
+	desc, err := rlp.EncodeToBytes(bd)
+	if err != nil {
+		panic(err)
+	}
+	return SignedDescriptor{
+		Descriptor: desc,
+		BridgeSig:  ed25519.Sign(sk, bridgeSigMsg(desc)),
+	}
+}
+
+// Open checks the bridge's own signature and the validity window, which must not be longer than MaxDescriptorLifetime, returning the descriptor.
+func (sd SignedDescriptor) Open(now time.Time) (bd BridgeDescriptor, err error) {
+	if err = rlp.DecodeBytes(sd.Descriptor, &bd); err != nil {
+		err = ErrBadDescriptor
+		return
+	}
+	if len(bd.PublicKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(bd.PublicKey, bridgeSigMsg(sd.Descriptor), sd.BridgeSig) {
+		err = ErrBadDescriptor
+		return
+	}
+	t := uint64(now.Unix())
+	if t < bd.ValidFrom || t > bd.ValidUntil ||
+		bd.ValidUntil-bd.ValidFrom > uint64(MaxDescriptorLifetime/time.Second) {
+		err = ErrBadDescriptor
+	}
+	return
+}
+
+// Countersign adds the binder's signature.
+func (sd *SignedDescriptor) Countersign(binderSK ed25519.PrivateKey) {
+	sd.BinderSig = ed25519.Sign(binderSK, binderSigMsg(sd.Descriptor, sd.BridgeSig))
+}
+
+// Verify checks both signatures and the validity window, returning the descriptor.
+func (sd SignedDescriptor) Verify(binderPK ed25519.PublicKey, now time.Time) (bd BridgeDescriptor, err error) {
+	if !ed25519.Verify(binderPK, binderSigMsg(sd.Descriptor, sd.BridgeSig), sd.BinderSig) {
+		err = ErrBadDescriptor
+		return
+	}
+	return sd.Open(now)
+}
+
+// Info converts the descriptor into the BridgeInfo used for dialing.
+func (bd BridgeDescriptor) Info() BridgeInfo {
+	return BridgeInfo{
+		Cookie:   bd.Cookie,
+		Host:     bd.Host,
+		LastSeen: time.Unix(int64(bd.ValidFrom), 0),
+	}
+}
+
+// String encodes a SignedDescriptor as text, suitable for files or QR codes.
+func (sd SignedDescriptor) String() string {
+	b, err := rlp.EncodeToBytes(sd)
+	if err != nil {
+		panic(err)
+	}
+	return descriptorPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseDescriptor decodes the text encoding of a SignedDescriptor. It does not verify anything.
+func ParseDescriptor(s string) (sd SignedDescriptor, err error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, descriptorPrefix) {
+		err = ErrBadDescriptor
+		return
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[len(descriptorPrefix):])
+	if err != nil {
+		err = ErrBadDescriptor
+		return
+	}
+	if err = rlp.DecodeBytes(b, &sd); err != nil {
+		err = ErrBadDescriptor
+	}
+	return
+}
@@ -0,0 +1,53 @@
+package bdclient
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestDescriptor(t *testing.T) {
+	_, bridgeSK, _ := ed25519.GenerateKey(nil)
+	binderPK, binderSK, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+	sd := BridgeDescriptor{
+		Cookie:     []byte("cookie"),
+		Host:       "1.2.3.4:5678",
+		Transports: []string{"cshirt2"},
+		ValidFrom:  uint64(now.Unix()),
+		ValidUntil: uint64(now.Add(time.Hour).Unix()),
+	}.Sign(bridgeSK)
+	if _, err := sd.Verify(binderPK, now); err == nil {
+		t.Fatal("verified without a countersignature")
+	}
+	sd.Countersign(binderSK)
+	// round trip through the text encoding
+	sd, err := ParseDescriptor(sd.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := sd.Verify(binderPK, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Host != "1.2.3.4:5678" {
+		t.Fatal("wrong host", desc.Host)
+	}
+	if _, err := sd.Verify(binderPK, now.Add(time.Hour*2)); err == nil {
+		t.Fatal("verified an expired descriptor")
+	}
+	sd.Descriptor[len(sd.Descriptor)-1]++
+	if _, err := sd.Verify(binderPK, now); err == nil {
+		t.Fatal("verified a tampered descriptor")
+	}
+	// descriptors that would practically never expire aren't accepted
+	forever := BridgeDescriptor{
+		Cookie:     []byte("cookie"),
+		ValidFrom:  uint64(now.Unix()),
+		ValidUntil: 1 << 62,
+	}.Sign(bridgeSK)
+	if _, err := forever.Open(now); err == nil {
+		t.Fatal("opened a descriptor that never expires")
+	}
+}
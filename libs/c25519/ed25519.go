@@ -0,0 +1,110 @@
+package c25519
+
+import (
+	"crypto/sha512"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var fieldPrime, _ = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+
+// FromEd25519SK converts an ed25519 secret key to the Curve25519 secret key with the same scalar.
+func FromEd25519SK(sk ed25519.PrivateKey) [32]byte {
+	h := sha512.Sum512(sk.Seed())
+	var toret [32]byte
+	copy(toret[:], h[:32])
+	toret[0] &= 248
+	toret[31] &= 127
+	toret[31] |= 64
+	return toret
+}
+
+// ErrBadPoint means an ed25519 public key isn't a point we can use for Diffie-Hellman.
+var ErrBadPoint = errors.New("c25519: invalid or low-order point")
+
+// lowOrder are the Curve25519 u-coordinates of the points of small order, which would make any shared secret predictable.
+var lowOrder = []*big.Int{
+	big.NewInt(0),
+	big.NewInt(1),
+	bigFromString("325606250916557431795983626356110631294008115727848805560023387167927233504"),
+	bigFromString("39382357235489614581723060781553021112529911719440698176882885853963445705823"),
+	new(big.Int).Sub(fieldPrime, big.NewInt(1)),
+}
+
+// edwardsD is the d of the ed25519 curve, -121665/121666.
+var edwardsD = func() *big.Int {
+	d := new(big.Int).ModInverse(big.NewInt(121666), fieldPrime)
+	d.Mul(d, big.NewInt(-121665))
+	return d.Mod(d, fieldPrime)
+}()
+
+func bigFromString(s string) *big.Int {
+	n, _ := new(big.Int).SetString(s, 10)
+	return n
+}
+
+// FromEd25519PK converts an ed25519 public key to the corresponding Curve25519 public key, using the birational map u = (1+y)/(1-y). It returns ErrBadPoint for keys that aren't on the curve or have small order, since they are usually peer-supplied.
+func FromEd25519PK(pk ed25519.PublicKey) (toret [32]byte, err error) {
+	if len(pk) != ed25519.PublicKeySize {
+		err = ErrBadPoint
+		return
+	}
+	var ybytes [32]byte
+	copy(ybytes[:], pk)
+	ybytes[31] &= 127
+	y := new(big.Int).SetBytes(reverse(ybytes[:]))
+	if y.Cmp(fieldPrime) >= 0 || !onCurve(y) {
+		err = ErrBadPoint
+		return
+	}
+	num := new(big.Int).Add(big.NewInt(1), y)
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, fieldPrime)
+	if den.Sign() == 0 {
+		err = ErrBadPoint
+		return
+	}
+	den.ModInverse(den, fieldPrime)
+	u := num.Mul(num, den)
+	u.Mod(u, fieldPrime)
+	for _, bad := range lowOrder {
+		if u.Cmp(bad) == 0 {
+			err = ErrBadPoint
+			return
+		}
+	}
+	ubytes := u.Bytes()
+	copy(toret[32-len(ubytes):], ubytes)
+	copy(toret[:], reverse(toret[:]))
+	return
+}
+
+// onCurve returns whether some x makes (x, y) a point of the ed25519 curve, that is, whether x^2 = (y^2-1)/(dy^2+1) has a solution.
+func onCurve(y *big.Int) bool {
+	y2 := new(big.Int).Mul(y, y)
+	num := new(big.Int).Sub(y2, big.NewInt(1))
+	den := new(big.Int).Mul(edwardsD, y2)
+	den.Add(den, big.NewInt(1))
+	den.Mod(den, fieldPrime)
+	if den.Sign() == 0 {
+		return false
+	}
+	x2 := num.Mul(num, den.ModInverse(den, fieldPrime))
+	x2.Mod(x2, fieldPrime)
+	if x2.Sign() == 0 {
+		return true
+	}
+	// Euler's criterion
+	exp := new(big.Int).Rsh(new(big.Int).Sub(fieldPrime, big.NewInt(1)), 1)
+	return new(big.Int).Exp(x2, exp, fieldPrime).Cmp(big.NewInt(1)) == 0
+}
+
+func reverse(b []byte) []byte {
+	toret := make([]byte, len(b))
+	for i := range b {
+		toret[len(b)-1-i] = b[i]
+	}
+	return toret
+}
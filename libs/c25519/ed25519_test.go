@@ -0,0 +1,52 @@
+package c25519
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestFromEd25519(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		pk, sk, _ := ed25519.GenerateKey(nil)
+		cpk, err := FromEd25519PK(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ToPK(FromEd25519SK(sk)) != cpk {
+			t.Fatal("converted keys don't match")
+		}
+	}
+}
+
+func TestFromEd25519BadPoints(t *testing.T) {
+	point := func(y byte, top byte) ed25519.PublicKey {
+		pk := make(ed25519.PublicKey, 32)
+		pk[0] = y
+		pk[31] = top
+		return pk
+	}
+	// the identity, y = 1, whose 1-y has no inverse
+	if _, err := FromEd25519PK(point(1, 0)); err != ErrBadPoint {
+		t.Fatal("accepted y = 1")
+	}
+	// the point of order 2, y = -1
+	minusOne := point(0xec, 0x7f)
+	for i := 1; i < 31; i++ {
+		minusOne[i] = 0xff
+	}
+	if _, err := FromEd25519PK(minusOne); err != ErrBadPoint {
+		t.Fatal("accepted y = -1")
+	}
+	// the points of order 4, y = 0
+	if _, err := FromEd25519PK(point(0, 0)); err != ErrBadPoint {
+		t.Fatal("accepted y = 0")
+	}
+	// y = 2 isn't on the curve
+	if _, err := FromEd25519PK(point(2, 0)); err != ErrBadPoint {
+		t.Fatal("accepted a point off the curve")
+	}
+	if _, err := FromEd25519PK(make(ed25519.PublicKey, 31)); err != ErrBadPoint {
+		t.Fatal("accepted a short key")
+	}
+}
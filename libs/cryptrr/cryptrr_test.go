@@ -0,0 +1,59 @@
+package cryptrr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/geph-official/geph2/libs/c25519"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	clientSK := c25519.GenSK()
+	serverSK := c25519.GenSK()
+	cmsg := NewPlainMsg("hello", "world").Encrypt(clientSK, c25519.ToPK(serverSK), false)
+	pmsg, err := cmsg.Decrypt(serverSK, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pmsg.Cmd != "hello" {
+		t.Fatal("wrong command", pmsg.Cmd)
+	}
+	// wrong direction
+	if _, err := cmsg.Decrypt(serverSK, false); err != ErrDecrypt {
+		t.Fatal("decrypted with the wrong direction")
+	}
+	// tampered timestamp
+	cmsg.Time++
+	if _, err := cmsg.Decrypt(serverSK, true); err != ErrDecrypt {
+		t.Fatal("decrypted with a tampered timestamp")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	serverSK := c25519.GenSK()
+	srv := httptest.NewServer(NewHandler(serverSK, func(r *http.Request, req PlainMsg) PlainMsg {
+		return NewPlainMsg("re:" + req.Cmd)
+	}))
+	defer srv.Close()
+	tport := &DomainFrontClient{Endpoint: srv.URL}
+	resp, err := Call(tport, c25519.ToPK(serverSK), NewPlainMsg("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Cmd != "re:ping" {
+		t.Fatal("wrong response", resp.Cmd)
+	}
+	// pinned to the wrong key
+	if _, err := Call(tport, c25519.ToPK(c25519.GenSK()), NewPlainMsg("ping")); err == nil {
+		t.Fatal("call to the wrong key succeeded")
+	}
+	// replays are rejected
+	cmsg := NewPlainMsg("ping").Encrypt(c25519.GenSK(), c25519.ToPK(serverSK), false)
+	if _, err := tport.RoundTrip(cmsg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tport.RoundTrip(cmsg); err == nil {
+		t.Fatal("replay accepted")
+	}
+}
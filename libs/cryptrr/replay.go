@@ -0,0 +1,38 @@
+package cryptrr
+
+import (
+	"errors"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// MaxSkew is how far a message's timestamp may be from our clock.
+const MaxSkew = time.Minute * 5
+
+// ErrReplay is returned for messages that are stale or have been seen before.
+var ErrReplay = errors.New("cryptrr: replayed or stale message")
+
+// ReplayFilter rejects messages whose nonces it has already seen. Nonces only need to be remembered for as long as their timestamps are acceptable.
+type ReplayFilter struct {
+	seen *cache.Cache
+}
+
+// NewReplayFilter creates a new ReplayFilter.
+func NewReplayFilter() *ReplayFilter {
+	return &ReplayFilter{
+		seen: cache.New(MaxSkew*2, time.Minute),
+	}
+}
+
+// Check returns ErrReplay if the message should be rejected, otherwise remembering its nonce. Only call this on messages that decrypted successfully, since the timestamp is authenticated.
+func (rf *ReplayFilter) Check(cmsg CiphMsg) error {
+	skew := time.Since(time.Unix(int64(cmsg.Time), 0))
+	if skew > MaxSkew || skew < -MaxSkew {
+		return ErrReplay
+	}
+	if rf.seen.Add(string(cmsg.Nonce[:]), true, cache.DefaultExpiration) != nil {
+		return ErrReplay
+	}
+	return nil
+}
@@ -1,9 +1,13 @@
 package cryptrr
 
 import (
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/ethereum/go-ethereum/rlp"
 	"golang.org/x/crypto/chacha20poly1305"
@@ -32,9 +36,28 @@ func NewPlainMsg(cmd string, args ...interface{}) PlainMsg {
 type CiphMsg struct {
 	LocalPK [32]byte
 	Nonce   [32]byte
+	Time    uint64
 	Ctext   []byte
 }
 
+// ErrDecrypt is returned when a CiphMsg cannot be decrypted.
+var ErrDecrypt = errors.New("cryptrr: cannot decrypt")
+
+func msgKey(nonce [32]byte, senderIsServer bool, ss []byte) cipher.AEAD {
+	key := sha256.Sum256(append(nonce[:], append([]byte(fmt.Sprint(senderIsServer)), ss...)...))
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func timeAD(t uint64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, t)
+	return ad
+}
+
 // Encrypt encrypts a PlainMsg to be decoded by someone holding the secret key to remotePK.
 func (pmsg PlainMsg) Encrypt(localSK [32]byte, remotePK [32]byte, isServer bool) CiphMsg {
 	payload, err := rlp.EncodeToBytes(pmsg)
@@ -47,17 +70,30 @@ func (pmsg PlainMsg) Encrypt(localSK [32]byte, remotePK [32]byte, isServer bool)
 	}
 	var nonce [32]byte
 	rand.Read(nonce[:])
-	key := sha256.Sum256(append(nonce[:], append([]byte(fmt.Sprint(isServer)), ss...)...))
-	aead, err := chacha20poly1305.New(key[:])
-	if err != nil {
-		panic(err)
-	}
-	ctext := aead.Seal(nil, make([]byte, 12), payload, nil)
+	now := uint64(time.Now().Unix())
+	ctext := msgKey(nonce, isServer, ss).Seal(nil, make([]byte, 12), payload, timeAD(now))
 	var localPK [32]byte
 	curve25519.ScalarBaseMult(&localPK, &localSK)
 	return CiphMsg{
 		LocalPK: localPK,
 		Nonce:   nonce,
+		Time:    now,
 		Ctext:   ctext,
 	}
 }
+
+// Decrypt decrypts a CiphMsg sent to the holder of localSK. isServer says whether we are the server, i.e. whether the message came from a client.
+func (cmsg CiphMsg) Decrypt(localSK [32]byte, isServer bool) (pmsg PlainMsg, err error) {
+	ss, err := curve25519.X25519(localSK[:], cmsg.LocalPK[:])
+	if err != nil {
+		err = ErrDecrypt
+		return
+	}
+	payload, err := msgKey(cmsg.Nonce, !isServer, ss).Open(nil, make([]byte, 12), cmsg.Ctext, timeAD(cmsg.Time))
+	if err != nil {
+		err = ErrDecrypt
+		return
+	}
+	err = rlp.DecodeBytes(payload, &pmsg)
+	return
+}
@@ -1,36 +1,128 @@
 package cryptrr
 
-// // Client encapsulates a CryptRR client transport.
-// type Client interface {
-// 	// RoundTrip sends a CiphMsg and returns a CiphMsg response.
-// 	RoundTrip(CiphMsg) (CiphMsg error)
-// }
-
-// // DomainFrontClient is an implementation of Client that uses POST requests to a domain-fronted endpoint
-// type DomainFrontClient struct {
-// 	// Endpoint should include the "fake" domain, for example https://ajax.aspnetcdn.com/
-// 	Endpoint string
-// 	// RealHost is the real host to put in the Host header, for example gephbinder.azureedge.net
-// 	RealHost string
-
-// 	once    sync.Once
-// 	hclient *http.Client
-// }
-
-// func (dft *DomainFrontClient) init() {
-// 	dft.once.Do(func() {
-// 		dft.hclient = &http.Client{
-// 			Transport: &http.Transport{
-// 				Proxy:           nil,
-// 				IdleConnTimeout: time.Second * 10,
-// 			},
-// 			Timeout: time.Second * 10,
-// 		}
-// 	})
-// }
-
-// // RoundTrip impl
-// func (dft *DomainFrontClient) RoundTrip(req CiphMsg) (resp CiphMsg, err error) {
-// 	dft.init()
-
-//}
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/c25519"
+)
+
+// Client encapsulates a CryptRR client transport.
+type Client interface {
+	// RoundTrip sends a CiphMsg and returns a CiphMsg response.
+	RoundTrip(CiphMsg) (CiphMsg, error)
+}
+
+// DomainFrontClient is an implementation of Client that uses POST requests to a domain-fronted endpoint
+type DomainFrontClient struct {
+	// Endpoint should include the "fake" domain, for example https://ajax.aspnetcdn.com/cryptrr
+	Endpoint string
+	// RealHost is the real host to put in the Host header, for example gephbinder.azureedge.net
+	RealHost string
+	// UserAgent is sent with every request
+	UserAgent string
+
+	once    sync.Once
+	hclient *http.Client
+}
+
+func (dft *DomainFrontClient) init() {
+	dft.once.Do(func() {
+		dft.hclient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           nil,
+				IdleConnTimeout: time.Second * 10,
+			},
+			Timeout: time.Second * 10,
+		}
+	})
+}
+
+// RoundTrip impl
+func (dft *DomainFrontClient) RoundTrip(req CiphMsg) (resp CiphMsg, err error) {
+	dft.init()
+	reqBts, err := rlp.EncodeToBytes(req)
+	if err != nil {
+		return
+	}
+	hreq, _ := http.NewRequest("POST", dft.Endpoint, bytes.NewReader(reqBts))
+	hreq.Host = dft.RealHost
+	hreq.Header.Set("content-type", "application/octet-stream")
+	if dft.UserAgent != "" {
+		hreq.Header.Set("user-agent", dft.UserAgent)
+	}
+	hresp, err := dft.hclient.Do(hreq)
+	if err != nil {
+		return
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("cryptrr: unexpected status code %v", hresp.StatusCode)
+		return
+	}
+	err = rlp.Decode(io.LimitReader(hresp.Body, 1024*1024), &resp)
+	return
+}
+
+// Call encrypts a PlainMsg to the server holding remotePK, round-trips it and decrypts the response. Responses not from remotePK are rejected.
+func Call(tport Client, remotePK [32]byte, req PlainMsg) (resp PlainMsg, err error) {
+	// a fresh key for every call means that old responses can't be replayed at us
+	mySK := c25519.GenSK()
+	cresp, err := tport.RoundTrip(req.Encrypt(mySK, remotePK, false))
+	if err != nil {
+		return
+	}
+	if cresp.LocalPK != remotePK {
+		err = ErrDecrypt
+		return
+	}
+	resp, err = cresp.Decrypt(mySK, false)
+	return
+}
+
+// Handler is an http.Handler that serves CryptRR requests, decrypting them with a server key and rejecting replays.
+type Handler struct {
+	localSK [32]byte
+	filter  *ReplayFilter
+	handle  func(r *http.Request, req PlainMsg) PlainMsg
+}
+
+// NewHandler creates a Handler that passes decrypted requests to handle.
+func NewHandler(localSK [32]byte, handle func(r *http.Request, req PlainMsg) PlainMsg) *Handler {
+	return &Handler{
+		localSK: localSK,
+		filter:  NewReplayFilter(),
+		handle:  handle,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqBts, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024*1024))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var creq CiphMsg
+	if err := rlp.DecodeBytes(reqBts, &creq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req, err := creq.Decrypt(h.localSK, true)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := h.filter.Check(creq); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	resp := h.handle(r, req).Encrypt(h.localSK, creq.LocalPK, true)
+	w.Header().Set("content-type", "application/octet-stream")
+	rlp.Encode(w, resp)
+}
@@ -0,0 +1,147 @@
+package cshirt2
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DecoyWait is how long a DecoyConn waits for the first bytes before giving up on a connection.
+var DecoyWait = 2 * time.Second
+
+// errShortBurst is what reads past the first burst return when it was too short to hold a handshake blob. Real clients write the whole blob at once, and it's smaller than any MSS, so it always arrives in one piece. Failing right away hands probes that send short requests to the decoy as quickly as the decoy itself would answer them.
+var errShortBurst = errors.New("first burst too short for a handshake")
+
+// firstBurstSize is how much a DecoyConn reads at once for the first burst.
+const firstBurstSize = 65536
+
+// DecoyConn wraps a server-side connection, remembering everything read from it until the handshake is over. If the handshake fails, Decoy hands the connection, including what was already read, to a decoy service, so that probers see exactly that service.
+type DecoyConn struct {
+	net.Conn
+
+	lock          sync.Mutex
+	recording     bool
+	recorded      []byte
+	pending       []byte // read in the first burst, but not yet returned
+	gotFirst      bool
+	firstDeadline time.Time
+	readDeadline  time.Time
+}
+
+// NewDecoyConn wraps a connection that is about to be handshaken.
+func NewDecoyConn(conn net.Conn) *DecoyConn {
+	return &DecoyConn{
+		Conn:          conn,
+		recording:     true,
+		firstDeadline: time.Now().Add(DecoyWait),
+	}
+}
+
+// Read reads from the connection, recording what it read during the handshake. The first read takes in everything that arrived in the first burst.
+func (dc *DecoyConn) Read(p []byte) (n int, err error) {
+	dc.lock.Lock()
+	if len(dc.pending) > 0 {
+		n = copy(p, dc.pending)
+		dc.pending = dc.pending[n:]
+		dc.lock.Unlock()
+		return
+	}
+	if !dc.recording {
+		dc.lock.Unlock()
+		return dc.Conn.Read(p)
+	}
+	if dc.gotFirst {
+		short := len(dc.recorded) < pkSize
+		dc.lock.Unlock()
+		if short {
+			return 0, errShortBurst
+		}
+		n, err = dc.Conn.Read(p)
+		dc.lock.Lock()
+		if dc.recording {
+			dc.recorded = append(dc.recorded, p[:n]...)
+		}
+		dc.lock.Unlock()
+		return
+	}
+	deadline := dc.readDeadline
+	if deadline.IsZero() || dc.firstDeadline.Before(deadline) {
+		deadline = dc.firstDeadline
+	}
+	dc.lock.Unlock()
+	dc.Conn.SetReadDeadline(deadline)
+	buf := make([]byte, firstBurstSize)
+	m, err := dc.Conn.Read(buf)
+	dc.Conn.SetReadDeadline(dc.getReadDeadline())
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if m > 0 {
+		dc.gotFirst = true
+		dc.recorded = append(dc.recorded, buf[:m]...)
+		n = copy(p, buf[:m])
+		dc.pending = buf[n:m]
+	}
+	return
+}
+
+func (dc *DecoyConn) getReadDeadline() time.Time {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	return dc.readDeadline
+}
+
+// SetDeadline sets the deadline.
+func (dc *DecoyConn) SetDeadline(t time.Time) error {
+	dc.lock.Lock()
+	dc.readDeadline = t
+	dc.lock.Unlock()
+	return dc.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline.
+func (dc *DecoyConn) SetReadDeadline(t time.Time) error {
+	dc.lock.Lock()
+	dc.readDeadline = t
+	dc.lock.Unlock()
+	return dc.Conn.SetReadDeadline(t)
+}
+
+// HandshakeDone stops recording, once the handshake succeeded.
+func (dc *DecoyConn) HandshakeDone() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.recording = false
+	dc.recorded = nil
+	dc.Conn.SetReadDeadline(dc.readDeadline)
+}
+
+// Decoy forwards the connection to the decoy service at addr, replaying what the failed handshake read. It returns when the decoy is done with it.
+func (dc *DecoyConn) Decoy(addr string) error {
+	dc.lock.Lock()
+	dc.recording = false
+	recorded := dc.recorded
+	dc.recorded = nil
+	dc.pending = nil
+	dc.lock.Unlock()
+	// from now on, the decoy's own timeouts apply
+	dc.Conn.SetDeadline(time.Time{})
+	decoy, err := net.DialTimeout("tcp", addr, time.Second*10)
+	if err != nil {
+		return err
+	}
+	defer decoy.Close()
+	_, err = decoy.Write(recorded)
+	if err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(decoy, dc.Conn)
+		if tc, ok := decoy.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(dc.Conn, decoy)
+	return err
+}
@@ -0,0 +1,138 @@
+package cshirt2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// decoyServer is a bridge whose failed handshakes go to an echo server.
+func decoyServer(t *testing.T, secret []byte, compatibility bool) net.Listener {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	bridge, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer echo.Close()
+		for {
+			raw, err := bridge.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer raw.Close()
+				dc := NewDecoyConn(raw)
+				conn, err := Server(secret, compatibility, dc, time.Time{})
+				if err != nil {
+					dc.Decoy(echo.Addr().String())
+					return
+				}
+				dc.HandshakeDone()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return bridge
+}
+
+func TestDecoyAnswersProbes(t *testing.T) {
+	for _, compatibility := range []bool{false, true} {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		bridge := decoyServer(t, secret, compatibility)
+		defer bridge.Close()
+
+		// short and long probes both get what the decoy would answer, without waiting for a handshake that can't come
+		short := []byte("GET / HTTP/1.1\r\n\r\n")
+		long := make([]byte, 1000)
+		rand.Read(long)
+		for _, probe := range [][]byte{short, long} {
+			conn, err := net.Dial("tcp", bridge.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			start := time.Now()
+			conn.Write(probe)
+			got := make([]byte, len(probe))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, probe) {
+				t.Fatal("probe didn't reach the decoy:", err)
+			}
+			// only legacy handshakes, whose MACs come after the key, are waited for
+			limit := legacyGap
+			if compatibility && len(probe) >= pkSize {
+				limit += 300 * time.Millisecond
+			}
+			if elapsed := time.Since(start); elapsed > limit {
+				t.Fatalf("%v-byte probe held for %v", len(probe), elapsed)
+			}
+			conn.Close()
+		}
+
+		// real clients are unaffected
+		clients := []func([]byte, net.Conn) (net.Conn, error){Client}
+		if compatibility {
+			clients = append(clients, ClientLegacy)
+		}
+		for _, client := range clients {
+			raw, err := net.Dial("tcp", bridge.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer raw.Close()
+			raw.SetDeadline(time.Now().Add(5 * time.Second))
+			conn, err := client(secret, raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write([]byte("hello"))
+			got := make([]byte, 5)
+			if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+				t.Fatal("client didn't get through:", err)
+			}
+		}
+	}
+}
+
+func TestDecoyAnswersSilentProbes(t *testing.T) {
+	DecoyWait = 200 * time.Millisecond
+	defer func() { DecoyWait = 2 * time.Second }()
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	bridge := decoyServer(t, secret, false)
+	defer bridge.Close()
+	conn, err := net.Dial("tcp", bridge.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// by now it's the decoy's connection, so even a handshake is just echoed
+	time.Sleep(400 * time.Millisecond)
+	probe := make([]byte, 500)
+	rand.Read(probe)
+	conn.Write(probe)
+	got := make([]byte, len(probe))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, probe) {
+		t.Fatal("silent probe didn't reach the decoy:", err)
+	}
+}
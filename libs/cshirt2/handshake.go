@@ -1,21 +1,20 @@
 package cshirt2
 
 import (
+	"bytes"
 	"crypto/rand"
-	"crypto/subtle"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
-	"sync"
 
 	"net"
 	"time"
 
 	"github.com/geph-official/geph2/libs/erand"
+	"github.com/geph-official/geph2/libs/replay"
+	"github.com/geph-official/geph2/libs/shaper"
 	"github.com/minio/blake2b-simd"
-	"github.com/patrickmn/go-cache"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 )
@@ -38,106 +37,122 @@ func mac128(m, k []byte) []byte {
 	return mac.Sum(nil)
 }
 
-var (
-	globCache     = cache.New(time.Hour*3, time.Minute*30)
-	globCacheLock sync.Mutex
+// ReplayFilter rejects replayed handshakes. Servers can replace it with a persistent or shared filter before accepting connections.
+var ReplayFilter replay.Filter = replay.NewBloom(replay.DefaultCapacity)
+
+// epochWindow is how many 30-second epochs off a handshake blob may be. legacyEpochWindow is the same for legacy MACs.
+const (
+	epochWindow       = 30
+	legacyEpochWindow = 3
 )
 
+// epochExpiry returns when a handshake made at the given epoch stops being accepted.
+func epochExpiry(epoch int64, window int64) time.Time {
+	return time.Unix((epoch+window+1)*30, 0)
+}
+
 const (
 	pkSize = 192
 )
 
-func readPK(compatibility bool, secret []byte, isDown bool, transport net.Conn) (pubKey, int64, error) {
-	epoch := time.Now().Unix() / 30
-	// Read their public key
-	theirPublic := make([]byte, pkSize)
-	_, err := io.ReadFull(transport, theirPublic)
+// Handshake versions. Legacy clients use UniformDH. Version 2 clients send an encrypted x25519 key. Version 3 clients also say which version they speak inside the encrypted blob, right after the padding length, where older clients leave zeroes.
+const (
+	VersionLegacy = 1
+	Version2      = 2
+	Version3      = 3
+)
+
+// LegacyCutoff, if set, is when servers stop accepting legacy clients, even with compatibility on.
+var LegacyCutoff time.Time
+
+// ErrLegacyRejected is returned by Server for legacy clients after LegacyCutoff.
+var ErrLegacyRejected = errors.New("legacy cshirt2 clients no longer accepted")
+
+// Version returns the handshake version of a cshirt2 connection, or 0 if it isn't one.
+func Version(conn net.Conn) int {
+	switch conn := conn.(type) {
+	case *transport:
+		return conn.version
+	case *legacyTransport:
+		return VersionLegacy
+	}
+	return 0
+}
+
+// readPK reads the other side's handshake blob, returning their x25519 key, the epoch and the version they speak. If the blob can't be decrypted, theirPK is nil and blob holds what was read, so that the server can fall back to the legacy handshake.
+func readPK(secret []byte, isDown bool, transport net.Conn) (theirPK []byte, epoch int64, version int, blob []byte, err error) {
+	now := time.Now().Unix() / 30
+	blob = make([]byte, pkSize)
+	_, err = io.ReadFull(transport, blob)
 	if err != nil {
-		return nil, 0, err
+		return
 	}
-	// new PK format: chacha20poly1305-encrypted ed25519 public key, with following two bytes denoting padding
-	// try to decode as new PK format
-	var edpk []byte
+	// chacha20poly1305-encrypted x25519 public key, then two bytes denoting padding and one denoting the version
 	var padlen uint16
-	for e := epoch - 30; e < epoch+30; e++ {
+	for e := now - epochWindow; e < now+epochWindow; e++ {
 		hsKey := mac256(secret, []byte(fmt.Sprintf("handshake-%v-%v", e, isDown)))
 		crypt, _ := chacha20poly1305.New(hsKey)
-		plain, er := crypt.Open(nil, make([]byte, 12), theirPublic, nil)
+		plain, er := crypt.Open(nil, make([]byte, 12), blob, nil)
 		if er != nil {
-			err = er
 			continue
 		}
-		edpk = plain[:32]
+		theirPK = plain[:32]
 		padlen = binary.LittleEndian.Uint16(plain[32:][:2])
+		version = int(plain[34])
 		epoch = e
 	}
-	if edpk != nil {
-		if !replayFilter(edpk) {
-			return nil, 0, ErrAttackDetected
-		}
-		// read past padding
-		_, err = io.ReadFull(transport, make([]byte, padlen))
-		if err != nil {
-			err = fmt.Errorf("couldn't read past padding: %w", err)
-			return nil, 0, err
-		}
-		return edpk, epoch, nil
+	if theirPK == nil {
+		return
 	}
-	if !compatibility {
-		return nil, 0, errors.New("unrecognizable handshake")
+	if version < Version2 {
+		version = Version2
 	}
-	// Read their public key MAC
-	theirPublicMAC := make([]byte, 32)
-	_, err = io.ReadFull(transport, theirPublicMAC)
-	if err != nil {
-		return nil, 0, err
-	}
-	macOK := false
-	//shift := 0
-	// shift one byte at a time until we find the mac
-	for i := 0; i < 1024+(erand.Int(1024)); i++ {
-		for e := epoch - 3; e < epoch+3; e++ {
-			macKey := mac256(secret, []byte(fmt.Sprintf("%v", e)))
-			if i > 0 && subtle.ConstantTimeCompare(theirPublicMAC, mac256(theirPublic, macKey)) == 1 {
-				log.Printf("*** ΔE = %v sec, shift = %v ***", (e-epoch)*30, i)
-				macOK = true
-				epoch = e
-				//shift = i
-				goto out
-			}
-		}
-		// read another byte
-		oneBytes := make([]byte, 1)
-		_, err = io.ReadFull(transport, oneBytes)
-		if err != nil {
-			return nil, 0, err
-		}
-		theirPublicMAC = append(theirPublicMAC, oneBytes...)[1:]
-	}
-	log.Println("** zero shift **", transport.RemoteAddr())
-	return nil, 0, errors.New("zero shift")
-out:
-	if !replayFilter(theirPublic) {
-		log.Printf("** replay attack detected ** %x %v", theirPublic[:10], transport.RemoteAddr())
-		return nil, 0, ErrAttackDetected
+	if !ReplayFilter.Check(theirPK, epochExpiry(epoch, epochWindow)) {
+		err = ErrAttackDetected
+		return
 	}
-	log.Printf("-- GOOD %x %v", theirPublic[:10], transport.RemoteAddr())
-	if !macOK {
-		log.Println("** bad pk mac **", transport.RemoteAddr())
-		return nil, 0, ErrBadHandshakeMAC
+	// read past padding
+	_, err = io.ReadFull(transport, make([]byte, padlen))
+	if err != nil {
+		err = fmt.Errorf("couldn't read past padding: %w", err)
 	}
-	return theirPublic, epoch, nil
+	return
 }
 
-func replayFilter(pk []byte) bool {
-	globCacheLock.Lock()
-	defer globCacheLock.Unlock()
-	if _, ok := globCache.Get(string(pk)); ok {
-		return false
+// maxLegacyShift is how much padding legacy clients put between their public key and its MAC.
+const maxLegacyShift = 2048
+
+// legacyGap is how long servers wait for the rest of a legacy handshake after its key. Legacy clients write their key, padding and MAC at once, so the rest is already in flight, and whatever doesn't show up by then never will.
+const legacyGap = 200 * time.Millisecond
+
+// readPKLegacy finishes reading a legacy UniformDH public key, whose MAC comes after up to maxLegacyShift bytes of padding.
+func readPKLegacy(secret []byte, theirPublic []byte, transport net.Conn) (epoch int64, err error) {
+	now := time.Now().Unix() / 30
+	expected := make(map[int64][]byte)
+	for e := now - legacyEpochWindow; e < now+legacyEpochWindow; e++ {
+		macKey := mac256(secret, []byte(fmt.Sprintf("%v", e)))
+		expected[e] = mac256(theirPublic, macKey)
+	}
+	// legacy clients wait for us after sending the MAC, so reading whatever arrives never reads past it
+	var window []byte
+	buf := make([]byte, 4096)
+	for len(window) < maxLegacyShift+32 {
+		var n int
+		n, err = transport.Read(buf)
+		if err != nil {
+			return
+		}
+		window = append(window, buf[:n]...)
+		for e, mac := range expected {
+			// there's always at least one byte of padding
+			if len(window) > 1 && bytes.Contains(window[1:], mac) {
+				epoch = e
+				return
+			}
+		}
 	}
-	// Reject if bad
-	globCache.SetDefault(string(pk), true)
-	return true
+	err = ErrBadHandshakeMAC
+	return
 }
 
 func writePKLegacy(epoch int64, shift int, secret []byte, myPublic pubKey, transport net.Conn) error {
@@ -155,7 +170,7 @@ func writePKLegacy(epoch int64, shift int, secret []byte, myPublic pubKey, trans
 	return nil
 }
 
-func writePK(secret []byte, epoch int64, myPublic pubKey, isDown bool, transport net.Conn) error {
+func writePK(secret []byte, epoch int64, myPublic []byte, version int, isDown bool, transport net.Conn) error {
 	if epoch == 0 {
 		epoch = time.Now().Unix() / 30
 	}
@@ -163,6 +178,9 @@ func writePK(secret []byte, epoch int64, myPublic pubKey, isDown bool, transport
 	copy(hsPlain, myPublic)
 	paddingAmount := erand.Int(65536)
 	binary.LittleEndian.PutUint16(hsPlain[32:][:2], uint16(paddingAmount))
+	if version >= Version3 {
+		hsPlain[34] = byte(version)
+	}
 	hsKey := mac256(secret, []byte(fmt.Sprintf("handshake-%v-%v", epoch, isDown)))
 	hsCrypter, _ := chacha20poly1305.New(hsKey)
 	hsCrypt := hsCrypter.Seal(nil, make([]byte, 12), hsPlain, nil)
@@ -172,42 +190,74 @@ func writePK(secret []byte, epoch int64, myPublic pubKey, isDown bool, transport
 	return err
 }
 
-// Server negotiates obfuscation on a network connection, acting as the server. The secret must be provided.
-func Server(secret []byte, compatibility bool, transport net.Conn) (net.Conn, error) {
-	theirPK, epoch, err := readPK(compatibility, secret, false, transport)
+// sessionSecret binds the negotiated version into the shared secret, so that both sides must agree on it.
+func sessionSecret(shSecret []byte, version int) []byte {
+	if version < Version3 {
+		return shSecret
+	}
+	return mac256(shSecret, []byte(fmt.Sprintf("cshirt2-v%v", version)))
+}
+
+// Server negotiates obfuscation on a network connection, acting as the server. The secret must be provided. Legacy clients are only accepted with compatibility on, and until LegacyCutoff. The deadline is the read deadline the caller set on transport for the handshake, or zero for none; legacy handshakes shorten it while waiting for the rest of the handshake, and put it back afterwards.
+func Server(secret []byte, compatibility bool, transport net.Conn, deadline time.Time) (net.Conn, error) {
+	theirPK, epoch, version, blob, err := readPK(secret, false, transport)
 	if err != nil {
 		return nil, err
 	}
-	if len(theirPK) == 32 {
+	if theirPK != nil {
+		if version > Version3 {
+			version = Version3
+		}
 		mySK := make([]byte, 32)
 		rand.Read(mySK)
-		log.Printf("mySK = %x", mySK)
 		myPK, err := curve25519.X25519(mySK, curve25519.Basepoint)
 		if err != nil {
 			panic(err)
 		}
-		writePK(secret, epoch, myPK, true, transport)
-		log.Printf("myPK = %x, theirPK = %x", myPK, theirPK)
+		err = writePK(secret, epoch, myPK, version, true, transport)
+		if err != nil {
+			return nil, err
+		}
 		shSecret, err := curve25519.X25519(mySK, theirPK)
 		if err != nil {
 			return nil, err
 		}
-		return newTransport(transport, shSecret, true), nil
+		tp := newTransport(transport, sessionSecret(shSecret, version), true, shaper.New(ShapingProfile, secret))
+		tp.version = version
+		return tp, nil
+	}
+	if !compatibility {
+		return nil, errors.New("unrecognizable handshake")
+	}
+	if !LegacyCutoff.IsZero() && time.Now().After(LegacyCutoff) {
+		return nil, ErrLegacyRejected
+	}
+	gap := time.Now().Add(legacyGap)
+	if !deadline.IsZero() && deadline.Before(gap) {
+		gap = deadline
+	}
+	transport.SetReadDeadline(gap)
+	epoch, err = readPKLegacy(secret, blob, transport)
+	transport.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+	if !ReplayFilter.Check(blob, epochExpiry(epoch, legacyEpochWindow)) {
+		return nil, ErrAttackDetected
 	}
 	myPK, mySK := dhGenKey()
-	// if shift > 0 {
-	// 	shift = erand.Int(1024)
-	// }
+	// our own keys must never be accepted from clients
+	ReplayFilter.Check(myPK, epochExpiry(epoch, legacyEpochWindow))
 	err = writePKLegacy(epoch, erand.Int(1000)+1, secret, myPK, transport)
 	if err != nil {
 		return nil, err
 	}
 	// Compute shared secret
-	shSecret := udhSecret(mySK, theirPK)
-	return newLegacyTransport(transport, shSecret, true), nil
+	shSecret := udhSecret(mySK, blob)
+	return newLegacyTransport(transport, shSecret, true, shaper.New(ShapingProfile, secret)), nil
 }
 
-// Client negotiates low-level obfuscation as a client, using the new protocol.
+// Client negotiates low-level obfuscation as a client, offering version 3 and accepting version 2 servers.
 func Client(secret []byte, transport net.Conn) (net.Conn, error) {
 	mySK := make([]byte, 32)
 	rand.Read(mySK)
@@ -215,38 +265,49 @@ func Client(secret []byte, transport net.Conn) (net.Conn, error) {
 	if err != nil {
 		panic(err)
 	}
-	err = writePK(secret, 0, myPK, false, transport)
+	err = writePK(secret, 0, myPK, Version3, false, transport)
 	if err != nil {
 		return nil, err
 	}
-	theirPK, _, err := readPK(false, secret, true, transport)
+	theirPK, _, version, _, err := readPK(secret, true, transport)
 	if err != nil {
 		return nil, err
 	}
-	if len(theirPK) != 32 {
-		err = errors.New("wrong length for theirPK")
-		return nil, err
+	if theirPK == nil {
+		return nil, ErrBadHandshakeMAC
+	}
+	if version > Version3 {
+		return nil, fmt.Errorf("server answered with unknown version %v", version)
 	}
 	shSecret, err := curve25519.X25519(mySK, theirPK)
 	if err != nil {
 		return nil, err
 	}
-	return newTransport(transport, shSecret, false), nil
+	tp := newTransport(transport, sessionSecret(shSecret, version), false, shaper.New(ShapingProfile, secret))
+	tp.version = version
+	return tp, nil
 }
 
-// ClientLegacy negotiates low-level obfuscation as a client, using the legacy protocol.. The server
+// ClientLegacy negotiates low-level obfuscation as a client, using the legacy protocol. The server
 // secret must be given so that the client can prove knowledge.
+//
+// Deprecated: servers stop accepting legacy clients at LegacyCutoff. Use Client.
 func ClientLegacy(secret []byte, transport net.Conn) (net.Conn, error) {
 	myPK, mySK := dhGenKey()
 	err := writePKLegacy(0, erand.Int(1000)+1, secret, myPK, transport)
 	if err != nil {
 		return nil, err
 	}
-	theirPK, _, err := readPK(true, secret, true, transport)
+	theirPK := make([]byte, pkSize)
+	_, err = io.ReadFull(transport, theirPK)
+	if err != nil {
+		return nil, err
+	}
+	_, err = readPKLegacy(secret, theirPK, transport)
 	if err != nil {
 		return nil, err
 	}
 	// Compute shared secret
 	shSecret := udhSecret(mySK, theirPK)
-	return newLegacyTransport(transport, shSecret, false), nil
+	return newLegacyTransport(transport, shSecret, false, shaper.New(ShapingProfile, secret)), nil
 }
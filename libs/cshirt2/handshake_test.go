@@ -0,0 +1,159 @@
+package cshirt2
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func handshakePair(t *testing.T, compatibility bool, client func([]byte, net.Conn) (net.Conn, error)) (cconn, sconn net.Conn, serr error) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		raw, err := listener.Accept()
+		if err != nil {
+			serr = err
+			return
+		}
+		sconn, serr = Server(secret, compatibility, raw, time.Time{})
+		if serr != nil {
+			raw.Close()
+		}
+	}()
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	cconn, cerr := client(secret, raw)
+	<-done
+	if serr == nil && cerr != nil {
+		t.Fatal("client failed:", cerr)
+	}
+	return
+}
+
+func echoOnce(t *testing.T, cconn, sconn net.Conn) {
+	go cconn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sconn, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("bad transfer", err, string(buf))
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	cconn, sconn, err := handshakePair(t, false, Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cconn.Close()
+	defer sconn.Close()
+	if Version(cconn) != Version3 || Version(sconn) != Version3 {
+		t.Fatal("wrong versions", Version(cconn), Version(sconn))
+	}
+	echoOnce(t, cconn, sconn)
+}
+
+func TestLegacyCutoff(t *testing.T) {
+	if _, _, err := handshakePair(t, false, ClientLegacy); err == nil {
+		t.Fatal("accepted a legacy client without compatibility")
+	}
+	cconn, sconn, err := handshakePair(t, true, ClientLegacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Version(sconn) != VersionLegacy {
+		t.Fatal("wrong version", Version(sconn))
+	}
+	echoOnce(t, cconn, sconn)
+	cconn.Close()
+	sconn.Close()
+
+	LegacyCutoff = time.Now().Add(-time.Hour)
+	defer func() { LegacyCutoff = time.Time{} }()
+	if _, _, err := handshakePair(t, true, ClientLegacy); err != ErrLegacyRejected {
+		t.Fatal("accepted a legacy client after the cutoff:", err)
+	}
+	// newer clients are still fine
+	cconn, sconn, err = handshakePair(t, true, Client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cconn.Close()
+	sconn.Close()
+}
+
+func TestLegacyKeepsDeadline(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serve := func(deadline time.Time) chan error {
+		done := make(chan error, 1)
+		go func() {
+			raw, err := listener.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+			defer raw.Close()
+			raw.SetReadDeadline(deadline)
+			conn, err := Server(secret, true, raw, deadline)
+			if err != nil {
+				// a failed handshake still leaves the caller's deadline, so the decoy can read
+				conn = raw
+			}
+			_, err = io.ReadFull(conn, make([]byte, 5))
+			done <- err
+		}()
+		return done
+	}
+
+	// after a failed legacy handshake, reads work until the caller's deadline
+	done := serve(time.Now().Add(5 * time.Second))
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	garbage := make([]byte, 1000)
+	rand.Read(garbage)
+	raw.Write(garbage)
+	time.Sleep(2 * legacyGap)
+	raw.Write([]byte("hello"))
+	if err := <-done; err != nil {
+		t.Fatal("gap deadline left behind:", err)
+	}
+
+	// after a successful one, the caller's deadline still applies
+	done = serve(time.Now().Add(time.Second))
+	raw, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ClientLegacy(secret, raw); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("read without data succeeded")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("caller's deadline cleared")
+	}
+}
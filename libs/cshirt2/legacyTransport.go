@@ -14,13 +14,22 @@ import (
 	"time"
 
 	"github.com/geph-official/geph2/libs/erand"
+	"github.com/geph-official/geph2/libs/shaper"
 	pool "github.com/libp2p/go-buffer-pool"
 	"golang.org/x/crypto/chacha20"
 )
 
+// the MAC, the encrypted length and the real length
+const legacyOverhead = 16 + 2 + 2
+
 // generates padding, given a write size
-func generatePadding(wsize int) []byte {
-	// TODO improve
+func (tp *legacyTransport) generatePadding(wsize int) []byte {
+	if tp.shaper != nil {
+		if wsize+legacyOverhead >= tp.shaper.Profile().MaxSize {
+			return nil
+		}
+		return make([]byte, tp.shaper.WriteSize(wsize+legacyOverhead)-wsize-legacyOverhead)
+	}
 	if wsize > 3000 {
 		return nil
 	}
@@ -35,6 +44,7 @@ type legacyTransport struct {
 	wireBuf    *bufio.Reader
 	wire       net.Conn
 	readbuf    bytes.Buffer
+	shaper     *shaper.Shaper
 
 	readDeadline  atomic.Value
 	writeDeadline atomic.Value
@@ -107,7 +117,7 @@ func (tp *legacyTransport) Write(b []byte) (n int, err error) {
 	}
 	// first generate the plaintext payload
 	plainBuf := new(bytes.Buffer)
-	padding := generatePadding(len(b))
+	padding := tp.generatePadding(len(b))
 	binary.Write(plainBuf, binary.BigEndian, uint16(len(padding)+len(b)+2))
 	binary.Write(plainBuf, binary.BigEndian, uint16(len(b)))
 	plainBuf.Write(b)
@@ -123,6 +133,11 @@ func (tp *legacyTransport) Write(b []byte) (n int, err error) {
 	copy(toWrite, mac)
 	copy(toWrite[len(mac):], cryptPayload)
 	// then we assemble everything
+	if tp.shaper != nil {
+		if wait := tp.shaper.Pace(time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
 	_, err = tp.wire.Write(toWrite)
 	if err != nil {
 		return
@@ -157,7 +172,7 @@ func (tp *legacyTransport) SetWriteDeadline(t time.Time) error {
 	return tp.wire.SetWriteDeadline(t)
 }
 
-func newLegacyTransport(wire net.Conn, ss []byte, isServer bool) *legacyTransport {
+func newLegacyTransport(wire net.Conn, ss []byte, isServer bool, sh *shaper.Shaper) *legacyTransport {
 	tp := new(legacyTransport)
 	readKey := mac256(ss, []byte("c2s"))
 	writeKey := mac256(ss, []byte("c2c"))
@@ -177,5 +192,6 @@ func newLegacyTransport(wire net.Conn, ss []byte, isServer bool) *legacyTranspor
 	}
 	tp.wire = wire
 	tp.wireBuf = bufio.NewReader(wire)
+	tp.shaper = sh
 	return tp
 }
@@ -8,9 +8,11 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/geph-official/geph2/libs/erand"
+	"github.com/geph-official/geph2/libs/shaper"
 	pool "github.com/libp2p/go-buffer-pool"
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -23,12 +25,21 @@ type transport struct {
 	wireBuf    *bufio.Reader
 	wire       net.Conn
 	readbuf    bytes.Buffer
+	shaper     *shaper.Shaper
+	wlock      sync.Mutex
+	version    int
 
 	buf [128]byte
 }
 
 const maxWriteSize = 16384
 
+// a segment with nothing in it: the encrypted length, the padding length and the body's tag
+const segmentOverhead = 2 + 16 + 1 + 16
+
+// ShapingProfile is the shaper profile that new connections follow. The default, "none", only adds some random padding.
+var ShapingProfile = "none"
+
 func (tp *transport) getiWriteNonce() uint64 {
 	n := tp.writeNonce
 	tp.writeNonce++
@@ -41,15 +52,6 @@ func (tp *transport) getiReadNonce() uint64 {
 	return n
 }
 
-func addPadding(appendTo, data []byte) []byte {
-	padAmount := erand.Int(200)
-	appendTo = append(appendTo, byte(padAmount))
-	appendTo = append(appendTo, make([]byte, padAmount)...)
-	appendTo = append(appendTo, data...)
-	return appendTo
-	//return data
-}
-
 func remPadding(data []byte) []byte {
 	if len(data) > 0 && len(data) > int(data[0]) {
 		return data[data[0]+1:]
@@ -58,24 +60,97 @@ func remPadding(data []byte) []byte {
 }
 
 func (tp *transport) writeSegment(unpadded []byte) (err error) {
-	toWrite := pool.Get(len(unpadded) + 256)[:0]
+	buffer := pool.Get(maxWriteSize + 512)[:0]
+	defer pool.Put(buffer)
+	buffer = tp.sealSegment(buffer, unpadded, erand.Int(200))
+	_, err = tp.wire.Write(buffer)
+	return
+}
+
+// sealSegment appends an encrypted segment, carrying data and padAmount bytes of padding, to buffer.
+func (tp *transport) sealSegment(buffer, data []byte, padAmount int) []byte {
+	toWrite := pool.Get(len(data) + 256)[:0]
 	defer pool.Put(toWrite)
-	toWrite = addPadding(toWrite, unpadded)
+	toWrite = append(toWrite, byte(padAmount))
+	toWrite = append(toWrite, make([]byte, padAmount)...)
+	toWrite = append(toWrite, data...)
 	lengthNonce := tp.buf[:12]
 	binary.LittleEndian.PutUint64(lengthNonce, tp.getiWriteNonce())
 	bodyNonce := tp.buf[12:24]
 	binary.LittleEndian.PutUint64(bodyNonce, tp.getiWriteNonce())
 	length := tp.buf[24:26]
 	binary.LittleEndian.PutUint16(length, uint16(len(toWrite)+tp.readCrypt.Overhead()))
-	buffer := pool.Get(maxWriteSize + 128)[:0]
-	defer pool.Put(buffer)
 	buffer = tp.writeCrypt.Seal(buffer, lengthNonce, length, nil)
 	buffer = tp.writeCrypt.Seal(buffer, bodyNonce, toWrite, nil)
+	return buffer
+}
+
+// fillTo appends padding-only segments to buffer until it's about size bytes long. Readers skip them, since they carry no data.
+func (tp *transport) fillTo(buffer []byte, size int) []byte {
+	for size-len(buffer) >= segmentOverhead {
+		padAmount := size - len(buffer) - segmentOverhead
+		if padAmount > 255 {
+			padAmount = 255
+		}
+		buffer = tp.sealSegment(buffer, nil, padAmount)
+	}
+	return buffer
+}
+
+// writeShaped writes p in writes whose sizes and timing follow the shaper.
+func (tp *transport) writeShaped(p []byte) (err error) {
+	for len(p) > 0 {
+		size := tp.shaper.WriteSize(len(p) + segmentOverhead)
+		chunk := size - segmentOverhead
+		if chunk > maxWriteSize {
+			chunk = maxWriteSize
+		}
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		padAmount := size - segmentOverhead - chunk
+		if padAmount > 255 {
+			padAmount = 255
+		}
+		buffer := pool.Get(size + 512)[:0]
+		buffer = tp.sealSegment(buffer, p[:chunk], padAmount)
+		buffer = tp.fillTo(buffer, size)
+		if wait := tp.shaper.Pace(time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
+		_, err = tp.wire.Write(buffer)
+		pool.Put(buffer)
+		if err != nil {
+			return
+		}
+		tp.shaper.Touch()
+		p = p[chunk:]
+	}
+	return
+}
+
+// writeCover writes a write's worth of padding, for cover traffic.
+func (tp *transport) writeCover(size int) (err error) {
+	tp.wlock.Lock()
+	defer tp.wlock.Unlock()
+	buffer := pool.Get(size + 512)[:0]
+	defer pool.Put(buffer)
+	buffer = tp.fillTo(buffer, size)
 	_, err = tp.wire.Write(buffer)
 	return
 }
 
 func (tp *transport) Write(p []byte) (n int, err error) {
+	tp.wlock.Lock()
+	defer tp.wlock.Unlock()
+	if tp.shaper != nil {
+		err = tp.writeShaped(p)
+		if err != nil {
+			return
+		}
+		n = len(p)
+		return
+	}
 	ptr := p
 	for len(ptr) > maxWriteSize {
 		err = tp.writeSegment(ptr[:maxWriteSize])
@@ -153,7 +228,7 @@ func (tp *transport) SetReadDeadline(t time.Time) error {
 	return tp.wire.SetReadDeadline(t)
 }
 
-func newTransport(wire net.Conn, ss []byte, isServer bool) *transport {
+func newTransport(wire net.Conn, ss []byte, isServer bool, sh *shaper.Shaper) *transport {
 	tp := new(transport)
 	readKey := mac256(ss, []byte("c2s"))
 	writeKey := mac256(ss, []byte("c2c"))
@@ -171,5 +246,10 @@ func newTransport(wire net.Conn, ss []byte, isServer bool) *transport {
 	}
 	tp.wire = wire
 	tp.wireBuf = bufio.NewReader(wire)
+	tp.shaper = sh
+	if sh != nil {
+		sh.Touch()
+		go sh.Cover(tp.writeCover)
+	}
 	return tp
 }
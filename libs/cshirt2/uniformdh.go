@@ -51,8 +51,5 @@ retry:
 		goto retry
 	}
 	copy(pub, candid)
-	globCacheLock.Lock()
-	defer globCacheLock.Unlock()
-	globCache.SetDefault(string(pk), false)
 	return pub, priv
 }
@@ -0,0 +1,181 @@
+// Package e2enat serves e2e UDP, where a client's niaucchi4 packets go through a bridge to an exit. Bridges answer "conn/e2e" requests by opening a NAT to the exit's e2e port, and exits run KCP over niaucchi4.E2EConn on that port.
+package e2enat
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/fastudp"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"golang.org/x/time/rate"
+)
+
+// ExitPort is the UDP port exits serve e2e on.
+const ExitPort = 2399
+
+// Config configures a bridge's NATs.
+type Config struct {
+	AllowExit func(host string) bool // which exit hosts clients may ask for
+	ExitPort  int                    // zero for ExitPort
+	Limiter   *rate.Limiter          // limits traffic towards clients, if set
+
+	// optional statistics hooks
+	OnUp     func(n int)
+	OnDown   func(n int)
+	OnQueued func(d time.Duration)
+}
+
+type e2ePacket struct {
+	Session niaucchi4.SessionAddr
+	Sn      uint64
+	Ack     uint64
+	Body    []byte
+	Padding []byte
+}
+
+func parseSess(bts []byte) uint64 {
+	var pkt e2ePacket
+	rlp.DecodeBytes(bts, &pkt)
+	return binary.BigEndian.Uint64(pkt.Session[:8])
+}
+
+var natCount int64
+
+// Count returns how many NATs are open.
+func Count() int64 {
+	return atomic.LoadInt64(&natCount)
+}
+
+// Handle serves a conn/e2e request, whose command was already read from dec. It reads the exit's host and the client's cookie, opens a NAT to the exit, and tells the client the NAT's port.
+func (cfg *Config) Handle(client io.Writer, dec *rlp.Stream) (port int, err error) {
+	var host string
+	err = dec.Decode(&host)
+	if err != nil {
+		return
+	}
+	if !cfg.AllowExit(host) {
+		err = fmt.Errorf("bad pattern: %v", host)
+		return
+	}
+	var cookie []byte
+	err = dec.Decode(&cookie)
+	if err != nil {
+		return
+	}
+	exitPort := cfg.ExitPort
+	if exitPort == 0 {
+		exitPort = ExitPort
+	}
+	port, err = cfg.NAT(fmt.Sprintf("%v:%v", host, exitPort), cookie)
+	if err != nil {
+		return
+	}
+	err = rlp.Encode(client, uint(port))
+	return
+}
+
+// NAT opens a UDP port that relays niaucchi4 packets obfuscated with cookie to dest, and the exit's answers back. It closes after 30 minutes without traffic.
+func (cfg *Config) NAT(dest string, cookie []byte) (port int, err error) {
+	leftRaw, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return
+	}
+	leftRaw = fastudp.NewConn(leftRaw.(*net.UDPConn))
+	leftSock := niaucchi4.ObfsListen(cookie, leftRaw, true)
+	rightSock, err := net.ListenPacket("udp", "")
+	if err != nil {
+		leftSock.Close()
+		return
+	}
+	destReal, err := net.ResolveUDPAddr("udp", dest)
+	if err != nil {
+		leftSock.Close()
+		rightSock.Close()
+		return
+	}
+	rightSock = fastudp.NewConn(rightSock.(*net.UDPConn))
+	// mapping
+	sessMap := new(sync.Map)
+	go func() {
+		atomic.AddInt64(&natCount, 1)
+		defer atomic.AddInt64(&natCount, -1)
+		defer leftSock.Close()
+		defer rightSock.Close()
+		bts := malloc(2048)
+		for {
+			dl := time.Now().Add(time.Minute * 30)
+			leftSock.SetReadDeadline(dl)
+			n, addr, err := leftSock.ReadFrom(bts)
+			if err != nil {
+				return
+			}
+			sid := parseSess(bts[:n])
+			sessMap.Store(sid, addr)
+			btsCopy := malloc(n)
+			copy(btsCopy, bts)
+			maybeDoJob(func() {
+				rightSock.WriteTo(btsCopy, destReal)
+				if cfg.OnUp != nil {
+					cfg.OnUp(n)
+				}
+				free(btsCopy)
+			})
+		}
+	}()
+	go func() {
+		defer leftSock.Close()
+		defer rightSock.Close()
+		bts := malloc(2048)
+		for {
+			dl := time.Now().Add(time.Minute * 30)
+			rightSock.SetReadDeadline(dl)
+			n, _, e := rightSock.ReadFrom(bts)
+			if e != nil {
+				return
+			}
+			leftSock.SetWriteDeadline(dl)
+			sid := parseSess(bts[:n])
+			if addri, ok := sessMap.Load(sid); ok {
+				btsCopy := malloc(n)
+				copy(btsCopy, bts)
+				start := time.Now()
+				maybeDoJob(func() {
+					if cfg.Limiter != nil {
+						cfg.Limiter.WaitN(context.Background(), n)
+					}
+					leftSock.WriteTo(btsCopy, addri.(net.Addr))
+					free(btsCopy)
+					if cfg.OnDown != nil {
+						cfg.OnDown(n)
+					}
+					if cfg.OnQueued != nil {
+						cfg.OnQueued(time.Since(start))
+					}
+				})
+			}
+		}
+	}()
+	return leftRaw.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// ServeExit serves e2e on an exit's sock, which exits bind to ExitPort. It calls handle with every new session, set up the way clients set up theirs, and returns once sock is closed.
+func ServeExit(sock net.PacketConn, handle func(*kcp.UDPSession)) error {
+	listener := niaucchi4.ListenKCP(niaucchi4.NewE2EConn(sock))
+	defer listener.Close()
+	for {
+		rc, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		rc.SetStreamMode(true)
+		go handle(rc)
+	}
+}
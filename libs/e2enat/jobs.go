@@ -1,4 +1,4 @@
-package main
+package e2enat
 
 import (
 	"runtime"
@@ -27,14 +27,12 @@ func maybeDoJob(f func()) {
 	case e2ejobs <- f:
 	default:
 	}
-	//f()
 }
 
 func init() {
 	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		//log.Println("spawning worker thread", workerID)
 		go func() {
-			for i := 0; ; i++ {
+			for {
 				(<-e2ejobs)()
 			}
 		}()
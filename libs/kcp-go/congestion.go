@@ -0,0 +1,86 @@
+package kcp
+
+import (
+	"errors"
+	"time"
+)
+
+// CongestionController decides how much a KCP session may have in flight and how fast it may send. All hooks are called with the session locked.
+type CongestionController interface {
+	// OnAck is called when segments are acknowledged. acks is how far the cumulative ack advanced, which is zero when only later segments were selectively acknowledged.
+	OnAck(kcp *KCP, acks int32)
+	// OnLoss is called with the sequence numbers of segments that are being retransmitted.
+	OnLoss(kcp *KCP, lost []uint32)
+	// OnRTTSample is called with every new round-trip time sample, in milliseconds.
+	OnRTTSample(kcp *KCP, rtt int32)
+	// Pace returns whether a new segment of the given size may be sent right now.
+	Pace(kcp *KCP, size int) bool
+}
+
+// idler is implemented by controllers that want to know when a session has nothing to send.
+type idler interface {
+	OnIdle(kcp *KCP)
+}
+
+// ECNObserver is implemented by controllers that react to ECN congestion-experienced marks.
+type ECNObserver interface {
+	// OnECN is called with how many of the acked segments carried a congestion-experienced mark.
+	OnECN(kcp *KCP, marked, acked int32)
+}
+
+// PacingRater is implemented by controllers that pace their sending.
+type PacingRater interface {
+	// PacingRate returns the current pacing rate in bytes per second, or zero when not pacing.
+	PacingRate(kcp *KCP) float64
+}
+
+// ErrUnknownCongestionController is returned for unknown congestion control algorithms.
+var ErrUnknownCongestionController = errors.New("unknown congestion control algorithm")
+
+// NewCongestionController returns a fresh controller running the named algorithm: BIC, CUBIC, VGS, LOL or BBR.
+func NewCongestionController(name string) (CongestionController, error) {
+	switch name {
+	case "BIC":
+		return newBIC(), nil
+	case "CUBIC":
+		return newCUBIC(), nil
+	case "VGS":
+		return &vgsController{}, nil
+	case "LOL":
+		return newLOL(), nil
+	case "BBR":
+		return newBBR(), nil
+	}
+	return nil, ErrUnknownCongestionController
+}
+
+// timeNow is the clock used by the state machine. The simulation tests replace it.
+var timeNow = time.Now
+
+// Cwnd returns the congestion window, in segments.
+func (kcp *KCP) Cwnd() float64 { return kcp.cwnd }
+
+// SetCwnd sets the congestion window, in segments.
+func (kcp *KCP) SetCwnd(cwnd float64) { kcp.cwnd = cwnd }
+
+// Mss returns the maximum segment size.
+func (kcp *KCP) Mss() int { return int(kcp.mss) }
+
+// MinRTT returns the minimum round-trip time seen recently, in milliseconds.
+func (kcp *KCP) MinRTT() float64 { return kcp.DRE.minRtt }
+
+// DeliveryRate returns the estimated delivery rate, in bytes per second.
+func (kcp *KCP) DeliveryRate() float64 { return kcp.DRE.maxAckRate }
+
+// Inflight returns the number of segments sent but not yet acknowledged.
+func (kcp *KCP) Inflight() int { return len(kcp.snd_buf) - kcp.sacked }
+
+// SetCongestionController replaces the congestion controller.
+func (kcp *KCP) SetCongestionController(cc CongestionController) { kcp.cc = cc }
+
+// ReportECN passes ECN feedback from the transport to the congestion controller, if it cares.
+func (kcp *KCP) ReportECN(marked, acked int32) {
+	if eo, ok := kcp.cc.(ECNObserver); ok {
+		eo.OnECN(kcp, marked, acked)
+	}
+}
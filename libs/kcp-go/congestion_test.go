@@ -0,0 +1,273 @@
+package kcp
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// simLink is a deterministic, virtual-time version of a lossyconn link: a bottleneck with a rate, a drop-tail queue, a one-way delay and random loss. Packets that find more than ecnQueue bytes queued get an ECN mark.
+type simLink struct {
+	rate      float64 // bytes per second
+	delay     time.Duration
+	loss      float64
+	queue     float64 // bytes
+	ecnQueue  float64 // bytes, 0 for no ECN
+	busyUntil time.Time
+	rng       *rand.Rand
+}
+
+// send returns when a packet of the given size sent now arrives and whether it's marked, or false if it's dropped.
+func (sl *simLink) send(now time.Time, size int) (at time.Time, marked bool, ok bool) {
+	start := now
+	if sl.busyUntil.After(now) {
+		queued := sl.busyUntil.Sub(now).Seconds() * sl.rate
+		if queued > sl.queue {
+			return
+		}
+		marked = sl.ecnQueue > 0 && queued > sl.ecnQueue
+		start = sl.busyUntil
+	}
+	if sl.rng.Float64() < sl.loss {
+		return
+	}
+	sl.busyUntil = start.Add(time.Duration(float64(size) / sl.rate * float64(time.Second)))
+	return sl.busyUntil.Add(sl.delay), marked, true
+}
+
+type simPacket struct {
+	at     time.Time
+	flow   int
+	ack    bool
+	marked bool
+	data   []byte
+}
+
+type simFlow struct {
+	sender, receiver *KCP
+	received         int
+	// ECN feedback not yet carried back by an ack
+	marked, unmarked int32
+}
+
+// simResult is the goodput, in bytes per second, and the average smoothed RTT, in milliseconds, of every flow over the second half of a simulation.
+type simResult struct {
+	goodput []float64
+	srtt    []float64
+}
+
+func (sr simResult) total() (sum float64) {
+	for _, v := range sr.goodput {
+		sum += v
+	}
+	return
+}
+
+// fairness returns Jain's fairness index.
+func (sr simResult) fairness() float64 {
+	var sum, sqsum float64
+	for _, v := range sr.goodput {
+		sum += v
+		sqsum += v * v
+	}
+	if sqsum == 0 {
+		return 0
+	}
+	return sum * sum / (float64(len(sr.goodput)) * sqsum)
+}
+
+// simulate runs bulk flows with the given algorithm through a shared bottleneck, all in virtual time.
+func simulate(algo string, flows int, link simLink, duration time.Duration) simResult {
+	defer func(old func() time.Time) { timeNow = old }(timeNow)
+	now := refTime.Add(time.Second)
+	timeNow = func() time.Time { return now }
+	link.rng = rand.New(rand.NewSource(1))
+
+	var inflight []simPacket
+	fl := make([]*simFlow, flows)
+	for i := range fl {
+		i := i
+		f := &simFlow{}
+		f.sender = NewKCP(uint32(i+1), func(buf []byte, size int) {
+			at, marked, ok := link.send(now, size)
+			if ok {
+				inflight = append(inflight, simPacket{at, i, false, marked, append([]byte(nil), buf[:size]...)})
+			}
+		})
+		f.receiver = NewKCP(uint32(i+1), func(buf []byte, size int) {
+			inflight = append(inflight, simPacket{now.Add(link.delay), i, true, false, append([]byte(nil), buf[:size]...)})
+		})
+		cc, err := NewCongestionController(algo)
+		if err != nil {
+			panic(err)
+		}
+		f.sender.SetCongestionController(cc)
+		for _, k := range []*KCP{f.sender, f.receiver} {
+			k.WndSize(10000, 10000)
+			k.NoDelay(0, 20, 32, 0)
+			k.stream = 1
+		}
+		fl[i] = f
+	}
+
+	chunk := make([]byte, 4096)
+	buf := make([]byte, 65536)
+	var halfway []int
+	res := simResult{
+		goodput: make([]float64, flows),
+		srtt:    make([]float64, flows),
+	}
+	for ms := 0; time.Duration(ms)*time.Millisecond < duration; ms++ {
+		now = now.Add(time.Millisecond)
+		if time.Duration(ms)*time.Millisecond == duration/2 {
+			for _, f := range fl {
+				halfway = append(halfway, f.received)
+			}
+		}
+		if halfway != nil {
+			for i, f := range fl {
+				res.srtt[i] += float64(f.sender.rx_srtt) / float64(duration/2/time.Millisecond)
+			}
+		}
+		// deliver everything that has arrived, in order of arrival
+		sort.SliceStable(inflight, func(i, j int) bool { return inflight[i].at.Before(inflight[j].at) })
+		n := 0
+		for n < len(inflight) && !inflight[n].at.After(now) {
+			n++
+		}
+		arrived := inflight[:n:n]
+		inflight = inflight[n:]
+		for _, pkt := range arrived {
+			f := fl[pkt.flow]
+			if pkt.ack {
+				f.sender.Input(pkt.data, true, false)
+				f.sender.ReportECN(f.marked, f.marked+f.unmarked)
+				f.marked, f.unmarked = 0, 0
+			} else {
+				if pkt.marked {
+					f.marked++
+				} else {
+					f.unmarked++
+				}
+				f.receiver.Input(pkt.data, true, false)
+				for {
+					n := f.receiver.Recv(buf)
+					if n <= 0 {
+						break
+					}
+					f.received += n
+				}
+			}
+		}
+		for _, f := range fl {
+			for f.sender.WaitSnd() < 1000 {
+				f.sender.Send(chunk)
+			}
+			if ms%int(f.sender.interval) == 0 {
+				f.sender.flush(false)
+				f.receiver.flush(false)
+			}
+		}
+	}
+
+	for i, f := range fl {
+		res.goodput[i] = float64(f.received-halfway[i]) / (duration / 2).Seconds()
+	}
+	return res
+}
+
+func TestCongestionSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulation in short mode")
+	}
+	link := simLink{
+		rate:  1250 * 1000,
+		delay: 50 * time.Millisecond,
+		loss:  0.005,
+		queue: 125 * 1000,
+	}
+	for _, algo := range []string{"BIC", "CUBIC", "VGS", "LOL", "BBR"} {
+		res := simulate(algo, 3, link, 30*time.Second)
+		t.Logf("%v: %vK total, fairness %.2f, per flow %.0f, srtt %.0f", algo,
+			int(res.total()/1000), res.fairness(), res.goodput, res.srtt)
+		if res.total() < link.rate*0.1 {
+			t.Errorf("%v uses less than a tenth of the link", algo)
+		}
+		if res.total() > link.rate*1.01 {
+			t.Errorf("%v delivers more than the link can carry", algo)
+		}
+		if res.fairness() < 0.5 {
+			t.Errorf("%v shares the link unfairly", algo)
+		}
+		again := simulate(algo, 3, link, 30*time.Second)
+		for i := range res.goodput {
+			if res.goodput[i] != again.goodput[i] {
+				t.Fatalf("%v simulation isn't deterministic", algo)
+			}
+		}
+	}
+}
+
+func TestBBRSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping simulation in short mode")
+	}
+	bloated := simLink{
+		rate:  1250 * 1000,
+		delay: 50 * time.Millisecond,
+		loss:  0.001,
+		queue: 1000 * 1000,
+	}
+	marking := bloated
+	marking.ecnQueue = 60 * 1000
+	lossy := simLink{
+		rate:  1250 * 1000,
+		delay: 100 * time.Millisecond,
+		loss:  0.03,
+		queue: 250 * 1000,
+	}
+	for _, c := range []struct {
+		name    string
+		link    simLink
+		minRate float64 // fraction of the link
+		maxRtt  float64 // multiple of the base RTT
+	}{
+		{"bufferbloat", bloated, 0.8, 1.5},
+		{"ECN", marking, 0.6, 1.5},
+		{"random loss", lossy, 0.7, 1.5},
+	} {
+		bbr := simulate("BBR", 1, c.link, 30*time.Second)
+		bic := simulate("BIC", 1, c.link, 30*time.Second)
+		t.Logf("%v: BBR %vK @ %.0fms, BIC %vK @ %.0fms", c.name,
+			int(bbr.total()/1000), bbr.srtt[0], int(bic.total()/1000), bic.srtt[0])
+		if bbr.total() < c.link.rate*c.minRate {
+			t.Errorf("%v: BBR only gets %vK", c.name, int(bbr.total()/1000))
+		}
+		if base := 2 * c.link.delay.Seconds() * 1000; bbr.srtt[0] > base*c.maxRtt {
+			t.Errorf("%v: BBR builds a queue, srtt %.0fms", c.name, bbr.srtt[0])
+		}
+	}
+}
+
+func TestDuplicateAcks(t *testing.T) {
+	kcp := NewKCP(1, func([]byte, int) {})
+	kcp.WndSize(128, 128)
+	kcp.NoDelay(0, 20, 0, 1)
+	kcp.Send(make([]byte, int(kcp.mss)*10))
+	kcp.flush(false)
+	if len(kcp.snd_buf) != 10 {
+		t.Fatal("segments not sent", len(kcp.snd_buf))
+	}
+	// an out-of-order ack, then the same ack again and again, as when acks are retransmitted
+	for i := 0; i < 3; i++ {
+		kcp.parse_ack(3)
+	}
+	if kcp.sacked != 1 || kcp.Inflight() != 9 {
+		t.Fatal("duplicate acks counted", kcp.sacked, kcp.Inflight())
+	}
+	kcp.parse_una(5)
+	if kcp.sacked != 0 || kcp.Inflight() != 5 {
+		t.Fatal("wrong count after una", kcp.sacked, kcp.Inflight())
+	}
+}
@@ -2,7 +2,6 @@ package kcp
 
 import (
 	"encoding/binary"
-	"sync/atomic"
 
 	"github.com/klauspost/reedsolomon"
 )
@@ -22,6 +21,23 @@ func (bts fecPacket) seqid() uint32 { return binary.LittleEndian.Uint32(bts) }
 func (bts fecPacket) flag() uint16  { return binary.LittleEndian.Uint16(bts[4:]) }
 func (bts fecPacket) data() []byte  { return bts[6:] }
 
+// geometry returns the index into fecGeometries carried by adaptive packets
+func (bts fecPacket) geometry() int { return int(bts.flag() >> 8) }
+
+// adaptive returns whether the packet carries its own shard geometry
+func (bts fecPacket) adaptive() bool {
+	kind := bts.flag() & 0xff
+	return (kind == typeAdaptiveData || kind == typeAdaptiveParity) && bts.geometry() < len(fecGeometries)
+}
+
+func (bts fecPacket) isData() bool {
+	return bts.flag() == typeData || (bts.adaptive() && bts.flag()&0xff == typeAdaptiveData)
+}
+
+func (bts fecPacket) isParity() bool {
+	return bts.flag() == typeParity || (bts.adaptive() && bts.flag()&0xff == typeAdaptiveParity)
+}
+
 // fecElement has auxcilliary time field
 type fecElement struct {
 	fecPacket
@@ -36,6 +52,15 @@ type fecDecoder struct {
 	shardSize    int
 	rx           []fecElement // ordered receive queue
 
+	// recently completed groups, so that their late shards are dropped right away
+	done    [fecDoneGroups]uint32
+	doneIdx int
+
+	// counters collected by the session: parity shards that arrived for nothing,
+	// and data shards given up on
+	wasted uint64
+	short  uint64
+
 	// caches
 	decodeCache [][]byte
 	flagCache   []bool
@@ -43,10 +68,13 @@ type fecDecoder struct {
 	// zeros
 	zeros []byte
 
-	// RS decoder
-	codec reedsolomon.Encoder
+	// RS decoder for the fixed geometry, and for adaptive geometries by index
+	codec  reedsolomon.Encoder
+	codecs map[int]reedsolomon.Encoder
 }
 
+const fecDoneGroups = 16
+
 func newFECDecoder(rxlimit, dataShards, parityShards int) *fecDecoder {
 	if dataShards <= 0 || parityShards <= 0 {
 		return nil
@@ -65,14 +93,74 @@ func newFECDecoder(rxlimit, dataShards, parityShards int) *fecDecoder {
 		return nil
 	}
 	dec.codec = codec
-	dec.decodeCache = make([][]byte, dec.shardSize)
-	dec.flagCache = make([]bool, dec.shardSize)
+	dec.codecs = make(map[int]reedsolomon.Encoder)
+	for k := range dec.done {
+		dec.done[k] = 0xffffffff
+	}
+	maxShards := dec.shardSize
+	if maxShards < fecMaxShards {
+		maxShards = fecMaxShards
+	}
+	dec.decodeCache = make([][]byte, maxShards)
+	dec.flagCache = make([]bool, maxShards)
 	dec.zeros = make([]byte, mtuLimit)
 	return dec
 }
 
+// codecFor returns the RS codec for an adaptive geometry
+func (dec *fecDecoder) codecFor(geometry int) reedsolomon.Encoder {
+	if codec, ok := dec.codecs[geometry]; ok {
+		return codec
+	}
+	g := fecGeometries[geometry]
+	codec, err := reedsolomon.New(g[0], g[1])
+	if err != nil {
+		return nil
+	}
+	dec.codecs[geometry] = codec
+	return codec
+}
+
+func (dec *fecDecoder) markDone(shardBegin uint32) {
+	dec.done[dec.doneIdx] = shardBegin
+	dec.doneIdx = (dec.doneIdx + 1) % fecDoneGroups
+}
+
+func (dec *fecDecoder) isDone(shardBegin uint32) bool {
+	for _, v := range dec.done {
+		if v == shardBegin {
+			return true
+		}
+	}
+	return false
+}
+
 // decode a fec packet
 func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
+	// geometry of the group the packet belongs to
+	dataShards, codec := dec.dataShards, dec.codec
+	shardSize := dec.shardSize
+	if in.adaptive() {
+		g := fecGeometries[in.geometry()]
+		if g[1] == 0 { // FEC is off, nothing to recover
+			return nil
+		}
+		dataShards, shardSize = g[0], g[0]+g[1]
+		if codec = dec.codecFor(in.geometry()); codec == nil {
+			return nil
+		}
+	}
+
+	// shard range for current packet
+	shardBegin := in.seqid() - in.seqid()%uint32(shardSize)
+	shardEnd := shardBegin + uint32(shardSize) - 1
+	if dec.isDone(shardBegin) {
+		if in.isParity() {
+			dec.wasted++
+		}
+		return nil
+	}
+
 	// insertion
 	n := len(dec.rx) - 1
 	insertIdx := 0
@@ -99,28 +187,24 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 		dec.rx[insertIdx] = elem
 	}
 
-	// shard range for current packet
-	shardBegin := pkt.seqid() - pkt.seqid()%uint32(dec.shardSize)
-	shardEnd := shardBegin + uint32(dec.shardSize) - 1
-
 	// max search range in ordered queue for current shard
-	searchBegin := insertIdx - int(pkt.seqid()%uint32(dec.shardSize))
+	searchBegin := insertIdx - int(pkt.seqid()%uint32(shardSize))
 	if searchBegin < 0 {
 		searchBegin = 0
 	}
-	searchEnd := searchBegin + dec.shardSize - 1
+	searchEnd := searchBegin + shardSize - 1
 	if searchEnd >= len(dec.rx) {
 		searchEnd = len(dec.rx) - 1
 	}
 
 	// re-construct datashards
-	if searchEnd-searchBegin+1 >= dec.dataShards {
+	if searchEnd-searchBegin+1 >= dataShards {
 		var numshard, numDataShard, first, maxlen int
 
 		// zero caches
-		shards := dec.decodeCache
-		shardsflag := dec.flagCache
-		for k := range dec.decodeCache {
+		shards := dec.decodeCache[:shardSize]
+		shardsflag := dec.flagCache[:shardSize]
+		for k := range shards {
 			shards[k] = nil
 			shardsflag[k] = false
 		}
@@ -131,10 +215,10 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 			if _itimediff(seqid, shardEnd) > 0 {
 				break
 			} else if _itimediff(seqid, shardBegin) >= 0 {
-				shards[seqid%uint32(dec.shardSize)] = dec.rx[i].data()
-				shardsflag[seqid%uint32(dec.shardSize)] = true
+				shards[seqid%uint32(shardSize)] = dec.rx[i].data()
+				shardsflag[seqid%uint32(shardSize)] = true
 				numshard++
-				if dec.rx[i].flag() == typeData {
+				if dec.rx[i].isData() {
 					numDataShard++
 				}
 				if numshard == 1 {
@@ -146,36 +230,42 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 			}
 		}
 
-		if numDataShard == dec.dataShards {
+		if numDataShard == dataShards {
 			// case 1: no loss on data shards
+			dec.wasted += uint64(numshard - numDataShard)
+			dec.markDone(shardBegin)
 			dec.rx = dec.freeRange(first, numshard, dec.rx)
-		} else if numshard >= dec.dataShards {
+		} else if numshard >= dataShards {
 			// case 2: loss on data shards, but it's recoverable from parity shards
 			for k := range shards {
 				if shards[k] != nil {
 					dlen := len(shards[k])
 					shards[k] = shards[k][:maxlen]
 					copy(shards[k][dlen:], dec.zeros)
-				} else if k < dec.dataShards {
+				} else if k < dataShards {
 					shards[k] = xmitBuf.Get().([]byte)[:0]
 				}
 			}
-			if err := dec.codec.ReconstructData(shards); err == nil {
-				for k := range shards[:dec.dataShards] {
+			if err := codec.ReconstructData(shards); err == nil {
+				for k := range shards[:dataShards] {
 					if !shardsflag[k] {
 						// recovered data should be recycled
 						recovered = append(recovered, shards[k])
 					}
 				}
 			}
+			dec.wasted += uint64(numshard - dataShards)
+			dec.markDone(shardBegin)
 			dec.rx = dec.freeRange(first, numshard, dec.rx)
 		}
 	}
 
 	// keep rxlimit
 	if len(dec.rx) > dec.rxlimit {
-		if dec.rx[0].flag() == typeData { // track the unrecoverable data
-			atomic.AddUint64(&DefaultSnmp.FECShortShards, 1)
+		if dec.rx[0].isData() { // track the unrecoverable data
+			dec.short++
+		} else {
+			dec.wasted++
 		}
 		dec.rx = dec.freeRange(0, 1, dec.rx)
 	}
@@ -185,6 +275,9 @@ func (dec *fecDecoder) decode(in fecPacket) (recovered [][]byte) {
 	numExpired := 0
 	for k := range dec.rx {
 		if _itimediff(current, dec.rx[k].ts) > fecExpire {
+			if dec.rx[k].isParity() {
+				dec.wasted++
+			}
 			numExpired++
 			continue
 		}
@@ -231,6 +324,10 @@ type (
 		headerOffset  int // FEC header offset
 		payloadOffset int // FEC payload offset
 
+		// adaptive geometry, as indices into fecGeometries; -1 is the fixed geometry
+		geometry int // geometry of the current group
+		pending  int // geometry to use from the next group on
+
 		// caches
 		shardCache  [][]byte
 		encodeCache [][]byte
@@ -238,8 +335,9 @@ type (
 		// zeros
 		zeros []byte
 
-		// RS encoder
-		codec reedsolomon.Encoder
+		// RS encoder, and the ones for adaptive geometries by index
+		codec  reedsolomon.Encoder
+		codecs map[int]reedsolomon.Encoder
 	}
 )
 
@@ -254,16 +352,23 @@ func newFECEncoder(dataShards, parityShards, offset int) *fecEncoder {
 	enc.paws = 0xffffffff / uint32(enc.shardSize) * uint32(enc.shardSize)
 	enc.headerOffset = offset
 	enc.payloadOffset = enc.headerOffset + fecHeaderSize
+	enc.geometry = -1
+	enc.pending = -1
 
 	codec, err := reedsolomon.New(dataShards, parityShards)
 	if err != nil {
 		return nil
 	}
 	enc.codec = codec
+	enc.codecs = make(map[int]reedsolomon.Encoder)
 
 	// caches
-	enc.encodeCache = make([][]byte, enc.shardSize)
-	enc.shardCache = make([][]byte, enc.shardSize)
+	maxShards := enc.shardSize
+	if maxShards < fecMaxShards {
+		maxShards = fecMaxShards
+	}
+	enc.encodeCache = make([][]byte, maxShards)
+	enc.shardCache = make([][]byte, maxShards)
 	for k := range enc.shardCache {
 		enc.shardCache[k] = make([]byte, mtuLimit)
 	}
@@ -274,11 +379,18 @@ func newFECEncoder(dataShards, parityShards, offset int) *fecEncoder {
 // encodes the packet, outputs parity shards if we have collected quorum datashards
 // notice: the contents of 'ps' will be re-written in successive calling
 func (enc *fecEncoder) encode(b []byte) (ps [][]byte) {
+	if enc.shardCount == 0 && enc.pending != enc.geometry {
+		enc.switchGeometry()
+	}
+
 	// The header format:
 	// | FEC SEQID(4B) | FEC TYPE(2B) | SIZE (2B) | PAYLOAD(SIZE-2) |
 	// |<-headerOffset                |<-payloadOffset
 	enc.markData(b[enc.headerOffset:])
 	binary.LittleEndian.PutUint16(b[enc.payloadOffset:], uint16(len(b[enc.payloadOffset:])))
+	if enc.parityShards == 0 { // adaptive FEC is off
+		return
+	}
 
 	// copy data from payloadOffset to fec shard cache
 	sz := len(b)
@@ -301,14 +413,14 @@ func (enc *fecEncoder) encode(b []byte) (ps [][]byte) {
 		}
 
 		// construct equal-sized slice with stripped header
-		cache := enc.encodeCache
+		cache := enc.encodeCache[:enc.shardSize]
 		for k := range cache {
 			cache[k] = enc.shardCache[k][enc.payloadOffset:enc.maxSize]
 		}
 
 		// encoding
 		if err := enc.codec.Encode(cache); err == nil {
-			ps = enc.shardCache[enc.dataShards:]
+			ps = enc.shardCache[enc.dataShards:enc.shardSize]
 			for k := range ps {
 				enc.markParity(ps[k][enc.headerOffset:])
 				ps[k] = ps[k][:enc.maxSize]
@@ -323,15 +435,66 @@ func (enc *fecEncoder) encode(b []byte) (ps [][]byte) {
 	return
 }
 
+// setGeometry switches to an adaptive geometry once the current group is complete
+func (enc *fecEncoder) setGeometry(geometry int) {
+	enc.pending = geometry
+}
+
+// switchGeometry starts using the pending geometry. Groups of adaptive geometries start at multiples of fecMaxShards.
+func (enc *fecEncoder) switchGeometry() {
+	g := fecGeometries[enc.pending]
+	if g[1] > 0 {
+		codec, ok := enc.codecs[enc.pending]
+		if !ok {
+			var err error
+			if codec, err = reedsolomon.New(g[0], g[1]); err != nil {
+				enc.pending = enc.geometry
+				return
+			}
+			enc.codecs[enc.pending] = codec
+		}
+		enc.codec = codec
+	}
+	enc.geometry = enc.pending
+	enc.dataShards = g[0]
+	enc.parityShards = g[1]
+	enc.shardSize = g[0] + g[1]
+	enc.paws = 0xffffffff / fecMaxShards * fecMaxShards
+	enc.next = uint32((uint64(enc.next) + fecMaxShards - 1) / fecMaxShards * fecMaxShards % uint64(enc.paws))
+}
+
+// hello writes a fixed-geometry parity packet announcing adaptive FEC support into b.
+// It uses up the sequence ids of a whole group, which peers without adaptive FEC never
+// complete and so ignore. It must only be called between groups.
+func (enc *fecEncoder) hello(b []byte) []byte {
+	b = b[:fecHelloSize]
+	copy(b, make([]byte, fecHelloSize))
+	binary.LittleEndian.PutUint32(b, enc.next)
+	binary.LittleEndian.PutUint16(b[4:], typeParity)
+	copy(b[fecHeaderSize:], fecHelloMagic)
+	b[fecHeaderSize+len(fecHelloMagic)] = fecVersion
+	enc.next = (enc.next + uint32(enc.shardSize)) % enc.paws
+	return b
+}
+
 func (enc *fecEncoder) markData(data []byte) {
 	binary.LittleEndian.PutUint32(data, enc.next)
-	binary.LittleEndian.PutUint16(data[4:], typeData)
-	enc.next++
+	if enc.geometry < 0 {
+		binary.LittleEndian.PutUint16(data[4:], typeData)
+		enc.next++
+		return
+	}
+	binary.LittleEndian.PutUint16(data[4:], typeAdaptiveData|uint16(enc.geometry)<<8)
+	enc.next = (enc.next + 1) % enc.paws
 }
 
 func (enc *fecEncoder) markParity(data []byte) {
 	binary.LittleEndian.PutUint32(data, enc.next)
-	binary.LittleEndian.PutUint16(data[4:], typeParity)
+	if enc.geometry < 0 {
+		binary.LittleEndian.PutUint16(data[4:], typeParity)
+	} else {
+		binary.LittleEndian.PutUint16(data[4:], typeAdaptiveParity|uint16(enc.geometry)<<8)
+	}
 	// sequence wrap will only happen at parity shard
 	enc.next = (enc.next + 1) % enc.paws
 }
@@ -0,0 +1,292 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"math"
+	"sync/atomic"
+)
+
+const (
+	typeAdaptiveData   = 0xf3 // the high byte of the flag is the geometry
+	typeAdaptiveParity = 0xf4
+	typeFECControl     = 0xf5
+
+	fecMaxShards  = 32
+	fecHelloMagic = "GFEC"
+	fecVersion    = 1
+	fecHelloSize  = fecHeaderSizePlus2 + IKCP_OVERHEAD // the smallest packet read loops accept
+	fecReportSize = fecHelloSize
+
+	fecHelloTries     = 10
+	fecHelloInterval  = 1000 // ms
+	fecReportInterval = 1000 // ms
+	fecMinReport      = 32   // packets a loss report must cover
+	fecOffLoss        = 0.005
+)
+
+// AdaptiveFEC makes sessions created with FEC negotiate adaptive shard geometries with peers that support them.
+// Peers that don't keep getting the fixed geometry the session was created with.
+var AdaptiveFEC = true
+
+// fecGeometries are the data/parity shard counts adaptive FEC picks from. Every
+// total divides fecMaxShards, so that groups of any geometry start at multiples of it.
+// The first one turns FEC off.
+var fecGeometries = [][2]int{
+	{0, 0},
+	{6, 2}, {4, 4},
+	{14, 2}, {12, 4}, {8, 8},
+	{30, 2}, {28, 4}, {24, 8}, {16, 16},
+}
+
+// chooseFECGeometry returns the geometry for a path with the given loss rate, mean
+// loss burst length, RTT in ms and packet rate in packets per second.
+func chooseFECGeometry(loss, burst float64, rtt int32, pps float64) int {
+	if loss < fecOffLoss {
+		return 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	// the largest group that fills within a quarter RTT, so that parity is still
+	// quicker than a retransmission
+	total := 8
+	for _, t := range []int{32, 16} {
+		if float64(t) <= pps*float64(rtt)/4000 {
+			total = t
+			break
+		}
+	}
+	// enough parity for the expected losses in a group plus two standard deviations,
+	// where bursts make losses come in clumps
+	expected := loss * float64(total) * burst
+	need := int(math.Ceil(expected + 2*math.Sqrt(expected)))
+	best := 0
+	for i, g := range fecGeometries {
+		if g[0]+g[1] != total {
+			continue
+		}
+		if best == 0 || fecGeometries[best][1] < need {
+			best = i
+		}
+		if g[1] >= need {
+			break
+		}
+	}
+	return best
+}
+
+// fecLossMeter measures the loss rate and burstiness of the adaptive FEC packets a
+// peer sends from the gaps in their sequence ids.
+type fecLossMeter struct {
+	started  bool
+	lo, hi   uint32 // sequence ids covered by the current window
+	geometry int    // geometry of packet hi
+	got      int
+	skipped  int // ids the sender skipped when changing geometry
+	lost     int
+	bursts   int
+}
+
+func (lm *fecLossMeter) observe(pkt fecPacket) {
+	seqid, geometry := pkt.seqid(), pkt.geometry()
+	if !lm.started {
+		lm.started = true
+		lm.lo, lm.hi, lm.geometry = seqid, seqid, geometry
+		lm.got = 1
+		return
+	}
+	d := _itimediff(seqid, lm.hi)
+	if d <= 0 { // reordered
+		if _itimediff(seqid, lm.lo) >= 0 {
+			lm.got++
+		}
+		return
+	}
+	gap := int(d) - 1
+	if geometry != lm.geometry {
+		// the sender finished the group and skipped to a multiple of fecMaxShards
+		end := lm.hi + 1
+		if g := fecGeometries[lm.geometry]; g[1] > 0 {
+			total := uint32(g[0] + g[1])
+			end = lm.hi - lm.hi%total + total
+		}
+		skip := int(_itimediff(end+(fecMaxShards-end%fecMaxShards)%fecMaxShards, end))
+		if skip > gap {
+			skip = gap
+		}
+		lm.skipped += skip
+		gap -= skip
+	}
+	if gap > 0 {
+		lm.lost += gap
+		lm.bursts++
+	}
+	lm.hi, lm.geometry = seqid, geometry
+	lm.got++
+}
+
+// report returns the loss rate and mean burst length since the last report and
+// starts over. It returns false if too few packets were seen to tell.
+func (lm *fecLossMeter) report() (loss, burst float64, ok bool) {
+	if !lm.started {
+		return
+	}
+	expected := int(_itimediff(lm.hi, lm.lo)) + 1 - lm.skipped
+	if expected < fecMinReport {
+		return
+	}
+	got := lm.got
+	if got > expected {
+		got = expected
+	}
+	loss = 1 - float64(got)/float64(expected)
+	burst = 1
+	if lm.bursts > 0 {
+		burst = float64(lm.lost) / float64(lm.bursts)
+	}
+	lm.lo = lm.hi + 1
+	lm.got, lm.skipped, lm.lost, lm.bursts = 0, 0, 0, 0
+	ok = true
+	return
+}
+
+// isFECHello returns whether the packet is a peer announcing adaptive FEC support
+func isFECHello(pkt fecPacket) bool {
+	return len(pkt) == fecHelloSize && pkt.flag() == typeParity &&
+		string(pkt[fecHeaderSize:fecHeaderSize+len(fecHelloMagic)]) == fecHelloMagic
+}
+
+// fecReport writes a loss report for the peer into b
+func fecReport(b []byte, loss, burst float64) []byte {
+	b = b[:fecReportSize]
+	copy(b, make([]byte, fecReportSize))
+	binary.LittleEndian.PutUint16(b[4:], typeFECControl)
+	binary.LittleEndian.PutUint16(b[fecHeaderSize:], uint16(math.Round(loss*1000)))
+	binary.LittleEndian.PutUint16(b[fecHeaderSize+2:], uint16(math.Min(burst*100, math.MaxUint16)))
+	return b
+}
+
+// parseFECReport reads a loss report from the peer
+func parseFECReport(pkt fecPacket) (loss, burst float64, ok bool) {
+	if len(pkt) < fecReportSize || pkt.flag() != typeFECControl {
+		return
+	}
+	loss = float64(binary.LittleEndian.Uint16(pkt[fecHeaderSize:])) / 1000
+	burst = float64(binary.LittleEndian.Uint16(pkt[fecHeaderSize+2:])) / 100
+	ok = loss <= 1
+	return
+}
+
+// FECStats are the FEC counters and state of a session.
+type FECStats struct {
+	ParitySent     uint64 // parity shards sent
+	ParityReceived uint64 // parity shards received
+	Recovered      uint64 // packets recovered from parity
+	ParityWasted   uint64 // parity shards received that weren't needed
+	Adaptive       bool   // whether the peer negotiated adaptive FEC
+	DataShards     int    // current outgoing geometry
+	ParityShards   int
+	PeerLoss       float64 // loss of our packets as reported by the peer
+}
+
+// adaptiveFEC is the per-session state of adaptive FEC
+type adaptiveFEC struct {
+	enabled      bool
+	peerAdaptive bool
+	hellos       int
+	lastHello    uint32
+	lastTick     uint32
+	sent         int // packets since lastTick
+	meter        fecLossMeter
+	haveReport   bool
+	peerLoss     float64
+	peerBurst    float64
+}
+
+// fecTick runs adaptive FEC negotiation and geometry selection before a packet is encoded
+func (s *UDPSession) fecTick() {
+	a := &s.afec
+	if !a.enabled {
+		return
+	}
+	a.sent++
+	now := currentMs()
+	enc := s.fecEncoder
+	if !a.peerAdaptive {
+		// say hello between groups, after the first one has created the session on the other side
+		if a.hellos < fecHelloTries && enc.shardCount == 0 && enc.next > 0 &&
+			(a.hellos == 0 || _itimediff(now, a.lastHello) >= fecHelloInterval) {
+			s.queueFEC(enc.hello(xmitBuf.Get().([]byte)))
+			a.hellos++
+			a.lastHello = now
+		}
+		return
+	}
+
+	elapsed := _itimediff(now, a.lastTick)
+	if a.lastTick != 0 && elapsed < fecReportInterval {
+		return
+	}
+	pps := 0.0
+	if a.lastTick != 0 {
+		pps = float64(a.sent) * 1000 / float64(elapsed)
+	}
+	a.lastTick, a.sent = now, 0
+	if loss, burst, ok := a.meter.report(); ok {
+		s.queueFEC(fecReport(xmitBuf.Get().([]byte), loss, burst))
+	}
+	loss, burst := a.peerLoss, a.peerBurst
+	if !a.haveReport {
+		loss, burst = s.kcp.estimLoss, 1
+	}
+	enc.setGeometry(chooseFECGeometry(loss, burst, s.kcp.rx_srtt, pps))
+}
+
+// fecControlInput handles adaptive FEC hellos and loss reports, returning whether the packet was one
+func (s *UDPSession) fecControlInput(f fecPacket) bool {
+	hello := isFECHello(f)
+	loss, burst, report := parseFECReport(f)
+	if !hello && !report {
+		return f.flag() == typeFECControl
+	}
+	s.mu.Lock()
+	a := &s.afec
+	a.peerAdaptive = a.enabled
+	if report {
+		if a.haveReport {
+			loss = (a.peerLoss + loss) / 2
+			burst = (a.peerBurst + burst) / 2
+		}
+		a.peerLoss, a.peerBurst, a.haveReport = loss, burst, true
+	}
+	s.mu.Unlock()
+	return true
+}
+
+// fecAdaptiveInput accounts for an adaptive data or parity packet from the peer
+func (s *UDPSession) fecAdaptiveInput(f fecPacket) {
+	s.afec.peerAdaptive = s.afec.enabled
+	s.afec.meter.observe(f)
+}
+
+// FECStats returns the FEC counters and current outgoing geometry of the session.
+func (s *UDPSession) FECStats() FECStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fecStats()
+}
+
+func (s *UDPSession) fecStats() (stats FECStats) {
+	snmp := s.kcp.snmp
+	stats.ParitySent = atomic.LoadUint64(&snmp.FECParitySent)
+	stats.ParityReceived = atomic.LoadUint64(&snmp.FECParityShards)
+	stats.Recovered = atomic.LoadUint64(&snmp.FECRecovered)
+	stats.ParityWasted = atomic.LoadUint64(&snmp.FECParityWasted)
+	stats.Adaptive = s.afec.peerAdaptive
+	stats.PeerLoss = s.afec.peerLoss
+	if s.fecEncoder != nil {
+		stats.DataShards = s.fecEncoder.dataShards
+		stats.ParityShards = s.fecEncoder.parityShards
+	}
+	return
+}
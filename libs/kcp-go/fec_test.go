@@ -2,6 +2,7 @@ package kcp
 
 import (
 	"encoding/binary"
+	"math"
 	"math/rand"
 	"testing"
 )
@@ -41,3 +42,121 @@ func BenchmarkFECEncode(b *testing.B) {
 		encoder.encode(data)
 	}
 }
+
+func TestAdaptiveFEC(t *testing.T) {
+	const loss = 0.05
+	enc := newFECEncoder(16, 16, 0)
+	dec := newFECDecoder(rxFECMulti*fecMaxShards, 16, 16)
+	rng := rand.New(rand.NewSource(1))
+	var meter fecLossMeter
+	delivered := make(map[uint32]bool)
+	var measured []float64
+	geometry := -1
+	const count = 4000
+	for i := 0; i < count; i++ {
+		if i%1000 == 0 {
+			// every geometry change starts a group at a multiple of fecMaxShards
+			enc.setGeometry(1 + i/1000*2)
+		}
+		pkt := make([]byte, fecHeaderSizePlus2+4+rng.Intn(100))
+		binary.LittleEndian.PutUint32(pkt[fecHeaderSizePlus2:], uint32(i))
+		pkts := [][]byte{pkt}
+		for _, p := range enc.encode(pkt) {
+			pkts = append(pkts, append([]byte(nil), p...))
+		}
+		if g := fecPacket(pkt).geometry(); g != geometry {
+			if fecPacket(pkt).seqid()%fecMaxShards != 0 {
+				t.Fatal("geometry change isn't aligned")
+			}
+			geometry = g
+		}
+		for _, p := range pkts {
+			if rng.Float64() < loss {
+				continue
+			}
+			f := fecPacket(p)
+			if !f.adaptive() {
+				t.Fatal("adaptive packet without a geometry")
+			}
+			meter.observe(f)
+			if f.isData() {
+				delivered[binary.LittleEndian.Uint32(f[fecHeaderSizePlus2:])] = true
+			}
+			for _, r := range dec.decode(f) {
+				delivered[binary.LittleEndian.Uint32(r[2:])] = true
+			}
+		}
+		if l, _, ok := meter.report(); ok && i%100 == 99 {
+			measured = append(measured, l)
+		}
+	}
+	if frac := float64(len(delivered)) / count; frac < 0.985 {
+		t.Errorf("only %.2f%% delivered at %v%% loss", frac*100, loss*100)
+	}
+	if dec.wasted == 0 {
+		t.Error("no parity counted as wasted")
+	}
+	var avg float64
+	for _, l := range measured {
+		avg += l / float64(len(measured))
+	}
+	if math.Abs(avg-loss) > 0.01 {
+		t.Errorf("measured %.3f loss instead of %v", avg, loss)
+	}
+}
+
+func TestAdaptiveFECOff(t *testing.T) {
+	enc := newFECEncoder(10, 3, 0)
+	enc.setGeometry(0)
+	for i := 0; i < 100; i++ {
+		pkt := make([]byte, fecHeaderSizePlus2+20)
+		if ps := enc.encode(pkt); len(ps) != 0 {
+			t.Fatal("parity sent with FEC off")
+		}
+		if f := fecPacket(pkt); !f.isData() || f.seqid() != uint32(i) {
+			t.Fatal("bad data packet with FEC off")
+		}
+	}
+}
+
+func TestChooseFECGeometry(t *testing.T) {
+	for _, c := range []struct {
+		loss, burst float64
+		rtt         int32
+		pps         float64
+		data, par   int
+	}{
+		{0.001, 1, 100, 2000, 0, 0},
+		{0.02, 1, 100, 2000, 28, 4},
+		{0.02, 1, 100, 100, 6, 2},
+		{0.05, 1, 100, 700, 12, 4},
+		{0.05, 4, 100, 700, 8, 8},
+		{0.3, 3, 100, 2000, 16, 16},
+	} {
+		g := fecGeometries[chooseFECGeometry(c.loss, c.burst, c.rtt, c.pps)]
+		if g[0] != c.data || g[1] != c.par {
+			t.Errorf("%v loss, %v burst, %vms, %vpps: got %v/%v, want %v/%v",
+				c.loss, c.burst, c.rtt, c.pps, g[0], g[1], c.data, c.par)
+		}
+	}
+}
+
+func TestFECHello(t *testing.T) {
+	enc := newFECEncoder(10, 3, 0)
+	for i := 0; i < 10; i++ {
+		enc.encode(make([]byte, fecHeaderSizePlus2+20))
+	}
+	hello := fecPacket(enc.hello(make([]byte, mtuLimit)))
+	if !isFECHello(hello) || hello.seqid() != 13 || enc.next != 26 {
+		t.Fatal("bad hello")
+	}
+	// peers without adaptive FEC just hold on to it
+	dec := newFECDecoder(rxFECMulti*13, 10, 3)
+	if recovered := dec.decode(hello); len(recovered) != 0 {
+		t.Fatal("hello recovered something")
+	}
+	loss, burst, ok := parseFECReport(fecReport(make([]byte, mtuLimit), 0.123, 2.5))
+	if !ok || loss != 0.123 || burst != 2.5 {
+		t.Fatal("bad report", loss, burst)
+	}
+}
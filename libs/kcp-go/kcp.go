@@ -41,6 +41,7 @@ const (
 
 var QuiescentMax = 20
 
+// CongestionControl is the algorithm new sessions start with. See NewCongestionController.
 var CongestionControl = "BIC"
 
 var doLogging = false
@@ -53,7 +54,7 @@ func init() {
 var refTime time.Time = time.Now()
 
 // currentMs returns current elasped monotonic milliseconds since program startup
-func currentMs() uint32 { return uint32(time.Now().Sub(refTime) / time.Millisecond) }
+func currentMs() uint32 { return uint32(timeNow().Sub(refTime) / time.Millisecond) }
 
 // output_callback is a prototype which ought capture conn and call conn.Write
 type output_callback func(buf []byte, size int)
@@ -144,11 +145,16 @@ func (seg *segment) encode(ptr []byte) []byte {
 	ptr = ikcp_encode32u(ptr, seg.sn)
 	ptr = ikcp_encode32u(ptr, seg.una)
 	ptr = ikcp_encode32u(ptr, uint32(len(seg.data)))
-	atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
-
 	return ptr
 }
 
+// encodeSegment encodes a segment header and counts it as sent
+func (kcp *KCP) encodeSegment(seg *segment, ptr []byte) []byte {
+	atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
+	atomic.AddUint64(&kcp.snmp.OutSegs, 1)
+	return seg.encode(ptr)
+}
+
 const maxSpeed = 1000 * 1000 * 1000
 
 type rateLimiter struct {
@@ -176,7 +182,7 @@ func (rl *rateLimiter) Allow(speed float64, events int) bool {
 	defer rl.lock.Unlock()
 	rl.fixLimiter(speed)
 	evts := int(float64(events) * (float64(maxSpeed) / speed))
-	return rl.limiter.AllowN(time.Now(), evts)
+	return rl.limiter.AllowN(timeNow(), evts)
 }
 
 // KCP defines a single KCP connection
@@ -194,12 +200,12 @@ type KCP struct {
 
 	isDead bool
 
-	wmax     float64
-	lastLoss time.Time
-	retrans  uint64
-	trans    uint64
+	retrans uint64
+	trans   uint64
 
-	pacer rateLimiter
+	cc CongestionController
+
+	snmp *Snmp // this connection's share of DefaultSnmp
 
 	DRE struct {
 		delivered    float64
@@ -213,6 +219,8 @@ type KCP struct {
 		minRtt       float64
 		minRttTime   time.Time
 
+		highAcked uint32 // highest sequence number acknowledged so far
+
 		runDataAcked   float64
 		runElapsedTime float64
 
@@ -226,25 +234,11 @@ type KCP struct {
 		policeTime      time.Time
 	}
 
-	LOL struct {
-		filledPipe    bool
-		fullBwCount   int
-		fullBw        float64
-		lastFillTime  time.Time
-		gain          float64
-		slack         float64
-		lossRate      float64
-		bdpMultiplier float64
-
-		devi float64
-	}
-
-	VGS struct {
-	}
-
 	fastresend     int32
 	nocwnd, stream int32
 
+	sacked int // segments in snd_buf that were acknowledged out of order
+
 	snd_queue []segment
 	rcv_queue []segment
 	snd_buf   []segment
@@ -287,17 +281,17 @@ func NewKCP(conv uint32, output output_callback) *KCP {
 	kcp.ts_flush = IKCP_INTERVAL
 	kcp.ssthresh = IKCP_THRESH_INIT
 	kcp.output = output
-	kcp.wmax = 1 << 30
 	kcp.DRE.ppDelTime = make(map[uint32]time.Time)
 	kcp.DRE.ppDelivered = make(map[uint32]float64)
 	kcp.DRE.ppAppLimited = make(map[uint32]bool)
-	kcp.LOL.gain = 1
-	kcp.LOL.bdpMultiplier = 1.5
 	kcp.quiescent = QuiescentMax
 	kcp.fecRate = 0
-	if CongestionControl == "BBR" {
-		//kcp.bbrOnConnectionInit()
+	kcp.snmp = newSnmp()
+	cc, err := NewCongestionController(CongestionControl)
+	if err != nil {
+		cc = newBIC()
 	}
+	kcp.cc = cc
 	return kcp
 }
 
@@ -497,10 +491,11 @@ func (kcp *KCP) bdp() float64 {
 }
 
 func (kcp *KCP) update_ack(rtt int32) {
-	if float64(rtt) < kcp.DRE.minRtt || time.Since(kcp.DRE.minRttTime).Seconds() > 10 {
+	if float64(rtt) < kcp.DRE.minRtt || timeNow().Sub(kcp.DRE.minRttTime).Seconds() > 10 {
 		kcp.DRE.minRtt = float64(rtt)
-		kcp.DRE.minRttTime = time.Now()
+		kcp.DRE.minRttTime = timeNow()
 	}
+	kcp.cc.OnRTTSample(kcp, rtt)
 	// update CWND
 	// https://tools.ietf.org/html/rfc6298
 	var rto uint32
@@ -540,7 +535,7 @@ func (kcp *KCP) shrink_buf() {
 }
 
 func (kcp *KCP) processAck(seg *segment) {
-	kcp.DRE.delTime = time.Now()
+	kcp.DRE.delTime = timeNow()
 	pDelivered, ok := kcp.DRE.ppDelivered[seg.sn]
 	if !ok {
 		return
@@ -575,7 +570,15 @@ func (kcp *KCP) parse_ack(sn uint32) {
 			// and wait until `una` to delete this, then we don't
 			// have to shift the segments behind forward,
 			// which is an expensive operation for large window
+			if seg.acked == 1 {
+				// a duplicate ack
+				break
+			}
 			seg.acked = 1
+			kcp.sacked++
+			if _itimediff(sn, kcp.DRE.highAcked) > 0 {
+				kcp.DRE.highAcked = sn
+			}
 			kcp.processAck(seg)
 			kcp.delSegment(seg)
 			break
@@ -610,6 +613,11 @@ func (kcp *KCP) parse_una(una uint32) {
 	for k := range kcp.snd_buf {
 		seg := &kcp.snd_buf[k]
 		if _itimediff(una, seg.sn) > 0 {
+			if seg.acked == 1 {
+				kcp.sacked--
+			} else if _itimediff(seg.sn, kcp.DRE.highAcked) > 0 {
+				kcp.DRE.highAcked = seg.sn
+			}
 			kcp.processAck(seg)
 			kcp.delSegment(seg)
 			count++
@@ -694,6 +702,7 @@ func (kcp *KCP) parse_data(newseg segment) bool {
 func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 	kcp.quiescent = QuiescentMax
 	snd_una := kcp.snd_una
+	delivered := kcp.DRE.delivered
 	if len(data) < IKCP_OVERHEAD {
 		return -1
 	}
@@ -765,6 +774,7 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 			}
 			if regular && repeat {
 				atomic.AddUint64(&DefaultSnmp.RepeatSegs, 1)
+				atomic.AddUint64(&kcp.snmp.RepeatSegs, 1)
 			}
 		} else if cmd == IKCP_CMD_WASK {
 			// ready to send back IKCP_CMD_WINS in Ikcp_flush
@@ -780,6 +790,7 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 		data = data[length:]
 	}
 	atomic.AddUint64(&DefaultSnmp.InSegs, inSegs)
+	atomic.AddUint64(&kcp.snmp.InSegs, inSegs)
 
 	// update rtt with the latest ts
 	// ignore the FEC packet
@@ -792,69 +803,12 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 
 	// cwnd update when packet arrived
 	if kcp.nocwnd == 0 {
-		if acks := _itimediff(kcp.snd_una, snd_una); acks > 0 {
+		acks := _itimediff(kcp.snd_una, snd_una)
+		if acks > 0 {
 			kcp.trans += uint64(acks)
-			switch CongestionControl {
-			case "BIC":
-				kcp.bic_onack(acks)
-			case "CUBIC":
-				kcp.cubic_onack(acks)
-			case "VGS":
-				kcp.vgs_onack(acks)
-			case "LOL":
-				bdp := kcp.bdp() / float64(kcp.mss)
-				targetCwnd := bdp*kcp.LOL.bdpMultiplier + 64
-				if targetCwnd > kcp.cwnd+float64(acks) {
-					kcp.cwnd += float64(acks)
-				} else {
-					kcp.cwnd = targetCwnd
-				}
-				kcp.cwnd = targetCwnd
-				if kcp.cwnd < 16 {
-					kcp.cwnd = 16
-				}
-
-				if !kcp.LOL.filledPipe {
-					// check for filled pipe
-					if kcp.DRE.avgAckRate > kcp.LOL.fullBw {
-						// still growing
-						kcp.LOL.fullBw = kcp.DRE.avgAckRate
-						kcp.LOL.fullBwCount = 0
-						//log.Println("growing...")
-					} else {
-						kcp.LOL.fullBwCount++
-					}
-					kcp.LOL.gain = 2.89
-					if kcp.LOL.fullBwCount >= 5 {
-						//log.Printf("BW filled at %2.fK", kcp.LOL.fullBw/1000)
-						kcp.LOL.filledPipe = true
-						kcp.LOL.lastFillTime = time.Now()
-						kcp.LOL.gain = 1.0 / 2.89
-					}
-				} else {
-					// vibrate the gain up and down every 50 rtts
-					period := currentMs() / uint32(math.Max(1, kcp.DRE.minRtt))
-					//kcp.LOL.gain = math.Sin(period*(2*math.Pi)/4)*0.25 + 1
-					if period%10 == 0 && kcp.DRE.lastLoss < 0.03 {
-						kcp.LOL.gain = 1.5
-					} else if period%10 == 1 {
-						kcp.LOL.gain = 0.5
-					} else {
-						kcp.LOL.gain = 0.95
-					}
-				}
-
-				if doLogging {
-					log.Printf("[%p] %vK | %vK | cwnd %v/%v | bdp %v | gain %.2f | %v [%v] ms | %.2f%%", kcp,
-						int(kcp.DRE.maxAckRate/1000),
-						int(kcp.DRE.avgAckRate/1000),
-						len(kcp.snd_buf),
-						int(kcp.cwnd), int(bdp), kcp.LOL.gain,
-						kcp.rttProp(),
-						kcp.rx_rttvar,
-						100*float64(kcp.DRE.lastLoss))
-				}
-			}
+		}
+		if acks > 0 || kcp.DRE.delivered > delivered {
+			kcp.cc.OnAck(kcp, acks)
 		}
 	}
 
@@ -864,10 +818,6 @@ func (kcp *KCP) Input(data []byte, regular, ackNoDelay bool) int {
 	return 0
 }
 
-func (kcp *KCP) paceGain() float64 {
-	return kcp.LOL.gain
-}
-
 func (kcp *KCP) wnd_unused() uint16 {
 	if len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
 		return uint16(int(kcp.rcv_wnd) - len(kcp.rcv_queue))
@@ -887,13 +837,13 @@ func (kcp *KCP) updateSample(appLimited bool) {
 		beta := 10 / math.Max(1000, kcp.DRE.avgAckRate/300)
 		kcp.DRE.avgAckRate = (1-beta)*kcp.DRE.avgAckRate + beta*avgRate
 		//avgRate = kcp.DRE.avgAckRate
-		if kcp.DRE.maxAckRate < avgRate || (!appLimited && float64(time.Since(kcp.DRE.maxAckTime).Milliseconds()) > kcp.rttProp()*10) {
+		if kcp.DRE.maxAckRate < avgRate || (!appLimited && float64(timeNow().Sub(kcp.DRE.maxAckTime).Milliseconds()) > kcp.rttProp()*10) {
 			kcp.DRE.maxAckRate = avgRate
 			// if kcp.DRE.maxAckRate < 200*1000 {
 			// 	kcp.DRE.maxAckRate = 200 * 1000
 			// }
 			kcp.DRE.maxAckTime = kcp.DRE.delTime
-			if time.Since(kcp.DRE.policeTime).Seconds() < 20 && kcp.DRE.maxAckRate > kcp.DRE.policeRate {
+			if timeNow().Sub(kcp.DRE.policeTime).Seconds() < 20 && kcp.DRE.maxAckRate > kcp.DRE.policeRate {
 				kcp.DRE.maxAckRate = kcp.DRE.policeRate
 			}
 		}
@@ -909,9 +859,9 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	var busy bool
 	defer func() {
 		if !busy {
-			kcp.LOL.filledPipe = false
-			kcp.LOL.fullBwCount = 0
-			kcp.LOL.fullBw = 0
+			if idl, ok := kcp.cc.(idler); ok {
+				idl.OnIdle(kcp)
+			}
 			kcp.quiescent--
 			if kcp.quiescent <= 0 {
 				kcp.quiescent = 0
@@ -957,7 +907,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 		// filter jitters caused by bufferbloat
 		if ack.sn >= kcp.rcv_nxt || len(kcp.acklist)-1 == i {
 			seg.sn, seg.ts = ack.sn, ack.ts
-			ptr = seg.encode(ptr)
+			ptr = kcp.encodeSegment(&seg, ptr)
 		} else {
 		}
 	}
@@ -998,7 +948,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	if (kcp.probe & IKCP_ASK_SEND) != 0 {
 		seg.cmd = IKCP_CMD_WASK
 		makeSpace(IKCP_OVERHEAD)
-		ptr = seg.encode(ptr)
+		ptr = kcp.encodeSegment(&seg, ptr)
 		busy = true
 	}
 
@@ -1006,7 +956,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	if (kcp.probe & IKCP_ASK_TELL) != 0 {
 		seg.cmd = IKCP_CMD_WINS
 		makeSpace(IKCP_OVERHEAD)
-		ptr = seg.encode(ptr)
+		ptr = kcp.encodeSegment(&seg, ptr)
 		busy = true
 	}
 
@@ -1031,13 +981,8 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 			break
 		}
 		newseg := kcp.snd_queue[k]
-		if CongestionControl == "LOL" {
-			r, x := math.Max(500*1000, kcp.DRE.maxAckRate),
-				int(float64(len(newseg.data))/math.Max(0.5, kcp.LOL.gain))
-			if !kcp.pacer.Allow(r, x) && kcp.DRE.maxAckRate > 500*1000 {
-				break
-			}
-			//kcp.pacer.Limit(r, x)
+		if !kcp.cc.Pace(kcp, len(newseg.data)) {
+			break
 		}
 
 		newseg.conv = kcp.conv
@@ -1140,7 +1085,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 
 			need := IKCP_OVERHEAD + len(segment.data)
 			makeSpace(need)
-			ptr = segment.encode(ptr)
+			ptr = kcp.encodeSegment(segment, ptr)
 			copy(ptr, segment.data)
 			ptr = ptr[len(segment.data):]
 		}
@@ -1158,41 +1103,31 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 	sum := lostSegs
 	if lostSegs > 0 {
 		atomic.AddUint64(&DefaultSnmp.LostSegs, lostSegs)
+		atomic.AddUint64(&kcp.snmp.LostSegs, lostSegs)
 	}
 	if fastRetransSegs > 0 {
 		atomic.AddUint64(&DefaultSnmp.FastRetransSegs, fastRetransSegs)
+		atomic.AddUint64(&kcp.snmp.FastRetransSegs, fastRetransSegs)
 		sum += fastRetransSegs
 	}
 	if earlyRetransSegs > 0 {
 		atomic.AddUint64(&DefaultSnmp.EarlyRetransSegs, earlyRetransSegs)
+		atomic.AddUint64(&kcp.snmp.EarlyRetransSegs, earlyRetransSegs)
 		sum += earlyRetransSegs
 	}
 	if sum > 0 {
 		atomic.AddUint64(&DefaultSnmp.RetransSegs, sum)
+		atomic.AddUint64(&kcp.snmp.RetransSegs, sum)
 		kcp.retrans += sum
 	}
 
 	// cwnd update
 	if kcp.nocwnd == 0 {
-		switch CongestionControl {
-		case "BIC":
-			// congestion control, https://tools.ietf.org/html/rfc5681
-			if sum > 0 {
-				kcp.bic_onloss(lostSn)
-			}
-		case "CUBIC":
-			// congestion control, https://tools.ietf.org/html/rfc5681
-			if sum > 0 {
-				kcp.cubic_onloss(lostSn)
-			}
-		case "LOL":
-			// if sum > 0 {
-			// 	kcp.cwnd = math.Min(kcp.cwnd, kcp.bdp()/float64(kcp.mss))
-			// }
-		case "VGS":
+		if sum > 0 {
+			kcp.cc.OnLoss(kcp, lostSn)
 		}
 		if sum > 0 {
-			now := time.Now()
+			now := timeNow()
 			if now.Sub(kcp.DRE.lastLossTime).Milliseconds() > int64(kcp.DRE.minRtt*10) {
 				deltaR := kcp.retrans - kcp.DRE.lastLossRetrans
 				deltaT := kcp.trans - kcp.DRE.lastLossTrans
@@ -1202,7 +1137,7 @@ func (kcp *KCP) flush(ackOnly bool) uint32 {
 				if doLogging {
 					log.Printf("[%p] Loss-to-loss delivery rate: %vK @ %.2f%%", kcp, int(rate/1000), loss*100)
 				}
-				now := time.Now()
+				now := timeNow()
 				// if loss > 0.1 {
 				// 	kcp.LOL.bdpMultiplier = kcp.LOL.bdpMultiplier*0.7 + 0.3
 				// }
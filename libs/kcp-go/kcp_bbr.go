@@ -0,0 +1,409 @@
+package kcp
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// BBRv2-style model-based congestion control. The model is the bottleneck bandwidth (a windowed max of per-round delivery rates) and the min RTT; the window and pacing rate follow from the BDP, bounded by inflight limits learned from loss and ECN.
+// See https://datatracker.ietf.org/doc/draft-cardwell-iccrg-bbr-congestion-control/
+
+const (
+	bbrStartupGain      = 2.77
+	bbrDrainGain        = 1 / bbrStartupGain
+	bbrCwndGain         = 2.0
+	bbrProbeUpGain      = 1.25
+	bbrProbeDownGain    = 0.9
+	bbrBwRounds         = 10 // rounds covered by the max bandwidth filter
+	bbrFullBwGrowth     = 1.25
+	bbrFullBwRounds     = 3
+	bbrMinRTTInterval   = 5 * time.Second // min RTT older than this triggers ProbeRTT
+	bbrProbeRTTDuration = 200 * time.Millisecond
+	bbrProbeWaitBase    = 2 * time.Second
+	bbrLossThresh       = 0.02 // per-round loss rate, on top of the path's own loss, above which the path is considered overfull
+	bbrQueueFactor      = 1.25 // RTTs below minRtt times this mean no queue has built up
+	bbrMinRoundLosses   = 2    // a single loss in a small round says little about the path
+	bbrStartupLosses    = 8    // losses in a round that end startup
+	bbrECNThresh        = 0.5  // per-round fraction of CE marks above which the path is considered overfull
+	bbrBeta             = 0.7  // multiplicative decrease of the short-term bounds
+	bbrHeadroom         = 0.85 // fraction of inflightHi used while cruising, leaving room for others
+	bbrMinCwnd          = 4
+	bbrMinRate          = 64 * 1000 // bytes per second; below this we don't trust the estimate enough to pace
+)
+
+type bbrMode int
+
+const (
+	bbrStartup bbrMode = iota
+	bbrDrain
+	bbrProbeDown
+	bbrProbeCruise
+	bbrProbeRefill
+	bbrProbeUp
+	bbrProbeRTT
+)
+
+func (m bbrMode) String() string {
+	return [...]string{"Startup", "Drain", "ProbeBW_DOWN", "ProbeBW_CRUISE", "ProbeBW_REFILL", "ProbeBW_UP", "ProbeRTT"}[m]
+}
+
+// bbrController implements BBRv2-style congestion control.
+type bbrController struct {
+	mode bbrMode
+	cwnd float64 // in segments actually in flight, not counting selectively acked ones
+
+	lastDelivered float64
+
+	// round-trip counting: a round ends when everything sent at its start is acknowledged
+	round           int
+	roundEndSn      uint32
+	roundStart      time.Time
+	roundDelivered  float64
+	roundInflight   float64
+	roundAppLimited bool
+	roundAcked      int32
+	roundLost       int32
+	roundMarked     int32
+	roundECNAcked   int32
+	roundMaxRtt     float64
+
+	// pathLoss is the loss rate seen without a queue, i.e. loss that isn't caused by us
+	pathLoss float64
+
+	// bandwidth filter, in bytes per second
+	bwSamples [bbrBwRounds]float64
+	maxBw     float64
+	latestBw  float64
+
+	// min RTT filter, in milliseconds
+	minRtt      float64
+	minRttStamp time.Time
+	probeMinRtt float64
+
+	// startup
+	filledPipe  bool
+	fullBw      float64
+	fullBwCount int
+
+	// inflight bounds, in segments, and the short-term bandwidth bound
+	inflightHi float64
+	inflightLo float64
+	bwLo       float64
+
+	// ProbeBW and ProbeRTT bookkeeping
+	phaseStart    time.Time
+	phaseRound    int
+	probeWait     time.Duration
+	probeUpGrowth float64
+	probeRTTDone  time.Time
+
+	pacer rateLimiter
+	rng   *rand.Rand
+}
+
+func newBBR() *bbrController {
+	return &bbrController{
+		inflightHi: math.Inf(1),
+		inflightLo: math.Inf(1),
+		bwLo:       math.Inf(1),
+	}
+}
+
+// bw is the bandwidth the model currently allows.
+func (cc *bbrController) bw() float64 {
+	return math.Min(cc.maxBw, cc.bwLo)
+}
+
+// bdp is the estimated bandwidth-delay product, in segments.
+func (cc *bbrController) bdp(kcp *KCP) float64 {
+	if cc.maxBw == 0 || cc.minRtt == 0 {
+		return 32
+	}
+	return cc.bw() * cc.minRtt / 1000 / float64(kcp.mss)
+}
+
+func (cc *bbrController) pacingGain() float64 {
+	switch cc.mode {
+	case bbrStartup:
+		return bbrStartupGain
+	case bbrDrain:
+		return bbrDrainGain
+	case bbrProbeDown:
+		return bbrProbeDownGain
+	case bbrProbeUp:
+		return bbrProbeUpGain
+	}
+	return 1
+}
+
+func (cc *bbrController) OnRTTSample(kcp *KCP, rtt int32) {
+	r := float64(rtt)
+	cc.roundMaxRtt = math.Max(cc.roundMaxRtt, r)
+	if cc.mode == bbrProbeRTT {
+		if cc.probeMinRtt == 0 || r < cc.probeMinRtt {
+			cc.probeMinRtt = r
+		}
+		return
+	}
+	if cc.minRtt == 0 || r <= cc.minRtt {
+		cc.minRtt = r
+		cc.minRttStamp = timeNow()
+	}
+}
+
+func (cc *bbrController) OnLoss(kcp *KCP, lost []uint32) {
+	cc.roundLost += int32(len(lost))
+}
+
+// OnECN accumulates ECN feedback for the current round.
+func (cc *bbrController) OnECN(kcp *KCP, marked, acked int32) {
+	cc.roundMarked += marked
+	cc.roundECNAcked += acked
+}
+
+func (cc *bbrController) OnAck(kcp *KCP, acks int32) {
+	now := timeNow()
+	newly := (kcp.DRE.delivered - cc.lastDelivered) / float64(kcp.mss)
+	cc.lastDelivered = kcp.DRE.delivered
+	cc.roundAcked += int32(math.Ceil(newly))
+	if len(kcp.snd_queue) == 0 && float64(kcp.Inflight()) < cc.cwnd {
+		cc.roundAppLimited = true
+	}
+	if cc.roundStart.IsZero() {
+		cc.startRound(kcp, now)
+	} else if _itimediff(kcp.DRE.highAcked, cc.roundEndSn) >= 0 {
+		// something sent after the round started got acked
+		cc.endRound(kcp, now)
+		cc.startRound(kcp, now)
+	}
+	cc.updateMode(kcp, now)
+	cc.setCwnd(kcp, newly)
+
+	if doLogging {
+		log.Printf("[%p] BBR %v | bw %vK [lo %vK] | minrtt %v | cwnd %v/%v | hi %.0f lo %.0f", kcp,
+			cc.mode, int(cc.maxBw/1000), int(math.Min(cc.bwLo, 1e12)/1000), cc.minRtt,
+			kcp.Inflight(), int(cc.cwnd), cc.inflightHi, cc.inflightLo)
+	}
+}
+
+func (cc *bbrController) startRound(kcp *KCP, now time.Time) {
+	cc.round++
+	cc.roundEndSn = kcp.snd_nxt
+	cc.roundStart = now
+	cc.roundDelivered = kcp.DRE.delivered
+	cc.roundInflight = float64(kcp.Inflight())
+	cc.roundAppLimited = false
+	cc.roundAcked = 0
+	cc.roundLost = 0
+	cc.roundMarked = 0
+	cc.roundECNAcked = 0
+	cc.roundMaxRtt = 0
+}
+
+func (cc *bbrController) endRound(kcp *KCP, now time.Time) {
+	elapsed := now.Sub(cc.roundStart).Seconds()
+	// rounds much shorter than the RTT happen when little was in flight, and say nothing about the bandwidth
+	if elapsed > 0 && elapsed*1000 >= cc.minRtt/2 {
+		cc.latestBw = (kcp.DRE.delivered - cc.roundDelivered) / elapsed
+		slot := &cc.bwSamples[cc.round%bbrBwRounds]
+		*slot = 0
+		if !cc.roundAppLimited || cc.latestBw > cc.maxBw {
+			*slot = cc.latestBw
+		}
+		cc.maxBw = 0
+		for _, s := range cc.bwSamples {
+			cc.maxBw = math.Max(cc.maxBw, s)
+		}
+	}
+	if total := cc.roundAcked + cc.roundLost; total > 0 && cc.roundMaxRtt <= cc.minRtt*bbrQueueFactor {
+		cc.pathLoss = 0.9*cc.pathLoss + 0.1*float64(cc.roundLost)/float64(total)
+	}
+	cc.checkFullPipe()
+	cc.adaptBounds(kcp)
+}
+
+// checkFullPipe notices when startup stops finding more bandwidth.
+func (cc *bbrController) checkFullPipe() {
+	if cc.filledPipe || cc.roundAppLimited {
+		return
+	}
+	if cc.maxBw >= cc.fullBw*bbrFullBwGrowth {
+		cc.fullBw = cc.maxBw
+		cc.fullBwCount = 0
+		return
+	}
+	cc.fullBwCount++
+	if cc.fullBwCount >= bbrFullBwRounds {
+		cc.filledPipe = true
+	}
+}
+
+// overfull returns whether the last round saw too much loss or too many ECN marks. Only loss clearly above the path's own random loss counts, so that lossy links don't make us collapse.
+func (cc *bbrController) overfull() bool {
+	minLosses := int32(bbrMinRoundLosses)
+	if cc.mode == bbrStartup {
+		minLosses = bbrStartupLosses
+	}
+	if cc.roundLost >= minLosses {
+		total := float64(cc.roundAcked + cc.roundLost)
+		excess := float64(cc.roundLost) - cc.pathLoss*total
+		// random loss alone is binomial; ask for more than two standard deviations of it
+		noise := 2 * math.Sqrt(total*cc.pathLoss*(1-cc.pathLoss))
+		if excess > math.Max(bbrLossThresh*total, noise) {
+			return true
+		}
+	}
+	return cc.roundECNAcked > 0 &&
+		float64(cc.roundMarked)/float64(cc.roundECNAcked) > bbrECNThresh
+}
+
+// adaptBounds reacts to an overfull round: while probing, it caps the long-term inflightHi; otherwise it cuts the short-term bwLo and inflightLo.
+func (cc *bbrController) adaptBounds(kcp *KCP) {
+	if !cc.overfull() {
+		if cc.mode == bbrProbeUp && cc.roundInflight >= cc.inflightHi*bbrHeadroom {
+			// the path took everything we had without complaint, so probe further next round
+			cc.inflightHi += cc.probeUpGrowth
+			cc.probeUpGrowth *= 2
+		}
+		return
+	}
+	switch cc.mode {
+	case bbrStartup, bbrProbeUp, bbrProbeRefill:
+		cc.inflightHi = math.Max(cc.roundInflight, cc.bdp(kcp)*bbrBeta)
+		if cc.mode == bbrStartup {
+			cc.filledPipe = true
+		} else {
+			cc.enterPhase(bbrProbeDown, timeNow())
+		}
+	default:
+		if math.IsInf(cc.bwLo, 1) {
+			cc.bwLo = cc.maxBw
+		}
+		if math.IsInf(cc.inflightLo, 1) {
+			cc.inflightLo = cc.cwnd
+		}
+		cc.bwLo = math.Max(cc.latestBw, cc.bwLo*bbrBeta)
+		cc.inflightLo = math.Max(float64(cc.roundAcked), cc.inflightLo*bbrBeta)
+	}
+}
+
+func (cc *bbrController) enterPhase(mode bbrMode, now time.Time) {
+	cc.mode = mode
+	cc.phaseStart = now
+	cc.phaseRound = cc.round
+	switch mode {
+	case bbrProbeDown:
+		// wait a randomized while before probing again, so that flows don't probe in lockstep
+		if cc.rng == nil {
+			cc.rng = rand.New(rand.NewSource(now.UnixNano()))
+		}
+		cc.probeWait = bbrProbeWaitBase + time.Duration(cc.rng.Int63n(int64(time.Second)))
+	case bbrProbeRefill:
+		cc.bwLo = math.Inf(1)
+		cc.inflightLo = math.Inf(1)
+		cc.probeUpGrowth = 1
+	}
+}
+
+func (cc *bbrController) updateMode(kcp *KCP, now time.Time) {
+	inflight := float64(kcp.Inflight())
+	bdp := cc.bdp(kcp)
+
+	if cc.mode != bbrProbeRTT && !cc.minRttStamp.IsZero() && now.Sub(cc.minRttStamp) > bbrMinRTTInterval {
+		cc.mode = bbrProbeRTT
+		cc.probeMinRtt = 0
+		cc.probeRTTDone = time.Time{}
+	}
+
+	switch cc.mode {
+	case bbrStartup:
+		if cc.filledPipe {
+			cc.mode = bbrDrain
+		}
+	case bbrDrain:
+		if inflight <= bdp {
+			cc.enterPhase(bbrProbeDown, now)
+		}
+	case bbrProbeDown:
+		if inflight <= math.Min(bdp, cc.inflightHi*bbrHeadroom) {
+			cc.enterPhase(bbrProbeCruise, now)
+		}
+	case bbrProbeCruise:
+		if now.Sub(cc.phaseStart) >= cc.probeWait {
+			cc.enterPhase(bbrProbeRefill, now)
+		}
+	case bbrProbeRefill:
+		if cc.round > cc.phaseRound {
+			cc.enterPhase(bbrProbeUp, now)
+		}
+	case bbrProbeUp:
+		if cc.round > cc.phaseRound && inflight > bbrProbeUpGain*bdp {
+			cc.enterPhase(bbrProbeDown, now)
+		}
+	case bbrProbeRTT:
+		if cc.probeRTTDone.IsZero() {
+			if inflight <= cc.probeRTTCwnd(kcp) {
+				cc.probeRTTDone = now.Add(bbrProbeRTTDuration)
+				cc.phaseRound = cc.round
+			}
+		} else if now.After(cc.probeRTTDone) && cc.round > cc.phaseRound {
+			if cc.probeMinRtt > 0 {
+				cc.minRtt = cc.probeMinRtt
+			}
+			cc.minRttStamp = now
+			if cc.filledPipe {
+				cc.enterPhase(bbrProbeCruise, now)
+			} else {
+				cc.mode = bbrStartup
+			}
+		}
+	}
+}
+
+func (cc *bbrController) probeRTTCwnd(kcp *KCP) float64 {
+	return math.Max(bbrMinCwnd, cc.bdp(kcp)/2)
+}
+
+// setCwnd updates the window from the model. KCP's window covers everything from the first unacknowledged segment, so holes left by selective acks are added on top.
+func (cc *bbrController) setCwnd(kcp *KCP, newly float64) {
+	target := bbrCwndGain * cc.bdp(kcp)
+	if cc.filledPipe {
+		cc.cwnd = math.Min(cc.cwnd+newly, target)
+	} else if cc.cwnd < target || cc.maxBw == 0 {
+		cc.cwnd += newly
+	}
+
+	switch cc.mode {
+	case bbrProbeCruise, bbrProbeDown, bbrProbeRTT:
+		cc.cwnd = math.Min(cc.cwnd, cc.inflightHi*bbrHeadroom)
+	default:
+		cc.cwnd = math.Min(cc.cwnd, cc.inflightHi)
+	}
+	cc.cwnd = math.Min(cc.cwnd, cc.inflightLo)
+	if cc.mode == bbrProbeRTT {
+		cc.cwnd = math.Min(cc.cwnd, cc.probeRTTCwnd(kcp))
+	}
+	if cc.cwnd < bbrMinCwnd {
+		cc.cwnd = bbrMinCwnd
+	}
+	kcp.cwnd = cc.cwnd + float64(kcp.sacked)
+}
+
+func (cc *bbrController) Pace(kcp *KCP, size int) bool {
+	rate := cc.PacingRate(kcp)
+	if rate == 0 {
+		return true
+	}
+	return cc.pacer.Allow(rate, size)
+}
+
+// PacingRate is the pacing gain times the bandwidth estimate, unless that's too low to bother.
+func (cc *bbrController) PacingRate(kcp *KCP) float64 {
+	rate := cc.pacingGain() * cc.bw()
+	if cc.maxBw == 0 || rate < bbrMinRate {
+		return 0
+	}
+	return rate
+}
@@ -8,17 +8,38 @@ import (
 
 const bicMultiplier = 1
 
-func (kcp *KCP) cubic_onloss(lost []uint32) {
-	kcp.wmax = kcp.cwnd
+// bicController implements TCP BIC.
+type bicController struct {
+	wmax float64
+}
+
+func newBIC() *bicController {
+	return &bicController{wmax: 1 << 30}
+}
+
+// cubicController implements TCP CUBIC.
+type cubicController struct {
+	wmax     float64
+	lastLoss time.Time
+}
+
+func newCUBIC() *cubicController {
+	return &cubicController{wmax: 1 << 30}
+}
+
+func (cc *cubicController) OnLoss(kcp *KCP, lost []uint32) {
+	cc.wmax = kcp.cwnd
 	kcp.cwnd *= (2 - cubicB) / 2
-	kcp.lastLoss = time.Now()
+	cc.lastLoss = timeNow()
 	if kcp.cwnd < 32 {
 		kcp.cwnd = 32
 	}
-	log.Println("wmax at", int(kcp.cwnd))
+	if doLogging {
+		log.Println("wmax at", int(kcp.cwnd))
+	}
 }
 
-func (kcp *KCP) bic_onloss(lost []uint32) {
+func (cc *bicController) OnLoss(kcp *KCP, lost []uint32) {
 	maxRun := 1
 	currRun := 0
 	lastSeen := uint32(0)
@@ -38,10 +59,10 @@ func (kcp *KCP) bic_onloss(lost []uint32) {
 	// 	return
 	// }
 	beta := 0.05 / bicMultiplier
-	if kcp.cwnd < kcp.wmax {
-		kcp.wmax = kcp.cwnd * (2.0 - beta) / 2.0
+	if kcp.cwnd < cc.wmax {
+		cc.wmax = kcp.cwnd * (2.0 - beta) / 2.0
 	} else {
-		kcp.wmax = kcp.cwnd
+		cc.wmax = kcp.cwnd
 	}
 	kcp.cwnd = kcp.cwnd * (1.0 - beta)
 	mincwnd := kcp.bdp() / float64(kcp.mss)
@@ -58,19 +79,19 @@ const (
 	cubicB = 0.5
 )
 
-func (kcp *KCP) cubic_onack(acks int32) {
+func (cc *cubicController) OnAck(kcp *KCP, acks int32) {
 	if doLogging {
 		log.Printf("CUBIC cwnd=%v // t=%.2f%%", int(kcp.cwnd),
 			100*float64(kcp.retrans)/float64(kcp.trans))
 	}
 	for i := int32(0); i < acks; i++ {
-		t := time.Since(kcp.lastLoss).Seconds()
-		K := math.Pow(kcp.wmax*cubicB/cubicC, 1.0/3.0)
-		kcp.cwnd = math.Min(cubicC*math.Pow(t-K, 3)+kcp.wmax, kcp.cwnd+1)
+		t := timeNow().Sub(cc.lastLoss).Seconds()
+		K := math.Pow(cc.wmax*cubicB/cubicC, 1.0/3.0)
+		kcp.cwnd = math.Min(cubicC*math.Pow(t-K, 3)+cc.wmax, kcp.cwnd+1)
 	}
 }
 
-func (kcp *KCP) bic_onack(acks int32) {
+func (cc *bicController) OnAck(kcp *KCP, acks int32) {
 	if doLogging {
 		log.Printf("BIC cwnd=%v // t=%.2f%%", int(kcp.cwnd),
 			100*float64(kcp.retrans)/float64(kcp.trans))
@@ -79,10 +100,10 @@ func (kcp *KCP) bic_onack(acks int32) {
 	// // TCP BIC
 	for i := 0; i < int(acks*bicMultiplier); i++ {
 		var bicinc float64
-		if kcp.cwnd < kcp.wmax {
-			bicinc = (kcp.wmax - kcp.cwnd) / 2
+		if kcp.cwnd < cc.wmax {
+			bicinc = (cc.wmax - kcp.cwnd) / 2
 		} else {
-			bicinc = kcp.cwnd - kcp.wmax
+			bicinc = kcp.cwnd - cc.wmax
 		}
 		if bicinc <= 1 {
 			bicinc = 1
@@ -101,3 +122,11 @@ func (kcp *KCP) bic_onack(acks int32) {
 	// }
 	// kcp.cwnd += float64(acks) * kcp.aimd_multiplier()
 }
+
+func (cc *bicController) OnRTTSample(kcp *KCP, rtt int32) {}
+
+func (cc *bicController) Pace(kcp *KCP, size int) bool { return true }
+
+func (cc *cubicController) OnRTTSample(kcp *KCP, rtt int32) {}
+
+func (cc *cubicController) Pace(kcp *KCP, size int) bool { return true }
@@ -0,0 +1,98 @@
+package kcp
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+// lolController sizes the window from the estimated BDP and paces at the delivery rate, probing for more bandwidth with a vibrating gain.
+type lolController struct {
+	filledPipe    bool
+	fullBwCount   int
+	fullBw        float64
+	lastFillTime  time.Time
+	gain          float64
+	bdpMultiplier float64
+
+	pacer rateLimiter
+}
+
+func newLOL() *lolController {
+	return &lolController{
+		gain:          1,
+		bdpMultiplier: 1.5,
+	}
+}
+
+func (cc *lolController) OnAck(kcp *KCP, acks int32) {
+	bdp := kcp.bdp() / float64(kcp.mss)
+	targetCwnd := bdp*cc.bdpMultiplier + 64
+	kcp.cwnd = targetCwnd
+	if kcp.cwnd < 16 {
+		kcp.cwnd = 16
+	}
+
+	if !cc.filledPipe {
+		// check for filled pipe
+		if kcp.DRE.avgAckRate > cc.fullBw {
+			// still growing
+			cc.fullBw = kcp.DRE.avgAckRate
+			cc.fullBwCount = 0
+		} else {
+			cc.fullBwCount++
+		}
+		cc.gain = 2.89
+		if cc.fullBwCount >= 5 {
+			cc.filledPipe = true
+			cc.lastFillTime = timeNow()
+			cc.gain = 1.0 / 2.89
+		}
+	} else {
+		// vibrate the gain up and down every 10 rtts
+		period := currentMs() / uint32(math.Max(1, kcp.DRE.minRtt))
+		if period%10 == 0 && kcp.DRE.lastLoss < 0.03 {
+			cc.gain = 1.5
+		} else if period%10 == 1 {
+			cc.gain = 0.5
+		} else {
+			cc.gain = 0.95
+		}
+	}
+
+	if doLogging {
+		log.Printf("[%p] %vK | %vK | cwnd %v/%v | bdp %v | gain %.2f | %v [%v] ms | %.2f%%", kcp,
+			int(kcp.DRE.maxAckRate/1000),
+			int(kcp.DRE.avgAckRate/1000),
+			len(kcp.snd_buf),
+			int(kcp.cwnd), int(bdp), cc.gain,
+			kcp.rttProp(),
+			kcp.rx_rttvar,
+			100*float64(kcp.DRE.lastLoss))
+	}
+}
+
+func (cc *lolController) OnLoss(kcp *KCP, lost []uint32) {}
+
+func (cc *lolController) OnRTTSample(kcp *KCP, rtt int32) {}
+
+func (cc *lolController) Pace(kcp *KCP, size int) bool {
+	r, x := math.Max(500*1000, kcp.DRE.maxAckRate),
+		int(float64(size)/math.Max(0.5, cc.gain))
+	return cc.pacer.Allow(r, x) || kcp.DRE.maxAckRate <= 500*1000
+}
+
+// PacingRate is the delivery rate scaled by the gain, once it's fast enough to pace.
+func (cc *lolController) PacingRate(kcp *KCP) float64 {
+	if kcp.DRE.maxAckRate <= 500*1000 {
+		return 0
+	}
+	return kcp.DRE.maxAckRate * math.Max(0.5, cc.gain)
+}
+
+// OnIdle forgets the filled pipe, so that the next burst starts up again.
+func (cc *lolController) OnIdle(kcp *KCP) {
+	cc.filledPipe = false
+	cc.fullBwCount = 0
+	cc.fullBw = 0
+}
@@ -4,7 +4,10 @@ import "log"
 
 const multiplier = 16
 
-func (kcp *KCP) vgs_onack(acks int32) {
+// vgsController is a Vegas-like delay-based controller.
+type vgsController struct{}
+
+func (cc *vgsController) OnAck(kcp *KCP, acks int32) {
 	factor := float64(kcp.mss) / (float64(kcp.DRE.minRtt) / 1000)
 	expected := kcp.cwnd * factor
 	actual := kcp.DRE.maxAckRate
@@ -25,3 +28,9 @@ func (kcp *KCP) vgs_onack(acks int32) {
 		kcp.cwnd = 4
 	}
 }
+
+func (cc *vgsController) OnLoss(kcp *KCP, lost []uint32) {}
+
+func (cc *vgsController) OnRTTSample(kcp *KCP, rtt int32) {}
+
+func (cc *vgsController) Pace(kcp *KCP, size int) bool { return true }
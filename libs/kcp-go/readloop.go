@@ -16,6 +16,7 @@ func (s *UDPSession) defaultReadLoop() {
 				src = addr.String()
 			} else if addr.String() != src {
 				atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+				atomic.AddUint64(&s.kcp.snmp.InErrs, 1)
 				continue
 			}
 
@@ -23,6 +24,7 @@ func (s *UDPSession) defaultReadLoop() {
 				s.packetInput(buf[:n])
 			} else {
 				atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+				atomic.AddUint64(&s.kcp.snmp.InErrs, 1)
 			}
 		} else {
 			s.notifyReadError(errors.WithStack(err))
@@ -36,11 +36,13 @@ func (s *UDPSession) readLoop() {
 					src = msg.Addr.String()
 				} else if msg.Addr.String() != src {
 					atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+					atomic.AddUint64(&s.kcp.snmp.InErrs, 1)
 					continue
 				}
 
 				if msg.N < s.headerSize()+IKCP_OVERHEAD {
 					atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+					atomic.AddUint64(&s.kcp.snmp.InErrs, 1)
 					continue
 				}
 
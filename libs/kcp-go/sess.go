@@ -12,6 +12,7 @@ import (
 	"encoding/binary"
 	"io"
 	"log"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -48,6 +49,9 @@ var (
 )
 
 var (
+	// all open sessions, for AllStats
+	openSessions sync.Map
+
 	// a system-wide packet buffer shared among sending, receiving and FEC
 	// to mitigate high-frequency memory allocation for packets
 	xmitBuf sync.Pool
@@ -82,6 +86,7 @@ type (
 		// FEC codec
 		fecDecoder *fecDecoder
 		fecEncoder *fecEncoder
+		afec       adaptiveFEC
 
 		// settings
 		remote     net.Addr  // remote peer address
@@ -176,8 +181,13 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 	sess.lossReporter, _ = conn.(LossReporter)
 
 	// FEC codec initialization
-	sess.fecDecoder = newFECDecoder(rxFECMulti*(dataShards+parityShards), dataShards, parityShards)
+	rxShards := dataShards + parityShards
+	if AdaptiveFEC && rxShards < fecMaxShards {
+		rxShards = fecMaxShards
+	}
+	sess.fecDecoder = newFECDecoder(rxFECMulti*rxShards, dataShards, parityShards)
 	sess.fecEncoder = newFECEncoder(dataShards, parityShards, 0)
+	sess.afec.enabled = AdaptiveFEC && sess.fecEncoder != nil && sess.fecDecoder != nil
 
 	sess.kcp = NewKCP(conv, func(buf []byte, size int) {
 		if size >= IKCP_OVERHEAD+sess.headerSize() {
@@ -197,6 +207,7 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 		atomic.AddUint64(&DefaultSnmp.PassiveOpens, 1)
 	}
 
+	openSessions.Store(sess, struct{}{})
 	currestab := atomic.AddUint64(&DefaultSnmp.CurrEstab, 1)
 	maxconn := atomic.LoadUint64(&DefaultSnmp.MaxConn)
 	if currestab > maxconn {
@@ -206,6 +217,39 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 	return sess
 }
 
+// Stats returns a snapshot of the session's counters and link state.
+func (s *UDPSession) Stats() (stats SessionStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats.Snmp = *s.kcp.snmp.Copy()
+	stats.RemoteAddr = s.remote.String()
+	stats.SRTT = s.kcp.rx_srtt
+	stats.RTTVar = s.kcp.rx_rttvar
+	stats.MinRTT = s.kcp.MinRTT()
+	stats.RTO = s.kcp.rx_rto
+	stats.Cwnd = s.kcp.Cwnd()
+	stats.Inflight = s.kcp.Inflight()
+	stats.WaitSnd = s.kcp.WaitSnd()
+	stats.DeliveryRate = s.kcp.DeliveryRate()
+	if pr, ok := s.kcp.cc.(PacingRater); ok {
+		stats.PacingRate = pr.PacingRate(s.kcp)
+	}
+	if total := s.kcp.retrans + s.kcp.trans; total > 0 {
+		stats.Loss = float64(s.kcp.retrans) / float64(total)
+	}
+	stats.FEC = s.fecStats()
+	return
+}
+
+// AllStats returns snapshots of all open sessions.
+func AllStats() (all []SessionStats) {
+	openSessions.Range(func(k, _ interface{}) bool {
+		all = append(all, k.(*UDPSession).Stats())
+		return true
+	})
+	return
+}
+
 // FlowStats summarizes flow statistics
 func (s *UDPSession) FlowStats() (btlBw float64, latency float64, lossFrac float64) {
 	return s.kcp.DRE.maxAckRate, s.kcp.DRE.minRtt, float64(s.kcp.retrans) / float64(s.kcp.trans)
@@ -220,6 +264,7 @@ func (s *UDPSession) Read(b []byte) (n int, err error) {
 			s.bufptr = s.bufptr[n:]
 			s.mu.Unlock()
 			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			atomic.AddUint64(&s.kcp.snmp.BytesReceived, uint64(n))
 			return n, nil
 		}
 		if s.kcp.isDead {
@@ -234,6 +279,7 @@ func (s *UDPSession) Read(b []byte) (n int, err error) {
 				s.kcp.Recv(b)
 				s.mu.Unlock()
 				atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(size))
+				atomic.AddUint64(&s.kcp.snmp.BytesReceived, uint64(size))
 				return size, nil
 			}
 
@@ -249,6 +295,7 @@ func (s *UDPSession) Read(b []byte) (n int, err error) {
 			s.bufptr = s.recvbuf[n:] // pointer update
 			s.mu.Unlock()
 			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			atomic.AddUint64(&s.kcp.snmp.BytesReceived, uint64(n))
 			return n, nil
 		}
 
@@ -327,6 +374,7 @@ func (s *UDPSession) WriteBuffers(v [][]byte) (n int, err error) {
 			}
 			s.mu.Unlock()
 			atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
+			atomic.AddUint64(&s.kcp.snmp.BytesSent, uint64(n))
 
 			return n, nil
 		}
@@ -380,6 +428,7 @@ func (s *UDPSession) Close() error {
 		// remove from updater
 		s.updater.stop.Kill(io.EOF)
 		atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
+		openSessions.Delete(s)
 
 		if s.l != nil { // belongs to listener
 			s.l.closeSession(s.remote)
@@ -488,6 +537,13 @@ func (s *UDPSession) SetNoDelay(nodelay, interval, resend, nc int) {
 	s.kcp.NoDelay(nodelay, interval, resend, nc)
 }
 
+// SetCongestionController sets the congestion controller of this session. Every session needs its own controller.
+func (s *UDPSession) SetCongestionController(cc CongestionController) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.SetCongestionController(cc)
+}
+
 // SetDSCP sets the 6bit DSCP field in IPv4 header, or 8bit Traffic Class in IPv6 header.
 //
 // if the underlying connection has implemented `func SetDSCP(int) error`, SetDSCP() will invoke
@@ -546,91 +602,13 @@ func (s *UDPSession) SetWriteBuffer(bytes int) error {
 	return errInvalidOperation
 }
 
+// loss2fecfrac returns the fraction of parity shards to send to peers without adaptive FEC:
+// none on clean paths, otherwise twice the loss rounded up to sixteenths.
 func loss2fecfrac(loss float64) float64 {
-	if loss < 0 {
+	if loss < 0.01 {
 		return 0
-	} else if loss < 0.01 {
-		return 0
-	} else if loss < 0.02 {
-		return 0.0625
-	} else if loss < 0.03 {
-		return 0.0625
-	} else if loss < 0.04 {
-		return 0.0625
-	} else if loss < 0.05 {
-		return 0.125
-	} else if loss < 0.06 {
-		return 0.125
-	} else if loss < 0.07 {
-		return 0.125
-	} else if loss < 0.08 {
-		return 0.1875
-	} else if loss < 0.09 {
-		return 0.1875
-	} else if loss < 0.1 {
-		return 0.1875
-	} else if loss < 0.11 {
-		return 0.1875
-	} else if loss < 0.12 {
-		return 0.25
-	} else if loss < 0.13 {
-		return 0.25
-	} else if loss < 0.14 {
-		return 0.25
-	} else if loss < 0.15 {
-		return 0.3125
-	} else if loss < 0.16 {
-		return 0.3125
-	} else if loss < 0.17 {
-		return 0.3125
-	} else if loss < 0.18 {
-		return 0.375
-	} else if loss < 0.19 {
-		return 0.375
-	} else if loss < 0.2 {
-		return 0.375
-	} else if loss < 0.21 {
-		return 0.4375
-	} else if loss < 0.22 {
-		return 0.4375
-	} else if loss < 0.23 {
-		return 0.4375
-	} else if loss < 0.24 {
-		return 0.5
-	} else if loss < 0.25 {
-		return 0.5
-	} else if loss < 0.26 {
-		return 0.5
-	} else if loss < 0.27 {
-		return 0.5625
-	} else if loss < 0.28 {
-		return 0.5625
-	} else if loss < 0.29 {
-		return 0.625
-	} else if loss < 0.3 {
-		return 0.625
-	} else if loss < 0.31 {
-		return 0.6875
-	} else if loss < 0.32 {
-		return 0.6875
-	} else if loss < 0.33 {
-		return 0.6875
-	} else if loss < 0.34 {
-		return 0.75
-	} else if loss < 0.35 {
-		return 0.75
-	} else if loss < 0.36 {
-		return 0.8125
-	} else if loss < 0.37 {
-		return 0.8125
-	} else if loss < 0.38 {
-		return 0.875
-	} else if loss < 0.39 {
-		return 0.875
-	} else if loss < 0.4 {
-		return 0.9375
 	}
-	return 1.0
+	return math.Min(1, math.Ceil(loss*32)/16)
 }
 
 // post-processing for sending a packet from kcp core
@@ -644,6 +622,7 @@ func (s *UDPSession) output(buf []byte) {
 
 	// 1. FEC encoding
 	if s.fecEncoder != nil {
+		s.fecTick()
 		ecc = s.fecEncoder.encode(buf)
 	}
 
@@ -672,6 +651,17 @@ func (s *UDPSession) output(buf []byte) {
 		s.txqueue = append(s.txqueue, msg)
 	}
 
+	if s.fecEncoder != nil && s.fecEncoder.geometry >= 0 {
+		// adaptive geometries are sized for the loss, so all of the parity goes out
+		for k := range ecc {
+			bts := xmitBuf.Get().([]byte)[:len(ecc[k])]
+			copy(bts, ecc[k])
+			s.queueFEC(bts)
+		}
+		atomic.AddUint64(&DefaultSnmp.FECParitySent, uint64(len(ecc)))
+		atomic.AddUint64(&s.kcp.snmp.FECParitySent, uint64(len(ecc)))
+		ecc = nil
+	}
 	fecRate := 0.0
 	if s.lossReporter != nil {
 		//log.Println("LOSS REPORTER", s.lossReporter.UnderlyingLoss(s.remote))
@@ -694,12 +684,17 @@ func (s *UDPSession) output(buf []byte) {
 	if len(s.fecbuffer) > 0 {
 		bts := s.fecbuffer[0]
 		s.fecbuffer = s.fecbuffer[1:]
-		msg.Buffers = [][]byte{bts}
-		msg.Addr = s.remote
-		s.txqueue = append(s.txqueue, msg)
+		s.queueFEC(bts)
+		atomic.AddUint64(&DefaultSnmp.FECParitySent, 1)
+		atomic.AddUint64(&s.kcp.snmp.FECParitySent, 1)
 	}
 }
 
+// queueFEC puts an FEC packet taken from xmitBuf on the txqueue
+func (s *UDPSession) queueFEC(bts []byte) {
+	s.txqueue = append(s.txqueue, ipv4.Message{Buffers: [][]byte{bts}, Addr: s.remote})
+}
+
 // kcp update, returns interval for next calling
 func (s *UDPSession) update() (interval time.Duration) {
 	s.mu.Lock()
@@ -759,19 +754,26 @@ func (s *UDPSession) packetInput(data []byte) {
 
 func (s *UDPSession) kcpInput(data []byte) {
 	defer s.updater.addSessionIfNotExists(s)
-	var kcpInErrors, fecErrs, fecRecovered, fecParityShards uint64
+	var kcpInErrors, fecErrs, fecRecovered, fecParityShards, fecParityWasted, fecShortShards uint64
 	if s.fecDecoder != nil {
 		if len(data) > fecHeaderSize { // must be larger than fec header size
 			f := fecPacket(data)
-			if f.flag() == typeData || f.flag() == typeParity { // header check
-				if f.flag() == typeParity {
+			if s.fecControlInput(f) {
+				// adaptive FEC negotiation
+			} else if f.isData() || f.isParity() { // header check
+				if f.isParity() {
 					fecParityShards++
 				}
 
 				s.mu.Lock()
+				if f.adaptive() {
+					s.fecAdaptiveInput(f)
+				}
 				recovers := s.fecDecoder.decode(f)
+				fecParityWasted, fecShortShards = s.fecDecoder.wasted, s.fecDecoder.short
+				s.fecDecoder.wasted, s.fecDecoder.short = 0, 0
 				waitsnd := s.kcp.WaitSnd()
-				if f.flag() == typeData {
+				if f.isData() {
 					if ret := s.kcp.Input(data[fecHeaderSizePlus2:], true, s.ackNoDelay); ret != 0 {
 						kcpInErrors++
 					}
@@ -829,9 +831,12 @@ func (s *UDPSession) kcpInput(data []byte) {
 	}
 
 	atomic.AddUint64(&DefaultSnmp.InPkts, 1)
+	atomic.AddUint64(&s.kcp.snmp.InPkts, 1)
 	atomic.AddUint64(&DefaultSnmp.InBytes, uint64(len(data)))
+	atomic.AddUint64(&s.kcp.snmp.InBytes, uint64(len(data)))
 	if fecParityShards > 0 {
 		atomic.AddUint64(&DefaultSnmp.FECParityShards, fecParityShards)
+		atomic.AddUint64(&s.kcp.snmp.FECParityShards, fecParityShards)
 	}
 	if kcpInErrors > 0 && s.fecEncoder != nil {
 		log.Println(kcpInErrors, "bad packets, TURNING OFF FEC")
@@ -841,12 +846,23 @@ func (s *UDPSession) kcpInput(data []byte) {
 		s.kcp.ReserveBytes(s.headerSize())
 		s.mu.Unlock()
 		atomic.AddUint64(&DefaultSnmp.KCPInErrors, kcpInErrors)
+		atomic.AddUint64(&s.kcp.snmp.KCPInErrors, kcpInErrors)
 	}
 	if fecErrs > 0 {
 		atomic.AddUint64(&DefaultSnmp.FECErrs, fecErrs)
+		atomic.AddUint64(&s.kcp.snmp.FECErrs, fecErrs)
 	}
 	if fecRecovered > 0 {
 		atomic.AddUint64(&DefaultSnmp.FECRecovered, fecRecovered)
+		atomic.AddUint64(&s.kcp.snmp.FECRecovered, fecRecovered)
+	}
+	if fecParityWasted > 0 {
+		atomic.AddUint64(&DefaultSnmp.FECParityWasted, fecParityWasted)
+		atomic.AddUint64(&s.kcp.snmp.FECParityWasted, fecParityWasted)
+	}
+	if fecShortShards > 0 {
+		atomic.AddUint64(&DefaultSnmp.FECShortShards, fecShortShards)
+		atomic.AddUint64(&s.kcp.snmp.FECShortShards, fecShortShards)
 	}
 
 }
@@ -893,8 +909,7 @@ func (l *Listener) packetInput(data []byte, addr net.Addr) {
 				var conv uint32
 				convValid := false
 				if l.fecDecoder != nil {
-					isfec := binary.LittleEndian.Uint16(data[4:])
-					if isfec == typeData {
+					if fecPacket(data).isData() {
 						conv = binary.LittleEndian.Uint32(data[fecHeaderSizePlus2:])
 						convValid = true
 					}
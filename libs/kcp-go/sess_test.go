@@ -539,6 +539,50 @@ func TestSNMP(t *testing.T) {
 	t.Log(DefaultSnmp.ToSlice())
 }
 
+func TestSessionStats(t *testing.T) {
+	port := int(atomic.AddUint32(&baseport, 1))
+	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.AcceptKCP()
+		if err == nil {
+			handleEcho(s)
+		}
+	}()
+	cli, err := DialWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := echo_tester(cli, 1000, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := cli.Stats()
+	if stats.BytesSent != 100*1000 || stats.BytesReceived != 100*1000 {
+		t.Fatalf("sent %v and received %v bytes", stats.BytesSent, stats.BytesReceived)
+	}
+	if stats.OutSegs == 0 || stats.InPkts == 0 || stats.Cwnd == 0 {
+		t.Fatalf("bad snapshot %+v", stats)
+	}
+	if global := DefaultSnmp.Copy(); global.OutSegs < stats.OutSegs {
+		t.Fatal("session counters aren't aggregated into DefaultSnmp")
+	}
+	found := false
+	for _, s := range AllStats() {
+		if s.RemoteAddr == stats.RemoteAddr {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("open session missing from AllStats")
+	}
+}
+
 func TestListenerClose(t *testing.T) {
 	port := int(atomic.AddUint32(&baseport, 1))
 	l, err := ListenWithOptions(fmt.Sprintf("127.0.0.1:%v", port), nil, 10, 3)
@@ -31,6 +31,8 @@ type Snmp struct {
 	FECErrs          uint64 // incorrect packets recovered from FEC
 	FECParityShards  uint64 // FEC segments received
 	FECShortShards   uint64 // number of data shards that's not enough for recovery
+	FECParitySent    uint64 // FEC parity shards sent
+	FECParityWasted  uint64 // FEC parity shards received but not needed for recovery
 }
 
 func newSnmp() *Snmp {
@@ -64,6 +66,8 @@ func (s *Snmp) Header() []string {
 		"FECErrs",
 		"FECRecovered",
 		"FECShortShards",
+		"FECParitySent",
+		"FECParityWasted",
 	}
 }
 
@@ -109,6 +113,8 @@ func (s *Snmp) ToSlice() []string {
 		fmt.Sprint(snmp.FECErrs),
 		fmt.Sprint(snmp.FECRecovered),
 		fmt.Sprint(snmp.FECShortShards),
+		fmt.Sprint(snmp.FECParitySent),
+		fmt.Sprint(snmp.FECParityWasted),
 	}
 }
 
@@ -139,6 +145,8 @@ func (s *Snmp) Copy() *Snmp {
 	d.FECErrs = atomic.LoadUint64(&s.FECErrs)
 	d.FECRecovered = atomic.LoadUint64(&s.FECRecovered)
 	d.FECShortShards = atomic.LoadUint64(&s.FECShortShards)
+	d.FECParitySent = atomic.LoadUint64(&s.FECParitySent)
+	d.FECParityWasted = atomic.LoadUint64(&s.FECParityWasted)
 	return d
 }
 
@@ -168,6 +176,8 @@ func (s *Snmp) Reset() {
 	atomic.StoreUint64(&s.FECErrs, 0)
 	atomic.StoreUint64(&s.FECRecovered, 0)
 	atomic.StoreUint64(&s.FECShortShards, 0)
+	atomic.StoreUint64(&s.FECParitySent, 0)
+	atomic.StoreUint64(&s.FECParityWasted, 0)
 }
 
 // DefaultSnmp is the global KCP connection statistics collector
@@ -176,3 +186,20 @@ var DefaultSnmp *Snmp
 func init() {
 	DefaultSnmp = newSnmp()
 }
+
+// SessionStats is a snapshot of the counters and link state of one session.
+type SessionStats struct {
+	Snmp                 // the session's share of DefaultSnmp
+	RemoteAddr   string  // address of the peer
+	SRTT         int32   // smoothed RTT in ms
+	RTTVar       int32   // RTT variation in ms
+	MinRTT       float64 // minimum recent RTT in ms
+	RTO          uint32  // retransmission timeout in ms
+	Cwnd         float64 // congestion window in segments
+	Inflight     int     // segments sent but not yet acknowledged
+	WaitSnd      int     // segments waiting to be sent or acknowledged
+	DeliveryRate float64 // estimated delivery rate in bytes per second
+	PacingRate   float64 // pacing rate in bytes per second, zero when not pacing
+	Loss         float64 // fraction of segments that had to be retransmitted
+	FEC          FECStats
+}
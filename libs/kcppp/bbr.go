@@ -0,0 +1,210 @@
+package kcppp
+
+import "time"
+
+const (
+	bbrStartup = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+const (
+	bbrHighGain       = 2.885
+	bbrBwRounds       = 10
+	bbrMinRTTWindow   = 10 * time.Second
+	bbrProbeRTTTime   = 200 * time.Millisecond
+	bbrMinCwnd        = 4 * mtu
+	bbrFullBwGrowth   = 1.25
+	bbrFullBwRounds   = 3
+	bbrCwndExtraMTUs  = 3
+	bbrProbeBWCycleSz = 8
+)
+
+var bbrPacingGains = [bbrProbeBWCycleSz]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// bbr is a BBR (v1) congestion controller. It paces at the estimated bottleneck bandwidth and caps what's in flight at a multiple of the bandwidth-delay product, ignoring random loss.
+type bbr struct {
+	mode int
+
+	bw                 [bbrBwRounds]float64 // max delivery rate of each of the last rounds
+	round              int64
+	nextRoundDelivered int64
+
+	minRTT      time.Duration
+	minRTTStamp time.Time
+
+	fullBw      float64
+	fullBwCount int
+	filledPipe  bool
+
+	cycleIdx   int
+	cycleStamp time.Time
+
+	probeRTTDone time.Time
+	priorCwnd    int
+
+	pacingGain float64
+	cwndGain   float64
+	cwnd       int
+}
+
+func newBBR() *bbr {
+	return &bbr{
+		mode:       bbrStartup,
+		pacingGain: bbrHighGain,
+		cwndGain:   bbrHighGain,
+		cwnd:       initCwnd,
+	}
+}
+
+func (b *bbr) btlBw() (max float64) {
+	for _, v := range b.bw {
+		if v > max {
+			max = v
+		}
+	}
+	return
+}
+
+func (b *bbr) bdp() int {
+	if b.minRTT <= 0 {
+		return initCwnd
+	}
+	bw := b.btlBw()
+	if bw <= 0 {
+		return initCwnd
+	}
+	return int(bw * b.minRTT.Seconds())
+}
+
+func (b *bbr) OnAck(s AckSample) {
+	// count round trips by delivered data
+	if s.PriorDelivered >= b.nextRoundDelivered {
+		b.nextRoundDelivered = s.Delivered
+		b.round++
+		b.bw[b.round%bbrBwRounds] = 0
+		if !b.filledPipe && !s.AppLimited {
+			b.checkFullPipe()
+		}
+	}
+	if s.DeliveryRate > 0 && (!s.AppLimited || s.DeliveryRate > b.btlBw()) {
+		if i := b.round % bbrBwRounds; s.DeliveryRate > b.bw[i] {
+			b.bw[i] = s.DeliveryRate
+		}
+	}
+	expired := !b.minRTTStamp.IsZero() && s.Now.Sub(b.minRTTStamp) > bbrMinRTTWindow
+	if s.RTT > 0 && (b.minRTT == 0 || s.RTT <= b.minRTT || expired) {
+		b.minRTT = s.RTT
+		b.minRTTStamp = s.Now
+		expired = false
+	}
+
+	switch b.mode {
+	case bbrStartup:
+		if b.filledPipe {
+			b.mode = bbrDrain
+			b.pacingGain = 1 / bbrHighGain
+			b.cwndGain = bbrHighGain
+		}
+	case bbrDrain:
+		if s.Inflight <= b.bdp() {
+			b.enterProbeBW(s.Now)
+		}
+	case bbrProbeBW:
+		b.advanceCycle(s)
+	case bbrProbeRTT:
+		if b.probeRTTDone.IsZero() {
+			if s.Inflight <= bbrMinCwnd {
+				b.probeRTTDone = s.Now.Add(bbrProbeRTTTime)
+			}
+		} else if s.Now.After(b.probeRTTDone) {
+			b.minRTTStamp = s.Now
+			b.cwnd = b.priorCwnd
+			if b.filledPipe {
+				b.enterProbeBW(s.Now)
+			} else {
+				b.mode = bbrStartup
+				b.pacingGain = bbrHighGain
+				b.cwndGain = bbrHighGain
+			}
+		}
+	}
+	if expired && b.mode != bbrProbeRTT {
+		b.mode = bbrProbeRTT
+		b.pacingGain = 1
+		b.cwndGain = 1
+		b.priorCwnd = b.cwnd
+		b.probeRTTDone = time.Time{}
+	}
+
+	target := int(b.cwndGain*float64(b.bdp())) + bbrCwndExtraMTUs*mtu
+	if b.filledPipe {
+		b.cwnd += s.Acked
+		if b.cwnd > target {
+			b.cwnd = target
+		}
+	} else if b.cwnd < target || b.btlBw() == 0 {
+		b.cwnd += s.Acked
+	}
+	if b.cwnd < bbrMinCwnd {
+		b.cwnd = bbrMinCwnd
+	}
+}
+
+func (b *bbr) checkFullPipe() {
+	bw := b.btlBw()
+	if bw >= b.fullBw*bbrFullBwGrowth {
+		b.fullBw = bw
+		b.fullBwCount = 0
+		return
+	}
+	b.fullBwCount++
+	if b.fullBwCount >= bbrFullBwRounds {
+		b.filledPipe = true
+	}
+}
+
+func (b *bbr) enterProbeBW(now time.Time) {
+	b.mode = bbrProbeBW
+	b.cwndGain = 2
+	// start anywhere but in the draining phase
+	b.cycleIdx = int(now.UnixNano()%(bbrProbeBWCycleSz-1)) + 2
+	b.cycleIdx %= bbrProbeBWCycleSz
+	b.pacingGain = bbrPacingGains[b.cycleIdx]
+	b.cycleStamp = now
+}
+
+func (b *bbr) advanceCycle(s AckSample) {
+	elapsed := s.Now.Sub(b.cycleStamp) > b.minRTT
+	// the draining phase may end early once the queue it drains is gone
+	if !elapsed && !(b.pacingGain < 1 && s.Inflight <= b.bdp()) {
+		return
+	}
+	b.cycleIdx = (b.cycleIdx + 1) % bbrProbeBWCycleSz
+	b.pacingGain = bbrPacingGains[b.cycleIdx]
+	b.cycleStamp = s.Now
+}
+
+func (b *bbr) OnLoss(s LossSample) {
+	if s.Timeout {
+		// everything in flight is presumed gone; start over from a small window
+		b.priorCwnd = b.cwnd
+		b.cwnd = bbrMinCwnd
+	}
+}
+
+func (b *bbr) Cwnd() int {
+	if b.mode == bbrProbeRTT && b.cwnd > bbrMinCwnd {
+		return bbrMinCwnd
+	}
+	return b.cwnd
+}
+
+func (b *bbr) PacingRate() float64 {
+	bw := b.btlBw()
+	if bw <= 0 {
+		return 0
+	}
+	return b.pacingGain * bw
+}
@@ -0,0 +1,122 @@
+package kcppp
+
+import (
+	"errors"
+	"time"
+)
+
+// CongestionControl decides how much a connection may have in flight and how fast it may send. All methods are called with the connection locked.
+type CongestionControl interface {
+	// OnAck is called whenever an incoming packet acknowledges new data.
+	OnAck(s AckSample)
+	// OnLoss is called whenever in-flight segments are declared lost.
+	OnLoss(s LossSample)
+	// Cwnd returns the congestion window, in bytes.
+	Cwnd() int
+	// PacingRate returns the pacing rate in bytes per second, or zero when not pacing.
+	PacingRate() float64
+}
+
+// AckSample describes what an incoming acknowledgement did.
+type AckSample struct {
+	Now            time.Time
+	Acked          int           // bytes newly acknowledged
+	Inflight       int           // bytes still in flight
+	RTT            time.Duration // latest RTT sample, or zero if the packet carried none
+	SRTT           time.Duration
+	MinRTT         time.Duration
+	Delivered      int64   // bytes delivered over the connection's lifetime
+	PriorDelivered int64   // Delivered when the most recently sent acknowledged segment was sent
+	DeliveryRate   float64 // bytes per second, or zero without a sample
+	AppLimited     bool    // whether the rate sample was limited by the application rather than the network
+}
+
+// LossSample describes a loss event.
+type LossSample struct {
+	Now      time.Time
+	Lost     int       // bytes declared lost
+	Inflight int       // bytes still in flight
+	SentAt   time.Time // when the most recently sent lost segment was sent
+	Timeout  bool      // whether the loss was detected by a retransmission timeout
+}
+
+// ErrUnknownCongestionControl is returned for unknown congestion control algorithms.
+var ErrUnknownCongestionControl = errors.New("unknown congestion control algorithm")
+
+// DefaultCongestionControl is the algorithm new connections start with.
+var DefaultCongestionControl = "BBR"
+
+// NewCongestionControl returns a fresh controller running the named algorithm: BBR or RENO.
+func NewCongestionControl(name string) (CongestionControl, error) {
+	switch name {
+	case "BBR":
+		return newBBR(), nil
+	case "RENO":
+		return newReno(), nil
+	}
+	return nil, ErrUnknownCongestionControl
+}
+
+const initCwnd = 10 * mtu
+
+// reno is classic NewReno: slow start, additive increase and halving once per loss event.
+type reno struct {
+	cwnd          int
+	ssthresh      int
+	acked         int // bytes acked since the last increase in congestion avoidance
+	recoveryStart time.Time
+	srtt          time.Duration
+}
+
+func newReno() *reno {
+	return &reno{
+		cwnd:     initCwnd,
+		ssthresh: 1 << 30,
+	}
+}
+
+func (r *reno) OnAck(s AckSample) {
+	r.srtt = s.SRTT
+	if s.AppLimited {
+		return
+	}
+	if r.cwnd < r.ssthresh {
+		r.cwnd += s.Acked
+		return
+	}
+	r.acked += s.Acked
+	if r.acked >= r.cwnd {
+		r.acked -= r.cwnd
+		r.cwnd += mtu
+	}
+}
+
+func (r *reno) OnLoss(s LossSample) {
+	if !s.Timeout && !s.SentAt.After(r.recoveryStart) {
+		// already reduced for this round trip
+		return
+	}
+	r.ssthresh = r.cwnd / 2
+	if r.ssthresh < 2*mtu {
+		r.ssthresh = 2 * mtu
+	}
+	r.cwnd = r.ssthresh
+	if s.Timeout {
+		r.cwnd = 2 * mtu
+	}
+	r.acked = 0
+	r.recoveryStart = s.Now
+}
+
+func (r *reno) Cwnd() int { return r.cwnd }
+
+func (r *reno) PacingRate() float64 {
+	if r.srtt <= 0 {
+		return 0
+	}
+	gain := 1.2
+	if r.cwnd < r.ssthresh {
+		gain = 2
+	}
+	return gain * float64(r.cwnd) / r.srtt.Seconds()
+}
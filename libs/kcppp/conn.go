@@ -0,0 +1,250 @@
+package kcppp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout   = 10 * time.Second
+	acceptBacklog = 128
+)
+
+// ErrListenerClosed is returned by Accept once the listener is closed.
+var ErrListenerClosed = errors.New("kcppp: listener closed")
+
+// Conn is a KCP++ connection. It implements net.Conn.
+type Conn struct {
+	sess   *session
+	local  net.Addr
+	remote net.Addr
+}
+
+func newConn(convID uint32, pconn net.PacketConn, raddr net.Addr) *Conn {
+	return &Conn{
+		sess: newSession(convID, func(seg segment) {
+			pconn.WriteTo(seg.encode(), raddr)
+		}),
+		local:  pconn.LocalAddr(),
+		remote: raddr,
+	}
+}
+
+// Read reads from the connection. It returns io.EOF once the peer closed its side.
+func (c *Conn) Read(b []byte) (int, error) { return c.sess.read(b) }
+
+// Write writes to the connection.
+func (c *Conn) Write(b []byte) (int, error) { return c.sess.write(b) }
+
+// Close closes the connection. Data already written is still delivered before the peer sees io.EOF.
+func (c *Conn) Close() error { return c.sess.close() }
+
+// LocalAddr returns the local address.
+func (c *Conn) LocalAddr() net.Addr { return c.local }
+
+// RemoteAddr returns the remote address.
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline sets both deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline sets the read deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.sess.lock.Lock()
+	c.sess.rdeadline = t
+	c.sess.lock.Unlock()
+	notify(c.sess.readEvent)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.sess.lock.Lock()
+	c.sess.wdeadline = t
+	c.sess.lock.Unlock()
+	notify(c.sess.writeEvent)
+	return nil
+}
+
+// SetCongestionControl replaces the congestion controller.
+func (c *Conn) SetCongestionControl(cc CongestionControl) {
+	c.sess.lock.Lock()
+	c.sess.cc = cc
+	c.sess.lock.Unlock()
+}
+
+// Dial opens a connection to raddr over conn. The connection takes conn over and closes it once the connection is gone.
+func Dial(conn net.PacketConn, raddr net.Addr) (*Conn, error) {
+	var convID uint32
+	binary.Read(rand.Reader, binary.LittleEndian, &convID)
+	c := newConn(convID, conn, raddr)
+	c.sess.onDead = func() { conn.Close() }
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				c.sess.lock.Lock()
+				c.sess.die(err)
+				c.sess.lock.Unlock()
+				return
+			}
+			if addr.String() != raddr.String() {
+				continue
+			}
+			seg, err := parseSegment(buf[:n])
+			if err != nil {
+				continue
+			}
+			c.sess.segInput(seg)
+		}
+	}()
+	timer := time.NewTimer(dialTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.sess.established:
+		return c, nil
+	case <-c.sess.dead:
+		return nil, c.sess.err()
+	case <-timer.C:
+		c.sess.lock.Lock()
+		c.sess.die(ErrTimeout)
+		c.sess.lock.Unlock()
+		return nil, ErrTimeout
+	}
+}
+
+// err returns why the session died.
+func (sess *session) err() error {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	return sess.deathErr
+}
+
+// Listener accepts KCP++ connections over a net.PacketConn. Connections are told apart by remote address.
+type Listener struct {
+	conn     net.PacketConn
+	lock     sync.Mutex
+	sessions map[string]*Conn
+	accepted chan *Conn
+	dead     chan struct{}
+	once     sync.Once
+}
+
+// Listen starts accepting connections over conn. Closing the listener closes conn.
+func Listen(conn net.PacketConn) *Listener {
+	l := &Listener{
+		conn:     conn,
+		sessions: make(map[string]*Conn),
+		accepted: make(chan *Conn, acceptBacklog),
+		dead:     make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *Listener) readLoop() {
+	defer l.Close()
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if doLogging {
+				log.Println("listener dying:", err)
+			}
+			return
+		}
+		seg, err := parseSegment(buf[:n])
+		if err != nil {
+			continue
+		}
+		h := seg.Header
+		key := addr.String()
+		l.lock.Lock()
+		c := l.sessions[key]
+		if h.Cmd == cmdSYN && (c == nil || c.sess.convID != h.ConvID) {
+			// a new connection, which replaces whatever the address had before
+			if c != nil {
+				go c.sess.reset()
+			}
+			c = l.newConn(h.ConvID, addr, key)
+			l.lock.Unlock()
+			c.sess.segInput(seg)
+			select {
+			case l.accepted <- c:
+			default:
+				c.sess.reset()
+			}
+			continue
+		}
+		l.lock.Unlock()
+		if c == nil || c.sess.convID != h.ConvID {
+			if h.Cmd != cmdRST {
+				rst := segment{Header: segHeader{ConvID: h.ConvID, Cmd: cmdRST}}
+				l.conn.WriteTo(rst.encode(), addr)
+			}
+			continue
+		}
+		c.sess.segInput(seg)
+	}
+}
+
+// newConn registers a new connection. It must be called with the lock held.
+func (l *Listener) newConn(convID uint32, addr net.Addr, key string) *Conn {
+	c := newConn(convID, l.conn, addr)
+	c.sess.onDead = func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if l.sessions[key] == c {
+			delete(l.sessions, key)
+		}
+	}
+	l.sessions[key] = c
+	return c
+}
+
+// Accept waits for the next connection.
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptConn()
+}
+
+// AcceptConn waits for the next connection.
+func (l *Listener) AcceptConn() (*Conn, error) {
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.dead:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Addr returns the listening address.
+func (l *Listener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Close resets every connection and closes the underlying net.PacketConn.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		l.lock.Lock()
+		sessions := l.sessions
+		l.sessions = make(map[string]*Conn)
+		l.lock.Unlock()
+		for _, c := range sessions {
+			c.sess.reset()
+		}
+		err = l.conn.Close()
+		close(l.dead)
+	})
+	return err
+}
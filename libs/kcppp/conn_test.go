@@ -0,0 +1,260 @@
+package kcppp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/kcp-go"
+)
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// memConn is one end of an in-memory lossy link with a fixed one-way delay.
+type memConn struct {
+	addr  memAddr
+	peer  *memConn
+	loss  float64
+	delay time.Duration
+	in    chan memPacket
+	dead  chan struct{}
+	once  sync.Once
+}
+
+func memPipe(loss float64, delay time.Duration) (a, b *memConn) {
+	a = &memConn{addr: "a", loss: loss, delay: delay, in: make(chan memPacket, 4096), dead: make(chan struct{})}
+	b = &memConn{addr: "b", loss: loss, delay: delay, in: make(chan memPacket, 4096), dead: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return
+}
+
+func (mc *memConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-mc.in:
+		return copy(p, pkt.data), pkt.from, nil
+	case <-mc.dead:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+func (mc *memConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if mrand.Float64() < mc.loss {
+		return len(p), nil
+	}
+	pkt := memPacket{append([]byte(nil), p...), mc.addr}
+	time.AfterFunc(mc.delay, func() {
+		select {
+		case mc.peer.in <- pkt:
+		default:
+		}
+	})
+	return len(p), nil
+}
+
+func (mc *memConn) Close() error {
+	mc.once.Do(func() { close(mc.dead) })
+	return nil
+}
+
+func (mc *memConn) LocalAddr() net.Addr                { return mc.addr }
+func (mc *memConn) SetDeadline(t time.Time) error      { return nil }
+func (mc *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (mc *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func dialPair(t testing.TB, loss float64, delay time.Duration) (client, server *Conn, l *Listener) {
+	a, b := memPipe(loss, delay)
+	l = Listen(b)
+	client, err := Dial(a, b.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestTransfer(t *testing.T) {
+	for _, cc := range []string{"BBR", "RENO"} {
+		DefaultCongestionControl = cc
+		client, server, l := dialPair(t, 0.05, 10*time.Millisecond)
+		data := make([]byte, 1<<20)
+		rand.Read(data)
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+		got, err := ioutil.ReadAll(server)
+		if err != nil {
+			t.Fatalf("%v: %v", cc, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%v: got %v bytes, not what was sent", cc, len(got))
+		}
+		server.Close()
+		l.Close()
+	}
+	DefaultCongestionControl = "BBR"
+}
+
+func TestCloseAndReset(t *testing.T) {
+	client, server, l := dialPair(t, 0, time.Millisecond)
+	server.Write([]byte("hello"))
+	server.Close()
+	buf := make([]byte, 10)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("didn't get data before FIN:", n, err)
+	}
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Fatal("expected EOF, got", err)
+	}
+	if _, err := server.Read(buf); err != io.ErrClosedPipe {
+		t.Fatal("expected a closed pipe, got", err)
+	}
+
+	l.Close()
+
+	// closing the listener resets its connections
+	client, _, l = dialPair(t, 0, time.Millisecond)
+	l.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(buf); err != ErrReset {
+		t.Fatal("expected a reset, got", err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	client, _, l := dialPair(t, 0, time.Millisecond)
+	defer l.Close()
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := client.Read(make([]byte, 10))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("expected a timeout, got", err)
+	}
+}
+
+const benchBytes = 4 << 20
+
+func benchTransfer(b *testing.B, client, server net.Conn) {
+	data := make([]byte, 64*1024)
+	buf := make([]byte, 64*1024)
+	b.SetBytes(benchBytes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		go func() {
+			for sent := 0; sent < benchBytes; sent += len(data) {
+				client.Write(data)
+			}
+		}()
+		for got := 0; got < benchBytes; {
+			n, err := server.Read(buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			got += n
+		}
+	}
+}
+
+func benchKCPPP(b *testing.B, loss float64) {
+	client, server, l := dialPair(b, loss, 20*time.Millisecond)
+	defer l.Close()
+	benchTransfer(b, client, server)
+}
+
+func benchKCP(b *testing.B, loss float64) {
+	ca, cb := memPipe(loss, 20*time.Millisecond)
+	l, err := kcp.ServeConn(nil, 0, 0, cb)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	client, err := kcp.NewConn2(cb.addr, nil, 0, 0, ca)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+	tune := func(s *kcp.UDPSession) {
+		s.SetWindowSize(1024, 1024)
+		s.SetNoDelay(0, 20, 32, 0)
+		s.SetStreamMode(true)
+		s.SetMtu(mtu)
+	}
+	tune(client)
+	client.Write([]byte{0})
+	server, err := l.AcceptKCP()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Close()
+	tune(server)
+	server.Read(make([]byte, 1))
+	benchTransfer(b, client, server)
+}
+
+func BenchmarkKCPPP(b *testing.B)      { benchKCPPP(b, 0) }
+func BenchmarkKCPPPLossy(b *testing.B) { benchKCPPP(b, 0.05) }
+func BenchmarkKCP(b *testing.B)        { benchKCP(b, 0) }
+func BenchmarkKCPLossy(b *testing.B)   { benchKCP(b, 0.05) }
+
+func TestHostileSACK(t *testing.T) {
+	sess := newSession(1, func(segment) {})
+	defer func() {
+		sess.lock.Lock()
+		sess.die(io.ErrClosedPipe)
+		sess.lock.Unlock()
+	}()
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	for i := 0; i < 4; i++ {
+		var seg segment
+		seg.Header.Cmd = cmdPUSH
+		seg.Header.Seqno = 100 + uint32(i)
+		seg.Body = []byte("data")
+		sess.inFlight = append(sess.inFlight, annSegment{seg: seg, sentAt: time.Now()})
+		sess.inflightBytes += seg.size()
+	}
+	sess.nextFreeSN = 104
+	sess.remAckSN = 100
+	sack := func(ranges ...sackRange) {
+		sess.ackInput(segment{
+			Header: segHeader{Cmd: cmdSACK, Ackno: 100},
+			Body:   encodeSACK(ranges),
+		}, time.Now())
+	}
+	start := time.Now()
+	// ranges far outside the window must neither spin nor ack anything
+	head := uint32(100)
+	sack(sackRange{Start: head + 100, End: head + 1<<31 - 1}, sackRange{Start: head + 1<<31, End: head - 1})
+	for i := range sess.inFlight {
+		if sess.inFlight[i].acked {
+			t.Fatal("acked a segment outside the ranges")
+		}
+	}
+	// a huge range covering the window only acks what's in flight
+	sack(sackRange{Start: head + 1 - 1<<30, End: head + 1 + 1<<30})
+	if time.Since(start) > time.Second {
+		t.Fatal("hostile SACK ranges took too long")
+	}
+	for i := range sess.inFlight {
+		if sess.inFlight[i].acked != (i > 0) {
+			t.Fatal("wrong segments acked")
+		}
+	}
+}
@@ -1,22 +1,27 @@
 package kcppp
 
+import (
+	"encoding/binary"
+	"errors"
+)
+
 const (
 	cmdPUSH = 81
 	cmdACK  = 82
 	cmdWASK = 83
 	cmdWINS = 84
+	cmdSYN  = 85
+	cmdFIN  = 86
 	cmdSACK = 91
 	cmdRST  = 0
 )
 
-type inlineBytes struct {
-	len int
-	raw [2048]byte
-}
+const headerSize = 20
 
-func (ib *inlineBytes) slice() []byte {
-	return ib.raw[:ib.len]
-}
+// maxSACKRanges is how many received ranges a SACK carries at most
+const maxSACKRanges = 8
+
+var errBadSegment = errors.New("malformed segment")
 
 type segHeader struct {
 	ConvID    uint32
@@ -30,5 +35,86 @@ type segHeader struct {
 
 type segment struct {
 	Header segHeader
-	Body   inlineBytes
+	Body   []byte
+}
+
+// reliable returns whether the segment occupies a sequence number.
+func (seg *segment) reliable() bool {
+	switch seg.Header.Cmd {
+	case cmdPUSH, cmdSYN, cmdFIN:
+		return true
+	}
+	return false
+}
+
+// size is the size of the segment on the wire.
+func (seg *segment) size() int {
+	return headerSize + len(seg.Body)
+}
+
+// encode writes the segment into a new packet.
+func (seg *segment) encode() []byte {
+	b := make([]byte, seg.size())
+	h := seg.Header
+	binary.LittleEndian.PutUint32(b[0:], h.ConvID)
+	b[4] = h.Cmd
+	b[5] = h.Rsrv
+	binary.LittleEndian.PutUint16(b[6:], h.Window)
+	binary.LittleEndian.PutUint32(b[8:], h.Timestamp)
+	binary.LittleEndian.PutUint32(b[12:], h.Seqno)
+	binary.LittleEndian.PutUint32(b[16:], h.Ackno)
+	copy(b[headerSize:], seg.Body)
+	return b
+}
+
+// parseSegment reads a segment from a packet. The body aliases the packet.
+func parseSegment(b []byte) (seg segment, err error) {
+	if len(b) < headerSize {
+		err = errBadSegment
+		return
+	}
+	h := &seg.Header
+	h.ConvID = binary.LittleEndian.Uint32(b[0:])
+	h.Cmd = b[4]
+	h.Rsrv = b[5]
+	h.Window = binary.LittleEndian.Uint16(b[6:])
+	h.Timestamp = binary.LittleEndian.Uint32(b[8:])
+	h.Seqno = binary.LittleEndian.Uint32(b[12:])
+	h.Ackno = binary.LittleEndian.Uint32(b[16:])
+	seg.Body = b[headerSize:]
+	switch h.Cmd {
+	case cmdPUSH, cmdACK, cmdWASK, cmdWINS, cmdSYN, cmdFIN, cmdRST:
+	case cmdSACK:
+		if len(seg.Body)%8 != 0 || len(seg.Body) > maxSACKRanges*8 {
+			err = errBadSegment
+		}
+	default:
+		err = errBadSegment
+	}
+	return
+}
+
+// sackRange is a range [Start, End) of sequence numbers the receiver has.
+type sackRange struct {
+	Start uint32
+	End   uint32
+}
+
+func encodeSACK(ranges []sackRange) []byte {
+	b := make([]byte, 8*len(ranges))
+	for i, r := range ranges {
+		binary.LittleEndian.PutUint32(b[8*i:], r.Start)
+		binary.LittleEndian.PutUint32(b[8*i+4:], r.End)
+	}
+	return b
+}
+
+func decodeSACK(b []byte) (ranges []sackRange) {
+	for ; len(b) >= 8; b = b[8:] {
+		ranges = append(ranges, sackRange{
+			Start: binary.LittleEndian.Uint32(b),
+			End:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return
 }
@@ -1,14 +1,40 @@
 package kcppp
 
 import (
+	"errors"
+	"io"
 	"log"
 	"os"
 	"sync"
+	"time"
 )
 
 var doLogging = false
 
-const mss = 1300
+const (
+	mtu = 1300             // largest packet we send
+	mss = mtu - headerSize // largest body we send
+
+	rcvWnd     = 1024 // receive window, in segments
+	sndBufSegs = 1024 // segments Write queues before blocking
+
+	initRTO           = time.Second
+	minRTO            = 200 * time.Millisecond
+	maxRTO            = 60 * time.Second
+	minRTTWindow      = 10 * time.Second
+	keepAliveInterval = 10 * time.Second
+	idleTimeout       = 60 * time.Second
+	finTimeout        = 30 * time.Second
+	lingerTime        = 3 * time.Second // how long a closed connection keeps acking the peer's FIN
+	tickInterval      = time.Second
+)
+
+var (
+	// ErrReset is returned when the peer reset the connection.
+	ErrReset = errors.New("kcppp: connection reset by peer")
+	// ErrTimeout is returned when the peer stopped responding.
+	ErrTimeout = errors.New("kcppp: connection timed out")
+)
 
 func init() {
 	doLogging = os.Getenv("KCPLOG") != ""
@@ -16,85 +42,371 @@ func init() {
 
 // session is a KCP++ session.
 type session struct {
-	convID     uint32
-	inFlight   []annSegment
-	nextFreeSN uint32
-	remAckSN   uint32
-	locAckSN   uint32
+	convID uint32
 
-	rtoTimer *resettableTimer
+	// sending side
+	inFlight      []annSegment // reliable segments not yet cumulatively acked, in sequence order
+	nextFreeSN    uint32
+	remAckSN      uint32 // the peer has everything before this
+	remWndEnd     uint32 // the peer accepts everything before this
+	toSend        [][]byte
+	synSent       bool
+	finQueued     bool
+	finSent       bool
+	finAcked      bool
+	numLost       int // segments in inFlight waiting for retransmission
+	inflightBytes int
+	delivered     int64
+	deliveredTime time.Time
+	rackSentAt    time.Time // when the most recently sent acknowledged segment was sent
+	rackRTT       time.Duration
+	nextSend      time.Time
+	nextProbe     time.Time
+	cc            CongestionControl
 
-	isDead bool
+	srtt        time.Duration
+	rttvar      time.Duration
+	rto         time.Duration
+	minRTT      time.Duration
+	minRTTStamp time.Time
 
-	lock sync.Mutex
-	cvar *sync.Cond
+	// receiving side
+	locAckSN uint32 // the next sequence number we expect
+	ooo      map[uint32]segment
+	oooMax   uint32 // one past the highest out-of-order sequence number
+	toRecv   [][]byte
+	advWnd   uint16
+	synRcvd  bool
+	remFin   bool
+
+	lastRecv    time.Time
+	lastSend    time.Time
+	closedAt    time.Time
+	doneAt      time.Time // when both sides' FINs were acknowledged
+	localClosed bool
+	isDead      bool
+	deathErr    error
+	rdeadline   time.Time
+	wdeadline   time.Time
+
+	lock        sync.Mutex
+	readEvent   chan struct{}
+	writeEvent  chan struct{}
+	wake        chan struct{}
+	established chan struct{}
+	dead        chan struct{}
 
-	toSend       []inlineBytes
-	toRecv       []inlineBytes
 	sendCallback func(seg segment)
+	onDead       func()
 }
 
 func newSession(convID uint32, cback func(seg segment)) *session {
+	cc, err := NewCongestionControl(DefaultCongestionControl)
+	if err != nil {
+		cc = newBBR()
+	}
+	now := time.Now()
 	sess := &session{
-		convID:   convID,
-		rtoTimer: newTimer(),
+		convID:    convID,
+		remWndEnd: rcvWnd,
+		cc:        cc,
+		rto:       initRTO,
+		ooo:       make(map[uint32]segment),
+		advWnd:    rcvWnd,
+		lastRecv:  now,
+		lastSend:  now,
+
+		readEvent:   make(chan struct{}, 1),
+		writeEvent:  make(chan struct{}, 1),
+		wake:        make(chan struct{}, 1),
+		established: make(chan struct{}),
+		dead:        make(chan struct{}),
 
 		sendCallback: cback,
 	}
-	sess.cvar = sync.NewCond(&sess.lock)
 	go sess.writeLoop()
 	return sess
 }
 
 // annSegment is an "annotated" segment with state info.
 type annSegment struct {
-	seg          segment
-	acked        bool
-	retransTimes int
+	seg           segment
+	sentAt        time.Time
+	delivered     int64     // session's delivered count when sent
+	deliveredTime time.Time // session's deliveredTime when sent
+	appLimited    bool
+	acked         bool
+	lost          bool
+	retransTimes  int
 }
 
 // writeLoop is the main writing loop of the session.
 func (sess *session) writeLoop() {
-	sess.lock.Lock()
-	defer sess.lock.Unlock()
-	defer func() {
-		sess.isDead = true
-		sess.cvar.Broadcast()
-	}()
-	// maximum send window size
-	maxInflight := 1000
-	for !sess.isDead {
-		// first, wait for space in window
-		for len(sess.inFlight) >= maxInflight {
-			sess.cvar.Wait()
-			if sess.isDead {
-				return
+	timer := time.NewTimer(tickInterval)
+	defer timer.Stop()
+	for {
+		sess.lock.Lock()
+		wait := sess.flush(time.Now())
+		isDead := sess.isDead
+		sess.lock.Unlock()
+		if isDead {
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-sess.wake:
+		case <-sess.dead:
+		}
+	}
+}
+
+// flush sends whatever may be sent now and returns how long until it should be called again.
+func (sess *session) flush(now time.Time) time.Duration {
+	if sess.isDead {
+		return tickInterval
+	}
+	switch {
+	case now.Sub(sess.lastRecv) > idleTimeout:
+		sess.die(ErrTimeout)
+		return tickInterval
+	case !sess.doneAt.IsZero() && now.Sub(sess.doneAt) > lingerTime:
+		sess.die(nil)
+		return tickInterval
+	case sess.localClosed && now.Sub(sess.closedAt) > finTimeout:
+		sess.sendCtl(cmdRST)
+		sess.die(ErrTimeout)
+		return tickInterval
+	}
+	wait := sess.detectLosses(now)
+
+	cwnd := sess.cc.Cwnd()
+	rate := sess.cc.PacingRate()
+	for sess.inflightBytes == 0 || sess.inflightBytes+mtu <= cwnd {
+		if rate > 0 && now.Before(sess.nextSend) {
+			wait = minDuration(wait, sess.nextSend.Sub(now))
+			break
+		}
+		seg := sess.nextSegment()
+		if seg == nil {
+			break
+		}
+		sess.transmit(seg, now)
+		if rate > 0 {
+			// allow catching up on a couple of milliseconds of late wakeups, but no more
+			if earliest := now.Add(-2 * time.Millisecond); sess.nextSend.Before(earliest) {
+				sess.nextSend = earliest
+			}
+			sess.nextSend = sess.nextSend.Add(time.Duration(float64(seg.seg.size()) / rate * float64(time.Second)))
+		}
+	}
+
+	// probe a closed receive window
+	if sess.hasNewData() && !sess.windowOpen() && sess.inflightBytes == 0 {
+		if !now.Before(sess.nextProbe) {
+			sess.sendCtl(cmdWASK)
+			sess.nextProbe = now.Add(sess.rto)
+		}
+		wait = minDuration(wait, sess.nextProbe.Sub(now))
+	}
+	if sess.synRcvd && now.Sub(sess.lastSend) >= keepAliveInterval {
+		sess.sendAck(0)
+	}
+	return wait
+}
+
+// detectLosses marks lost segments for retransmission, RACK-style and by retransmission timeout. It returns how long until it has something new to say.
+func (sess *session) detectLosses(now time.Time) time.Duration {
+	wait := tickInterval
+	reoWnd := sess.minRTT / 4
+	var lost int
+	var lostSentAt, oldest time.Time
+	for i := range sess.inFlight {
+		seg := &sess.inFlight[i]
+		if seg.acked || seg.lost {
+			continue
+		}
+		if seg.sentAt.Before(sess.rackSentAt) {
+			// something sent later got there, so this is reordered or lost
+			deadline := seg.sentAt.Add(sess.rackRTT + reoWnd)
+			if !now.Before(deadline) {
+				lost += seg.seg.size()
+				if seg.sentAt.After(lostSentAt) {
+					lostSentAt = seg.sentAt
+				}
+				sess.markLost(seg)
+				continue
+			}
+			wait = minDuration(wait, deadline.Sub(now))
+		}
+		if oldest.IsZero() || seg.sentAt.Before(oldest) {
+			oldest = seg.sentAt
+		}
+	}
+	if lost > 0 {
+		sess.cc.OnLoss(LossSample{
+			Now:      now,
+			Lost:     lost,
+			Inflight: sess.inflightBytes,
+			SentAt:   lostSentAt,
+		})
+	}
+	if oldest.IsZero() {
+		return wait
+	}
+	if deadline := oldest.Add(sess.rto); now.Before(deadline) {
+		return minDuration(wait, deadline.Sub(now))
+	}
+	// retransmission timeout: everything in flight is presumed lost
+	lost = 0
+	for i := range sess.inFlight {
+		seg := &sess.inFlight[i]
+		if !seg.acked && !seg.lost {
+			lost += seg.seg.size()
+			sess.markLost(seg)
+		}
+	}
+	if doLogging {
+		log.Println(sess.convID, "RTO", sess.rto, "lost", lost, "bytes")
+	}
+	sess.cc.OnLoss(LossSample{
+		Now:     now,
+		Lost:    lost,
+		SentAt:  now,
+		Timeout: true,
+	})
+	sess.rto *= 2
+	if sess.rto > maxRTO {
+		sess.rto = maxRTO
+	}
+	return minDuration(wait, sess.rto)
+}
+
+func (sess *session) markLost(seg *annSegment) {
+	seg.lost = true
+	sess.numLost++
+	sess.inflightBytes -= seg.seg.size()
+}
+
+// nextSegment returns the segment to send next: a lost one, or a new one if the peer's window allows.
+func (sess *session) nextSegment() *annSegment {
+	if sess.numLost > 0 {
+		for i := range sess.inFlight {
+			if seg := &sess.inFlight[i]; seg.lost {
+				seg.retransTimes++
+				return seg
 			}
 		}
-		// send as much stuff as possible
-		for len(sess.inFlight) < maxInflight && len(sess.toSend) > 0 {
-			var seg segment
-			seg.Body = sess.toSend[0]
-			sess.toSend = sess.toSend[1:]
-			seg.Header = segHeader{
-				ConvID:    sess.convID,
-				Cmd:       cmdPUSH,
-				Window:    1000,
-				Timestamp: currentMS(),
-				Seqno:     sess.nextFreeSN,
-				Ackno:     sess.locAckSN,
+	}
+	if !sess.hasNewData() || !sess.windowOpen() {
+		return nil
+	}
+	var seg segment
+	switch {
+	case !sess.synSent:
+		seg.Header.Cmd = cmdSYN
+		sess.synSent = true
+	case len(sess.toSend) > 0:
+		seg.Header.Cmd = cmdPUSH
+		seg.Body = sess.toSend[0]
+		sess.toSend[0] = nil
+		sess.toSend = sess.toSend[1:]
+		notify(sess.writeEvent)
+	default:
+		seg.Header.Cmd = cmdFIN
+		sess.finSent = true
+	}
+	seg.Header.ConvID = sess.convID
+	seg.Header.Seqno = sess.nextFreeSN
+	sess.nextFreeSN++
+	sess.inFlight = append(sess.inFlight, annSegment{seg: seg})
+	if doLogging {
+		log.Println(sess.convID, "sending seqno", seg.Header.Seqno)
+	}
+	return &sess.inFlight[len(sess.inFlight)-1]
+}
+
+func (sess *session) hasNewData() bool {
+	return !sess.synSent || len(sess.toSend) > 0 || (sess.finQueued && !sess.finSent)
+}
+
+func (sess *session) windowOpen() bool {
+	return !sess.synSent || diff32(sess.remWndEnd, sess.nextFreeSN) > 0
+}
+
+// transmit sends a reliable segment for the first time or again.
+func (sess *session) transmit(seg *annSegment, now time.Time) {
+	if seg.lost {
+		seg.lost = false
+		sess.numLost--
+	}
+	if sess.inflightBytes == 0 {
+		// nothing has been delivered while idle
+		sess.deliveredTime = now
+	}
+	seg.sentAt = now
+	seg.delivered = sess.delivered
+	seg.deliveredTime = sess.deliveredTime
+	seg.appLimited = len(sess.toSend) == 0
+	sess.inflightBytes += seg.seg.size()
+	seg.seg.Header.Timestamp = currentMS()
+	sess.send(seg.seg)
+}
+
+// send fills in the acknowledgement fields of a segment and sends it.
+func (sess *session) send(seg segment) {
+	seg.Header.Ackno = sess.locAckSN
+	seg.Header.Window = sess.window()
+	sess.advWnd = seg.Header.Window
+	sess.lastSend = time.Now()
+	sess.sendCallback(seg)
+}
+
+func (sess *session) sendCtl(cmd uint8) {
+	var seg segment
+	seg.Header.ConvID = sess.convID
+	seg.Header.Cmd = cmd
+	seg.Header.Timestamp = currentMS()
+	sess.send(seg)
+}
+
+// sendAck acknowledges what we have, echoing the given timestamp.
+func (sess *session) sendAck(echo uint32) {
+	var seg segment
+	seg.Header.ConvID = sess.convID
+	seg.Header.Cmd = cmdACK
+	seg.Header.Timestamp = echo
+	if len(sess.ooo) > 0 {
+		var ranges []sackRange
+		for sn := sess.locAckSN + 1; diff32(sess.oooMax, sn) > 0 && len(ranges) < maxSACKRanges; sn++ {
+			if _, ok := sess.ooo[sn]; !ok {
+				continue
 			}
-			sess.nextFreeSN++
-			sess.inFlight = append(sess.inFlight, annSegment{
-				seg: seg,
-			})
-			sess.sendCallback(seg)
-			sess.setTimer()
-			if doLogging {
-				log.Println(sess.convID, "sending seqno", seg.Header.Seqno)
+			if k := len(ranges); k > 0 && ranges[k-1].End == sn {
+				ranges[k-1].End++
+			} else {
+				ranges = append(ranges, sackRange{sn, sn + 1})
 			}
 		}
+		seg.Header.Cmd = cmdSACK
+		seg.Body = encodeSACK(ranges)
+	}
+	sess.send(seg)
+}
+
+// window is the receive window we advertise, in segments.
+func (sess *session) window() uint16 {
+	wnd := rcvWnd - len(sess.toRecv) - len(sess.ooo)
+	if wnd < 0 {
+		wnd = 0
 	}
+	return uint16(wnd)
 }
 
 // segInput inputs a packet into the state machine
@@ -108,27 +420,322 @@ func (sess *session) segInput(seg segment) {
 	}
 	sess.lock.Lock()
 	defer sess.lock.Unlock()
+	if sess.isDead {
+		return
+	}
+	now := time.Now()
+	sess.lastRecv = now
 	if seg.Header.Cmd == cmdRST {
-
+		sess.die(ErrReset)
+		return
 	}
+	sess.ackInput(seg, now)
 	switch seg.Header.Cmd {
-	case cmdRST:
-		sess.isDead = true
+	case cmdPUSH, cmdSYN, cmdFIN:
+		sess.receive(seg)
+		sess.sendAck(seg.Header.Timestamp)
+	case cmdWASK:
+		sess.sendCtl(cmdWINS)
+	}
+	if sess.finAcked && sess.remFin && sess.doneAt.IsZero() {
+		sess.doneAt = now
+	}
+	notify(sess.wake)
+}
+
+// ackInput processes the acknowledgement information every segment carries.
+func (sess *session) ackInput(seg segment, now time.Time) {
+	h := seg.Header
+	if diff32(h.Ackno, sess.remAckSN) >= 0 && diff32(h.Ackno, sess.nextFreeSN) <= 0 {
+		sess.remAckSN = h.Ackno
+		sess.remWndEnd = h.Ackno + uint32(h.Window)
+	}
+	if len(sess.inFlight) == 0 {
 		return
-	case cmdACK:
 	}
-	// update UNA
-	if seg.Header.Ackno > sess.remAckSN {
-		sess.remAckSN = seg.Header.Ackno
+	headSN := sess.inFlight[0].seg.Header.Seqno
+	acked := 0
+	var newest *annSegment
+	ack := func(seg *annSegment) {
+		if seg.acked {
+			return
+		}
+		seg.acked = true
+		if seg.lost {
+			seg.lost = false
+			sess.numLost--
+		} else {
+			sess.inflightBytes -= seg.seg.size()
+		}
+		acked += seg.seg.size()
+		if newest == nil || seg.sentAt.After(newest.sentAt) {
+			newest = seg
+		}
+	}
+	for i := 0; i < len(sess.inFlight) && diff32(sess.remAckSN, headSN+uint32(i)) > 0; i++ {
+		ack(&sess.inFlight[i])
+	}
+	if h.Cmd == cmdSACK {
+		tailSN := headSN + uint32(len(sess.inFlight))
+		for _, r := range decodeSACK(seg.Body) {
+			// the peer picks the ranges, so only look at what's in flight
+			start, end := r.Start, r.End
+			if diff32(start, headSN) < 0 {
+				start = headSN
+			}
+			if diff32(end, tailSN) > 0 {
+				end = tailSN
+			}
+			for i := diff32(start, headSN); i < diff32(end, headSN); i++ {
+				ack(&sess.inFlight[i])
+			}
+		}
+	}
+	if newest == nil {
+		return
 	}
-	// mark as acked
-	for _, seg := range sess.inFlight {
-		if diff32(sess.remAckSN, seg.seg.Header.Seqno) > 0 {
-			seg.acked = true
+
+	// sample the RTT from fresh segments, and from the echoed timestamp otherwise
+	var rtt time.Duration
+	if newest.retransTimes == 0 {
+		rtt = now.Sub(newest.sentAt)
+	} else if (h.Cmd == cmdACK || h.Cmd == cmdSACK) && h.Timestamp != 0 {
+		if d := diff32(currentMS(), h.Timestamp); d >= 0 {
+			rtt = time.Duration(d) * time.Millisecond
 		}
 	}
+	if rtt > 0 {
+		sess.updateRTT(rtt, now)
+	}
+	if newest.sentAt.After(sess.rackSentAt) {
+		sess.rackSentAt = newest.sentAt
+		sess.rackRTT = now.Sub(newest.sentAt)
+	}
+
+	sess.delivered += int64(acked)
+	var rate float64
+	if interval := now.Sub(newest.deliveredTime); interval >= time.Millisecond {
+		rate = float64(sess.delivered-newest.delivered) / interval.Seconds()
+	}
+	sample := AckSample{
+		Now:            now,
+		Acked:          acked,
+		RTT:            rtt,
+		SRTT:           sess.srtt,
+		MinRTT:         sess.minRTT,
+		Delivered:      sess.delivered,
+		PriorDelivered: newest.delivered,
+		DeliveryRate:   rate,
+		AppLimited:     newest.appLimited,
+	}
+	sess.deliveredTime = now
+
 	// trim acked
 	for len(sess.inFlight) > 0 && sess.inFlight[0].acked {
+		sess.inFlight[0] = annSegment{}
 		sess.inFlight = sess.inFlight[1:]
 	}
+	if sess.finSent && len(sess.inFlight) == 0 {
+		sess.finAcked = true
+	}
+	sample.Inflight = sess.inflightBytes
+	sess.cc.OnAck(sample)
+}
+
+func (sess *session) updateRTT(rtt time.Duration, now time.Time) {
+	if sess.srtt == 0 {
+		sess.srtt = rtt
+		sess.rttvar = rtt / 2
+	} else {
+		delta := sess.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		sess.rttvar = (3*sess.rttvar + delta) / 4
+		sess.srtt = (7*sess.srtt + rtt) / 8
+	}
+	sess.rto = sess.srtt + 4*sess.rttvar
+	if sess.rto < minRTO {
+		sess.rto = minRTO
+	}
+	if sess.rto > maxRTO {
+		sess.rto = maxRTO
+	}
+	if sess.minRTT == 0 || rtt <= sess.minRTT || now.Sub(sess.minRTTStamp) > minRTTWindow {
+		sess.minRTT = rtt
+		sess.minRTTStamp = now
+	}
+}
+
+// receive puts a reliable segment into the receive buffer.
+func (sess *session) receive(seg segment) {
+	sn := seg.Header.Seqno
+	d := diff32(sn, sess.locAckSN)
+	if d < 0 || d >= rcvWnd {
+		return
+	}
+	seg.Body = append([]byte(nil), seg.Body...)
+	if d > 0 {
+		if _, ok := sess.ooo[sn]; !ok {
+			sess.ooo[sn] = seg
+		}
+		if len(sess.ooo) == 1 || diff32(sn+1, sess.oooMax) > 0 {
+			sess.oooMax = sn + 1
+		}
+		return
+	}
+	for {
+		sess.deliver(seg)
+		sess.locAckSN++
+		var ok bool
+		if seg, ok = sess.ooo[sess.locAckSN]; !ok {
+			return
+		}
+		delete(sess.ooo, sess.locAckSN)
+	}
+}
+
+func (sess *session) deliver(seg segment) {
+	switch seg.Header.Cmd {
+	case cmdSYN:
+		if !sess.synRcvd {
+			sess.synRcvd = true
+			close(sess.established)
+		}
+	case cmdPUSH:
+		if !sess.localClosed && !sess.remFin && len(seg.Body) > 0 {
+			sess.toRecv = append(sess.toRecv, seg.Body)
+			notify(sess.readEvent)
+		}
+	case cmdFIN:
+		sess.remFin = true
+		notify(sess.readEvent)
+	}
+}
+
+// die kills the session. It must be called with the lock held.
+func (sess *session) die(err error) {
+	if sess.isDead {
+		return
+	}
+	if doLogging {
+		log.Println(sess.convID, "dying:", err)
+	}
+	sess.isDead = true
+	sess.deathErr = err
+	close(sess.dead)
+	if sess.onDead != nil {
+		go sess.onDead()
+	}
+}
+
+// reset kills the session and tells the peer.
+func (sess *session) reset() {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if !sess.isDead {
+		sess.sendCtl(cmdRST)
+		sess.die(ErrReset)
+	}
+}
+
+func (sess *session) read(p []byte) (n int, err error) {
+	for {
+		sess.lock.Lock()
+		switch {
+		case sess.localClosed:
+			err = io.ErrClosedPipe
+		case len(sess.toRecv) > 0:
+			for n < len(p) && len(sess.toRecv) > 0 {
+				c := copy(p[n:], sess.toRecv[0])
+				n += c
+				if c == len(sess.toRecv[0]) {
+					sess.toRecv[0] = nil
+					sess.toRecv = sess.toRecv[1:]
+				} else {
+					sess.toRecv[0] = sess.toRecv[0][c:]
+				}
+			}
+			// tell a peer that's waiting for the window to open
+			if !sess.isDead && sess.advWnd < rcvWnd/4 && sess.window() >= rcvWnd/2 {
+				sess.sendCtl(cmdWINS)
+			}
+		case sess.remFin:
+			err = io.EOF
+		case sess.isDead:
+			err = sess.deathErr
+			if err == nil {
+				err = io.EOF
+			}
+		}
+		deadline := sess.rdeadline
+		sess.lock.Unlock()
+		if n > 0 || err != nil {
+			return
+		}
+		if err = waitEvent(sess.readEvent, sess.dead, deadline); err != nil {
+			return
+		}
+	}
+}
+
+func (sess *session) write(p []byte) (n int, err error) {
+	for {
+		sess.lock.Lock()
+		switch {
+		case sess.localClosed:
+			err = io.ErrClosedPipe
+		case sess.isDead:
+			err = sess.deathErr
+			if err == nil {
+				err = io.ErrClosedPipe
+			}
+		}
+		if err != nil {
+			sess.lock.Unlock()
+			return
+		}
+		for n < len(p) && len(sess.toSend) < sndBufSegs {
+			if k := len(sess.toSend); k > 0 && len(sess.toSend[k-1]) < mss {
+				// top up the last chunk
+				c := copy(sess.toSend[k-1][len(sess.toSend[k-1]):mss], p[n:])
+				sess.toSend[k-1] = sess.toSend[k-1][:len(sess.toSend[k-1])+c]
+				n += c
+				continue
+			}
+			chunk := make([]byte, 0, mss)
+			c := copy(chunk[:mss], p[n:])
+			sess.toSend = append(sess.toSend, chunk[:c])
+			n += c
+		}
+		notify(sess.wake)
+		deadline := sess.wdeadline
+		sess.lock.Unlock()
+		if n == len(p) {
+			return
+		}
+		if err = waitEvent(sess.writeEvent, sess.dead, deadline); err != nil {
+			return
+		}
+	}
+}
+
+// close queues a FIN after whatever is left to send.
+func (sess *session) close() error {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if sess.localClosed {
+		return io.ErrClosedPipe
+	}
+	sess.localClosed = true
+	sess.closedAt = time.Now()
+	sess.finQueued = true
+	sess.toRecv = nil
+	if sess.finAcked && sess.remFin {
+		sess.doneAt = sess.closedAt
+	}
+	notify(sess.wake)
+	notify(sess.readEvent)
+	notify(sess.writeEvent)
+	return nil
 }
@@ -1,37 +1,43 @@
 package kcppp
 
-import (
-	"log"
-	"time"
-)
+import "time"
 
-func (sess *session) setTimer() {
-	sess.rtoTimer.actions <- rtAction{
-		dline: time.Now().Add(time.Second * 2),
-		action: func() {
-			sess.lock.Lock()
-			defer sess.lock.Unlock()
-			if doLogging {
-				log.Println(sess.convID, "timer fired")
-			}
-			// send the last unacknowledged one
-			for _, seg := range sess.inFlight {
-				if !seg.acked {
-					if doLogging {
-						log.Println(sess.convID,
-							"RTO sending last unack",
-							seg.seg.Header.Seqno)
-					}
-					sess.sendCallback(seg.seg)
-					seg.retransTimes++
-					go sess.setTimer()
-					break
-				}
-			}
-		},
+func diff32(later, earlier uint32) int32 {
+	return (int32)(later - earlier)
+}
+
+// notify wakes up whoever waits on a notification channel, without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
 	}
 }
 
-func diff32(later, earlier uint32) int32 {
-	return (int32)(later - earlier)
+// waitEvent waits for a notification, until the session dies or the deadline passes.
+func waitEvent(ch, dead chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return errTimeout{}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-dead:
+	case <-timeout:
+		return errTimeout{}
+	}
+	return nil
 }
+
+// errTimeout is the net.Error returned when a deadline passes.
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
@@ -0,0 +1,85 @@
+package niaucchi4
+
+import (
+	"bytes"
+	"encoding/binary"
+	mrand "math/rand"
+	"net"
+)
+
+// Control messages are sealed with ctlAD and start with their type.
+const (
+	ctlPathChallenge = 1 // [8-byte challenge][padding]
+	ctlPathResponse  = 2 // [8-byte challenge][padding]
+	ctlPadded        = 3 // [2-byte payload length][payload][padding]
+	ctlCover         = 4 // [padding]
+)
+
+// the overhead of a padded payload over a plain one: the type and the length
+const paddedOverhead = 3
+
+func genCtl(kind byte, data [8]byte) []byte {
+	msg := append([]byte{kind}, data[:]...)
+	padding := make([]byte, mrand.Intn(32))
+	mrand.Read(padding)
+	return append(msg, padding...)
+}
+
+func genPadded(payload []byte, padAmount int) []byte {
+	msg := make([]byte, paddedOverhead+len(payload)+padAmount)
+	msg[0] = ctlPadded
+	binary.LittleEndian.PutUint16(msg[1:3], uint16(len(payload)))
+	copy(msg[paddedOverhead:], payload)
+	return msg
+}
+
+func genCover(size int) []byte {
+	msg := make([]byte, 1+size)
+	msg[0] = ctlCover
+	return msg
+}
+
+// handleCtl handles a control message, returning the payload if it carried one. It must be called with the lock held.
+func (os *ObfsSocket) handleCtl(tun *tunstate, addr net.Addr, msg []byte) (payload []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	switch msg[0] {
+	case ctlPadded:
+		if len(msg) < paddedOverhead {
+			return
+		}
+		length := int(binary.LittleEndian.Uint16(msg[1:3]))
+		if length == 0 || length > len(msg)-paddedOverhead {
+			return
+		}
+		payload = msg[paddedOverhead:][:length]
+		if tun.checkReplay(payload) != nil {
+			payload = nil
+		}
+		return
+	case ctlCover:
+		return
+	}
+	if len(msg) < 9 {
+		return
+	}
+	var data [8]byte
+	copy(data[:], msg[1:9])
+	switch msg[0] {
+	case ctlPathChallenge:
+		os.wire.WriteTo(tun.encryptCtl(genCtl(ctlPathResponse, data)), addr)
+	case ctlPathResponse:
+		v, ok := os.candidates.Get(addr.String())
+		if !ok {
+			return
+		}
+		cand := v.(*pathCandidate)
+		if cand.tun != tun || !bytes.Equal(cand.challenge[:], data[:]) {
+			return
+		}
+		os.candidates.Remove(addr.String())
+		os.migrate(tun, addr)
+	}
+	return
+}
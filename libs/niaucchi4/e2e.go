@@ -91,6 +91,13 @@ func (e2e *E2EConn) SetSessPath(sid SessionAddr, host net.Addr) {
 	sess.AddPath(host)
 }
 
+// RemoveSessPath stops a session from using a path, for example when a bridge goes away.
+func (e2e *E2EConn) RemoveSessPath(sid SessionAddr, host net.Addr) {
+	if sessi, ok := e2e.sidToSess.Get(sid.String()); ok {
+		sessi.(*e2eSession).RemovePath(host)
+	}
+}
+
 // ReadFrom implements PacketConn.
 func (e2e *E2EConn) ReadFrom(p []byte) (n int, from net.Addr, err error) {
 	for {
@@ -125,7 +132,7 @@ func (e2e *E2EConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return
 }
 
-// UnderlyingLoss returns the underlying loss.
+// UnderlyingLoss returns the underlying loss, averaged over the paths in use.
 func (e2e *E2EConn) UnderlyingLoss(destAddr net.Addr) (frac float64) {
 	sessid := destAddr.(SessionAddr)
 	sessi, ok := e2e.sidToSess.Get(sessid.String())
@@ -133,11 +140,7 @@ func (e2e *E2EConn) UnderlyingLoss(destAddr net.Addr) (frac float64) {
 		log.Println("cannot find underlying loss")
 		return
 	}
-	sess := sessi.(*e2eSession)
-	sess.lock.Lock()
-	defer sess.lock.Unlock()
-	rem := sess.info[sess.lastRemid]
-	frac = rem.remoteLoss
+	frac = sessi.(*e2eSession).underlyingLoss()
 	return
 }
 
@@ -184,7 +187,7 @@ func (e2e *E2EConn) readOnePacket() error {
 		sess = newSession(pkt.Session, e2e.genSendCallback())
 	}
 	e2e.sidToSess.SetDefault(pkt.Session.String(), sess)
-	sess.AddPath(from)
+	sess.learnPath(from)
 	sess.Input(pkt, from)
 	sess.FlushReadQueue(func(b []byte) {
 		select {
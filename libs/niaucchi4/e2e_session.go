@@ -6,6 +6,7 @@ import (
 	"log"
 	"math"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -44,6 +45,13 @@ func (rtt *rtTracker) get(k uint64) int {
 	return z
 }
 
+const (
+	pathTimeout      = 30 * time.Second       // paths that received nothing for this long are presumed dead
+	scheduleInterval = 100 * time.Millisecond // how often path weights are recomputed
+	pathScoreSlack   = 2.0                    // paths scoring within this factor of the best one share the traffic
+	criticalSize     = 200                    // packets this small, like acks, are latency-critical and go over two paths
+)
+
 type e2eSession struct {
 	remote        []net.Addr
 	info          []*e2eLinkInfo
@@ -53,6 +61,8 @@ type e2eSession struct {
 	infoRateLimit *rate.Limiter
 	lastSend      time.Time
 	lastRemid     int
+	ranked        []int // usable paths, best first
+	totalWeight   float64
 	recvDedup     *lru.Cache
 	sendDedup     *rtTracker
 	sendCallback  func(e2ePacket, net.Addr)
@@ -95,6 +105,15 @@ type e2eLinkInfo struct {
 	lastPingTime  time.Time
 
 	lastRecvTime time.Time
+
+	removed bool
+	weight  float64 // share of bulk traffic
+	credit  float64 // for weighted round-robin
+}
+
+// usable returns whether the path should carry traffic.
+func (el *e2eLinkInfo) usable(now time.Time) bool {
+	return !el.removed && now.Sub(el.lastRecvTime) < pathTimeout
 }
 
 func (el *e2eLinkInfo) getScore() float64 {
@@ -138,12 +157,16 @@ type LinkInfo struct {
 	LossPct       float64
 	RecentLossPct float64
 	Score         float64
+	Weight        float64
+	Removed       bool
+	Alive         bool
 }
 
 // DebugInfo dumps out info about all the links.
 func (es *e2eSession) DebugInfo() (lii []LinkInfo) {
 	es.lock.Lock()
 	defer es.lock.Unlock()
+	now := time.Now()
 	for i, nfo := range es.info {
 		lii = append(lii, LinkInfo{
 			RemoteIP:      strings.Split(es.remote[i].String(), ":")[0],
@@ -152,12 +175,33 @@ func (es *e2eSession) DebugInfo() (lii []LinkInfo) {
 			LossPct:       math.Max(0, 1.0-float64(nfo.recvcnt)/(1+float64(nfo.recvsn))),
 			RecentLossPct: math.Max(0, 1.0-float64(nfo.recvcntRecent)/(1+float64(nfo.recvsnRecent))),
 			Score:         nfo.getScore(),
+			Weight:        nfo.weight,
+			Removed:       nfo.removed,
+			Alive:         nfo.usable(now),
 		})
 	}
 	return
 }
 
+// AddPath adds a path to the session, or brings back a removed one.
 func (es *e2eSession) AddPath(host net.Addr) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	for i, h := range es.remote {
+		if h.String() == host.String() {
+			if es.info[i].removed {
+				es.info[i].removed = false
+				es.info[i].lastRecvTime = time.Now()
+				es.lastSend = time.Time{}
+			}
+			return
+		}
+	}
+	es.addPath(host)
+}
+
+// learnPath adds a path that packets came from, unless it's already known.
+func (es *e2eSession) learnPath(host net.Addr) {
 	es.lock.Lock()
 	defer es.lock.Unlock()
 	for _, h := range es.remote {
@@ -165,11 +209,31 @@ func (es *e2eSession) AddPath(host net.Addr) {
 			return
 		}
 	}
+	es.addPath(host)
+}
+
+func (es *e2eSession) addPath(host net.Addr) {
 	if doLogging {
 		log.Printf("N4: [%p] adding new path %v", es, host)
 	}
 	es.remote = append(es.remote, host)
 	es.info = append(es.info, &e2eLinkInfo{lastPing: 10000000, lastRecvTime: time.Now(), remoteLoss: -1})
+	es.lastSend = time.Time{}
+}
+
+// RemovePath stops sending over a path. Paths stay in the tables so that their indices don't change.
+func (es *e2eSession) RemovePath(host net.Addr) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	for i, h := range es.remote {
+		if h.String() == host.String() {
+			if doLogging {
+				log.Printf("N4: [%p] removing path %v", es, host)
+			}
+			es.info[i].removed = true
+			es.lastSend = time.Time{}
+		}
+	}
 }
 
 func (es *e2eSession) processStats(pkt e2ePacket, remid int) {
@@ -291,49 +355,126 @@ func (es *e2eSession) rawSend(rtd bool, remid int, payload []byte) {
 	es.sendCallback(toSend, dest)
 }
 
-// Send sends a packet. It returns instructions to where the packet should be sent etc
-func (es *e2eSession) Send(payload []byte) (err error) {
-	es.lock.Lock()
-	defer es.lock.Unlock()
-	now := time.Now()
-	// find the right destination
-	if es.dupRateLimit.AllowN(time.Now(), len(es.remote)) {
-		//log.Println("sending small payload", len(payload), "to all paths")
-		for remid := range es.remote {
-			es.rawSend(false, remid, payload)
+// reschedule ranks the usable paths by score and gives the ones close to the best a share of the traffic.
+func (es *e2eSession) reschedule(now time.Time) {
+	es.ranked = es.ranked[:0]
+	for i, li := range es.info {
+		li.weight = 0
+		if li.usable(now) {
+			es.ranked = append(es.ranked, i)
 		}
 	}
-	remid := -1
-	if time.Since(es.lastSend).Seconds() > 0.1 {
-		lowPoint := -1.0
+	if len(es.ranked) == 0 {
+		// everything looks dead, so keep trying everything that wasn't removed
 		for i, li := range es.info {
-			if score := li.getScore(); score < lowPoint || lowPoint < 0 {
-				lowPoint = score
-				remid = i
+			if !li.removed {
+				es.ranked = append(es.ranked, i)
 			}
 		}
-		if doLogging {
-			log.Println("N4: selected", es.remote[remid], "with score", es.info[remid].getScore())
-			go func() {
-				for remid, v := range es.DebugInfo() {
-					log.Printf("%v %v %v/%v", v.RemoteIP, v.Ping,
-						es.info[remid].rtxCount, es.info[remid].txCount)
-				}
-			}()
+	}
+	scores := make([]float64, len(es.info))
+	for _, i := range es.ranked {
+		scores[i] = es.info[i].getScore()
+	}
+	sort.SliceStable(es.ranked, func(a, b int) bool {
+		return scores[es.ranked[a]] < scores[es.ranked[b]]
+	})
+	es.totalWeight = 0
+	if len(es.ranked) == 0 {
+		return
+	}
+	best := scores[es.ranked[0]]
+	for _, i := range es.ranked {
+		if scores[i] > best*pathScoreSlack {
+			break
 		}
-		if remid == -1 {
-			err = errors.New("cannot find any path")
-			return
+		w := 1.0
+		if scores[i] > 0 {
+			w = best / scores[i]
 		}
+		es.info[i].weight = w
+		es.totalWeight += w
+	}
+	if doLogging {
+		for _, i := range es.ranked {
+			log.Printf("N4: %v score %.1f weight %.2f", es.remote[i], scores[i], es.info[i].weight)
+		}
+	}
+}
+
+// pickWeighted picks a path for bulk traffic by smooth weighted round-robin.
+func (es *e2eSession) pickWeighted() int {
+	remid := -1
+	for _, i := range es.ranked {
+		li := es.info[i]
+		if li.weight <= 0 {
+			continue
+		}
+		li.credit += li.weight
+		if remid < 0 || li.credit > es.info[remid].credit {
+			remid = i
+		}
+	}
+	es.info[remid].credit -= es.totalWeight
+	return remid
+}
+
+// Send sends a packet. Bulk packets are spread over the best paths in proportion to their scores, while latency-critical ones go over the two best paths at once.
+func (es *e2eSession) Send(payload []byte) (err error) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	now := time.Now()
+	if now.Sub(es.lastSend) > scheduleInterval {
+		es.reschedule(now)
 		es.lastSend = now
-	} else {
-		remid = es.lastRemid
 	}
+	if es.totalWeight <= 0 {
+		err = errors.New("cannot find any path")
+		return
+	}
+	// every now and then, probe every path so that their scores stay fresh
+	if es.dupRateLimit.AllowN(now, len(es.remote)) {
+		for remid, li := range es.info {
+			if !li.removed {
+				es.rawSend(false, remid, payload)
+			}
+		}
+		return
+	}
+	if len(payload) <= criticalSize {
+		es.lastRemid = es.ranked[0]
+		es.rawSend(true, es.ranked[0], payload)
+		if len(es.ranked) > 1 {
+			es.rawSend(true, es.ranked[1], payload)
+		}
+		return
+	}
+	remid := es.pickWeighted()
 	es.lastRemid = remid
 	es.rawSend(true, remid, payload)
 	return
 }
 
+// underlyingLoss returns the loss of the paths weighted by how much traffic they carry.
+func (es *e2eSession) underlyingLoss() (frac float64) {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+	var sum float64
+	for _, li := range es.info {
+		if li.weight > 0 && li.remoteLoss >= 0 {
+			frac += li.weight * li.remoteLoss
+			sum += li.weight
+		}
+	}
+	if sum > 0 {
+		return frac / sum
+	}
+	if es.lastRemid < len(es.info) {
+		frac = es.info[es.lastRemid].remoteLoss
+	}
+	return
+}
+
 // FlushReadQueue flushes the entire read queue.
 func (es *e2eSession) FlushReadQueue(onPacket func([]byte)) {
 	es.lock.Lock()
@@ -0,0 +1,66 @@
+package niaucchi4
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func testSession(pings ...int64) (es *e2eSession, paths []net.Addr, counts map[string]int) {
+	counts = make(map[string]int)
+	es = newSession(NewSessAddr(), func(pkt e2ePacket, dest net.Addr) {
+		counts[dest.String()]++
+	})
+	es.dupRateLimit = rate.NewLimiter(0, 0)
+	for i, ping := range pings {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 2399}
+		es.AddPath(addr)
+		es.info[i].lastPing = ping
+		paths = append(paths, addr)
+	}
+	return
+}
+
+func TestSessionSpreadsBulkTraffic(t *testing.T) {
+	es, paths, counts := testSession(100, 150, 1000)
+	big := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		es.Send(big)
+	}
+	a, b, c := counts[paths[0].String()], counts[paths[1].String()], counts[paths[2].String()]
+	if a <= b || b == 0 {
+		t.Fatal("bulk traffic not spread in favor of the better path:", a, b)
+	}
+	if c != 0 {
+		t.Fatal("path much worse than the best still got traffic:", c)
+	}
+}
+
+func TestSessionDuplicatesSmallPackets(t *testing.T) {
+	es, paths, counts := testSession(100, 1000)
+	es.Send(make([]byte, 50))
+	if counts[paths[0].String()] != 1 || counts[paths[1].String()] != 1 {
+		t.Fatal("small packet not sent over both paths:", counts)
+	}
+}
+
+func TestSessionRemovePath(t *testing.T) {
+	es, paths, counts := testSession(100, 100)
+	es.RemovePath(paths[0])
+	big := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		es.Send(big)
+	}
+	if counts[paths[0].String()] != 0 {
+		t.Fatal("removed path still used")
+	}
+	es.RemovePath(paths[1])
+	if err := es.Send(big); err == nil {
+		t.Fatal("sending with no paths left should fail")
+	}
+	es.AddPath(paths[0])
+	if err := es.Send(big); err != nil || counts[paths[0].String()] != 1 {
+		t.Fatal("re-added path not used:", err)
+	}
+}
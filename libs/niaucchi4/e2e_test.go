@@ -0,0 +1,130 @@
+package niaucchi4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/kcp-go"
+)
+
+func loopbackUDP(t *testing.T) net.PacketConn {
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sock
+}
+
+// startExit runs an echo server behind E2EConn and KCP, like e2enat.ServeExit.
+func startExit(t *testing.T) (addr net.Addr, closer io.Closer) {
+	sock := loopbackUDP(t)
+	l := ListenKCP(NewE2EConn(sock))
+	go func() {
+		for {
+			rc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			rc.SetStreamMode(true)
+			go func() {
+				defer rc.Close()
+				io.Copy(rc, rc)
+			}()
+		}
+	}()
+	return sock.LocalAddr(), l
+}
+
+// testNAT is a stripped-down version of e2enat's NAT, which can't be imported here. Once blackholed, it silently drops everything.
+type testNAT struct {
+	left, right net.PacketConn
+	blackholed  int32
+}
+
+func startNAT(t *testing.T, cookie []byte, exit net.Addr) *testNAT {
+	nat := &testNAT{
+		left:  ObfsListen(cookie, loopbackUDP(t), true),
+		right: loopbackUDP(t),
+	}
+	var client atomic.Value
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := nat.left.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(&nat.blackholed) == 0 {
+				client.Store(addr)
+				nat.right.WriteTo(buf[:n], exit)
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := nat.right.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if addr, ok := client.Load().(net.Addr); ok && atomic.LoadInt32(&nat.blackholed) == 0 {
+				nat.left.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+	return nat
+}
+
+func (nat *testNAT) Close() error {
+	nat.left.Close()
+	return nat.right.Close()
+}
+
+func TestE2EThroughBridges(t *testing.T) {
+	exitAddr, exit := startExit(t)
+	defer exit.Close()
+	cookie := make([]byte, 32)
+	rand.Read(cookie)
+	good := startNAT(t, cookie, exitAddr)
+	defer good.Close()
+	bad := startNAT(t, cookie, exitAddr)
+	defer bad.Close()
+	atomic.StoreInt32(&bad.blackholed, 1)
+
+	e2e := NewE2EConn(ObfsListen(cookie, loopbackUDP(t), false))
+	sid := NewSessAddr()
+	e2e.SetSessPath(sid, good.left.LocalAddr())
+	e2e.SetSessPath(sid, bad.left.LocalAddr())
+	conn, err := kcp.NewConn2(sid, nil, 16, 16, e2e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e2e.Close()
+	defer conn.Close()
+	conn.SetWindowSize(10000, 10000)
+	conn.SetNoDelay(0, 100, 32, 0)
+	conn.SetStreamMode(true)
+	conn.SetMtu(1300)
+
+	data := make([]byte, 256*1024)
+	rand.Read(data)
+	go conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("echo through bridges failed:", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo doesn't match")
+	}
+	for _, li := range e2e.DebugInfo()[0] {
+		if li.RecvCnt > 0 && li.Weight == 0 {
+			t.Fatal("the working path isn't carrying traffic")
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/geph-official/geph2/libs/fastudp"
 	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/kcppp"
 )
 
 // DialKCP dials KCP over obfs in one function.
@@ -35,6 +36,20 @@ func DialKCP(addr string, cookie []byte) (conn net.Conn, err error) {
 	return
 }
 
+// DialKCPPP dials KCP++ over obfs in one function.
+func DialKCPPP(addr string, cookie []byte) (conn net.Conn, err error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	udpsock, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return
+	}
+	conn, err = kcppp.Dial(ObfsListen(cookie, udpsock, false), udpaddr)
+	return
+}
+
 // KCPListener operates KCP over obfs. Standard caveats about KCP not having proper open and close signaling apply.
 type KCPListener struct {
 	k    *kcp.Listener
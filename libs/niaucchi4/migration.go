@@ -0,0 +1,90 @@
+package niaucchi4
+
+import (
+	"crypto/rand"
+	"log"
+	"net"
+	"time"
+)
+
+// Tunnels are identified by connection IDs rather than addresses, so they survive the peer's address changing. Packets from a new address are processed, but the tunnel only migrates there after the new address answers an encrypted challenge. Until then, we send it at most antiAmpFactor times what it sent us, so spoofed packets can't turn us into an amplifier. Older peers don't carry connection IDs and can't answer challenges, so for them we fall back to scanning every tunnel and migrating as soon as a packet decrypts.
+
+const (
+	antiAmpFactor     = 3
+	challengeInterval = 200 * time.Millisecond
+)
+
+// pathCandidate is an address that a tunnel may migrate to once validated.
+type pathCandidate struct {
+	tun       *tunstate
+	challenge [8]byte
+	received  int
+	sent      int
+	lastSent  time.Time
+}
+
+// challengePath is called when a tunnel gets n bytes from an unvalidated address. It must be called with the lock held.
+func (os *ObfsSocket) challengePath(tun *tunstate, addr net.Addr, n int) {
+	var cand *pathCandidate
+	if v, ok := os.candidates.Get(addr.String()); ok && v.(*pathCandidate).tun == tun {
+		cand = v.(*pathCandidate)
+	} else {
+		cand = &pathCandidate{tun: tun}
+		rand.Read(cand.challenge[:])
+		os.candidates.Add(addr.String(), cand)
+	}
+	cand.received += n
+	if time.Since(cand.lastSent) < challengeInterval {
+		return
+	}
+	pkt := tun.encryptCtl(genCtl(ctlPathChallenge, cand.challenge))
+	if cand.sent+len(pkt) > antiAmpFactor*cand.received {
+		return
+	}
+	cand.sent += len(pkt)
+	cand.lastSent = time.Now()
+	if doLogging {
+		log.Println("N4: challenging new path", addr, "for", tun.addr)
+	}
+	os.wire.WriteTo(pkt, addr)
+}
+
+// migrate moves a tunnel to a validated address. It must be called with the lock held.
+func (os *ObfsSocket) migrate(tun *tunstate, addr net.Addr) {
+	if doLogging {
+		log.Println("N4: path validated, migrating", tun.addr, "to", addr)
+	}
+	if v, ok := os.tunnels.Peek(tun.addr.String()); ok && v.(*tunstate) == tun {
+		os.tunnels.Remove(tun.addr.String())
+	}
+	os.tunnels.Add(addr.String(), tun)
+	tun.addr = addr
+	if _, ok := os.sscache.Peek(string(tun.ss)); ok {
+		os.sscache.Add(string(tun.ss), addr)
+	}
+}
+
+// scanLegacy finds the tunnel of a packet from an unknown address by trying every tunnel whose peer doesn't carry connection IDs, migrating it to the address. It must be called with the lock held.
+func (os *ObfsSocket) scanLegacy(addr net.Addr, pkt []byte) (payload []byte, tun *tunstate, ok bool) {
+	for _, k := range os.tunnels.Keys() {
+		v, found := os.tunnels.Peek(k)
+		if !found {
+			continue
+		}
+		tun = v.(*tunstate)
+		if tun.peerCIDs {
+			continue
+		}
+		plain, e := tun.Decrypt(pkt)
+		if e != nil {
+			continue
+		}
+		if doLogging {
+			log.Println("N4: found a decryptable session through scanning, ROAM to", addr)
+		}
+		tun.lastRecv = time.Now()
+		os.migrate(tun, addr)
+		return plain, tun, true
+	}
+	return nil, nil, false
+}
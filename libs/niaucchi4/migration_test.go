@@ -0,0 +1,285 @@
+package niaucchi4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/kcp-go"
+)
+
+// rebindConn is a client socket that can move to a new port at any time, like a phone switching networks.
+type rebindConn struct {
+	t        *testing.T
+	lock     sync.Mutex
+	conn     net.PacketConn
+	lastSent []byte
+	incoming chan wrapperRead
+	dead     chan struct{}
+	once     sync.Once
+}
+
+func newRebindConn(t *testing.T) *rebindConn {
+	rc := &rebindConn{t: t, incoming: make(chan wrapperRead, 1024), dead: make(chan struct{})}
+	rc.rebind()
+	return rc
+}
+
+func (rc *rebindConn) rebind() {
+	conn := loopbackUDP(rc.t)
+	rc.lock.Lock()
+	if rc.conn != nil {
+		rc.conn.Close()
+	}
+	rc.conn = conn
+	rc.lock.Unlock()
+	go func() {
+		for {
+			buf := make([]byte, 2048)
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case rc.incoming <- wrapperRead{buf[:n], addr}:
+			default:
+			}
+		}
+	}()
+}
+
+func (rc *rebindConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case r := <-rc.incoming:
+		return copy(p, r.bts), r.rmAddr, nil
+	case <-rc.dead:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+func (rc *rebindConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.lastSent = append([]byte(nil), p...)
+	return rc.conn.WriteTo(p, addr)
+}
+
+func (rc *rebindConn) Close() error {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.once.Do(func() { close(rc.dead) })
+	return rc.conn.Close()
+}
+
+func (rc *rebindConn) LocalAddr() net.Addr {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.conn.LocalAddr()
+}
+
+func (rc *rebindConn) SetDeadline(t time.Time) error      { return nil }
+func (rc *rebindConn) SetReadDeadline(t time.Time) error  { return nil }
+func (rc *rebindConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestRebindMidTransfer(t *testing.T) {
+	cookie := make([]byte, 32)
+	rand.Read(cookie)
+	server := loopbackUDP(t)
+	l := ListenKCP(ObfsListen(cookie, server, false))
+	defer l.Close()
+	go func() {
+		rc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		rc.SetStreamMode(true)
+		defer rc.Close()
+		io.Copy(rc, rc)
+	}()
+
+	wire := newRebindConn(t)
+	conn, err := kcp.NewConn2(server.LocalAddr(), nil, 16, 16, ObfsListen(cookie, wire, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wire.Close()
+	defer conn.Close()
+	conn.SetWindowSize(10000, 10000)
+	conn.SetNoDelay(0, 100, 32, 0)
+	conn.SetStreamMode(true)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go func() {
+		for i := 0; i < len(data); i += 64 * 1024 {
+			conn.Write(data[i : i+64*1024])
+			if i%(256*1024) == 0 {
+				wire.rebind()
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("session didn't survive rebinding:", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo doesn't match")
+	}
+}
+
+func TestSpoofedPathNotMigrated(t *testing.T) {
+	cookie := make([]byte, 32)
+	rand.Read(cookie)
+	serverWire := loopbackUDP(t)
+	server := ObfsListen(cookie, serverWire, false)
+	defer server.Close()
+	wire := newRebindConn(t)
+	client := ObfsListen(cookie, wire, false)
+	defer client.Close()
+
+	serverRecv := make(chan net.Addr, 100)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			_, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			serverRecv <- addr
+		}
+	}()
+	clientRecv := make(chan []byte, 100)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := client.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			clientRecv <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	// the first writes only establish the tunnel
+	var clientAddr net.Addr
+	for clientAddr == nil {
+		client.WriteTo([]byte("hello"), serverWire.LocalAddr())
+		select {
+		case clientAddr = <-serverRecv:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	wire.lock.Lock()
+	captured := wire.lastSent
+	wire.lock.Unlock()
+
+	// an attacker replays a captured packet from somewhere else
+	attacker := loopbackUDP(t)
+	defer attacker.Close()
+	attacker.WriteTo(captured, serverWire.LocalAddr())
+	<-serverRecv
+	received := 0
+	buf := make([]byte, 2048)
+	for {
+		attacker.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		n, _, err := attacker.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		received += n
+	}
+	if received == 0 {
+		t.Fatal("new path wasn't challenged")
+	}
+	if received > antiAmpFactor*len(captured) {
+		t.Fatalf("attacker got %v bytes for %v sent", received, len(captured))
+	}
+
+	// the tunnel must still lead to the real client
+	server.WriteTo([]byte("still here"), clientAddr)
+	select {
+	case msg := <-clientRecv:
+		if string(msg) != "still here" {
+			t.Fatal("got", string(msg))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tunnel was hijacked")
+	}
+}
+
+func TestLegacyPeerRoams(t *testing.T) {
+	cookie := make([]byte, 32)
+	rand.Read(cookie)
+	serverWire := loopbackUDP(t)
+	server := ObfsListen(cookie, serverWire, false)
+	defer server.Close()
+	wire := newRebindConn(t)
+	client := ObfsListen(cookie, wire, false)
+	defer client.Close()
+
+	serverRecv := make(chan net.Addr, 100)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			_, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			serverRecv <- addr
+		}
+	}()
+	clientRecv := make(chan []byte, 100)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := client.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			clientRecv <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	// finish the handshake, then make the client act like one from before connection IDs
+	client.WriteTo([]byte("hello"), serverWire.LocalAddr())
+	for {
+		client.wlock.Lock()
+		v, ok := client.tunnels.Peek(serverWire.LocalAddr().String())
+		if ok {
+			v.(*tunstate).cidKey = nil
+		}
+		client.wlock.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.WriteTo([]byte("hello"), serverWire.LocalAddr())
+	clientAddr := <-serverRecv
+
+	// the client moves, and the server follows it without a challenge
+	wire.rebind()
+	client.WriteTo([]byte("moved"), serverWire.LocalAddr())
+	select {
+	case addr := <-serverRecv:
+		if addr.String() != clientAddr.String() {
+			t.Fatal("upper layer saw a different address")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet from the new address dropped")
+	}
+	server.WriteTo([]byte("still here"), clientAddr)
+	select {
+	case msg := <-clientRecv:
+		if string(msg) != "still here" {
+			t.Fatal("got", string(msg))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tunnel didn't follow the client")
+	}
+}
@@ -1,6 +1,7 @@
 package niaucchi4
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"net"
@@ -8,12 +9,19 @@ import (
 	"sync"
 	"time"
 
+	"github.com/geph-official/geph2/libs/shaper"
 	"github.com/hashicorp/golang-lru/simplelru"
 	"github.com/patrickmn/go-cache"
 )
 
 var doLogging = false
 
+// ShapingProfile is the shaper profile that new sockets follow. The default, "none", sends payloads unpadded.
+var ShapingProfile = "none"
+
+// tunnels that received nothing for this long don't get cover traffic
+const coverIdleLimit = 30 * time.Second
+
 func init() {
 	doLogging = os.Getenv("N4LOG") != ""
 }
@@ -35,6 +43,12 @@ type ObfsSocket struct {
 	sscache          *simplelru.LRU
 	tunnels          *simplelru.LRU
 	pending          *simplelru.LRU
+	cids             *simplelru.LRU
+	candidates       *simplelru.LRU
+	cidKey           []byte
+	shaping          string // the shaping profile of new tunnels
+	dead             chan struct{}
+	closeOnce        sync.Once
 	wire             net.PacketConn
 	wlock            sync.Mutex
 	rdbuf            [65536]byte
@@ -51,14 +65,23 @@ func newLRU() *simplelru.LRU {
 
 // ObfsListen opens a new obfuscated PacketConn.
 func ObfsListen(cookie []byte, wire net.PacketConn, replayProtection bool) *ObfsSocket {
-	return &ObfsSocket{
+	os := &ObfsSocket{
 		cookie:           cookie,
 		sscache:          newLRU(),
 		tunnels:          newLRU(),
 		pending:          newLRU(),
+		cids:             newLRU(),
+		candidates:       newLRU(),
+		cidKey:           genCidKey(cookie),
+		shaping:          ShapingProfile,
+		dead:             make(chan struct{}),
 		wire:             wire,
 		replayProtection: replayProtection,
 	}
+	if p, err := shaper.Get(ShapingProfile); err == nil && p.CoverInterval > 0 {
+		go os.coverLoop(p.CoverInterval)
+	}
+	return os
 }
 
 // AddCookieException adds a cookie exception to a particular destination.
@@ -81,11 +104,7 @@ func (os *ObfsSocket) WriteTo(b []byte, addr net.Addr) (int, error) {
 	}
 	if tuni, ok := os.tunnels.Get(addr.String()); ok {
 		tun := tuni.(*tunstate)
-		toWrite := tun.Encrypt(b)
-		_, err := os.wire.WriteTo(toWrite, addr)
-		if err != nil {
-			return 0, nil
-		}
+		os.send(tun, os.seal(tun, b))
 		return len(b), nil
 	}
 	if isHidden {
@@ -139,10 +158,12 @@ func (os *ObfsSocket) hiddenReadFrom(p []byte) (n int, addr net.Addr, err error)
 	// check if the packet belongs to a known tunnel
 	if tuni, ok := os.tunnels.Get(addr.String()); ok {
 		tun := tuni.(*tunstate)
-		plain, e := tun.Decrypt(os.rdbuf[:readBytes])
-		if e == nil {
+		if payload, ok := os.open(tun, addr, os.rdbuf[:readBytes]); ok {
+			if payload == nil {
+				return
+			}
 			os.tunnels.Add(addr.String(), tun)
-			n = copy(p, plain)
+			n = copy(p, payload)
 			if _, ok := os.sscache.Get(string(tun.ss)); ok {
 				os.sscache.Add(string(tun.ss), addr)
 				addr = oAddr(tun.ss)
@@ -157,33 +178,34 @@ func (os *ObfsSocket) hiddenReadFrom(p []byte) (n int, addr net.Addr, err error)
 		if e != nil {
 			return
 		}
-		os.tunnels.Add(addr.String(), ts)
+		os.addTunnel(addr, ts)
 		if doLogging {
 			log.Println("N4: got realization of pending", addr)
 		}
 		return
 	}
-	// iterate through all the stuff to create an association
-	for _, k := range os.tunnels.Keys() {
-		v, ok := os.tunnels.Get(k)
-		if !ok {
-			continue
-		}
-		tun := v.(*tunstate)
-		plain, e := tun.Decrypt(os.rdbuf[:readBytes])
-		if e == nil {
-			os.tunnels.Remove(k)
-			if doLogging {
-				log.Println("N4: found a decryptable session through scanning, ROAM to", addr)
-			}
-			os.tunnels.Add(addr.String(), tun)
-			n = copy(p, plain)
+	// check if the packet belongs to a known tunnel that's coming from a new address
+	if tuni, ok := os.cids.Get(string(peekCID(os.rdbuf[:readBytes], os.cidKey))); ok {
+		tun := tuni.(*tunstate)
+		if payload, ok := os.open(tun, addr, os.rdbuf[:readBytes]); ok && payload != nil {
+			os.challengePath(tun, addr, readBytes)
+			n = copy(p, payload)
+			// the upper layer keeps seeing the validated address
+			addr = tun.addr
 			if _, ok := os.sscache.Get(string(tun.ss)); ok {
-				os.sscache.Add(string(tun.ss), addr)
 				addr = oAddr(tun.ss)
 			}
-			return
 		}
+		return
+	}
+	// older peers don't carry connection IDs, so they can only be found by trying every tunnel
+	if payload, tun, ok := os.scanLegacy(addr, os.rdbuf[:readBytes]); ok {
+		n = copy(p, payload)
+		addr = tun.addr
+		if _, ok := os.sscache.Get(string(tun.ss)); ok {
+			addr = oAddr(tun.ss)
+		}
+		return
 	}
 	// otherwise it has to be some sort of tunnel opener
 	//log.Println("got suspected hello")
@@ -196,7 +218,7 @@ func (os *ObfsSocket) hiddenReadFrom(p []byte) (n int, addr net.Addr, err error)
 		badHelloBlacklist.SetDefault(addr.String(), true)
 		return
 	}
-	os.tunnels.Add(addr.String(), ts)
+	os.addTunnel(addr, ts)
 	os.sscache.Add(string(ts.ss), addr)
 	go func() {
 		os.wlock.Lock()
@@ -209,7 +231,37 @@ func (os *ObfsSocket) hiddenReadFrom(p []byte) (n int, addr net.Addr, err error)
 	return
 }
 
+// addTunnel registers a newly established tunnel. It must be called with the lock held.
+func (os *ObfsSocket) addTunnel(addr net.Addr, ts *tunstate) {
+	ts.addr = addr
+	ts.shaper = shaper.New(os.shaping, os.cookie)
+	os.tunnels.Add(addr.String(), ts)
+	os.cids.Add(string(ts.cid), ts)
+}
+
+// open decrypts a packet of a tunnel, handling it if it's a control message. It returns the payload if there is one, and ok is false if the packet doesn't belong to the tunnel. It must be called with the lock held.
+func (os *ObfsSocket) open(tun *tunstate, addr net.Addr, pkt []byte) (payload []byte, ok bool) {
+	if plain, e := tun.Decrypt(pkt); e == nil {
+		os.gotFrom(tun, pkt)
+		return plain, true
+	}
+	if msg, e := tun.decryptCtl(pkt); e == nil {
+		os.gotFrom(tun, pkt)
+		return os.handleCtl(tun, addr, msg), true
+	}
+	return nil, false
+}
+
+// gotFrom notes that a tunnel got a valid packet. It must be called with the lock held.
+func (os *ObfsSocket) gotFrom(tun *tunstate, pkt []byte) {
+	tun.lastRecv = time.Now()
+	if !tun.peerCIDs && tun.cidKey != nil && bytes.Equal(peekCID(pkt, tun.cidKey), tun.cid) {
+		tun.peerCIDs = true
+	}
+}
+
 func (os *ObfsSocket) Close() error {
+	os.closeOnce.Do(func() { close(os.dead) })
 	return os.wire.Close()
 }
 
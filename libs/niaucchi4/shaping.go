@@ -0,0 +1,110 @@
+package niaucchi4
+
+import (
+	"time"
+)
+
+// maxShapedSize is the largest UDP payload that fits in a 1500-byte IPv6 packet. Padding never makes a packet bigger than this, whatever the shaping profile's maximum, so that shaping doesn't cause fragmentation.
+const maxShapedSize = 1452
+
+// maxQueued is how many packets a tunnel holds back for the shaper before dropping new ones.
+const maxQueued = 1024
+
+// seal encrypts a payload for a tunnel, padding it if we're shaping traffic. It must be called with the lock held.
+func (os *ObfsSocket) seal(tun *tunstate, b []byte) []byte {
+	tun.lastSend = time.Now()
+	if tun.shaper == nil {
+		return tun.Encrypt(b)
+	}
+	need := len(b) + sealOverhead + paddedOverhead
+	size := tun.shaper.WriteSize(need)
+	if size > maxShapedSize {
+		size = maxShapedSize
+	}
+	padAmount := size - need
+	if padAmount < 0 {
+		padAmount = 0
+	}
+	return tun.encryptCtl(genPadded(b, padAmount))
+}
+
+// send writes a sealed packet of a tunnel to the wire, or queues it if the tunnel's shaper says to wait, so that a tunnel in a burst gap never holds up the others. It must be called with the lock held.
+func (os *ObfsSocket) send(tun *tunstate, pkt []byte) {
+	if tun.shaper == nil {
+		os.wire.WriteTo(pkt, tun.addr)
+		return
+	}
+	if len(tun.queue) > 0 {
+		// keep the order, and drop rather than buffer without bound, like a full socket would
+		if len(tun.queue) < maxQueued {
+			tun.queue = append(tun.queue, pkt)
+		}
+		return
+	}
+	wait := tun.shaper.Pace(time.Now())
+	if wait == 0 {
+		os.wire.WriteTo(pkt, tun.addr)
+		return
+	}
+	tun.queue = append(tun.queue, pkt)
+	time.AfterFunc(wait, func() { os.flushQueue(tun) })
+}
+
+// flushQueue writes out a tunnel's queued packets as its shaper allows. The first one has already been paced.
+func (os *ObfsSocket) flushQueue(tun *tunstate) {
+	os.wlock.Lock()
+	defer os.wlock.Unlock()
+	for len(tun.queue) > 0 {
+		select {
+		case <-os.dead:
+			tun.queue = nil
+			return
+		default:
+		}
+		os.wire.WriteTo(tun.queue[0], tun.addr)
+		tun.queue[0] = nil
+		tun.queue = tun.queue[1:]
+		if len(tun.queue) == 0 {
+			break
+		}
+		if wait := tun.shaper.Pace(time.Now()); wait > 0 {
+			time.AfterFunc(wait, func() { os.flushQueue(tun) })
+			return
+		}
+	}
+	tun.queue = nil
+}
+
+// coverLoop sends cover packets over tunnels that are in use but have been quiet for a cover interval.
+func (os *ObfsSocket) coverLoop(interval time.Duration) {
+	for {
+		select {
+		case <-os.dead:
+			return
+		case <-time.After(interval):
+		}
+		now := time.Now()
+		os.wlock.Lock()
+		for _, k := range os.tunnels.Keys() {
+			v, ok := os.tunnels.Peek(k)
+			if !ok {
+				continue
+			}
+			tun := v.(*tunstate)
+			if tun.shaper == nil || now.Sub(tun.lastRecv) > coverIdleLimit || now.Sub(tun.lastSend) < interval {
+				continue
+			}
+			size := tun.shaper.WriteSize(0)
+			if size > maxShapedSize {
+				size = maxShapedSize
+			}
+			size -= sealOverhead + 1
+			if size < 0 {
+				size = 0
+			}
+			os.send(tun, tun.encryptCtl(genCover(size)))
+			tun.lastSend = now
+		}
+		os.wlock.Unlock()
+	}
+}
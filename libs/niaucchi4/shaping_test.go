@@ -0,0 +1,143 @@
+package niaucchi4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/kcp-go"
+)
+
+func TestShapedTransfer(t *testing.T) {
+	ShapingProfile = "voip"
+	defer func() { ShapingProfile = "none" }()
+	cookie := make([]byte, 32)
+	rand.Read(cookie)
+	server := loopbackUDP(t)
+	l := ListenKCP(ObfsListen(cookie, server, false))
+	defer l.Close()
+	go func() {
+		rc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		rc.SetStreamMode(true)
+		defer rc.Close()
+		io.Copy(rc, rc)
+	}()
+
+	wire := newRebindConn(t)
+	conn, err := kcp.NewConn2(server.LocalAddr(), nil, 16, 16, ObfsListen(cookie, wire, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetStreamMode(true)
+
+	data := make([]byte, 64*1024)
+	rand.Read(data)
+	go conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo doesn't match")
+	}
+}
+
+// sizeConn records the sizes of the packets written to it.
+type sizeConn struct {
+	net.PacketConn
+	lock  sync.Mutex
+	sizes []int
+}
+
+func (sc *sizeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	sc.lock.Lock()
+	sc.sizes = append(sc.sizes, len(p))
+	sc.lock.Unlock()
+	return sc.PacketConn.WriteTo(p, addr)
+}
+
+func TestShapingDoesntBlock(t *testing.T) {
+	ShapingProfile = "stream"
+	defer func() { ShapingProfile = "none" }()
+	cookie := make([]byte, 32)
+	rand.Read(cookie)
+	serverWire := loopbackUDP(t)
+	server := ObfsListen(cookie, serverWire, false)
+	defer server.Close()
+	wire := &sizeConn{PacketConn: loopbackUDP(t)}
+	client := ObfsListen(cookie, wire, false)
+	defer client.Close()
+
+	serverRecv := make(chan []byte, 1000)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, _, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			serverRecv <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := client.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for established := false; !established; {
+		client.WriteTo(make([]byte, 8), serverWire.LocalAddr())
+		select {
+		case <-serverRecv:
+			established = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	for len(serverRecv) > 0 {
+		<-serverRecv
+	}
+
+	// several bursts' worth of packets are queued rather than waited for
+	const count = 300
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		pkt := make([]byte, 8)
+		binary.LittleEndian.PutUint64(pkt, uint64(i))
+		client.WriteTo(pkt, serverWire.LocalAddr())
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatal("writes blocked for", elapsed)
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case pkt := <-serverRecv:
+			if got := binary.LittleEndian.Uint64(pkt); got != uint64(i) {
+				t.Fatal("got packet", got, "instead of", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued packets not sent")
+		}
+	}
+
+	// stream's sizes go up to 16384, but not over UDP
+	wire.lock.Lock()
+	defer wire.lock.Unlock()
+	for _, size := range wire.sizes[1:] {
+		if size > maxShapedSize {
+			t.Fatal("sent a packet of", size, "bytes")
+		}
+	}
+}
@@ -10,16 +10,25 @@ import (
 	"errors"
 	"fmt"
 	mrand "math/rand"
+	"net"
 	"time"
 
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/geph-official/geph2/libs/c25519"
+	"github.com/geph-official/geph2/libs/replay"
+	"github.com/geph-official/geph2/libs/shaper"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
 )
 
 var masterSec = make([]byte, 32)
 
+// ReplayFilter rejects replayed hellos on sockets with replay protection. Servers can replace it with a persistent or shared filter before accepting tunnels.
+var ReplayFilter replay.Filter = replay.NewBloom(replay.DefaultCapacity)
+
+// helloEpochWindow is how many 30-second epochs off a hello may be.
+const helloEpochWindow = 30
+
 func genSK(seed []byte) [32]byte {
 	return c25519.GenSKWithSeed(append(seed, masterSec...))
 }
@@ -38,14 +47,48 @@ type tunstate struct {
 	enc              cipher.AEAD
 	dec              cipher.AEAD
 	ss               []byte
+	cid              []byte // connection ID, which identifies the tunnel regardless of address
+	cidKey           []byte // masks the connection ID on the wire
+	addr             net.Addr
+	peerCIDs         bool // whether the peer carries the connection ID, which older peers don't
+	lastRecv         time.Time
+	lastSend         time.Time
 	isserv           bool
 	replayProtection bool
 	rw               replayWindow
+	shaper           *shaper.Shaper // nil if not shaping
+	queue            [][]byte       // sealed packets waiting for the shaper
+}
+
+const cidLen = 8
+
+// the nonce and the tag
+const sealOverhead = chacha20poly1305.NonceSizeX + 16
+
+// control messages are sealed with different additional data than payloads, so they look the same on the wire
+var ctlAD = []byte("ctl")
+
+func genCidKey(cookie []byte) []byte {
+	return hm([]byte("cid"), cookie)
+}
+
+// peekCID unmasks the connection ID that a sealed packet carries in its nonce.
+func peekCID(pkt []byte, cidKey []byte) []byte {
+	if len(pkt) < chacha20poly1305.NonceSizeX {
+		return nil
+	}
+	mask := hm(pkt[:chacha20poly1305.NonceSizeX-cidLen], cidKey)
+	cid := make([]byte, cidLen)
+	for i := range cid {
+		cid[i] = pkt[chacha20poly1305.NonceSizeX-cidLen+i] ^ mask[i]
+	}
+	return cid
 }
 
 func (ts *tunstate) deriveKeys(ss []byte) {
 	//log.Printf("deriving keys from shared state %x", ss[:5])
 	ts.ss = ss
+	ts.cid = hm(ss, []byte("cid"))[:cidLen]
 	upcrypt := aead(hm(ss, []byte("up")))
 	dncrypt := aead(hm(ss, []byte("dn")))
 	if ts.isserv {
@@ -67,6 +110,12 @@ func (ts *tunstate) Decrypt(pkt []byte) (bts []byte, err error) {
 	if err != nil {
 		return
 	}
+	err = ts.checkReplay(bts)
+	return
+}
+
+// checkReplay checks a decrypted e2e packet against the replay window, if the tunnel has replay protection.
+func (ts *tunstate) checkReplay(bts []byte) (err error) {
 	if ts.replayProtection {
 		var e2epkt e2ePacket
 		err = rlp.DecodeBytes(bts, &e2epkt)
@@ -81,10 +130,35 @@ func (ts *tunstate) Decrypt(pkt []byte) (bts []byte, err error) {
 	return
 }
 
+// decryptCtl decrypts a control message.
+func (ts *tunstate) decryptCtl(pkt []byte) (bts []byte, err error) {
+	ns := ts.dec.NonceSize()
+	if len(pkt) < ns {
+		err = errors.New("WAT")
+		return
+	}
+	return ts.dec.Open(nil, pkt[:ns], pkt[ns:], ctlAD)
+}
+
 func (ts *tunstate) Encrypt(pkt []byte) (ctext []byte) {
+	return ts.seal(pkt, nil)
+}
+
+func (ts *tunstate) encryptCtl(pkt []byte) (ctext []byte) {
+	return ts.seal(pkt, ctlAD)
+}
+
+func (ts *tunstate) seal(pkt []byte, ad []byte) (ctext []byte) {
 	nonceb := make([]byte, ts.enc.NonceSize())
 	rand.Read(nonceb)
-	ctext = ts.enc.Seal(nonceb, nonceb, pkt, nil)
+	if ts.cidKey != nil {
+		// the last bytes of the nonce carry the masked connection ID
+		mask := hm(nonceb[:len(nonceb)-cidLen], ts.cidKey)
+		for i := 0; i < cidLen; i++ {
+			nonceb[len(nonceb)-cidLen+i] = ts.cid[i] ^ mask[i]
+		}
+	}
+	ctext = ts.enc.Seal(nonceb, nonceb, pkt, ad)
 	return
 }
 
@@ -101,9 +175,10 @@ func (pt *prototun) realize(response []byte, isserv bool, replayProtection bool)
 		return
 	}
 	// create possible nowcookies
-	for i := -30; i < 30; i++ {
+	for i := -helloEpochWindow; i < helloEpochWindow; i++ {
 		// derive nowcookie
-		nowcookie := hm(pt.cookie, []byte(fmt.Sprintf("%v", time.Now().Unix()/30+int64(i))))
+		epoch := time.Now().Unix()/30 + int64(i)
+		nowcookie := hm(pt.cookie, []byte(fmt.Sprintf("%v", epoch)))
 		//log.Printf("trying nowcookie %x", nowcookie[:5])
 		boo := aead(hm(nowcookie, theirHello.Nonce[:]))
 		theirPK, e := boo.
@@ -111,6 +186,12 @@ func (pt *prototun) realize(response []byte, isserv bool, replayProtection bool)
 		if e != nil {
 			continue
 		}
+		// clients retransmit hellos with fresh nonces, so identical ones are replays
+		if isserv && replayProtection && ReplayFilter != nil &&
+			!ReplayFilter.Check(append(theirHello.Nonce[:], theirHello.EncPK[:]...), time.Unix((epoch+helloEpochWindow+1)*30, 0)) {
+			err = errors.New("replayed hello")
+			return
+		}
 		var sharedsec [32]byte
 		var theirPKf [32]byte
 		copy(theirPKf[:], theirPK)
@@ -120,6 +201,7 @@ func (pt *prototun) realize(response []byte, isserv bool, replayProtection bool)
 		curve25519.ScalarMult(&sharedsec, &pt.mySK, &theirPKf)
 		// make ts
 		ts = &tunstate{
+			cidKey:           genCidKey(pt.cookie),
 			isserv:           isserv,
 			replayProtection: replayProtection,
 		}
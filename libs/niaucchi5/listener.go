@@ -0,0 +1,164 @@
+package niaucchi5
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const listenerBacklog = 4096 // segments waiting for ReadFrom before we start dropping
+
+type lsPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// Listener accepts URTCP connections from a stream listener and presents them all as one net.PacketConn, where every connection is addressed by its remote address. This lets KCP or KCP++ listeners run over TCP.
+type Listener struct {
+	listener  net.Listener
+	handshake func(net.Conn) (net.Conn, error)
+	lock      sync.Mutex
+	wires     map[string]*URTCP
+	incoming  chan lsPacket
+	dead      chan struct{}
+	once      sync.Once
+}
+
+// Listen starts accepting URTCP connections from listener.
+func Listen(listener net.Listener) *Listener {
+	return ListenWith(listener, nil)
+}
+
+// ListenWith is like Listen, but first runs handshake on every connection, dropping those it fails on. URTCP then runs over the connection handshake returns.
+func ListenWith(listener net.Listener, handshake func(net.Conn) (net.Conn, error)) *Listener {
+	l := &Listener{
+		listener:  listener,
+		handshake: handshake,
+		wires:     make(map[string]*URTCP),
+		incoming:  make(chan lsPacket, listenerBacklog),
+		dead:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *Listener) acceptLoop() {
+	defer l.Close()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.serve(conn)
+	}
+}
+
+func (l *Listener) serve(conn net.Conn) {
+	addr := conn.RemoteAddr()
+	wire := conn
+	if l.handshake != nil {
+		var err error
+		wire, err = l.handshake(conn)
+		if err != nil {
+			conn.Close()
+			return
+		}
+	}
+	tr := NewURTCP(wire)
+	l.lock.Lock()
+	select {
+	case <-l.dead:
+		l.lock.Unlock()
+		tr.Close()
+		return
+	default:
+	}
+	l.wires[addr.String()] = tr
+	l.lock.Unlock()
+	l.recvLoop(tr, addr)
+}
+
+func (l *Listener) recvLoop(tr *URTCP, addr net.Addr) {
+	defer func() {
+		l.lock.Lock()
+		if l.wires[addr.String()] == tr {
+			delete(l.wires, addr.String())
+		}
+		l.lock.Unlock()
+		tr.Close()
+	}()
+	buf := make([]byte, maxSegmentSize)
+	for {
+		n, err := tr.RecvSegment(buf)
+		if err != nil {
+			return
+		}
+		pkt := lsPacket{append([]byte(nil), buf[:n]...), addr}
+		select {
+		case l.incoming <- pkt:
+		case <-l.dead:
+			return
+		default:
+		}
+	}
+}
+
+// ReadFrom reads a segment from any connection.
+func (l *Listener) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-l.incoming:
+		n = copy(p, pkt.data)
+		addr = pkt.from
+	case <-l.dead:
+		err = io.ErrClosedPipe
+	}
+	return
+}
+
+// WriteTo sends a segment to the connection with the given remote address. Segments to unknown addresses are silently dropped, as with UDP.
+func (l *Listener) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	l.lock.Lock()
+	tr := l.wires[addr.String()]
+	l.lock.Unlock()
+	n = len(p)
+	if tr != nil {
+		err = tr.SendSegment(p, false)
+	}
+	return
+}
+
+// Close closes the listener and every connection.
+func (l *Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		err = l.listener.Close()
+		l.lock.Lock()
+		for _, tr := range l.wires {
+			tr.Close()
+		}
+		l.wires = make(map[string]*URTCP)
+		close(l.dead)
+		l.lock.Unlock()
+	})
+	return err
+}
+
+// LocalAddr returns the listening address.
+func (l *Listener) LocalAddr() net.Addr {
+	return l.listener.Addr()
+}
+
+// deadlines aren't supported, just like for PacketWire-generated PacketConns
+
+func (l *Listener) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (l *Listener) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (l *Listener) SetWriteDeadline(t time.Time) error {
+	return nil
+}
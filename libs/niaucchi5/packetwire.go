@@ -1,7 +1,6 @@
 package niaucchi5
 
 import (
-	"log"
 	"net"
 	"time"
 )
@@ -10,6 +9,7 @@ import (
 type PacketWire interface {
 	SendSegment(seg []byte, allowBlocking bool) (err error)
 	RecvSegment(seg []byte) (n int, err error)
+	Close() error
 }
 
 type pwAddr struct{}
@@ -51,7 +51,7 @@ func (pw *pwPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 }
 
 func (pw *pwPacketConn) Close() (err error) {
-	panic("not implemented")
+	return pw.pwire.Close()
 }
 
 func (pw *pwPacketConn) LocalAddr() net.Addr {
@@ -62,17 +62,16 @@ func (pw *pwPacketConn) RemoteAddr() net.Addr {
 	return StandardAddr
 }
 
+// deadlines aren't supported, since nothing on top of a PacketWire needs them
+
 func (pw *pwPacketConn) SetDeadline(t time.Time) error {
-	log.Println("NOT IMPLEMENTED")
 	return nil
 }
 
 func (pw *pwPacketConn) SetReadDeadline(t time.Time) error {
-	log.Println("NOT IMPLEMENTED")
 	return nil
 }
 
 func (pw *pwPacketConn) SetWriteDeadline(t time.Time) error {
-	log.Println("NOT IMPLEMENTED")
 	return nil
 }
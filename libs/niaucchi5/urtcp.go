@@ -3,15 +3,16 @@ package niaucchi5
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"io"
 	"log"
 	"math"
 	"math/rand"
 	"net"
+	"os"
 	"sync"
 	"time"
 
-	"github.com/bep/debounce"
 	pool "github.com/libp2p/go-buffer-pool"
 	"gopkg.in/tomb.v1"
 )
@@ -24,7 +25,17 @@ const flagAck = 30001
 const flagPing = 40001
 const flagPong = 40002
 
-var delayer = debounce.New(50 * time.Millisecond)
+const (
+	ackDelay      = 20 * time.Millisecond
+	minRTTWindow  = 30 * time.Second
+	minQueueLimit = 64 * 1024 // bytes that may wait for the wire before we start dropping
+	maxRecvQueue  = 4096      // segments that may wait for RecvSegment before we start dropping
+)
+
+// ErrSegmentTooBig is returned when sending a segment bigger than a URTCP frame can carry.
+var ErrSegmentTooBig = errors.New("segment too big")
+
+var doLogging = os.Getenv("N5LOG") != ""
 
 // URTCP implements "unreliable TCP". This is an unreliable PacketWire implementation over reliable net.Conn's like TCP, yet avoids excessive bufferbloat, "TCP over TCP" problems, etc.
 type URTCP struct {
@@ -38,18 +49,21 @@ type URTCP struct {
 
 	// sending variables
 	sv struct {
-		sendBuffer    chan poolSlice // includes 2-byte length header
+		queue         []poolSlice // includes 2-byte length header, not yet written to the wire
+		queued        int         // bytes in queue and in the write in progress
+		queueLimit    int
 		inflight      int
 		inflightLimit int
 		delivered     uint64
 		lastAckNano   uint64
+		dropped       uint64
 
-		pingSendNano   uint64
-		ping           uint64
-		pingUpdateTime time.Time
+		pingSendNano uint64
+		srtt         time.Duration
+		minRTT       time.Duration
+		minRTTTime   time.Time
 
-		bw           float64
-		bwUpdateTime time.Time
+		bw float64
 	}
 
 	// receiving variables
@@ -57,9 +71,20 @@ type URTCP struct {
 		recvBuffer  []poolSlice
 		unacked     int
 		lastAckTime time.Time
+		ackTimer    *time.Timer
+		ackPending  bool
 	}
 }
 
+// URTCPStats are statistics about a URTCP connection.
+type URTCPStats struct {
+	SRTT      time.Duration // smoothed RTT, from pings
+	MinRTT    time.Duration // minimum RTT over the last 30 seconds
+	Bandwidth float64       // estimated delivery rate in bytes per second
+	Inflight  int           // bytes sent but not yet acknowledged
+	Dropped   uint64        // segments dropped because the wire couldn't keep up
+}
+
 // NewURTCP creates a new URTCP instance.
 func NewURTCP(wire net.Conn) *URTCP {
 	tr := &URTCP{
@@ -67,22 +92,29 @@ func NewURTCP(wire net.Conn) *URTCP {
 		wireRead: bufio.NewReaderSize(wire, 4096),
 	}
 	tr.cvar = sync.NewCond(new(sync.Mutex))
-	tr.sv.sendBuffer = make(chan poolSlice, 1048576)
 	tr.sv.inflightLimit = 100 * 1024
+	tr.sv.queueLimit = minQueueLimit
 	go func() {
 		<-tr.death.Dying()
 		tr.cvar.L.Lock()
 		tr.deatherr = tr.death.Err()
+		if tr.rv.ackTimer != nil {
+			tr.rv.ackTimer.Stop()
+		}
 		tr.cvar.Broadcast()
 		tr.cvar.L.Unlock()
+		tr.wire.Close()
 	}()
 	go tr.sendLoop()
 	go tr.recvLoop()
 	return tr
 }
 
-// SendSegment sends a single segment.
+// SendSegment sends a single segment. Without blocking, segments are dropped rather than queued when the wire can't keep up.
 func (tr *URTCP) SendSegment(seg []byte, block bool) (err error) {
+	if len(seg) > maxSegmentSize {
+		return ErrSegmentTooBig
+	}
 	tr.cvar.L.Lock()
 	defer tr.cvar.L.Unlock()
 	defer tr.cvar.Broadcast()
@@ -91,10 +123,16 @@ func (tr *URTCP) SendSegment(seg []byte, block bool) (err error) {
 			tr.cvar.Wait()
 		}
 	} else {
+		// the TCP send buffer is full, so anything more would just sit in a queue
+		if tr.sv.queued+len(seg)+2 > tr.sv.queueLimit {
+			tr.sv.dropped++
+			return
+		}
 		// random early detection
 		minThresh := 0.8
 		dropProb := math.Max(0, float64(tr.sv.inflight)/float64(tr.sv.inflightLimit)-minThresh) / (1 - minThresh)
 		if rand.Float64() < dropProb {
+			tr.sv.dropped++
 			return
 		}
 	}
@@ -137,41 +175,66 @@ func (tr *URTCP) RecvSegment(seg []byte) (n int, err error) {
 	return
 }
 
+// Close closes the URTCP connection and the underlying wire.
+func (tr *URTCP) Close() error {
+	tr.death.Kill(io.ErrClosedPipe)
+	return tr.wire.Close()
+}
+
+// Stats returns statistics about the connection.
+func (tr *URTCP) Stats() (stats URTCPStats) {
+	tr.cvar.L.Lock()
+	defer tr.cvar.L.Unlock()
+	stats.SRTT = tr.sv.srtt
+	stats.MinRTT = tr.sv.minRTT
+	stats.Bandwidth = tr.sv.bw
+	stats.Inflight = tr.sv.inflight
+	stats.Dropped = tr.sv.dropped
+	return
+}
+
+// queueForSend queues a frame for the send loop. It must be called with the lock held.
 func (tr *URTCP) queueForSend(b poolSlice) {
-	select {
-	case tr.sv.sendBuffer <- b:
-	default:
-		go func() {
-			select {
-			case tr.sv.sendBuffer <- b:
-			case <-tr.death.Dying():
-			}
-		}()
-	}
+	tr.sv.queue = append(tr.sv.queue, b)
+	tr.sv.queued += len(b)
+	tr.cvar.Broadcast()
 }
 
 func (tr *URTCP) sendLoop() {
 	defer tr.wire.Close()
+	var buf []byte
 	for {
-		select {
-		case toSend := <-tr.sv.sendBuffer:
-			if len(toSend) > maxSegmentSize+2 {
-				panic("shouldn't happen")
-			}
-			_, err := tr.wire.Write(toSend)
-			if err != nil {
-				tr.death.Kill(err)
-				tr.cvar.Broadcast()
-				return
-			}
+		tr.cvar.L.Lock()
+		for len(tr.sv.queue) == 0 && tr.deatherr == nil {
+			tr.cvar.Wait()
+		}
+		if tr.deatherr != nil {
+			tr.cvar.L.Unlock()
+			return
+		}
+		queue := tr.sv.queue
+		tr.sv.queue = nil
+		tr.cvar.L.Unlock()
+		// coalesce everything queued into one write
+		buf = buf[:0]
+		for _, toSend := range queue {
+			buf = append(buf, toSend...)
 			pool.Put(toSend)
-		case <-tr.death.Dying():
+		}
+		_, err := tr.wire.Write(buf)
+		if err != nil {
+			tr.death.Kill(err)
 			return
 		}
+		tr.cvar.L.Lock()
+		tr.sv.queued -= len(buf)
+		tr.cvar.L.Unlock()
 	}
 }
 
+// forceAck acknowledges everything received. It must be called with the lock held.
 func (tr *URTCP) forceAck() {
+	tr.rv.ackPending = false
 	if tr.rv.unacked > 0 {
 		ack := poolSlice(pool.Get(2 + 8 + 8))
 		binary.LittleEndian.PutUint16(ack[:2], flagAck)
@@ -183,17 +246,24 @@ func (tr *URTCP) forceAck() {
 	}
 }
 
+// delayedAck acknowledges what's received within ackDelay. It must be called with the lock held.
 func (tr *URTCP) delayedAck() {
-	delayer(func() {
-		tr.cvar.L.Lock()
-		defer tr.cvar.L.Unlock()
-		tr.forceAck()
-	})
+	if tr.rv.ackPending {
+		return
+	}
+	tr.rv.ackPending = true
+	if tr.rv.ackTimer == nil {
+		tr.rv.ackTimer = time.AfterFunc(ackDelay, func() {
+			tr.cvar.L.Lock()
+			defer tr.cvar.L.Unlock()
+			tr.forceAck()
+		})
+		return
+	}
+	tr.rv.ackTimer.Reset(ackDelay)
 }
 
 func (tr *URTCP) recvLoop() {
-	defer tr.wire.Close()
-	defer tr.cvar.Broadcast()
 	defer tr.death.Kill(io.ErrClosedPipe)
 	lenbuf := make([]byte, 2)
 	for {
@@ -204,19 +274,30 @@ func (tr *URTCP) recvLoop() {
 		lenint := binary.LittleEndian.Uint16(lenbuf)
 		switch lenint {
 		case flagPing:
-			pingPkt := pool.Get(8)
-			binary.LittleEndian.PutUint16(pingPkt, flagPong)
-			tr.queueForSend(pingPkt)
+			pongPkt := poolSlice(pool.Get(2))
+			binary.LittleEndian.PutUint16(pongPkt, flagPong)
+			tr.cvar.L.Lock()
+			tr.queueForSend(pongPkt)
+			tr.cvar.L.Unlock()
 		case flagPong:
 			tr.cvar.L.Lock()
-			now := time.Now()
-			pingSample := uint64(time.Now().UnixNano()) - tr.sv.pingSendNano
-			if pingSample < tr.sv.ping || now.Sub(tr.sv.pingUpdateTime) > time.Second*30 {
-				tr.sv.ping = pingSample
-				tr.sv.pingUpdateTime = now
+			if tr.sv.pingSendNano != 0 {
+				now := time.Now()
+				sample := time.Duration(uint64(now.UnixNano()) - tr.sv.pingSendNano)
+				tr.sv.pingSendNano = 0
+				if tr.sv.srtt == 0 {
+					tr.sv.srtt = sample
+				} else {
+					tr.sv.srtt = (7*tr.sv.srtt + sample) / 8
+				}
+				if tr.sv.minRTT == 0 || sample < tr.sv.minRTT || now.Sub(tr.sv.minRTTTime) > minRTTWindow {
+					tr.sv.minRTT = sample
+					tr.sv.minRTTTime = now
+				}
+				if doLogging {
+					log.Println("N5: ping sample", sample)
+				}
 			}
-			log.Println("********* ping sample", float64(pingSample)*1e-9*1000)
-			tr.sv.pingSendNano = 0
 			tr.cvar.L.Unlock()
 		case flagAck:
 			rUnixNanoB := pool.Get(8 + 8)
@@ -229,36 +310,27 @@ func (tr *URTCP) recvLoop() {
 			pool.Put(rUnixNanoB)
 
 			tr.cvar.L.Lock()
-			//now := time.Now()
-
-			ping := float64(tr.sv.ping) * 1e-9
-
-			deltaD := float64(rAckCount)
-			tr.sv.delivered += uint64(deltaD)
+			tr.sv.delivered += rAckCount
 			tr.sv.inflight -= int(rAckCount)
-			deltaT := float64(rUnixNano - tr.sv.lastAckNano)
+			if tr.sv.lastAckNano != 0 && rUnixNano > tr.sv.lastAckNano {
+				// the peer timestamps its acks, so this measures how fast it received
+				bwSample := 1e9 * float64(rAckCount) / float64(rUnixNano-tr.sv.lastAckNano)
+				if bwSample > tr.sv.bw {
+					tr.sv.bw = bwSample*0.5 + tr.sv.bw*0.5
+				} else {
+					tr.sv.bw = bwSample*0.1 + tr.sv.bw*0.9
+				}
+			}
 			tr.sv.lastAckNano = rUnixNano
-			bwSample := 1e9 * deltaD / deltaT
-			// if bwSample > tr.sv.bw || now.Sub(tr.sv.bwUpdateTime).Seconds() > ping*10 {
-			// 	tr.sv.bw = bwSample
-			// 	tr.sv.bwUpdateTime = now
-			// }
-			if bwSample > tr.sv.bw {
-				tr.sv.bw = bwSample*0.5 + tr.sv.bw*0.5
-			} else {
-				tr.sv.bw = bwSample*0.1 + tr.sv.bw*0.9
+			bdp := tr.sv.bw * tr.sv.minRTT.Seconds()
+			tr.sv.inflightLimit = int(bdp*3) + 100*1024
+			tr.sv.queueLimit = int(bdp)
+			if tr.sv.queueLimit < minQueueLimit {
+				tr.sv.queueLimit = minQueueLimit
+			}
+			if doLogging {
+				log.Println("N5: bw sample", int(tr.sv.bw/1000), "KB/s")
 			}
-
-			Bps := tr.sv.bw
-			log.Println("bw sample", int(Bps/1000), "KB/s")
-			bdp := Bps * ping
-			tgtIFL := int(bdp*3) + 100*1024
-			tr.sv.inflightLimit = tgtIFL
-			// if rand.Int()%10 == 0 {
-			// 	tr.sv.inflightLimit = int(bdp)
-			// 	log.Println("SEVERE LIMITING")
-			// }
-
 			tr.cvar.Broadcast()
 			tr.cvar.L.Unlock()
 
@@ -270,9 +342,13 @@ func (tr *URTCP) recvLoop() {
 			}
 			// notify the world
 			tr.cvar.L.Lock()
-			tr.rv.recvBuffer = append(tr.rv.recvBuffer, body)
-			tr.rv.unacked += len(body)
-			if time.Since(tr.rv.lastAckTime) > time.Millisecond*20 {
+			if len(tr.rv.recvBuffer) < maxRecvQueue {
+				tr.rv.recvBuffer = append(tr.rv.recvBuffer, body)
+			} else {
+				pool.Put(body)
+			}
+			tr.rv.unacked += int(lenint)
+			if time.Since(tr.rv.lastAckTime) > ackDelay {
 				tr.forceAck()
 			} else {
 				tr.delayedAck()
@@ -0,0 +1,75 @@
+package niaucchi5
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/kcppp"
+)
+
+func TestURTCPDropsWhenWireIsFull(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	tr := NewURTCP(a)
+	defer tr.Close()
+	// nobody reads b, so the wire fills up right away
+	seg := make([]byte, 1000)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			tr.SendSegment(seg, false)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("non-blocking sends blocked on a full wire")
+	}
+	if tr.Stats().Dropped == 0 {
+		t.Fatal("nothing was dropped")
+	}
+}
+
+func TestKCPPPOverURTCP(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := kcppp.Listen(Listen(tcpListener))
+	defer listener.Close()
+
+	tcpConn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ur := NewURTCP(tcpConn)
+	client, err := kcppp.Dial(ToPacketConn(ur), StandardAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted")
+	}
+	if ur.Stats().SRTT == 0 {
+		t.Fatal("no RTT estimate from pings")
+	}
+}
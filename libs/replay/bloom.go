@@ -0,0 +1,240 @@
+// Package replay implements filters that reject replayed handshakes. Bridges use one filter for both cshirt2 and niaucchi4, and can persist it across restarts and share it between processes.
+package replay
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Filter remembers handshake values to reject replays.
+type Filter interface {
+	// Check returns false if v was seen before. Otherwise it remembers v until expiry, after which the handshake v came from wouldn't be accepted anyway, and returns true.
+	Check(v []byte, expiry time.Time) bool
+}
+
+// BucketSpan is how much time each bucket of a Bloom filter covers. It matches the 30-second epochs of cshirt2 and niaucchi4 handshakes, so values are forgotten exactly when their epochs stop being accepted.
+const BucketSpan = 30 * time.Second
+
+// DefaultCapacity is how many values each bucket holds before false positives exceed one in a million.
+const DefaultCapacity = 10000
+
+const bloomMagic = "GRPLAY01"
+
+// errBadFile is returned for filter files that can't be read.
+var errBadFile = errors.New("replay: bad filter file")
+
+// Bloom is a time-bucketed Bloom filter. Values go into the bucket of their expiry, and whole buckets are dropped once they expire, so memory stays bounded and nothing is forgotten early. Bloom filters never forget values they've seen, but may wrongly reject a fresh value with a small probability.
+type Bloom struct {
+	lock    sync.Mutex
+	salt    [32]byte
+	k       int
+	m       uint64
+	buckets map[int64][]byte
+
+	path  string
+	dirty bool
+	dead  chan struct{}
+	once  sync.Once
+}
+
+// NewBloom creates an in-memory Bloom filter whose buckets each hold capacity values.
+func NewBloom(capacity int) *Bloom {
+	// optimal sizes for a false-positive rate of 1e-6
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(1e-6) / (math.Ln2 * math.Ln2)))
+	bl := &Bloom{
+		k:       int(math.Ceil(math.Log2(1e6))),
+		m:       (m + 7) / 8 * 8,
+		buckets: make(map[int64][]byte),
+		dead:    make(chan struct{}),
+	}
+	rand.Read(bl.salt[:])
+	return bl
+}
+
+// OpenBloom opens a Bloom filter persisted at path, creating it if it doesn't exist. The filter is saved every few seconds and on Close, so a crash forgets at most the last few seconds of values.
+func OpenBloom(path string, capacity int) (bl *Bloom, err error) {
+	bl = NewBloom(capacity)
+	bl.path = path
+	file, err := os.Open(path)
+	if err == nil {
+		err = bl.load(bufio.NewReader(file))
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if os.IsNotExist(err) {
+		err = nil
+	} else {
+		return nil, err
+	}
+	go bl.saveLoop()
+	return
+}
+
+func (bl *Bloom) slot(t time.Time) int64 {
+	span := int64(BucketSpan / time.Second)
+	return (t.Unix() + span - 1) / span
+}
+
+func (bl *Bloom) indices(v []byte) []uint64 {
+	h := sha256.New()
+	h.Write(bl.salt[:])
+	h.Write(v)
+	sum := h.Sum(nil)
+	a := binary.LittleEndian.Uint64(sum[:8])
+	b := binary.LittleEndian.Uint64(sum[8:16]) | 1
+	idx := make([]uint64, bl.k)
+	for i := range idx {
+		idx[i] = (a + uint64(i)*b) % bl.m
+	}
+	return idx
+}
+
+// Check implements Filter.
+func (bl *Bloom) Check(v []byte, expiry time.Time) bool {
+	now := time.Now()
+	if !expiry.After(now) {
+		return true
+	}
+	idx := bl.indices(v)
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	bl.expire(now)
+	for _, bits := range bl.buckets {
+		if hasAll(bits, idx) {
+			return false
+		}
+	}
+	slot := bl.slot(expiry)
+	bits, ok := bl.buckets[slot]
+	if !ok {
+		bits = make([]byte, bl.m/8)
+		bl.buckets[slot] = bits
+	}
+	for _, i := range idx {
+		bits[i/8] |= 1 << (i % 8)
+	}
+	bl.dirty = true
+	return true
+}
+
+func hasAll(bits []byte, idx []uint64) bool {
+	for _, i := range idx {
+		if bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// expire drops the buckets whose values have all expired. It must be called with the lock held.
+func (bl *Bloom) expire(now time.Time) {
+	for slot := range bl.buckets {
+		if slot*int64(BucketSpan/time.Second) < now.Unix() {
+			delete(bl.buckets, slot)
+			bl.dirty = true
+		}
+	}
+}
+
+func (bl *Bloom) saveLoop() {
+	for {
+		select {
+		case <-bl.dead:
+			return
+		case <-time.After(time.Second * 5):
+		}
+		bl.Save()
+	}
+}
+
+// Save writes the filter to its file, if it has one.
+func (bl *Bloom) Save() error {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	if bl.path == "" || !bl.dirty {
+		return nil
+	}
+	bl.expire(time.Now())
+	// write a new file and move it over the old one, so that a crash never leaves a torn file
+	tmp := bl.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	wr := bufio.NewWriter(file)
+	bl.store(wr)
+	if err = wr.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, bl.path); err != nil {
+		return err
+	}
+	bl.dirty = false
+	return nil
+}
+
+// Close saves the filter and stops saving it periodically.
+func (bl *Bloom) Close() error {
+	bl.once.Do(func() { close(bl.dead) })
+	return bl.Save()
+}
+
+func (bl *Bloom) store(w io.Writer) {
+	w.Write([]byte(bloomMagic))
+	w.Write(bl.salt[:])
+	binary.Write(w, binary.LittleEndian, uint32(bl.k))
+	binary.Write(w, binary.LittleEndian, bl.m)
+	binary.Write(w, binary.LittleEndian, uint32(len(bl.buckets)))
+	for slot, bits := range bl.buckets {
+		binary.Write(w, binary.LittleEndian, slot)
+		w.Write(bits)
+	}
+}
+
+func (bl *Bloom) load(r io.Reader) error {
+	magic := make([]byte, len(bloomMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != bloomMagic {
+		return errBadFile
+	}
+	var k, count uint32
+	var m uint64
+	if _, err := io.ReadFull(r, bl.salt[:]); err != nil {
+		return errBadFile
+	}
+	if binary.Read(r, binary.LittleEndian, &k) != nil ||
+		binary.Read(r, binary.LittleEndian, &m) != nil ||
+		binary.Read(r, binary.LittleEndian, &count) != nil ||
+		k == 0 || k > 64 || m == 0 || m%8 != 0 || m > 1<<32 {
+		return errBadFile
+	}
+	// the file's parameters win over the capacity we were given
+	bl.k = int(k)
+	bl.m = m
+	now := time.Now()
+	for i := uint32(0); i < count; i++ {
+		var slot int64
+		if binary.Read(r, binary.LittleEndian, &slot) != nil {
+			return errBadFile
+		}
+		bits := make([]byte, m/8)
+		if _, err := io.ReadFull(r, bits); err != nil {
+			return errBadFile
+		}
+		bl.buckets[slot] = bits
+	}
+	bl.expire(now)
+	return nil
+}
@@ -0,0 +1,102 @@
+package replay
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBloomRejectsReplays(t *testing.T) {
+	bl := NewBloom(1000)
+	expiry := time.Now().Add(time.Minute)
+	for i := 0; i < 1000; i++ {
+		if !bl.Check([]byte(fmt.Sprint(i)), expiry) {
+			t.Fatal("fresh value rejected", i)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if bl.Check([]byte(fmt.Sprint(i)), expiry) {
+			t.Fatal("replay accepted", i)
+		}
+	}
+	// expired values aren't worth remembering
+	if !bl.Check([]byte("old"), time.Now().Add(-time.Second)) || !bl.Check([]byte("old"), time.Now().Add(-time.Second)) {
+		t.Fatal("expired value rejected")
+	}
+}
+
+func TestBloomPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "filter")
+	bl, err := OpenBloom(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl.Check([]byte("hello"), time.Now().Add(time.Minute))
+	if err := bl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bl, err = OpenBloom(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bl.Close()
+	if bl.Check([]byte("hello"), time.Now().Add(time.Minute)) {
+		t.Fatal("forgot a value across a restart")
+	}
+	if !bl.Check([]byte("world"), time.Now().Add(time.Minute)) {
+		t.Fatal("fresh value rejected after a restart")
+	}
+}
+
+func TestShare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sock")
+	first, err := Share(path, NewBloom(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("socket isn't private", err)
+	}
+	second, err := Share(path, NewBloom(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := second.(*Remote); !ok {
+		t.Fatal("second process didn't use the first one's filter")
+	}
+	expiry := time.Now().Add(time.Minute)
+	if !second.Check([]byte("hello"), expiry) || first.Check([]byte("hello"), expiry) {
+		t.Fatal("replay through one process accepted by the other")
+	}
+	if !first.Check([]byte("world"), expiry) || second.Check([]byte("world"), expiry) {
+		t.Fatal("replay through one process accepted by the other")
+	}
+}
+
+func TestShareNeedsPrivateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Chmod(dir, 0777)
+	if _, err := Share(filepath.Join(dir, "sock"), NewBloom(1000)); err == nil {
+		t.Fatal("shared through a directory others can write to")
+	}
+	if _, err := Share(filepath.Join(dir, "private", "sock"), NewBloom(1000)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,162 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Processes on the same host share a filter over a Unix socket. One process owns the filter and serves it; the others send it every check as [2-byte length][8-byte expiry in Unix seconds][value], and get back a byte that is 1 if the value is fresh.
+
+// maxValueLen is the longest value that can be checked remotely.
+const maxValueLen = 4096
+
+// Serve answers checks from other processes against f, until the listener is closed.
+func Serve(l net.Listener, f Filter) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, f)
+	}
+}
+
+func serveConn(conn net.Conn, f Filter) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		var length uint16
+		var expiry int64
+		if binary.Read(rd, binary.BigEndian, &length) != nil ||
+			binary.Read(rd, binary.BigEndian, &expiry) != nil ||
+			length > maxValueLen {
+			return
+		}
+		v := make([]byte, length)
+		if _, err := io.ReadFull(rd, v); err != nil {
+			return
+		}
+		resp := []byte{0}
+		if f.Check(v, time.Unix(expiry, 0)) {
+			resp[0] = 1
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+// Remote is a Filter served by another process. If that process can't be reached, it falls back to a local filter, so replay protection degrades to per-process rather than failing open.
+type Remote struct {
+	path     string
+	fallback Filter
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+// NewRemote creates a filter that checks against the one served at the Unix socket path.
+func NewRemote(path string, fallback Filter) *Remote {
+	return &Remote{path: path, fallback: fallback}
+}
+
+// Check implements Filter.
+func (r *Remote) Check(v []byte, expiry time.Time) bool {
+	if len(v) > maxValueLen {
+		return r.fallback.Check(v, expiry)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if fresh, err := r.check(v, expiry); err == nil {
+		return fresh
+	}
+	// try again once, over a new connection
+	if fresh, err := r.check(v, expiry); err == nil {
+		return fresh
+	}
+	return r.fallback.Check(v, expiry)
+}
+
+func (r *Remote) check(v []byte, expiry time.Time) (fresh bool, err error) {
+	if r.conn == nil {
+		r.conn, err = net.DialTimeout("unix", r.path, time.Second)
+		if err != nil {
+			return
+		}
+	}
+	defer func() {
+		if err != nil {
+			r.conn.Close()
+			r.conn = nil
+		}
+	}()
+	r.conn.SetDeadline(time.Now().Add(time.Second))
+	msg := make([]byte, 10+len(v))
+	binary.BigEndian.PutUint16(msg, uint16(len(v)))
+	binary.BigEndian.PutUint64(msg[2:], uint64(expiry.Unix()))
+	copy(msg[10:], v)
+	if _, err = r.conn.Write(msg); err != nil {
+		return
+	}
+	resp := make([]byte, 1)
+	if _, err = io.ReadFull(r.conn, resp); err != nil {
+		return
+	}
+	fresh = resp[0] == 1
+	return
+}
+
+// Share shares f over the Unix socket at path. The first process to get there serves its filter, and the others use it remotely, falling back to f if it goes away. The socket's directory is created if needed, and must be private to our user, so that nobody else can poison the filter or pretend to serve it.
+func Share(path string, f Filter) (Filter, error) {
+	if err := privateDir(filepath.Dir(path)); err != nil {
+		return f, err
+	}
+	l, err := listen(path)
+	if err != nil {
+		// either somebody is serving, or a dead process left its socket behind
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return NewRemote(path, f), nil
+		}
+		os.Remove(path)
+		l, err = listen(path)
+		if err != nil {
+			return f, err
+		}
+	}
+	go Serve(l, f)
+	return f, nil
+}
+
+func privateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("replay: %v is accessible to other users", dir)
+	}
+	return nil
+}
+
+func listen(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,75 @@
+// Package shaper shapes the sizes and timing of obfuscated traffic, so that it looks less distinctive to statistical classifiers.
+package shaper
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Profile describes what traffic should look like on the wire.
+type Profile struct {
+	MinSize int // smallest write on the wire
+	MaxSize int // largest write on the wire, which bulk data is cut into
+	Modes   int // peaks in the size distribution that every connection derives from its cookie
+
+	BurstLen int           // at most this many writes go out back-to-back, 0 for no burst shaping
+	BurstGap time.Duration // pause between bursts
+
+	CoverInterval time.Duration // idle connections send a cover write this often, 0 for no cover traffic
+}
+
+// ErrUnknownProfile is returned for unknown profile names.
+var ErrUnknownProfile = errors.New("unknown shaping profile")
+
+var profiles = map[string]Profile{
+	// no shaping at all, only the transports' legacy random padding
+	"none": {},
+	// HTTPS browsing: small requests and bursts of big records
+	"web": {
+		MinSize:  80,
+		MaxSize:  16384,
+		Modes:    4,
+		BurstLen: 32,
+		BurstGap: 20 * time.Millisecond,
+	},
+	// video streaming: a steady trickle punctuated by big chunks
+	"stream": {
+		MinSize:       1000,
+		MaxSize:       16384,
+		Modes:         3,
+		BurstLen:      64,
+		BurstGap:      50 * time.Millisecond,
+		CoverInterval: 250 * time.Millisecond,
+	},
+	// voice calls: small packets at a constant rate
+	"voip": {
+		MinSize:       60,
+		MaxSize:       1300,
+		Modes:         2,
+		CoverInterval: 20 * time.Millisecond,
+	},
+}
+
+// Get returns the named profile.
+func Get(name string) (Profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return Profile{}, ErrUnknownProfile
+	}
+	return p, nil
+}
+
+// Names lists the known profiles.
+func Names() []string {
+	var names []string
+	for k := range profiles {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p Profile) isNone() bool {
+	return p.MaxSize == 0
+}
@@ -0,0 +1,294 @@
+// Command shapehist runs a synthetic browsing workload through cshirt2 or niaucchi4 over loopback, and plots histograms of the sizes and inter-arrival times that an observer would see on the wire.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	mrand "math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/geph-official/geph2/libs/cshirt2"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/geph-official/geph2/libs/shaper"
+)
+
+type record struct {
+	size int
+	when time.Time
+}
+
+// recorder remembers every write that goes out on the wire.
+type recorder struct {
+	lock    sync.Mutex
+	records []record
+}
+
+func (r *recorder) add(n int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = append(r.records, record{n, time.Now()})
+}
+
+func (r *recorder) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.records = nil
+}
+
+type recConn struct {
+	net.Conn
+	rec *recorder
+}
+
+func (rc recConn) Write(p []byte) (int, error) {
+	rc.rec.add(len(p))
+	return rc.Conn.Write(p)
+}
+
+type recPacketConn struct {
+	net.PacketConn
+	rec *recorder
+}
+
+func (rc recPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	rc.rec.add(len(p))
+	return rc.PacketConn.WriteTo(p, addr)
+}
+
+func main() {
+	var flagTransport, flagProfile, flagCookie string
+	var flagWrites int
+	var flagCSV bool
+	flag.StringVar(&flagTransport, "transport", "cshirt2", "transport to measure (cshirt2 or niaucchi4)")
+	flag.StringVar(&flagProfile, "profile", "none", "shaping profile ("+strings.Join(shaper.Names(), ", ")+")")
+	flag.StringVar(&flagCookie, "cookie", "", "hex cookie, which the size distribution is derived from; random if empty")
+	flag.IntVar(&flagWrites, "writes", 300, "number of writes in the workload")
+	flag.BoolVar(&flagCSV, "csv", false, "print size,microseconds-since-previous for every write instead of histograms")
+	flag.Parse()
+	if _, err := shaper.Get(flagProfile); err != nil {
+		log.Fatal(err)
+	}
+	cookie := make([]byte, 32)
+	rand.Read(cookie)
+	if flagCookie != "" {
+		var err error
+		cookie, err = hex.DecodeString(flagCookie)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	cshirt2.ShapingProfile = flagProfile
+	niaucchi4.ShapingProfile = flagProfile
+
+	rec := new(recorder)
+	var write func([]byte)
+	switch flagTransport {
+	case "cshirt2":
+		write = setupCshirt2(cookie, rec)
+	case "niaucchi4":
+		write = setupNiaucchi4(cookie, rec)
+	default:
+		log.Fatal("-transport must be cshirt2 or niaucchi4")
+	}
+	rec.reset()
+	runWorkload(write, flagWrites, flagTransport == "niaucchi4")
+	// let cover traffic and delayed bursts show up
+	time.Sleep(time.Second)
+
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	var sizes, gaps []float64
+	for i, r := range rec.records {
+		sizes = append(sizes, float64(r.size))
+		if i > 0 {
+			gaps = append(gaps, float64(r.when.Sub(rec.records[i-1].when).Microseconds()))
+		}
+	}
+	if flagCSV {
+		fmt.Println("size,gap_us")
+		for i, r := range rec.records {
+			gap := 0.0
+			if i > 0 {
+				gap = gaps[i-1]
+			}
+			fmt.Printf("%v,%v\n", r.size, gap)
+		}
+		return
+	}
+	fmt.Printf("%v writes through %v with profile %q\n\n", len(sizes), flagTransport, flagProfile)
+	plotLinear("write sizes (bytes)", sizes, 20)
+	fmt.Println()
+	plotLog("inter-arrival times (µs)", gaps)
+}
+
+// runWorkload imitates browsing: small requests, bigger responses and think time in between.
+func runWorkload(write func([]byte), n int, datagrams bool) {
+	for i := 0; i < n; i++ {
+		size := int(mrand.ExpFloat64()*300) + 20
+		if mrand.Intn(10) < 3 {
+			size = 2048 + mrand.Intn(62*1024)
+		}
+		if datagrams && size > 1200 {
+			size = 1200
+		}
+		write(make([]byte, size))
+		time.Sleep(time.Duration(mrand.ExpFloat64() * float64(10*time.Millisecond)))
+	}
+}
+
+func setupCshirt2(cookie []byte, rec *recorder) func([]byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sconn, err := cshirt2.Server(cookie, false, conn, time.Time{})
+				if err != nil {
+					log.Println("server handshake failed:", err)
+					return
+				}
+				io.Copy(ioutil.Discard, sconn)
+			}()
+		}
+	}()
+	raw, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := cshirt2.Client(cookie, recConn{raw, rec})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return func(b []byte) {
+		if _, err := conn.Write(b); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func setupNiaucchi4(cookie []byte, rec *recorder) func([]byte) {
+	serverSock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := niaucchi4.ObfsListen(cookie, serverSock, false)
+	established := make(chan struct{})
+	go func() {
+		var once sync.Once
+		buf := make([]byte, 2048)
+		for {
+			_, _, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			once.Do(func() { close(established) })
+		}
+	}()
+	clientSock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := niaucchi4.ObfsListen(cookie, recPacketConn{clientSock, rec}, false)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := client.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	// the first writes only establish the tunnel
+	for {
+		client.WriteTo([]byte("hello"), serverSock.LocalAddr())
+		select {
+		case <-established:
+			return func(b []byte) {
+				client.WriteTo(b, serverSock.LocalAddr())
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func plotLinear(title string, vals []float64, buckets int) {
+	if len(vals) == 0 {
+		return
+	}
+	max := 0.0
+	for _, v := range vals {
+		max = math.Max(max, v)
+	}
+	width := math.Ceil((max + 1) / float64(buckets))
+	counts := make([]int, buckets)
+	for _, v := range vals {
+		counts[int(v/width)]++
+	}
+	var labels []string
+	for i := range counts {
+		labels = append(labels, fmt.Sprintf("%6.0f-%-6.0f", float64(i)*width, float64(i+1)*width))
+	}
+	plot(title, labels, counts)
+}
+
+func plotLog(title string, vals []float64) {
+	if len(vals) == 0 {
+		return
+	}
+	counts := make([]int, 24)
+	for _, v := range vals {
+		i := 0
+		if v >= 1 {
+			i = int(math.Log2(v)) + 1
+		}
+		if i >= len(counts) {
+			i = len(counts) - 1
+		}
+		counts[i]++
+	}
+	// trim empty buckets at both ends
+	lo, hi := 0, len(counts)
+	for lo < hi && counts[lo] == 0 {
+		lo++
+	}
+	for hi > lo && counts[hi-1] == 0 {
+		hi--
+	}
+	var labels []string
+	for i := lo; i < hi; i++ {
+		if i == 0 {
+			labels = append(labels, fmt.Sprintf("%13s", "<1"))
+			continue
+		}
+		labels = append(labels, fmt.Sprintf("%6d-%-6d", 1<<uint(i-1), 1<<uint(i)))
+	}
+	plot(title, labels, counts[lo:hi])
+}
+
+func plot(title string, labels []string, counts []int) {
+	fmt.Println(title)
+	max := 1
+	for _, c := range counts {
+		if c > max {
+			max = c
+		}
+	}
+	for i, c := range counts {
+		fmt.Fprintf(os.Stdout, "%v | %-60s %v\n", labels[i], strings.Repeat("#", c*60/max), c)
+	}
+}
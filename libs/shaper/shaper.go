@@ -0,0 +1,145 @@
+package shaper
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	mrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shaper shapes one connection according to a profile. It's safe for concurrent use.
+type Shaper struct {
+	profile Profile
+	sizes   []int
+	cumw    []float64
+
+	lock       sync.Mutex
+	rng        *mrand.Rand
+	burstCount int
+	burstLen   int
+	lastWrite  time.Time
+
+	lastActive int64 // unix nanos
+}
+
+// New creates a shaper for the named profile, deriving its size distribution from the cookie, so that every bridge looks a bit different but always looks the same. It returns nil for "none" or an unknown profile, which means not shaping at all.
+func New(name string, cookie []byte) *Shaper {
+	p, err := Get(name)
+	if err != nil || p.isNone() {
+		return nil
+	}
+	return NewWithProfile(p, cookie)
+}
+
+// NewWithProfile creates a shaper for a custom profile.
+func NewWithProfile(p Profile, cookie []byte) *Shaper {
+	mac := hmac.New(sha256.New, []byte("shaper"))
+	mac.Write(cookie)
+	det := mrand.New(mrand.NewSource(int64(binary.LittleEndian.Uint64(mac.Sum(nil)))))
+	s := &Shaper{profile: p}
+	// the modes are skewed towards small sizes, plus one at the maximum for bulk data
+	var total float64
+	for i := 0; i < p.Modes; i++ {
+		size := p.MinSize
+		if p.MaxSize > p.MinSize {
+			size += int(float64(p.MaxSize-p.MinSize) * det.Float64() * det.Float64())
+		}
+		total += det.Float64() + 0.1
+		s.sizes = append(s.sizes, size)
+		s.cumw = append(s.cumw, total)
+	}
+	total += det.Float64() + 0.1
+	s.sizes = append(s.sizes, p.MaxSize)
+	s.cumw = append(s.cumw, total)
+	for i := range s.cumw {
+		s.cumw[i] /= total
+	}
+	var seed int64
+	binary.Read(rand.Reader, binary.LittleEndian, &seed)
+	s.rng = mrand.New(mrand.NewSource(seed))
+	return s
+}
+
+// Profile returns the profile being followed.
+func (s *Shaper) Profile() Profile {
+	return s.profile
+}
+
+// WriteSize returns how big the next write on the wire should be, given that at least need bytes are waiting to be written. The result is never more than the profile's maximum, so bigger writes must be cut up.
+func (s *Shaper) WriteSize(need int) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if need >= s.profile.MaxSize {
+		return s.profile.MaxSize
+	}
+	x := s.rng.Float64()
+	i := 0
+	for i < len(s.cumw)-1 && s.cumw[i] < x {
+		i++
+	}
+	// jitter within 10% of the mode
+	size := s.sizes[i] - s.sizes[i]/20 + s.rng.Intn(s.sizes[i]/10+1)
+	if size < need {
+		size = need
+	}
+	if size < s.profile.MinSize {
+		size = s.profile.MinSize
+	}
+	if size > s.profile.MaxSize {
+		size = s.profile.MaxSize
+	}
+	return size
+}
+
+// Pace returns how long to wait before a write made at the given time, so that writes come in bursts.
+func (s *Shaper) Pace(now time.Time) (wait time.Duration) {
+	if s.profile.BurstLen == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if now.Sub(s.lastWrite) >= s.profile.BurstGap {
+		// we were quiet for long enough that this is a new burst anyway
+		s.burstCount = 0
+	}
+	if s.burstLen == 0 || s.burstCount >= s.burstLen {
+		if s.burstLen != 0 {
+			wait = s.profile.BurstGap - now.Sub(s.lastWrite)
+			if wait < 0 {
+				wait = 0
+			}
+		}
+		s.burstCount = 0
+		s.burstLen = s.profile.BurstLen/2 + s.rng.Intn(s.profile.BurstLen/2+1)
+	}
+	s.burstCount++
+	s.lastWrite = now.Add(wait)
+	return
+}
+
+// Touch records that the connection just sent something.
+func (s *Shaper) Touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+// Cover sends cover traffic through send whenever the connection was idle for the profile's cover interval, until send fails. It blocks, so it should run in its own goroutine.
+func (s *Shaper) Cover(send func(size int) error) {
+	if s.profile.CoverInterval == 0 {
+		return
+	}
+	for {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+		if idle < s.profile.CoverInterval {
+			time.Sleep(s.profile.CoverInterval - idle)
+			continue
+		}
+		if err := send(s.WriteSize(0)); err != nil {
+			return
+		}
+		s.Touch()
+	}
+}
@@ -0,0 +1,52 @@
+package shaper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSizesFollowCookie(t *testing.T) {
+	p, _ := Get("web")
+	a := NewWithProfile(p, []byte("bridge A"))
+	b := NewWithProfile(p, []byte("bridge A"))
+	c := NewWithProfile(p, []byte("bridge B"))
+	for i := range a.sizes {
+		if a.sizes[i] != b.sizes[i] {
+			t.Fatal("same cookie gave different distributions")
+		}
+	}
+	same := true
+	for i := range a.sizes {
+		same = same && a.sizes[i] == c.sizes[i]
+	}
+	if same {
+		t.Fatal("different cookies gave the same distribution")
+	}
+	for i := 0; i < 1000; i++ {
+		need := i * 37
+		size := a.WriteSize(need)
+		if size < p.MinSize || size > p.MaxSize || (size < need && need <= p.MaxSize) {
+			t.Fatalf("bad size %v for %v bytes", size, need)
+		}
+	}
+}
+
+func TestPaceMakesBursts(t *testing.T) {
+	p := Profile{MinSize: 100, MaxSize: 1000, Modes: 1, BurstLen: 10, BurstGap: 10 * time.Millisecond}
+	s := NewWithProfile(p, nil)
+	now := time.Now()
+	var waits int
+	for i := 0; i < 100; i++ {
+		if wait := s.Pace(now); wait > 0 {
+			waits++
+			now = now.Add(wait)
+		}
+	}
+	// bursts are between 5 and 10 writes long
+	if waits < 9 || waits > 20 {
+		t.Fatal("unexpected number of bursts:", waits+1)
+	}
+	if New("none", nil) != nil || New("nonexistent", nil) != nil {
+		t.Fatal("expected no shaper")
+	}
+}
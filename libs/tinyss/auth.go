@@ -0,0 +1,199 @@
+package tinyss
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/c25519"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// TinySS-3 is an authenticated handshake with fixed client and server roles, in the style of Noise's XX pattern:
+//
+//   -> "TinySS-3" || e
+//   <- "TinySS-3" || e
+//   <- [version, nextprot, s, key chain, sig]
+//   -> [version, nextprot, s?, sig?]
+//
+// Keys come from the ephemeral DH and the transcript hash h of both hellos. Each side then sends its static key in the first encrypted record, with a signature over its role, h and its next protocol, so neither the versions nor the next protocol can be tampered with. Servers must have a static key, which clients trust if it's pinned or certified by a key chain from a pinned master key. Clients only have one for server-to-server links.
+//
+// Servers read the client's hello before sending theirs, so that they can answer older clients with a legacy handshake. Clients never fall back, since that would let anybody downgrade them.
+
+const authVersion = 3
+
+// Config configures an authenticated handshake.
+type Config struct {
+	NextProt byte
+
+	StaticKey ed25519.PrivateKey // our identity; servers need one, clients only for server-to-server links
+	KeyChain  KeyChain           // certifies StaticKey for peers that pin a master key
+
+	MasterKey   ed25519.PublicKey   // trust peer keys certified by this master key
+	PinnedKeys  []ed25519.PublicKey // trust these peer keys directly
+	RequirePeer bool                // servers only: refuse clients without a trusted static key
+}
+
+var (
+	// ErrDowngrade is returned by Client when the server only speaks a legacy handshake.
+	ErrDowngrade = errors.New("tinyss: server doesn't support authenticated handshakes")
+	// ErrUntrustedPeer is returned when the peer's static key is missing, unsigned or untrusted.
+	ErrUntrustedPeer = errors.New("tinyss: untrusted peer")
+
+	errNoStaticKey = errors.New("tinyss: servers need a static key")
+)
+
+type authMsg struct {
+	Version  uint
+	NextProt uint
+	StaticPK []byte
+	Chain    KeyChain
+	Sig      []byte
+}
+
+func authSigMsg(isServer bool, h []byte, nextProt uint) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("tinyss-3-auth\n")
+	if isServer {
+		buf.WriteByte('S')
+	} else {
+		buf.WriteByte('C')
+	}
+	buf.Write(h)
+	buf.WriteByte(byte(nextProt))
+	return buf.Bytes()
+}
+
+// Client performs an authenticated handshake as the initiator.
+func Client(plain net.Conn, cfg Config) (sok *Socket, err error) {
+	myesk := c25519.GenSK()
+	err = writeHello(plain, "TinySS-3", myesk)
+	if err != nil {
+		return
+	}
+	version, repk, err := readHello(plain)
+	if err != nil {
+		return
+	}
+	if version != "TinySS-3" {
+		err = ErrDowngrade
+		return
+	}
+	return authenticate(plain, cfg, false, myesk, repk)
+}
+
+// Server performs a handshake as the responder. Legacy clients get a legacy handshake, so check the socket's Version.
+func Server(plain net.Conn, cfg Config) (sok *Socket, err error) {
+	version, repk, err := readHello(plain)
+	if err != nil {
+		return
+	}
+	myesk := c25519.GenSK()
+	if version != "TinySS-3" {
+		err = writeHello(plain, "TinySS-2", myesk)
+		if err != nil {
+			return
+		}
+		return finishLegacy(plain, version, repk, myesk, cfg.NextProt)
+	}
+	if cfg.StaticKey == nil {
+		err = errNoStaticKey
+		return
+	}
+	err = writeHello(plain, "TinySS-3", myesk)
+	if err != nil {
+		return
+	}
+	return authenticate(plain, cfg, true, myesk, repk)
+}
+
+func authenticate(plain net.Conn, cfg Config, isServer bool, myesk, repk [32]byte) (sok *Socket, err error) {
+	var mypk [32]byte
+	curve25519.ScalarBaseMult(&mypk, &myesk)
+	// hash the transcript, client first
+	th := sha256.New()
+	th.Write([]byte("TinySS-3"))
+	if isServer {
+		th.Write(repk[:])
+		th.Write([]byte("TinySS-3"))
+		th.Write(mypk[:])
+	} else {
+		th.Write(mypk[:])
+		th.Write([]byte("TinySS-3"))
+		th.Write(repk[:])
+	}
+	h := th.Sum(nil)
+	var ee [32]byte
+	curve25519.ScalarMult(&ee, &myesk, &repk)
+	sharedsec := hm(h, ee[:])
+	c2s := hm([]byte("tinyss-3-c2s"), sharedsec)
+	s2c := hm([]byte("tinyss-3-s2c"), sharedsec)
+	var ns *Socket
+	if isServer {
+		ns = makeSocket(plain, sharedsec, c2s, s2c, myesk, mypk, repk)
+	} else {
+		ns = makeSocket(plain, sharedsec, s2c, c2s, myesk, mypk, repk)
+	}
+	ns.version = authVersion
+	ns.theirV2 = true
+	ns.peerRekeys = true
+	// send our part
+	mine := authMsg{Version: authVersion, NextProt: uint(cfg.NextProt)}
+	if cfg.StaticKey != nil {
+		mine.StaticPK = cfg.StaticKey.Public().(ed25519.PublicKey)
+		mine.Chain = cfg.KeyChain
+		mine.Sig = ed25519.Sign(cfg.StaticKey, authSigMsg(isServer, h, mine.NextProt))
+	}
+	wait := make(chan error, 1)
+	go func() {
+		b, err := rlp.EncodeToBytes(mine)
+		if err == nil {
+			err = ns.writeRecord(b, false)
+		}
+		wait <- err
+	}()
+	// the peer's part comes in exactly one record
+	buf := make([]byte, 32768)
+	n, err := ns.readRecord(buf)
+	if err != nil {
+		return
+	}
+	var theirs authMsg
+	if n == 0 || ns.rxbuf.Len() > 0 || rlp.DecodeBytes(buf[:n], &theirs) != nil || theirs.Version < authVersion {
+		err = ErrUntrustedPeer
+		return
+	}
+	if len(theirs.StaticPK) > 0 {
+		pk := ed25519.PublicKey(theirs.StaticPK)
+		if len(pk) != ed25519.PublicKeySize ||
+			!ed25519.Verify(pk, authSigMsg(!isServer, h, theirs.NextProt), theirs.Sig) ||
+			!cfg.trusts(pk, theirs.Chain) {
+			err = ErrUntrustedPeer
+			return
+		}
+		ns.peerKey = pk
+	} else if !isServer || cfg.RequirePeer {
+		err = ErrUntrustedPeer
+		return
+	}
+	ns.nextprot = byte(theirs.NextProt)
+	err = <-wait
+	if err != nil {
+		return
+	}
+	sok = ns
+	return
+}
+
+func (cfg Config) trusts(pk ed25519.PublicKey, chain KeyChain) bool {
+	for _, pinned := range cfg.PinnedKeys {
+		if bytes.Equal(pinned, pk) {
+			return true
+		}
+	}
+	return cfg.MasterKey != nil && chain.ends(cfg.MasterKey, pk, time.Now())
+}
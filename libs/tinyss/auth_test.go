@@ -0,0 +1,111 @@
+package tinyss
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func authPair(t *testing.T, ccfg, scfg Config) (client, server *Socket, cerr, serr error) {
+	rawC, rawS := tcpPair(t)
+	done := make(chan bool)
+	go func() {
+		server, serr = Server(rawS, scfg)
+		if serr != nil {
+			rawS.Close()
+		}
+		close(done)
+	}()
+	client, cerr = Client(rawC, ccfg)
+	if cerr != nil {
+		rawC.Close()
+	}
+	<-done
+	return
+}
+
+func TestAuthWithKeyChain(t *testing.T) {
+	masterPK, masterSK, _ := ed25519.GenerateKey(nil)
+	// the master certifies a long-lived key, which certifies a rotating one
+	midPK, midSK, _ := ed25519.GenerateKey(nil)
+	exitPK, exitSK, _ := ed25519.GenerateKey(nil)
+	now := time.Now()
+	chain := KeyChain{
+		SignKey(masterSK, midPK, now.Add(-time.Hour), now.Add(time.Hour*24*365)),
+		SignKey(midSK, exitPK, now.Add(-time.Hour), now.Add(time.Hour*24)),
+	}
+	client, server, cerr, serr := authPair(t,
+		Config{NextProt: 'N', MasterKey: masterPK},
+		Config{StaticKey: exitSK, KeyChain: chain})
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	defer client.Close()
+	defer server.Close()
+	if client.Version() != 3 || server.Version() != 3 {
+		t.Fatal("wrong versions", client.Version(), server.Version())
+	}
+	if server.NextProt() != 'N' || client.NextProt() != 0 {
+		t.Fatal("wrong next protocols", server.NextProt(), client.NextProt())
+	}
+	if !client.PeerKey().Equal(exitPK) || server.PeerKey() != nil {
+		t.Fatal("wrong peer keys")
+	}
+	transfer(t, client, server, 100000)
+
+	// an unrelated master, or a chain that expired, isn't good enough
+	otherPK, _, _ := ed25519.GenerateKey(nil)
+	if _, _, cerr, _ := authPair(t, Config{MasterKey: otherPK}, Config{StaticKey: exitSK, KeyChain: chain}); cerr != ErrUntrustedPeer {
+		t.Fatal("trusted a key from another master:", cerr)
+	}
+	expired := KeyChain{SignKey(masterSK, exitPK, now.Add(-time.Hour*2), now.Add(-time.Hour))}
+	if _, _, cerr, _ := authPair(t, Config{MasterKey: masterPK}, Config{StaticKey: exitSK, KeyChain: expired}); cerr != ErrUntrustedPeer {
+		t.Fatal("trusted an expired key:", cerr)
+	}
+}
+
+func TestAuthClientStaticKey(t *testing.T) {
+	serverPK, serverSK, _ := ed25519.GenerateKey(nil)
+	clientPK, clientSK, _ := ed25519.GenerateKey(nil)
+	client, server, cerr, serr := authPair(t,
+		Config{StaticKey: clientSK, PinnedKeys: []ed25519.PublicKey{serverPK}},
+		Config{StaticKey: serverSK, PinnedKeys: []ed25519.PublicKey{clientPK}, RequirePeer: true})
+	if cerr != nil || serr != nil {
+		t.Fatal(cerr, serr)
+	}
+	client.Close()
+	if !server.PeerKey().Equal(clientPK) {
+		t.Fatal("wrong client key")
+	}
+	// anonymous clients are refused
+	_, _, _, serr = authPair(t,
+		Config{PinnedKeys: []ed25519.PublicKey{serverPK}},
+		Config{StaticKey: serverSK, PinnedKeys: []ed25519.PublicKey{clientPK}, RequirePeer: true})
+	if serr != ErrUntrustedPeer {
+		t.Fatal("accepted an anonymous client:", serr)
+	}
+}
+
+func TestServerAcceptsLegacyClients(t *testing.T) {
+	_, serverSK, _ := ed25519.GenerateKey(nil)
+	a, b := handshakePair(t, func(c net.Conn) (*Socket, error) { return Server(c, Config{StaticKey: serverSK}) })
+	defer a.Close()
+	defer b.Close()
+	if b.Version() != 2 || b.NextProt() != 'N' || b.PeerKey() != nil {
+		t.Fatal("wrong legacy handshake", b.Version(), b.NextProt())
+	}
+	transfer(t, a, b, 1000)
+}
+
+func TestClientRefusesDowngrade(t *testing.T) {
+	serverPK, _, _ := ed25519.GenerateKey(nil)
+	rawC, rawS := tcpPair(t)
+	defer rawS.Close()
+	go Handshake(rawS, 0)
+	_, err := Client(rawC, Config{PinnedKeys: []ed25519.PublicKey{serverPK}})
+	if err != ErrDowngrade {
+		t.Fatal("didn't refuse a legacy server:", err)
+	}
+}
@@ -0,0 +1,128 @@
+package tinyss
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"golang.org/x/crypto/ed25519"
+)
+
+// KeyCert certifies a key for a period of time.
+type KeyCert struct {
+	Key        []byte // ed25519
+	ValidFrom  uint64 // Unix seconds
+	ValidUntil uint64 // Unix seconds
+}
+
+// SignedKey is a KeyCert signed by the key above it in a chain.
+type SignedKey struct {
+	Cert []byte // RLP-encoded KeyCert
+	Sig  []byte
+}
+
+// KeyChain certifies a static key starting from a master key, such as the binder's. The first link is signed by the master key and every other link by the key before it, so keys can be rotated without clients having to pin anything but the master.
+type KeyChain []SignedKey
+
+// ErrBadKeyChain is returned for key chains that are malformed, expired or not properly signed.
+var ErrBadKeyChain = errors.New("bad key chain")
+
+// keyChainPrefix starts the text encoding of a KeyChain.
+const keyChainPrefix = "tinyss-keychain:"
+
+func keySigMsg(cert []byte) []byte {
+	return append([]byte("tinyss-key-cert\n"), cert...)
+}
+
+// SignKey certifies a key with the signer's key.
+func SignKey(signer ed25519.PrivateKey, key ed25519.PublicKey, from, until time.Time) SignedKey {
+	cert, err := rlp.EncodeToBytes(KeyCert{
+		Key:        key,
+		ValidFrom:  uint64(from.Unix()),
+		ValidUntil: uint64(until.Unix()),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return SignedKey{
+		Cert: cert,
+		Sig:  ed25519.Sign(signer, keySigMsg(cert)),
+	}
+}
+
+// Verify checks every link of the chain, returning the key at its end.
+func (kc KeyChain) Verify(master ed25519.PublicKey, now time.Time) (key ed25519.PublicKey, err error) {
+	if len(kc) == 0 {
+		err = ErrBadKeyChain
+		return
+	}
+	key = master
+	t := uint64(now.Unix())
+	for _, sk := range kc {
+		var cert KeyCert
+		if len(key) != ed25519.PublicKeySize ||
+			!ed25519.Verify(key, keySigMsg(sk.Cert), sk.Sig) ||
+			rlp.DecodeBytes(sk.Cert, &cert) != nil ||
+			t < cert.ValidFrom || t > cert.ValidUntil {
+			key = nil
+			err = ErrBadKeyChain
+			return
+		}
+		key = cert.Key
+	}
+	if len(key) != ed25519.PublicKeySize {
+		key = nil
+		err = ErrBadKeyChain
+	}
+	return
+}
+
+// Expiry returns when the chain expires, which is when its earliest-expiring link does.
+func (kc KeyChain) Expiry() (exp time.Time) {
+	for _, sk := range kc {
+		var cert KeyCert
+		if rlp.DecodeBytes(sk.Cert, &cert) != nil {
+			return time.Time{}
+		}
+		t := time.Unix(int64(cert.ValidUntil), 0)
+		if exp.IsZero() || t.Before(exp) {
+			exp = t
+		}
+	}
+	return
+}
+
+// String encodes a KeyChain as text, suitable for files.
+func (kc KeyChain) String() string {
+	b, err := rlp.EncodeToBytes(kc)
+	if err != nil {
+		panic(err)
+	}
+	return keyChainPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseKeyChain decodes the text encoding of a KeyChain. It does not verify anything.
+func ParseKeyChain(s string) (kc KeyChain, err error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, keyChainPrefix) {
+		err = ErrBadKeyChain
+		return
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[len(keyChainPrefix):])
+	if err != nil {
+		err = ErrBadKeyChain
+		return
+	}
+	if err = rlp.DecodeBytes(b, &kc); err != nil {
+		err = ErrBadKeyChain
+	}
+	return
+}
+
+func (kc KeyChain) ends(master, key ed25519.PublicKey, now time.Time) bool {
+	end, err := kc.Verify(master, now)
+	return err == nil && bytes.Equal(end, key)
+}
@@ -0,0 +1,135 @@
+package tinyss
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/geph-official/geph2/libs/c25519"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Each direction's key is ratcheted forward through HKDF after it has protected RekeyBytes bytes or RekeyInterval of time, so a compromised key doesn't expose earlier traffic. A key update is announced with a key-update record, sealed with the old key; the sender switches right after it, and the receiver right after reading it. Every ReDHInterval, a key update also carries a fresh ephemeral public key, and the new key mixes in its Diffie-Hellman with the latest ephemeral the peer announced. 0 disables that.
+//
+// Peers that support key updates say so with the TinySS-2 header, followed by the next-protocol record and then an empty record. Old peers read the empty record as no data, and never send one, so we never send them key updates.
+var (
+	RekeyBytes    uint64 = 64 << 20
+	RekeyInterval        = 10 * time.Minute
+	ReDHInterval         = time.Hour
+)
+
+const (
+	// key-update records set the top bit of the length, which data records never reach
+	ctlBit = 0x8000
+	// the most data in one record, so that sealed data records stay below ctlBit
+	maxRecordData = 16384
+
+	kuDH = 1
+
+	// we keep our ephemerals until the peer uses a newer one, but never more than this
+	maxEphemerals = 64
+)
+
+var kuAD = []byte("tinyss-ku")
+
+var errBadKeyUpdate = errors.New("tinyss: bad key update")
+
+type ephemeral struct {
+	sk [32]byte
+	pk [32]byte
+}
+
+func newEphemeral() (eph ephemeral) {
+	eph.sk = c25519.GenSK()
+	curve25519.ScalarBaseMult(&eph.pk, &eph.sk)
+	return
+}
+
+// ratchet derives the next key from the current one, mixing in an optional Diffie-Hellman result.
+func ratchet(key, mix []byte) []byte {
+	next := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, mix, key, kuAD), next); err != nil {
+		panic(err)
+	}
+	return next
+}
+
+func (sk *Socket) needsRekey() bool {
+	sk.kulock.Lock()
+	defer sk.kulock.Unlock()
+	if !sk.peerRekeys {
+		return false
+	}
+	return sk.txbytes >= sk.rekeyBytes || time.Since(sk.txstart) >= sk.rekeyInterval
+}
+
+// updateTxKey sends a key-update record and switches to the next transmit key.
+func (sk *Socket) updateTxKey() (err error) {
+	msg := []byte{0}
+	var mix []byte
+	sk.kulock.Lock()
+	if sk.reDHInterval > 0 && time.Since(sk.lastDH) >= sk.reDHInterval && len(sk.myEph) < maxEphemerals {
+		eph := newEphemeral()
+		var dh [32]byte
+		curve25519.ScalarMult(&dh, &eph.sk, &sk.peerEph)
+		mix = dh[:]
+		msg = []byte{kuDH}
+		msg = append(msg, eph.pk[:]...)
+		msg = append(msg, sk.peerEph[:8]...)
+		sk.myEph = append(sk.myEph, eph)
+		sk.lastDH = time.Now()
+	}
+	sk.kulock.Unlock()
+	err = sk.writeRecord(msg, true)
+	if err != nil {
+		return
+	}
+	sk.txkey = ratchet(sk.txkey, mix)
+	sk.txcrypt = aead(sk.txkey)
+	sk.txctr = 0
+	sk.txbytes = 0
+	sk.txstart = time.Now()
+	sk.txepoch++
+	return
+}
+
+// handleKeyUpdate switches to the next receive key as told by a key-update record.
+func (sk *Socket) handleKeyUpdate(msg []byte) (err error) {
+	if len(msg) == 0 {
+		return errBadKeyUpdate
+	}
+	var mix []byte
+	if msg[0]&kuDH != 0 {
+		if len(msg) != 1+32+8 {
+			return errBadKeyUpdate
+		}
+		var theirpk [32]byte
+		copy(theirpk[:], msg[1:][:32])
+		sk.kulock.Lock()
+		found := -1
+		for i, eph := range sk.myEph {
+			if bytes.Equal(eph.pk[:8], msg[33:]) {
+				found = i
+			}
+		}
+		if found < 0 {
+			sk.kulock.Unlock()
+			return errBadKeyUpdate
+		}
+		var dh [32]byte
+		curve25519.ScalarMult(&dh, &sk.myEph[found].sk, &theirpk)
+		mix = dh[:]
+		// the peer will never use our older ephemerals again
+		sk.myEph = sk.myEph[found:]
+		sk.peerEph = theirpk
+		sk.kulock.Unlock()
+	}
+	sk.rxkey = ratchet(sk.rxkey, mix)
+	sk.rxcrypt = aead(sk.rxkey)
+	sk.rxctr = 0
+	sk.rxepoch++
+	return
+}
@@ -0,0 +1,220 @@
+package tinyss
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/geph-official/geph2/libs/c25519"
+	"golang.org/x/crypto/curve25519"
+)
+
+func tcpPair(t *testing.T) (a, b net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	a, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = <-accepted
+	return
+}
+
+func handshakePair(t *testing.T, handshakeB func(net.Conn) (*Socket, error)) (a, b *Socket) {
+	rawA, rawB := tcpPair(t)
+	done := make(chan error)
+	go func() {
+		var err error
+		b, err = handshakeB(rawB)
+		done <- err
+	}()
+	a, err := Handshake(rawA, 'N')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// oldHandshake is the handshake of peers from before key updates.
+func oldHandshake(plain net.Conn) (sok *Socket, err error) {
+	myesk := c25519.GenSK()
+	var pub [32]byte
+	curve25519.ScalarBaseMult(&pub, &myesk)
+	go plain.Write(append([]byte("TinySS-1"), pub[:]...))
+	bts := make([]byte, 32+8)
+	_, err = io.ReadFull(plain, bts)
+	if err != nil {
+		return
+	}
+	var repk [32]byte
+	copy(repk[:], bts[8:])
+	sok = newSocket(plain, repk, myesk)
+	if string(bts[:8]) == "TinySS-2" {
+		var theirNextProt byte
+		err = binary.Read(sok, binary.BigEndian, &theirNextProt)
+		sok.nextprot = theirNextProt
+	}
+	return
+}
+
+// transfer sends random data both ways at once and checks that it arrives intact.
+func transfer(t *testing.T, a, b *Socket, size int) {
+	check := func(from, to *Socket) chan error {
+		result := make(chan error, 2)
+		data := make([]byte, size)
+		rand.Read(data)
+		go func() {
+			for i := 0; i < len(data); i += 1000 {
+				end := i + 1000
+				if end > len(data) {
+					end = len(data)
+				}
+				if _, err := from.Write(data[i:end]); err != nil {
+					result <- err
+					return
+				}
+			}
+			result <- nil
+		}()
+		go func() {
+			got := make([]byte, len(data))
+			to.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.ReadFull(to, got); err != nil {
+				result <- err
+				return
+			}
+			if !bytes.Equal(got, data) {
+				result <- io.ErrUnexpectedEOF
+				return
+			}
+			result <- nil
+		}()
+		return result
+	}
+	ab := check(a, b)
+	ba := check(b, a)
+	for i := 0; i < 2; i++ {
+		if err := <-ab; err != nil {
+			t.Fatal("a to b:", err)
+		}
+		if err := <-ba; err != nil {
+			t.Fatal("b to a:", err)
+		}
+	}
+}
+
+func TestKeyUpdatesCross(t *testing.T) {
+	a, b := handshakePair(t, func(c net.Conn) (*Socket, error) { return Handshake(c, 0) })
+	defer a.Close()
+	defer b.Close()
+	if a.NextProt() != 0 || b.NextProt() != 'N' {
+		t.Fatal("wrong next protocols", a.NextProt(), b.NextProt())
+	}
+	// we only start switching keys after reading the peer's support for them
+	transfer(t, a, b, 1)
+	// both sides switch keys, with and without DH, while the other's key updates are in flight
+	a.rekeyBytes, b.rekeyBytes = 5000, 7000
+	a.reDHInterval, b.reDHInterval = time.Nanosecond, time.Millisecond
+	transfer(t, a, b, 1<<20)
+	if a.txepoch < 100 || b.txepoch < 100 {
+		t.Fatal("not enough key updates", a.txepoch, b.txepoch)
+	}
+	if a.txepoch != b.rxepoch || b.txepoch != a.rxepoch {
+		t.Fatal("key epochs don't match")
+	}
+}
+
+func TestKeyUpdatesByTime(t *testing.T) {
+	a, b := handshakePair(t, func(c net.Conn) (*Socket, error) { return Handshake(c, 0) })
+	defer a.Close()
+	defer b.Close()
+	a.rekeyInterval = time.Millisecond
+	transfer(t, a, b, 1000)
+	time.Sleep(5 * time.Millisecond)
+	transfer(t, a, b, 1000)
+	if a.txepoch == 0 || b.txepoch != 0 {
+		t.Fatal("wrong key epochs", a.txepoch, b.txepoch)
+	}
+}
+
+func TestNoKeyUpdatesWithOldPeer(t *testing.T) {
+	a, b := handshakePair(t, oldHandshake)
+	defer a.Close()
+	defer b.Close()
+	if b.NextProt() != 'N' {
+		t.Fatal("wrong next protocol", b.NextProt())
+	}
+	a.rekeyBytes = 1000
+	transfer(t, a, b, 100000)
+	if a.txepoch != 0 {
+		t.Fatal("sent key updates to an old peer")
+	}
+}
+
+func TestLargeWrites(t *testing.T) {
+	a, b := handshakePair(t, func(c net.Conn) (*Socket, error) { return Handshake(c, 0) })
+	defer a.Close()
+	defer b.Close()
+	transfer(t, a, b, 1)
+	a.rekeyBytes = 50000
+	for _, size := range []int{32753, 40000, 100000} {
+		data := make([]byte, size)
+		rand.Read(data)
+		written := make(chan error)
+		go func() {
+			_, err := a.Write(data)
+			written <- err
+		}()
+		got := make([]byte, size)
+		b.SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(b, got); err != nil {
+			t.Fatal(size, err)
+		}
+		if err := <-written; err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal(size, "data corrupted")
+		}
+	}
+	if a.txepoch == 0 {
+		t.Fatal("no key updates")
+	}
+}
+
+func TestLargeRecordsFromOldPeer(t *testing.T) {
+	a, b := handshakePair(t, oldHandshake)
+	defer a.Close()
+	defer b.Close()
+	// old peers send up to 32768 bytes in one record
+	data := make([]byte, 32768)
+	rand.Read(data)
+	go b.writeRecord(data, false)
+	got := make([]byte, len(data))
+	a.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(a, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted")
+	}
+}
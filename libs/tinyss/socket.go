@@ -9,12 +9,14 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/geph-official/geph2/libs/c25519"
 	pool "github.com/libp2p/go-buffer-pool"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
 )
 
 // Socket represents a TinySS connection; it implements net.Conn but with more methods.
@@ -23,15 +25,34 @@ type Socket struct {
 	rxerr   error
 	rxcrypt cipher.AEAD
 	rxbuf   bytes.Buffer
+	rxkey   []byte
+	rxepoch uint64
 
 	txctr   uint64
 	txcrypt cipher.AEAD
+	txkey   []byte
+	txepoch uint64
+	txbytes uint64
+	txstart time.Time
 
 	plain         net.Conn
 	plainBuffered *bufio.Reader
 	sharedsec     []byte
 
 	nextprot byte
+	version  int
+	peerKey  ed25519.PublicKey
+
+	rekeyBytes    uint64
+	rekeyInterval time.Duration
+	reDHInterval  time.Duration
+
+	kulock     sync.Mutex
+	theirV2    bool
+	peerRekeys bool
+	lastDH     time.Time
+	myEph      []ephemeral
+	peerEph    [32]byte
 }
 
 func hm(m, k []byte) []byte {
@@ -67,16 +88,26 @@ func newSocket(plain net.Conn, repk, lesk [32]byte) (sok *Socket) {
 		txkey = s1
 		rxkey = s2
 	}
-	// create socket
-	sok = &Socket{
+	return makeSocket(plain, sharedsec[:], rxkey, txkey, lesk, lepk, repk)
+}
+
+func makeSocket(plain net.Conn, sharedsec, rxkey, txkey []byte, lesk, lepk, repk [32]byte) *Socket {
+	return &Socket{
 		rxcrypt:       aead(rxkey),
+		rxkey:         rxkey,
 		txcrypt:       aead(txkey),
+		txkey:         txkey,
+		txstart:       time.Now(),
 		plain:         plain,
-		sharedsec:     sharedsec[:],
+		sharedsec:     sharedsec,
 		plainBuffered: bufio.NewReader(plain),
+		rekeyBytes:    RekeyBytes,
+		rekeyInterval: RekeyInterval,
+		reDHInterval:  ReDHInterval,
+		lastDH:        time.Now(),
+		myEph:         []ephemeral{{lesk, lepk}},
+		peerEph:       repk,
 	}
-
-	return
 }
 
 var decctr1 uint64
@@ -86,30 +117,60 @@ func (sk *Socket) NextProt() byte {
 	return sk.nextprot
 }
 
+// Version returns the handshake version: 3 for authenticated handshakes, or less for legacy ones.
+func (sk *Socket) Version() int {
+	return sk.version
+}
+
+// PeerKey returns the static key the remote authenticated with, or nil if it didn't.
+func (sk *Socket) PeerKey() ed25519.PublicKey {
+	return sk.peerKey
+}
+
 // Read reads into the given byte slice.
 func (sk *Socket) Read(p []byte) (n int, err error) {
-	// if any in buffer, read from buffer
-	if sk.rxbuf.Len() > 0 {
-		return sk.rxbuf.Read(p)
-	}
-	// if error exists, return it
-	err = sk.rxerr
-	if err != nil {
-		return
+	for {
+		// if any in buffer, read from buffer
+		if sk.rxbuf.Len() > 0 {
+			return sk.rxbuf.Read(p)
+		}
+		// if error exists, return it
+		err = sk.rxerr
+		if err != nil {
+			return
+		}
+		// otherwise wait for record
+		n, err = sk.readRecord(p)
+		if err != nil {
+			sk.rxerr = err
+			return
+		}
+		if n > 0 {
+			return
+		}
 	}
-	// otherwise wait for record
+}
+
+// readRecord reads one record, copying any data into p and the buffer.
+func (sk *Socket) readRecord(p []byte) (n int, err error) {
 	lenbts := pool.GlobalPool.Get(2)
 	defer pool.GlobalPool.Put(lenbts)
 	_, err = io.ReadFull(sk.plainBuffered, lenbts)
 	if err != nil {
-		sk.rxerr = err
 		return
 	}
-	ciph := pool.GlobalPool.Get(int(binary.BigEndian.Uint16(lenbts)))
+	length := binary.BigEndian.Uint16(lenbts)
+	// old peers send data records up to 32784 bytes long, but never key updates
+	sk.kulock.Lock()
+	isCtl := sk.peerRekeys && length&ctlBit != 0
+	sk.kulock.Unlock()
+	if isCtl {
+		length &^= ctlBit
+	}
+	ciph := pool.GlobalPool.Get(int(length))
 	defer pool.GlobalPool.Put(ciph)
 	_, err = io.ReadFull(sk.plainBuffered, ciph)
 	if err != nil {
-		sk.rxerr = err
 		return
 	}
 	// decrypt the ciphertext
@@ -120,9 +181,24 @@ func (sk *Socket) Read(p []byte) (n int, err error) {
 	defer pool.GlobalPool.Put(nonce)
 	binary.BigEndian.PutUint64(nonce, sk.rxctr)
 	sk.rxctr++
-	data, err := sk.rxcrypt.Open(ciph[:0], nonce, ciph, nil)
+	var ad []byte
+	if isCtl {
+		ad = kuAD
+	}
+	data, err := sk.rxcrypt.Open(ciph[:0], nonce, ciph, ad)
 	if err != nil {
-		sk.rxerr = err
+		return
+	}
+	if isCtl {
+		err = sk.handleKeyUpdate(data)
+		return
+	}
+	if len(data) == 0 {
+		sk.kulock.Lock()
+		if sk.theirV2 {
+			sk.peerRekeys = true
+		}
+		sk.kulock.Unlock()
 		return
 	}
 	// copy the data into the buffer
@@ -135,15 +211,15 @@ func (sk *Socket) Read(p []byte) (n int, err error) {
 
 // Write writes out the given byte slice. No guarantees are made regarding the number of low-level segments sent over the wire.
 func (sk *Socket) Write(p []byte) (n int, err error) {
-	if len(p) > 32768 {
+	if len(p) > maxRecordData {
 		// recurse
 		var n1 int
 		var n2 int
-		n1, err = sk.Write(p[:32768])
+		n1, err = sk.Write(p[:maxRecordData])
 		if err != nil {
 			return
 		}
-		n2, err = sk.Write(p[32768:])
+		n2, err = sk.Write(p[maxRecordData:])
 		if err != nil {
 			return
 		}
@@ -151,7 +227,22 @@ func (sk *Socket) Write(p []byte) (n int, err error) {
 		return
 	}
 	// main work here
+	if sk.needsRekey() {
+		err = sk.updateTxKey()
+		if err != nil {
+			return
+		}
+	}
+	err = sk.writeRecord(p, false)
+	sk.txbytes += uint64(len(p))
+	n = len(p)
+	return
+}
+
+// writeRecord seals and writes out one record.
+func (sk *Socket) writeRecord(p []byte, isCtl bool) (err error) {
 	backing := pool.GlobalPool.Get(sk.txcrypt.Overhead() + 2 + len(p))
+	defer pool.GlobalPool.Put(backing)
 	nonce := pool.GlobalPool.Get(sk.txcrypt.NonceSize())
 	defer pool.GlobalPool.Put(nonce)
 	for i := range nonce {
@@ -159,10 +250,15 @@ func (sk *Socket) Write(p []byte) (n int, err error) {
 	}
 	binary.BigEndian.PutUint64(nonce, sk.txctr)
 	sk.txctr++
-	ciph := sk.txcrypt.Seal(backing[2:][:0], nonce, p, nil)
-	binary.BigEndian.PutUint16(backing[:2], uint16(len(ciph)))
+	var ad []byte
+	length := uint16(0)
+	if isCtl {
+		ad = kuAD
+		length = ctlBit
+	}
+	ciph := sk.txcrypt.Seal(backing[2:][:0], nonce, p, ad)
+	binary.BigEndian.PutUint16(backing[:2], length|uint16(len(ciph)))
 	_, err = sk.plain.Write(backing)
-	n = len(p)
 	return
 }
 
@@ -208,20 +304,29 @@ func Handshake(plain net.Conn, nextProtocol byte) (sok *Socket, err error) {
 	// in another thread, send over hello
 	wet := make(chan bool)
 	go func() {
-		var msgb bytes.Buffer
-		// if nextProtocol isn't zero, we send a different protocol header
-		if nextProtocol == 0 {
-			msgb.Write([]byte("TinySS-1"))
-		} else {
-			msgb.Write([]byte("TinySS-2"))
-		}
-		var pub [32]byte
-		curve25519.ScalarBaseMult(&pub, &myesk)
-		msgb.Write(pub[:])
-		io.Copy(plain, &msgb)
+		// we always send TinySS-2, so that the peer knows to look for our key-update support
+		writeHello(plain, "TinySS-2", myesk)
 		close(wet)
 	}()
-	// read hello
+	version, repk, err := readHello(plain)
+	if err != nil {
+		return
+	}
+	<-wet
+	return finishLegacy(plain, version, repk, myesk, nextProtocol)
+}
+
+func writeHello(plain net.Conn, version string, myesk [32]byte) (err error) {
+	var msgb bytes.Buffer
+	msgb.Write([]byte(version))
+	var pub [32]byte
+	curve25519.ScalarBaseMult(&pub, &myesk)
+	msgb.Write(pub[:])
+	_, err = io.Copy(plain, &msgb)
+	return
+}
+
+func readHello(plain net.Conn) (version string, repk [32]byte, err error) {
 	bts := make([]byte, 32+8)
 	_, err = io.ReadFull(plain, bts)
 	if err != nil {
@@ -232,21 +337,27 @@ func Handshake(plain net.Conn, nextProtocol byte) (sok *Socket, err error) {
 		err = io.ErrClosedPipe
 		return
 	}
-	<-wet
-	// read rest of hello
-	var repk [32]byte
+	version = string(bts[:8])
 	copy(repk[:], bts[8:][:32])
+	return
+}
+
+// finishLegacy finishes an unauthenticated handshake once hellos are exchanged.
+func finishLegacy(plain net.Conn, version string, repk, myesk [32]byte, nextProtocol byte) (sok *Socket, err error) {
 	ns := newSocket(plain, repk, myesk)
+	ns.version = 1
 	wait := make(chan bool)
-	if nextProtocol != 0 {
-		go func() {
-			binary.Write(ns, binary.BigEndian, nextProtocol)
-			close(wait)
-		}()
-	}
-	switch string(bts[:8]) {
+	go func() {
+		binary.Write(ns, binary.BigEndian, nextProtocol)
+		// an empty record says we support key updates
+		ns.writeRecord(nil, false)
+		close(wait)
+	}()
+	switch version {
 	case "TinySS-1":
 	case "TinySS-2":
+		ns.theirV2 = true
+		ns.version = 2
 		// then we wait for their next protocol
 		var theirNextProt byte
 		err = binary.Read(ns, binary.BigEndian, &theirNextProt)
@@ -256,8 +367,6 @@ func Handshake(plain net.Conn, nextProtocol byte) (sok *Socket, err error) {
 		ns.nextprot = theirNextProt
 	}
 	sok = ns
-	if nextProtocol != 0 {
-		<-wait
-	}
+	<-wait
 	return
 }
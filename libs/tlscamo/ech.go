@@ -0,0 +1,155 @@
+package tlscamo
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hpke"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/minio/blake2b-simd"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	extensionServerName = 0x0000
+	extensionECH        = 0xfe0d
+	echVersion          = 0xfe0d
+	echOuter            = 0
+	kemX25519           = 0x0020
+	kdfHKDFSHA256       = 0x0001
+	aeadAES128GCM       = 0x0001
+)
+
+// echKey derives the ECH key and config ID of a cookie for an epoch.
+func echKey(cookie []byte, epoch int64) (*ecdh.PrivateKey, uint8) {
+	mac := blake2b.NewMAC(33, cookie)
+	mac.Write([]byte(fmt.Sprintf("tlscamo-ech-%v", epoch)))
+	seed := mac.Sum(nil)
+	sk, err := ecdh.X25519().NewPrivateKey(seed[:32])
+	if err != nil {
+		panic(err)
+	}
+	return sk, seed[32]
+}
+
+// echConfig encodes the ECHConfig of a key, with publicName as the server name outside the encryption.
+func echConfig(sk *ecdh.PrivateKey, configID uint8, publicName string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(echVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(configID)
+		b.AddUint16(kemX25519)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(sk.PublicKey().Bytes())
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(kdfHKDFSHA256)
+			b.AddUint16(aeadAES128GCM)
+		})
+		b.AddUint8(0) // maximum_name_length
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // no extensions
+	})
+	return b.BytesOrPanic()
+}
+
+// echConfigList wraps an ECHConfig in the list tls.Config takes.
+func echConfigList(config []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(config)
+	})
+	return b.BytesOrPanic()
+}
+
+// outerHello is what authenticating a ClientHello needs from it.
+type outerHello struct {
+	raw        []byte // the whole handshake message
+	serverName string
+	kdf, aead  uint16
+	configID   uint8
+	enc        []byte
+	payload    []byte
+}
+
+// parseHello parses the ClientHello in a record, which must have an outer ECH extension.
+func parseHello(record []byte) (hello outerHello, ok bool) {
+	if len(record) < 5 {
+		return
+	}
+	msg := cryptobyte.String(record[5:])
+	var msgType uint8
+	var body cryptobyte.String
+	if !msg.ReadUint8(&msgType) || msgType != typeClientHello || !msg.ReadUint24LengthPrefixed(&body) {
+		return
+	}
+	hello.raw = record[5 : len(record)-len(msg)]
+	var sessionID, suites, compression, extensions cryptobyte.String
+	if !body.Skip(2+32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&suites) ||
+		!body.ReadUint8LengthPrefixed(&compression) ||
+		!body.ReadUint16LengthPrefixed(&extensions) {
+		return
+	}
+	foundECH := false
+	for !extensions.Empty() {
+		var extType uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return
+		}
+		switch extType {
+		case extensionServerName:
+			var names, name cryptobyte.String
+			var nameType uint8
+			if !ext.ReadUint16LengthPrefixed(&names) || !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return
+			}
+			hello.serverName = string(name)
+		case extensionECH:
+			var echType uint8
+			var enc, payload cryptobyte.String
+			if !ext.ReadUint8(&echType) || echType != echOuter ||
+				!ext.ReadUint16(&hello.kdf) ||
+				!ext.ReadUint16(&hello.aead) ||
+				!ext.ReadUint8(&hello.configID) ||
+				!ext.ReadUint16LengthPrefixed(&enc) ||
+				!ext.ReadUint16LengthPrefixed(&payload) {
+				return
+			}
+			hello.enc = enc
+			hello.payload = payload
+			foundECH = true
+		}
+	}
+	ok = foundECH && hello.serverName != ""
+	return
+}
+
+// openHello tells whether a key decrypts a ClientHello's ECH payload, as a TLS server would.
+func openHello(hello outerHello, sk *ecdh.PrivateKey, config []byte) bool {
+	if hello.kdf != kdfHKDFSHA256 || hello.aead != aeadAES128GCM {
+		return false
+	}
+	priv, err := hpke.NewDHKEMPrivateKey(sk)
+	if err != nil {
+		return false
+	}
+	recipient, err := hpke.NewRecipient(hello.enc, priv, hpke.HKDFSHA256(), hpke.AES128GCM(), append([]byte("tls ech\x00"), config...))
+	if err != nil {
+		return false
+	}
+	// the payload is authenticated along with the rest of the ClientHello, with itself zeroed out
+	aad := bytes.Replace(hello.raw[4:], hello.payload, make([]byte, len(hello.payload)), 1)
+	_, err = recipient.Open(aad, hello.payload)
+	return err == nil
+}
+
+// echServerKey returns the key the TLS server needs to accept an ECH config.
+func echServerKey(sk *ecdh.PrivateKey, config []byte) tls.EncryptedClientHelloKey {
+	return tls.EncryptedClientHelloKey{Config: config, PrivateKey: sk.Bytes()}
+}
@@ -0,0 +1,44 @@
+package tlscamo
+
+import (
+	"errors"
+	"sort"
+)
+
+// Profile describes the ClientHello a client sends. The standard library builds the rest of it, so a profile only chooses the ALPN list, and the ClientHello still has Go's fingerprint rather than a browser's.
+type Profile struct {
+	ALPN []string
+}
+
+// ErrUnknownProfile is returned for unknown profile names.
+var ErrUnknownProfile = errors.New("unknown TLS profile")
+
+var profiles = map[string]Profile{
+	// a browser loading a website
+	"h2": {
+		ALPN: []string{"h2", "http/1.1"},
+	},
+	// an API client or command-line tool
+	"http1": {
+		ALPN: []string{"http/1.1"},
+	},
+}
+
+// GetProfile returns the named profile.
+func GetProfile(name string) (Profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return Profile{}, ErrUnknownProfile
+	}
+	return p, nil
+}
+
+// Names returns the names of all profiles, sorted.
+func Names() []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
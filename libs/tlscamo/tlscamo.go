@@ -0,0 +1,169 @@
+// Package tlscamo wraps connections to bridges in a genuine TLS 1.3 handshake, so that they don't start with high-entropy bytes.
+//
+// Clients authenticate inside the handshake itself, with Encrypted Client Hello: the ECH key is derived from the bridge cookie and the current 30-second epoch, so only clients that know the cookie can encrypt a ClientHello the bridge can open. Servers try to open it before answering. Connections that don't authenticate, including replays, are proxied byte for byte to a real upstream site, so probers see that site and its certificate. The server name outside the encryption is the one clients are told to use.
+//
+// The TLS layer only hides the connection. Servers use self-signed certificates that clients don't verify, so whatever runs inside, normally cshirt2, must still authenticate the bridge.
+package tlscamo
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/geph-official/geph2/libs/replay"
+)
+
+// ErrNotAuthenticated is returned by Server for connections that failed to authenticate, after they were proxied upstream.
+var ErrNotAuthenticated = errors.New("tlscamo: client not authenticated")
+
+// ReplayFilter rejects replayed ClientHellos. Servers can replace it with a persistent or shared filter before accepting connections.
+var ReplayFilter replay.Filter = replay.NewBloom(replay.DefaultCapacity)
+
+// epochWindow is how many 30-second epochs off a client's clock may be.
+const epochWindow = 30
+
+const (
+	recordHandshake = 0x16
+	typeClientHello = 0x01
+	maxRecordLen    = 16384 + 2048
+)
+
+// Client handshakes with a bridge, sending sni as the server name and a ClientHello shaped like profile.
+func Client(conn net.Conn, cookie []byte, sni string, profile Profile) (net.Conn, error) {
+	sk, configID := echKey(cookie, time.Now().Unix()/30)
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:                     sni,
+		NextProtos:                     profile.ALPN,
+		MinVersion:                     tls.VersionTLS13,
+		InsecureSkipVerify:             true,
+		EncryptedClientHelloConfigList: echConfigList(echConfig(sk, configID, sni)),
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// ServerConfig configures Server.
+type ServerConfig struct {
+	Certificate tls.Certificate // presented to authenticated clients; see SelfSigned
+	Upstream    string          // host:port of the site that gets everything else, or empty to just close
+}
+
+// Server handshakes with a client. Clients that don't authenticate are proxied to cfg.Upstream, and Server returns ErrNotAuthenticated once the upstream is done with them.
+func Server(conn net.Conn, cookie []byte, cfg ServerConfig) (net.Conn, error) {
+	record, err := readRecord(conn)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := checkHello(record, cookie)
+	if !ok {
+		if cfg.Upstream != "" {
+			proxy(conn, record, cfg.Upstream)
+		}
+		return nil, ErrNotAuthenticated
+	}
+	tlsConn := tls.Server(&prefixConn{Conn: conn, prefix: record}, &tls.Config{
+		Certificates:             []tls.Certificate{cfg.Certificate},
+		NextProtos:               []string{"h2", "http/1.1"},
+		MinVersion:               tls.VersionTLS13,
+		EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{key},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	if !tlsConn.ConnectionState().ECHAccepted {
+		tlsConn.Close()
+		return nil, ErrNotAuthenticated
+	}
+	return tlsConn, nil
+}
+
+// readRecord reads the first TLS record. Anything that doesn't look like one is returned as is, for proxying.
+func readRecord(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 5)
+	n, err := io.ReadFull(conn, header)
+	if err != nil {
+		return header[:n], err
+	}
+	length := int(binary.BigEndian.Uint16(header[3:]))
+	if header[0] != recordHandshake || length > maxRecordLen {
+		return header, nil
+	}
+	record := make([]byte, 5+length)
+	copy(record, header)
+	n, err = io.ReadFull(conn, record[5:])
+	return record[:5+n], err
+}
+
+// checkHello tries to open the ECH extension of the ClientHello in a record with the cookie's recent keys, and checks that it wasn't seen before. It returns the key the TLS server should accept.
+func checkHello(record []byte, cookie []byte) (key tls.EncryptedClientHelloKey, ok bool) {
+	hello, ok := parseHello(record)
+	if !ok {
+		return
+	}
+	ok = false
+	now := time.Now().Unix() / 30
+	for epoch := now - epochWindow; epoch <= now+epochWindow; epoch++ {
+		sk, configID := echKey(cookie, epoch)
+		if configID != hello.configID {
+			continue
+		}
+		config := echConfig(sk, configID, hello.serverName)
+		if openHello(hello, sk, config) {
+			ok = ReplayFilter.Check(hello.enc, time.Unix((epoch+epochWindow+1)*30, 0))
+			key = echServerKey(sk, config)
+			return
+		}
+	}
+	return
+}
+
+func proxy(conn net.Conn, prefix []byte, upstream string) {
+	// from now on, the upstream's own timeouts apply
+	conn.SetDeadline(time.Time{})
+	remote, err := net.DialTimeout("tcp", upstream, time.Second*10)
+	if err != nil {
+		return
+	}
+	defer remote.Close()
+	if _, err := remote.Write(prefix); err != nil {
+		return
+	}
+	go func() {
+		io.Copy(remote, conn)
+		if tc, ok := remote.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	io.Copy(conn, remote)
+}
+
+// Sniff tells whether a connection starts with a TLS handshake record, without consuming anything from it. Bridges use it to serve TLS and plain cshirt2 on the same ports.
+func Sniff(conn net.Conn) (net.Conn, bool, error) {
+	header := make([]byte, 3)
+	n, err := io.ReadFull(conn, header)
+	pc := &prefixConn{Conn: conn, prefix: header[:n]}
+	if err != nil {
+		return pc, false, err
+	}
+	return pc, header[0] == recordHandshake && header[1] == 0x03 && header[2] <= 0x04, nil
+}
+
+// prefixConn is a connection that first returns bytes read from it earlier.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (pc *prefixConn) Read(p []byte) (n int, err error) {
+	if len(pc.prefix) > 0 {
+		n = copy(p, pc.prefix)
+		pc.prefix = pc.prefix[n:]
+		return
+	}
+	return pc.Conn.Read(p)
+}
@@ -0,0 +1,215 @@
+package tlscamo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenCamo serves one camouflaged echo connection per accepted connection, reporting Server's errors.
+func listenCamo(t *testing.T, cookie []byte, upstream string) (string, chan error) {
+	cert, err := SelfSigned("bridge.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 16)
+	go func() {
+		defer l.Close()
+		for {
+			raw, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer raw.Close()
+				wire, isTLS, err := Sniff(raw)
+				if err != nil || !isTLS {
+					errs <- ErrNotAuthenticated
+					return
+				}
+				conn, err := Server(wire, cookie, ServerConfig{Certificate: cert, Upstream: upstream})
+				errs <- err
+				if err == nil {
+					io.Copy(conn, conn)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), errs
+}
+
+// listenUpstream runs a TLS echo server standing in for a real site.
+func listenUpstream(t *testing.T) (string, []byte) {
+	cert, err := SelfSigned("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), cert.Certificate[0]
+}
+
+func echo(t *testing.T, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	msg := []byte("hello world")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("echo mismatch")
+	}
+}
+
+func TestCamoRoundTrip(t *testing.T) {
+	cookie := []byte("cookie")
+	upstream, _ := listenUpstream(t)
+	addr, errs := listenCamo(t, cookie, upstream)
+	for _, name := range Names() {
+		profile, _ := GetProfile(name)
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := Client(raw, cookie, "www.example.com", profile)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(name, err)
+		}
+		if state := conn.(*tls.Conn).ConnectionState(); state.Version != tls.VersionTLS13 || state.NegotiatedProtocol != profile.ALPN[0] {
+			t.Fatal(name, "bad connection state", state.Version, state.NegotiatedProtocol)
+		}
+		echo(t, conn)
+		conn.Close()
+	}
+}
+
+func TestUnauthenticatedGoUpstream(t *testing.T) {
+	cookie := []byte("cookie")
+	upstream, upstreamCert := listenUpstream(t)
+	addr, errs := listenCamo(t, cookie, upstream)
+	// a prober without the cookie sees the upstream site
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe := tls.Client(raw, &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true})
+	if err := probe.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(probe.ConnectionState().PeerCertificates[0].Raw, upstreamCert) {
+		t.Fatal("prober didn't get the upstream's certificate")
+	}
+	echo(t, probe)
+	probe.Close()
+	if err := <-errs; err != ErrNotAuthenticated {
+		t.Fatal("expected ErrNotAuthenticated, got", err)
+	}
+	// so does a prober replaying a real ClientHello
+	recorder := &recordConn{hellos: make(chan []byte, 1)}
+	go Client(recorder, cookie, "www.example.com", profiles["h2"])
+	hello := <-recorder.hellos
+	for i := 0; i < 2; i++ {
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw.Write(hello)
+		raw.SetDeadline(time.Now().Add(time.Second * 5))
+		if _, err := raw.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		raw.Close()
+		err = <-errs
+		if i == 0 && err == ErrNotAuthenticated {
+			t.Fatal("fresh ClientHello rejected")
+		}
+		if i == 1 && err != ErrNotAuthenticated {
+			t.Fatal("replayed ClientHello accepted")
+		}
+	}
+}
+
+func TestHelloOnWire(t *testing.T) {
+	cookie := []byte("cookie")
+	recorder := &recordConn{hellos: make(chan []byte, 1)}
+	go Client(recorder, cookie, "www.example.com", profiles["h2"])
+	record := <-recorder.hellos
+	hello, ok := parseHello(record)
+	if !ok {
+		t.Fatal("no ECH extension in the ClientHello")
+	}
+	if hello.serverName != "www.example.com" {
+		t.Fatal("wrong server name on the wire:", hello.serverName)
+	}
+	// the extension is the one for the cookie's key in this epoch or the last
+	now := time.Now().Unix() / 30
+	opened := false
+	for _, epoch := range []int64{now, now - 1} {
+		sk, configID := echKey(cookie, epoch)
+		if hello.configID == configID && openHello(hello, sk, echConfig(sk, configID, hello.serverName)) {
+			opened = true
+		}
+	}
+	if !opened {
+		t.Fatal("ECH payload doesn't open with the cookie's key")
+	}
+	sk, configID := echKey([]byte("other"), now)
+	if openHello(hello, sk, echConfig(sk, configID, hello.serverName)) {
+		t.Fatal("ECH payload opens with another cookie's key")
+	}
+	// tampering with anything in the ClientHello fails authentication
+	tampered := append([]byte(nil), record...)
+	tampered[5+4+2] ^= 1
+	if _, ok := checkHello(tampered, cookie); ok {
+		t.Fatal("tampered ClientHello accepted")
+	}
+	if _, ok := checkHello(record, cookie); !ok {
+		t.Fatal("ClientHello not accepted")
+	}
+}
+
+// recordConn records the ClientHello and then blocks forever.
+type recordConn struct {
+	net.Conn
+	hellos chan []byte
+}
+
+func (rc *recordConn) Write(p []byte) (int, error) {
+	rc.hellos <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (rc *recordConn) Read(p []byte) (int, error) {
+	select {}
+}
+
+func (rc *recordConn) SetDeadline(t time.Time) error      { return nil }
+func (rc *recordConn) SetReadDeadline(t time.Time) error  { return nil }
+func (rc *recordConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,144 @@
+// Package urtcprelay carries URTCP through bridges, for clients whose paths only let TCP through. Clients ask a bridge for "conn/urtcp" inside their cshirt2 connection to it. The bridge opens its own cshirt2 connection to the exit's URTCP port with the exit's cookie, and relays segments between the two, dropping rather than queueing when either side can't keep up. Exits only speak URTCP after a cshirt2 handshake with their cookie.
+package urtcprelay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/geph-official/geph2/libs/cshirt2"
+	"github.com/geph-official/geph2/libs/kcp-go"
+	"github.com/geph-official/geph2/libs/niaucchi4"
+	"github.com/geph-official/geph2/libs/niaucchi5"
+	"golang.org/x/time/rate"
+)
+
+// ExitPort is the TCP port exits serve URTCP on.
+const ExitPort = 2390
+
+// Config configures a bridge's relays.
+type Config struct {
+	AllowExit func(host string) bool // which exit hosts clients may ask for
+	ExitPort  int                    // zero for ExitPort
+	Limiter   *rate.Limiter          // limits traffic both ways, if set
+
+	// optional statistics hooks
+	OnUp   func(n int)
+	OnDown func(n int)
+}
+
+// Handle serves a conn/urtcp request, whose command was already read from dec. It reads the exit's host and cookie, connects to the exit, tells the client to go ahead, and relays segments until either side goes away.
+func (cfg *Config) Handle(client net.Conn, dec *rlp.Stream) (err error) {
+	var host string
+	err = dec.Decode(&host)
+	if err != nil {
+		return
+	}
+	if !cfg.AllowExit(host) {
+		err = fmt.Errorf("bad pattern: %v", host)
+		return
+	}
+	var cookie []byte
+	err = dec.Decode(&cookie)
+	if err != nil {
+		return
+	}
+	exitPort := cfg.ExitPort
+	if exitPort == 0 {
+		exitPort = ExitPort
+	}
+	raw, err := net.DialTimeout("tcp", fmt.Sprintf("%v:%v", host, exitPort), time.Second*10)
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	raw.SetDeadline(deadline)
+	remote, err := cshirt2.Client(cookie, raw)
+	if err != nil {
+		raw.Close()
+		return
+	}
+	raw.SetDeadline(time.Time{})
+	// the client only starts speaking URTCP once it gets this
+	err = rlp.Encode(client, uint(0))
+	if err != nil {
+		remote.Close()
+		return
+	}
+	client.SetDeadline(time.Now().Add(time.Hour * 24))
+	cfg.relay(client, remote)
+	return
+}
+
+func (cfg *Config) relay(client, remote net.Conn) {
+	cl := niaucchi5.NewURTCP(client)
+	ex := niaucchi5.NewURTCP(remote)
+	defer cl.Close()
+	defer ex.Close()
+	go func() {
+		defer cl.Close()
+		defer ex.Close()
+		cfg.pump(cl, ex, cfg.OnDown)
+	}()
+	cfg.pump(ex, cl, cfg.OnUp)
+}
+
+func (cfg *Config) pump(dst, src *niaucchi5.URTCP, onSegment func(int)) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := src.RecvSegment(buf)
+		if err != nil {
+			return
+		}
+		if cfg.Limiter != nil {
+			cfg.Limiter.WaitN(context.Background(), n)
+		}
+		if onSegment != nil {
+			onSegment(n)
+		}
+		if err := dst.SendSegment(buf[:n], false); err != nil {
+			return
+		}
+	}
+}
+
+// Dial asks a bridge for URTCP to an exit, over bridgeConn, an established connection to the bridge. The exit is at niaucchi5.StandardAddr on the returned PacketConn.
+func Dial(bridgeConn net.Conn, exit string, exitCookie []byte) (net.PacketConn, error) {
+	bridgeConn.SetDeadline(time.Now().Add(time.Second * 30))
+	rlp.Encode(bridgeConn, "conn/urtcp")
+	rlp.Encode(bridgeConn, exit)
+	rlp.Encode(bridgeConn, exitCookie)
+	// the go-ahead is a single byte, after which the connection is all URTCP
+	if _, err := io.ReadFull(bridgeConn, make([]byte, 1)); err != nil {
+		return nil, err
+	}
+	bridgeConn.SetDeadline(time.Time{})
+	return niaucchi5.ToPacketConn(niaucchi5.NewURTCP(bridgeConn)), nil
+}
+
+// ServeExit serves KCP over URTCP on an exit's listener, which exits bind to ExitPort. Connections must open with a cshirt2 handshake with cookie. It calls handle with every new session, and returns once listener is closed.
+func ServeExit(listener net.Listener, cookie []byte, handle func(*kcp.UDPSession)) error {
+	urtcp := niaucchi5.ListenWith(listener, func(conn net.Conn) (net.Conn, error) {
+		deadline := time.Now().Add(time.Second * 10)
+		conn.SetDeadline(deadline)
+		obfs, err := cshirt2.Server(cookie, false, conn, deadline)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return obfs, nil
+	})
+	kcpListener := niaucchi4.ListenKCP(urtcp)
+	defer kcpListener.Close()
+	for {
+		rc, err := kcpListener.Accept()
+		if err != nil {
+			return err
+		}
+		rc.SetStreamMode(true)
+		go handle(rc)
+	}
+}
@@ -0,0 +1,345 @@
+package warpfront
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Carriers are the ways a session can travel through a front. WebSockets and HTTP/2 streams carry a whole session in one long-lived request, which is much cheaper than polling, but not every CDN passes them through.
+const (
+	CarrierWebSocket = "ws"
+	CarrierHTTP2     = "h2"
+	CarrierPoll      = "poll"
+)
+
+// carrierOrder is the order carriers are tried in, best first.
+var carrierOrder = []string{CarrierWebSocket, CarrierHTTP2, CarrierPoll}
+
+// carrierTimeout is how long setting up a WebSocket or HTTP/2 stream may take before we try the next carrier.
+const carrierTimeout = 10 * time.Second
+
+// Dial returns a warpfront session over the best carrier the front supports out of the given ones, trying the next whenever one fails. With no carriers given, it only polls, like Connect.
+func Dial(client *http.Client, frontHost string, realHost string, token string, carriers []string) (conn net.Conn, err error) {
+	supported := make(map[string]bool)
+	for _, c := range carriers {
+		supported[c] = true
+	}
+	if len(carriers) == 0 {
+		supported[CarrierPoll] = true
+	}
+	err = errors.New("warpfront: no known carriers")
+	for _, c := range carrierOrder {
+		if !supported[c] {
+			continue
+		}
+		switch c {
+		case CarrierWebSocket:
+			conn, err = dialWebSocket(client, frontHost, realHost, token)
+		case CarrierHTTP2:
+			conn, err = dialStream(client, frontHost, realHost, token)
+		case CarrierPoll:
+			conn, err = Connect(client, frontHost, realHost, token)
+		}
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// registerQuery returns the query registering a new session over a carrier.
+func registerQuery(token string) string {
+	num := make([]byte, 32)
+	rand.Read(num)
+	query := fmt.Sprintf("id=%x", num)
+	if token != "" {
+		query += "&token=" + token
+	}
+	return query
+}
+
+// shuttle moves bytes between a session and a carrier that streams both ways, until either dies. onRead and onWrite, if not nil, are told how much went each way.
+func shuttle(sesh *session, in io.Reader, out io.Writer, onRead func(int), onWrite func(int)) {
+	defer sesh.Close()
+	go func() {
+		defer sesh.Close()
+		buf := make([]byte, maxFrame)
+		for {
+			n, err := in.Read(buf)
+			if n > 0 {
+				if onRead != nil {
+					onRead(n)
+				}
+				select {
+				case sesh.rx <- append([]byte(nil), buf[:n]...):
+				case <-sesh.ded:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case bts := <-sesh.tx:
+			if _, err := out.Write(bts); err != nil {
+				return
+			}
+			if onWrite != nil {
+				onWrite(len(bts))
+			}
+		case <-sesh.ded:
+			return
+		}
+	}
+}
+
+// flushWriter flushes every write, so that streamed responses aren't held back.
+type flushWriter struct {
+	wr http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.wr.Write(p)
+	fw.wr.(http.Flusher).Flush()
+	return n, err
+}
+
+// serveCarried serves a session carried by a single request until it dies.
+func (srv *Server) serveCarried(chs *session, in io.Reader, out io.Writer) {
+	chs.begin()
+	defer chs.end()
+	shuttle(chs, in, out,
+		func(n int) { atomic.AddUint64(&srv.bytesUp, uint64(n)) },
+		func(n int) { atomic.AddUint64(&srv.bytesDown, uint64(n)) })
+}
+
+func (srv *Server) handleWebSocket(wr http.ResponseWriter, rq *http.Request) {
+	chs := newSession()
+	sesh, status := srv.addSession(rq, chs)
+	if status != http.StatusOK {
+		wr.WriteHeader(status)
+		return
+	}
+	defer srv.destroySession(sesh)
+	websocket.Server{
+		// fronts rewrite origins however they like, and tokens already keep strangers out
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			if srv.offerSession(sesh, chs) {
+				srv.serveCarried(chs, ws, ws)
+			}
+		},
+	}.ServeHTTP(wr, rq)
+}
+
+func (srv *Server) handleStream(wr http.ResponseWriter, rq *http.Request) {
+	wr.Header().Set("Cache-Control", "no-cache, no-store")
+	// HTTP/1.1 fronts buffer whole requests, so streams only work over HTTP/2
+	if rq.ProtoMajor != 2 {
+		wr.WriteHeader(http.StatusHTTPVersionNotSupported)
+		return
+	}
+	chs := newSession()
+	sesh, status := srv.addSession(rq, chs)
+	if status != http.StatusOK {
+		wr.WriteHeader(status)
+		return
+	}
+	defer srv.destroySession(sesh)
+	if !srv.offerSession(sesh, chs) {
+		wr.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	wr.Header().Set("Content-Type", "application/octet-stream")
+	wr.WriteHeader(http.StatusOK)
+	wr.(http.Flusher).Flush()
+	srv.serveCarried(chs, rq.Body, flushWriter{wr})
+}
+
+// dialWebSocket carries a session over a WebSocket to the front.
+func dialWebSocket(client *http.Client, frontHost string, realHost string, token string) (net.Conn, error) {
+	front, err := url.Parse(frontHost)
+	if err != nil {
+		return nil, err
+	}
+	if realHost == "" {
+		realHost = front.Host
+	}
+	scheme, port := "ws", "80"
+	if front.Scheme == "https" {
+		scheme, port = "wss", "443"
+	}
+	addr := front.Host
+	if front.Port() == "" {
+		addr = net.JoinHostPort(front.Hostname(), port)
+	}
+	config, err := websocket.NewConfig(
+		fmt.Sprintf("%v://%v%v/ws?%v", scheme, realHost, front.Path, registerQuery(token)),
+		fmt.Sprintf("https://%v/", realHost))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), carrierTimeout)
+	defer cancel()
+	raw, err := dialFront(ctx, client, front, addr)
+	if err != nil {
+		return nil, err
+	}
+	raw.SetDeadline(time.Now().Add(carrierTimeout))
+	if scheme == "wss" {
+		tlsConf := &tls.Config{}
+		if tr, ok := client.Transport.(*http.Transport); ok && tr.TLSClientConfig != nil {
+			tlsConf = tr.TLSClientConfig.Clone()
+		}
+		tlsConf.ServerName = front.Hostname()
+		raw = tls.Client(raw, tlsConf)
+	}
+	ws, err := websocket.NewClient(config, raw)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	sesh := newSession()
+	go shuttle(sesh, ws, ws, nil, nil)
+	go func() {
+		<-sesh.ded
+		ws.Close()
+	}()
+	return sesh, nil
+}
+
+// dialFront connects to the front the way the client's transport would, through its proxy and dialer, so that WebSockets take the same path as the other carriers.
+func dialFront(ctx context.Context, client *http.Client, front *url.URL, addr string) (conn net.Conn, err error) {
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	dial := (&net.Dialer{}).DialContext
+	var proxy *url.URL
+	if tr, ok := rt.(*http.Transport); ok {
+		if tr.DialContext != nil {
+			dial = tr.DialContext
+		}
+		if tr.Proxy != nil {
+			proxy, err = tr.Proxy(&http.Request{URL: front, Header: make(http.Header)})
+			if err != nil {
+				return
+			}
+		}
+	}
+	if proxy == nil {
+		return dial(ctx, "tcp", addr)
+	}
+	if proxy.Scheme != "http" {
+		err = fmt.Errorf("warpfront: can't carry WebSockets through %v proxies", proxy.Scheme)
+		return
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err = dial(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// tunnel through the proxy with CONNECT
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return
+	}
+	// the tunnel starts right after the headers, so the body isn't read
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		err = fmt.Errorf("warpfront: proxy refused CONNECT with status %v", resp.StatusCode)
+	}
+	return
+}
+
+// dialStream carries a session over a bidirectional HTTP/2 stream to the front: a POST whose body and response never end.
+func dialStream(client *http.Client, frontHost string, realHost string, token string) (net.Conn, error) {
+	// the standard transport only speaks HTTP/2 over TLS
+	if !strings.HasPrefix(frontHost, "https://") {
+		return nil, errors.New("warpfront: HTTP/2 streams need https")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	// an HTTP/1.1 front answers without reading the body, and the transport waits for it to end
+	go func() {
+		<-ctx.Done()
+		pw.Close()
+	}()
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%v/stream?%v", frontHost, registerQuery(token)), pr)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Host = realHost
+	req.Header.Add("Content-Type", "application/octet-stream")
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	// not client.Do, whose timeout would cut the stream
+	timer := time.AfterFunc(carrierTimeout, cancel)
+	resp, err := transport.RoundTrip(req)
+	if !timer.Stop() && err == nil {
+		resp.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		cancel()
+		resp.Body.Close()
+		return nil, fmt.Errorf("warpfront: can't stream (%v, status %v)", resp.Proto, resp.StatusCode)
+	}
+	sesh := newSession()
+	go shuttle(sesh, resp.Body, pw, nil, nil)
+	go func() {
+		<-sesh.ded
+		resp.Body.Close()
+		cancel()
+	}()
+	return sesh, nil
+}
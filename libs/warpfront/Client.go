@@ -14,8 +14,8 @@ import (
 	"golang.org/x/time/rate"
 )
 
-func getWithHost(client *http.Client, url string, host string) (resp *http.Response, err error) {
-	req, err := http.NewRequest("GET", url, nil)
+func getWithHost(ctx context.Context, client *http.Client, url string, host string) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return
 	}
@@ -23,8 +23,8 @@ func getWithHost(client *http.Client, url string, host string) (resp *http.Respo
 	return client.Do(req)
 }
 
-func postWithHost(client *http.Client, url string, host string, body io.Reader) (resp *http.Response, err error) {
-	req, err := http.NewRequest("POST", url, body)
+func postWithHost(ctx context.Context, client *http.Client, url string, host string, body io.Reader) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, body)
 	if err != nil {
 		return
 	}
@@ -33,19 +33,36 @@ func postWithHost(client *http.Client, url string, host string, body io.Reader)
 	return client.Do(req)
 }
 
-// Connect returns a warpfront session connected to the given front and real host. The front must contain a protocol scheme (http:// or https://).
-func Connect(client *http.Client, frontHost string, realHost string) (net.Conn, error) {
+// Connect returns a warpfront session connected to the given front and real host. The front must contain a protocol scheme (http:// or https://). The token comes from Token, for servers that need one. It uses the v2 protocol, unless the server only speaks v1.
+func Connect(client *http.Client, frontHost string, realHost string, token string) (net.Conn, error) {
 	// generate session number
 	num := make([]byte, 32)
 	rand.Read(num)
 	// register our session
-	resp, err := getWithHost(client, fmt.Sprintf("%v/register?id=%x", frontHost, num), realHost)
+	url := fmt.Sprintf("%v/register?id=%x&v=2", frontHost, num)
+	if token != "" {
+		url += "&token=" + token
+	}
+	resp, err := getWithHost(context.Background(), client, url, realHost)
+	if err != nil {
+		return nil, err
+	}
+	banner, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	resp.Body.Close()
 	if err != nil {
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("bad status code: %v", resp.StatusCode)
 	}
+	if string(banner) == v2Banner {
+		return connectV2(client, frontHost, realHost, num), nil
+	}
+	return connectV1(client, frontHost, realHost, num), nil
+}
+
+// connectV1 runs a v1 session, where any failed request kills the session.
+func connectV1(client *http.Client, frontHost string, realHost string, num []byte) net.Conn {
 	sesh := newSession()
 
 	emptyGetLimiter := rate.NewLimiter(1, 10)
@@ -54,7 +71,7 @@ func Connect(client *http.Client, frontHost string, realHost string) (net.Conn,
 		defer sesh.Close()
 		// poll and stuff into rx
 		for i := 0; ; i++ {
-			resp, err := getWithHost(client,
+			resp, err := getWithHost(context.Background(), client,
 				fmt.Sprintf("%v/%x?serial=%v", frontHost, num, i),
 				realHost)
 			if err != nil {
@@ -113,7 +130,7 @@ func Connect(client *http.Client, frontHost string, realHost string) (net.Conn,
 			case bts := <-sesh.tx:
 				buff.Write(bts)
 				if buff.Len() > 0 {
-					resp, err := postWithHost(client,
+					resp, err := postWithHost(context.Background(), client,
 						fmt.Sprintf("%v/%x?serial=%v", frontHost, num, i),
 						realHost,
 						buff)
@@ -133,9 +150,9 @@ func Connect(client *http.Client, frontHost string, realHost string) (net.Conn,
 	// couple closing the session with deletion
 	go func() {
 		<-sesh.ded
-		getWithHost(client, fmt.Sprintf("%v/delete?id=%x", frontHost, num), realHost)
+		getWithHost(context.Background(), client, fmt.Sprintf("%v/delete?id=%x", frontHost, num), realHost)
 	}()
 
 	// return the sesh
-	return sesh, nil
+	return sesh
 }
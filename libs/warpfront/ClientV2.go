@@ -0,0 +1,236 @@
+package warpfront
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxInflight is how many GETs, and how many POSTs, a v2 session keeps in flight at most.
+var MaxInflight = 4
+
+// ResumeTimeout is how long a v2 session survives without any request getting through, for example while a CDN resets connections.
+var ResumeTimeout = time.Minute
+
+const (
+	idleHold  = 20 * time.Second // how long idle GETs are held by the server
+	busyFor   = 2 * time.Second  // a session is busy for this long after receiving data
+	clientRTO = 30 * time.Second // frames whose POST didn't come back for this long go out again
+)
+
+// errSessionGone means the server no longer knows the session.
+type errSessionGone int
+
+func (e errSessionGone) Error() string {
+	return fmt.Sprintf("warpfront: session gone (status %v)", int(e))
+}
+
+type clientV2 struct {
+	client   *http.Client
+	url      string
+	realHost string
+	sesh     *session
+	up       *sender
+	down     *receiver
+
+	lost int32 // set when a GET failed, so the next one asks for retransmission
+
+	ctx context.Context // cancelled when the session dies, abandoning its requests
+
+	lock     sync.Mutex
+	lastOK   time.Time
+	lastData time.Time
+	wake     chan struct{}
+}
+
+// connectV2 runs a v2 session. Any request can fail without killing it: lost POSTs are sent again, and lost GETs make the server retransmit. One GET always waits at the server, so that data goes out as soon as there is some, and more join it while data is flowing.
+func connectV2(client *http.Client, frontHost string, realHost string, num []byte) *session {
+	cv := &clientV2{
+		client:   client,
+		url:      fmt.Sprintf("%v/%x", frontHost, num),
+		realHost: realHost,
+		sesh:     newSession(),
+		up:       newSender(),
+		down:     newReceiver(),
+		lastOK:   time.Now(),
+		wake:     make(chan struct{}),
+	}
+	cv.sesh.version = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	cv.ctx = ctx
+	go pump(cv.sesh, cv.up)
+	for i := 0; i < MaxInflight; i++ {
+		go cv.pollLoop(i)
+		go cv.postLoop()
+	}
+	go func() {
+		<-cv.sesh.ded
+		cancel()
+		getWithHost(context.Background(), client, fmt.Sprintf("%v/delete?id=%x", frontHost, num), realHost)
+	}()
+	return cv.sesh
+}
+
+// succeeded notes that a request got through. withData says whether it carried data from the server.
+func (cv *clientV2) succeeded(withData bool) {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+	cv.lastOK = time.Now()
+	if withData {
+		cv.lastData = cv.lastOK
+		close(cv.wake)
+		cv.wake = make(chan struct{})
+	}
+}
+
+// failed notes that a request failed, killing the session if nothing got through for too long or the server forgot it. It then waits before the next try.
+func (cv *clientV2) failed(err error, backoff *time.Duration) {
+	cv.lock.Lock()
+	dead := time.Since(cv.lastOK) > ResumeTimeout
+	cv.lock.Unlock()
+	if _, ok := err.(errSessionGone); ok || dead {
+		cv.sesh.Close()
+		return
+	}
+	if *backoff == 0 {
+		*backoff = 50 * time.Millisecond
+	} else if *backoff < 5*time.Second {
+		*backoff *= 2
+	}
+	select {
+	case <-time.After(*backoff):
+	case <-cv.sesh.ded:
+	}
+}
+
+// idle returns a channel that is closed when the session gets busy, or nil if it's busy already.
+func (cv *clientV2) idle() chan struct{} {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+	if time.Since(cv.lastData) < busyFor {
+		return nil
+	}
+	return cv.wake
+}
+
+func (cv *clientV2) checkStatus(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest, http.StatusNotFound:
+		return errSessionGone(resp.StatusCode)
+	default:
+		return fmt.Errorf("unexpected status code %v", resp.StatusCode)
+	}
+}
+
+func (cv *clientV2) pollLoop(i int) {
+	var backoff time.Duration
+	for {
+		// only the first poller runs while idle
+		if i > 0 {
+			if wake := cv.idle(); wake != nil {
+				select {
+				case <-wake:
+				case <-cv.sesh.ded:
+					return
+				}
+			}
+		}
+		select {
+		case <-cv.sesh.ded:
+			return
+		default:
+		}
+		got, err := cv.poll()
+		if err != nil {
+			atomic.StoreInt32(&cv.lost, 1)
+			cv.failed(err, &backoff)
+			continue
+		}
+		backoff = 0
+		cv.succeeded(got > 0)
+	}
+}
+
+func (cv *clientV2) poll() (got int, err error) {
+	url := fmt.Sprintf("%v?ack=%v&wait=%v", cv.url, cv.down.acked(), int64(idleHold/time.Millisecond))
+	if atomic.SwapInt32(&cv.lost, 0) == 1 {
+		url += "&lost=1"
+	}
+	resp, err := getWithHost(cv.ctx, cv.client, url, cv.realHost)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if err = cv.checkStatus(resp); err != nil {
+		return
+	}
+	for {
+		seq, data, e := readFrame(resp.Body)
+		if e == io.EOF {
+			return
+		}
+		if e != nil {
+			err = e
+			return
+		}
+		got++
+		if !cv.down.push(seq, data, cv.sesh.rx, cv.sesh.ded) {
+			err = io.ErrClosedPipe
+			return
+		}
+	}
+}
+
+func (cv *clientV2) postLoop() {
+	var backoff time.Duration
+	for {
+		due, changed := cv.up.take(maxBody, clientRTO)
+		if len(due) == 0 {
+			select {
+			case <-changed:
+			case <-time.After(clientRTO):
+			case <-cv.sesh.ded:
+				return
+			}
+			continue
+		}
+		if err := cv.post(due); err != nil {
+			cv.up.retry(due)
+			cv.failed(err, &backoff)
+			continue
+		}
+		backoff = 0
+		cv.succeeded(false)
+	}
+}
+
+func (cv *clientV2) post(frames []*sentFrame) error {
+	buf := new(bytes.Buffer)
+	for _, f := range frames {
+		writeFrame(buf, f.seq, f.data)
+	}
+	resp, err := postWithHost(cv.ctx, cv.client, cv.url, cv.realHost, buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := cv.checkStatus(resp); err != nil {
+		return err
+	}
+	ack := make([]byte, 8)
+	if _, err := io.ReadFull(resp.Body, ack); err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	cv.up.ack(binary.BigEndian.Uint64(ack), false)
+	return nil
+}
@@ -0,0 +1,209 @@
+package warpfront
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Warpfront v2 carries each direction as numbered frames, so that lost HTTP requests can be retried and several can be in flight at once. A frame is
+//
+//   [8-byte sequence number][4-byte length][data]
+//
+// and POST and GET bodies are just frames back to back.
+
+// maxFrame is the largest frame we send. Bigger writes are split.
+const maxFrame = 65536
+
+// reorderWindow is how far ahead of the next expected frame we buffer frames. Frames beyond it are dropped and will be retransmitted.
+const reorderWindow = 4096
+
+var errBadFrame = errors.New("warpfront: bad frame")
+
+func writeFrame(w io.Writer, seq uint64, data []byte) error {
+	hdr := make([]byte, 12)
+	binary.BigEndian.PutUint64(hdr, seq)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(data)))
+	_, err := w.Write(append(hdr, data...))
+	return err
+}
+
+// readFrame reads a frame. It returns io.EOF only if the body ended cleanly between frames.
+func readFrame(r io.Reader) (seq uint64, data []byte, err error) {
+	hdr := make([]byte, 12)
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return
+	}
+	seq = binary.BigEndian.Uint64(hdr)
+	length := binary.BigEndian.Uint32(hdr[8:])
+	if length > maxFrame {
+		err = errBadFrame
+		return
+	}
+	data = make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// splitFrames cuts a write into frame-sized pieces.
+func splitFrames(bts []byte) (pieces [][]byte) {
+	for len(bts) > maxFrame {
+		pieces = append(pieces, bts[:maxFrame])
+		bts = bts[maxFrame:]
+	}
+	return append(pieces, bts)
+}
+
+// receiver puts frames that may arrive more than once and out of order back in sequence, and delivers them to a session.
+type receiver struct {
+	lock    sync.Mutex
+	next    uint64
+	pending map[uint64][]byte
+
+	deliver sync.Mutex
+}
+
+func newReceiver() *receiver {
+	return &receiver{pending: make(map[uint64][]byte)}
+}
+
+// acked returns the sequence number of the first frame not received yet.
+func (rv *receiver) acked() uint64 {
+	rv.lock.Lock()
+	defer rv.lock.Unlock()
+	return rv.next
+}
+
+// push accepts a frame, delivering whatever is now in sequence to rx. It returns false if the session died while delivering.
+func (rv *receiver) push(seq uint64, data []byte, rx chan []byte, ded chan bool) bool {
+	rv.deliver.Lock()
+	defer rv.deliver.Unlock()
+	rv.lock.Lock()
+	if seq >= rv.next && seq < rv.next+reorderWindow {
+		rv.pending[seq] = data
+	}
+	var ready [][]byte
+	for {
+		bts, ok := rv.pending[rv.next]
+		if !ok {
+			break
+		}
+		delete(rv.pending, rv.next)
+		rv.next++
+		if len(bts) > 0 {
+			ready = append(ready, bts)
+		}
+	}
+	rv.lock.Unlock()
+	for _, bts := range ready {
+		select {
+		case rx <- bts:
+		case <-ded:
+			return false
+		}
+	}
+	return true
+}
+
+// sentFrame is a frame waiting to be acknowledged.
+type sentFrame struct {
+	seq    uint64
+	data   []byte
+	sentAt time.Time
+}
+
+// sender keeps the frames of one direction until they're acknowledged, handing them out to whichever request can carry them. Frames that weren't acknowledged for a while, or that the peer says it lost, are handed out again.
+type sender struct {
+	lock    sync.Mutex
+	nextSeq uint64
+	frames  []*sentFrame
+	notify  chan struct{}
+}
+
+func newSender() *sender {
+	return &sender{notify: make(chan struct{})}
+}
+
+// add queues a frame, waiting while too many frames are unacknowledged. It returns false if the session died while waiting.
+func (sd *sender) add(data []byte, limit int, ded chan bool) bool {
+	sd.lock.Lock()
+	for len(sd.frames) >= limit {
+		changed := sd.notify
+		sd.lock.Unlock()
+		select {
+		case <-changed:
+		case <-ded:
+			return false
+		}
+		sd.lock.Lock()
+	}
+	defer sd.lock.Unlock()
+	sd.frames = append(sd.frames, &sentFrame{seq: sd.nextSeq, data: data})
+	sd.nextSeq++
+	close(sd.notify)
+	sd.notify = make(chan struct{})
+	return true
+}
+
+// ack drops frames the peer has received, and, if it lost some, makes the rest go out again.
+func (sd *sender) ack(acked uint64, lost bool) {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	i := 0
+	for i < len(sd.frames) && sd.frames[i].seq < acked {
+		i++
+	}
+	if i > 0 {
+		sd.frames = append([]*sentFrame(nil), sd.frames[i:]...)
+		close(sd.notify)
+		sd.notify = make(chan struct{})
+	}
+	if lost {
+		for _, f := range sd.frames {
+			f.sentAt = time.Time{}
+		}
+	}
+}
+
+// retry makes frames whose request failed go out again.
+func (sd *sender) retry(failed []*sentFrame) {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	for _, f := range failed {
+		f.sentAt = time.Time{}
+	}
+	close(sd.notify)
+	sd.notify = make(chan struct{})
+}
+
+// take hands out up to limit bytes of frames that are due, and a channel that is closed when that might change.
+func (sd *sender) take(limit int, rto time.Duration) (due []*sentFrame, changed chan struct{}) {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	now := time.Now()
+	total := 0
+	for _, f := range sd.frames {
+		if total >= limit {
+			break
+		}
+		if f.sentAt.IsZero() || now.Sub(f.sentAt) > rto {
+			f.sentAt = now
+			due = append(due, f)
+			total += len(f.data)
+		}
+	}
+	return due, sd.notify
+}
+
+// unacked returns how many frames are waiting for acknowledgement.
+func (sd *sender) unacked() int {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	return len(sd.frames)
+}
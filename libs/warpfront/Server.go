@@ -2,17 +2,32 @@ package warpfront
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Server wraps around the packet server
 type Server struct {
+	// counters come first, so that they're aligned for atomic access on 32-bit platforms
+	registered uint64
+	rejected   uint64
+	bytesUp    uint64
+	bytesDown  uint64
+	polls      uint64
+	posts      uint64
+
+	cfg      ServerConfig
 	sessions map[string]*session
+	perIP    map[string]int
 	seshch   chan *session
 	dedch    chan bool
 
@@ -20,22 +35,116 @@ type Server struct {
 	sync.Mutex
 }
 
+// ServerConfig configures a warpfront server. Zero values pick the defaults.
+type ServerConfig struct {
+	Secret           []byte        // if set, registrations need a token from Token
+	IdleTimeout      time.Duration // sessions without requests for this long are destroyed, 2 minutes by default
+	MaxSessions      int           // sessions at once, 10000 by default
+	MaxSessionsPerIP int           // sessions at once per front IP, 1000 by default; fronts are CDN edges carrying many clients
+}
+
 // NewServer creates a http.Handler for warpfront.
-func NewServer() *Server {
-	return &Server{
+func NewServer(cfg ServerConfig) *Server {
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 2 * time.Minute
+	}
+	if cfg.MaxSessions <= 0 {
+		cfg.MaxSessions = 10000
+	}
+	if cfg.MaxSessionsPerIP <= 0 {
+		cfg.MaxSessionsPerIP = 1000
+	}
+	srv := &Server{
+		cfg:      cfg,
 		sessions: make(map[string]*session),
+		perIP:    make(map[string]int),
 		seshch:   make(chan *session),
+		dedch:    make(chan bool),
 	}
+	go srv.gcLoop()
+	return srv
 }
 
 // Close destroys the warpfront context.
 func (srv *Server) Close() error {
 	srv.once.Do(func() {
 		close(srv.dedch)
+		srv.Lock()
+		for _, chs := range srv.sessions {
+			chs.Close()
+		}
+		srv.Unlock()
 	})
 	return nil
 }
 
+// Token returns the registration token for a server with the given secret. It is valid on the day of t and the day after.
+func Token(secret []byte, t time.Time) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "warpfront-token-%v", t.Unix()/86400)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (srv *Server) checkToken(token string) bool {
+	if srv.cfg.Secret == nil {
+		return true
+	}
+	now := time.Now()
+	return hmac.Equal([]byte(token), []byte(Token(srv.cfg.Secret, now))) ||
+		hmac.Equal([]byte(token), []byte(Token(srv.cfg.Secret, now.Add(-24*time.Hour))))
+}
+
+// gcLoop destroys sessions that clients abandoned without deleting them.
+func (srv *Server) gcLoop() {
+	ticker := time.NewTicker(srv.cfg.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-srv.dedch:
+			return
+		}
+		var idle []string
+		srv.Lock()
+		for key, chs := range srv.sessions {
+			if chs.idleFor() > srv.cfg.IdleTimeout {
+				idle = append(idle, key)
+			}
+		}
+		srv.Unlock()
+		for _, key := range idle {
+			srv.destroySession(key)
+		}
+	}
+}
+
+// Stats are a server's counters.
+type Stats struct {
+	Sessions   int    // sessions right now
+	Registered uint64 // sessions ever registered
+	Rejected   uint64 // registrations rejected for bad tokens or limits
+	BytesUp    uint64 // bytes from clients
+	BytesDown  uint64 // bytes to clients
+	Polls      uint64 // GETs served
+	Posts      uint64 // POSTs served
+}
+
+// Stats returns the server's counters.
+func (srv *Server) Stats() Stats {
+	srv.Lock()
+	sessions := len(srv.sessions)
+	srv.Unlock()
+	return Stats{
+		Sessions:   sessions,
+		Registered: atomic.LoadUint64(&srv.registered),
+		Rejected:   atomic.LoadUint64(&srv.rejected),
+		BytesUp:    atomic.LoadUint64(&srv.bytesUp),
+		BytesDown:  atomic.LoadUint64(&srv.bytesDown),
+		Polls:      atomic.LoadUint64(&srv.polls),
+		Posts:      atomic.LoadUint64(&srv.posts),
+	}
+}
+
 // Accept accepts a warpfront session.
 func (srv *Server) Accept() (net.Conn, error) {
 	select {
@@ -54,6 +163,10 @@ func (srv *Server) destroySession(key string) {
 	if ok {
 		chs.Close()
 		delete(srv.sessions, key)
+		srv.perIP[chs.frontIP]--
+		if srv.perIP[chs.frontIP] <= 0 {
+			delete(srv.perIP, chs.frontIP)
+		}
 	}
 }
 
@@ -68,35 +181,70 @@ func (srv *Server) handleDelete(wr http.ResponseWriter, rq *http.Request) {
 }
 
 func (srv *Server) handleRegister(wr http.ResponseWriter, rq *http.Request) {
-	sesh := rq.URL.Query().Get("id")
-	if sesh == "" {
-		wr.WriteHeader(http.StatusBadRequest)
+	wr.Header().Set("cache-control", "no-cache")
+	chs := newSession()
+	v2 := rq.URL.Query().Get("v") == "2"
+	if v2 {
+		chs.version = 2
+		chs.up = newReceiver()
+		chs.down = newSender()
+	}
+	sesh, status := srv.addSession(rq, chs)
+	if status != http.StatusOK {
+		wr.WriteHeader(status)
 		return
 	}
-	wr.Header().Set("cache-control", "no-cache")
+	if !srv.offerSession(sesh, chs) {
+		wr.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	wr.WriteHeader(http.StatusOK)
+	if v2 {
+		wr.Write([]byte(v2Banner))
+		go pump(chs, chs.down)
+	}
+}
+
+// addSession registers a session under the id in a request, checking its token and our limits. It returns the status to fail the request with if it can't.
+func (srv *Server) addSession(rq *http.Request, chs *session) (sesh string, status int) {
+	sesh = rq.URL.Query().Get("id")
+	if sesh == "" {
+		return "", http.StatusBadRequest
+	}
+	if !srv.checkToken(rq.URL.Query().Get("token")) {
+		atomic.AddUint64(&srv.rejected, 1)
+		return "", http.StatusForbidden
+	}
+	frontIP, _, _ := net.SplitHostPort(rq.RemoteAddr)
 	srv.Lock()
-	_, ok := srv.sessions[sesh]
+	defer srv.Unlock()
 	// reject if already exists
-	if ok {
-		wr.WriteHeader(http.StatusForbidden)
-		srv.Unlock()
-		return
+	if _, ok := srv.sessions[sesh]; ok {
+		return "", http.StatusForbidden
 	}
-	// otherwise, we initialize
-	chs := newSession()
+	if len(srv.sessions) >= srv.cfg.MaxSessions || srv.perIP[frontIP] >= srv.cfg.MaxSessionsPerIP {
+		atomic.AddUint64(&srv.rejected, 1)
+		return "", http.StatusServiceUnavailable
+	}
+	chs.frontIP = frontIP
 	srv.sessions[sesh] = chs
-	srv.Unlock()
-	// now we feed into the big chan
+	srv.perIP[frontIP]++
+	atomic.AddUint64(&srv.registered, 1)
+	return sesh, http.StatusOK
+}
+
+// offerSession hands a registered session to Accept, and destroys it once it dies. It gives up, destroying the session, if nobody accepts it.
+func (srv *Server) offerSession(sesh string, chs *session) bool {
 	select {
 	case srv.seshch <- chs:
-		wr.WriteHeader(http.StatusOK)
 		go func() {
 			<-chs.ded
 			srv.destroySession(sesh)
 		}()
+		return true
 	case <-time.After(time.Second * 1):
 		srv.destroySession(sesh)
-		wr.WriteHeader(http.StatusInternalServerError)
+		return false
 	}
 }
 
@@ -114,6 +262,16 @@ func (srv *Server) ServeHTTP(wr http.ResponseWriter, rq *http.Request) {
 		return
 	}
 
+	if key == "ws" {
+		srv.handleWebSocket(wr, rq)
+		return
+	}
+
+	if key == "stream" {
+		srv.handleStream(wr, rq)
+		return
+	}
+
 	// query for the session
 	srv.Lock()
 	chs, ok := srv.sessions[key]
@@ -123,6 +281,18 @@ func (srv *Server) ServeHTTP(wr http.ResponseWriter, rq *http.Request) {
 		wr.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	chs.begin()
+	defer chs.end()
+	if rq.Method == "GET" {
+		atomic.AddUint64(&srv.polls, 1)
+	} else {
+		atomic.AddUint64(&srv.posts, 1)
+	}
+
+	if chs.down != nil {
+		srv.serveV2(wr, rq, key, chs)
+		return
+	}
 
 	up, dn, ded := chs.rx, chs.tx, chs.ded
 
@@ -150,6 +320,7 @@ func (srv *Server) ServeHTTP(wr http.ResponseWriter, rq *http.Request) {
 					return
 				}
 				ctr += len(bts)
+				atomic.AddUint64(&srv.bytesDown, uint64(len(bts)))
 				wr.(http.Flusher).Flush()
 				delay = time.Millisecond * 5000
 			case <-time.After(delay):
@@ -175,6 +346,7 @@ func (srv *Server) ServeHTTP(wr http.ResponseWriter, rq *http.Request) {
 			srv.destroySession(key)
 			return
 		}
+		atomic.AddUint64(&srv.bytesUp, uint64(pkrd.Len()))
 		select {
 		case up <- pkrd.Bytes(): // TODO potential deadlock; currently mitigated by a buffer
 			return
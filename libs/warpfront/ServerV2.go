@@ -0,0 +1,114 @@
+package warpfront
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// v2Banner is what v2 servers answer registrations for v2 sessions with. Older servers answer with nothing, so clients know to fall back.
+const v2Banner = "warpfront/2"
+
+const (
+	maxUnacked = 256              // frames a direction keeps unacknowledged before writes block
+	maxBody    = 1024 * 1024      // bytes in one GET or POST body, so CDNs don't buffer too much
+	maxHold    = 30 * time.Second // longest a GET is held open waiting for data
+	linger     = 20 * time.Millisecond
+	serverRTO  = 5 * time.Second // frames unacknowledged for this long go out again
+)
+
+// pump moves what a session writes into a sender, in frames.
+func pump(sesh *session, sd *sender) {
+	for {
+		select {
+		case bts := <-sesh.tx:
+			for _, piece := range splitFrames(bts) {
+				if !sd.add(piece, maxUnacked, sesh.ded) {
+					return
+				}
+			}
+		case <-sesh.ded:
+			return
+		}
+	}
+}
+
+// serveV2 serves GETs and POSTs of a v2 session. GETs carry the client's acknowledgement and whether it lost a response, and are held until there's something to send or for as long as the client asks. POSTs are answered with our acknowledgement.
+func (srv *Server) serveV2(wr http.ResponseWriter, rq *http.Request, key string, chs *session) {
+	wr.Header().Set("Content-Type", "application/octet-stream")
+	wr.Header().Set("Cache-Control", "no-cache, no-store")
+	switch rq.Method {
+	case "GET":
+		query := rq.URL.Query()
+		if ack, err := strconv.ParseUint(query.Get("ack"), 10, 64); err == nil {
+			chs.down.ack(ack, query.Get("lost") == "1")
+		}
+		wait, _ := strconv.Atoi(query.Get("wait"))
+		hold := time.Duration(wait) * time.Millisecond
+		if hold > maxHold || hold < 0 {
+			hold = maxHold
+		}
+		wr.WriteHeader(http.StatusOK)
+		deadline := time.Now().Add(hold)
+		written := 0
+		for {
+			due, changed := chs.down.take(maxBody-written, serverRTO)
+			for i, f := range due {
+				if writeFrame(wr, f.seq, f.data) != nil {
+					chs.down.retry(due[i:])
+					return
+				}
+				written += len(f.data)
+				atomic.AddUint64(&srv.bytesDown, uint64(len(f.data)))
+			}
+			if len(due) > 0 {
+				wr.(http.Flusher).Flush()
+				if written >= maxBody {
+					return
+				}
+				// end soon, so the client sees the data even through CDNs that buffer whole responses
+				if d := time.Now().Add(linger); d.Before(deadline) {
+					deadline = d
+				}
+			}
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return
+			}
+			if remaining > serverRTO {
+				remaining = serverRTO
+			}
+			select {
+			case <-changed:
+			case <-time.After(remaining):
+			case <-rq.Context().Done():
+				return
+			case <-chs.ded:
+				return
+			}
+		}
+	case "POST":
+		body := http.MaxBytesReader(wr, rq.Body, maxBody+maxBody/8)
+		for {
+			seq, data, err := readFrame(body)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				wr.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			atomic.AddUint64(&srv.bytesUp, uint64(len(data)))
+			if !chs.up.push(seq, data, chs.rx, chs.ded) {
+				srv.destroySession(key)
+				return
+			}
+		}
+		ack := make([]byte, 8)
+		binary.BigEndian.PutUint64(ack, chs.up.acked())
+		wr.Write(ack)
+	}
+}
@@ -6,15 +6,26 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type session struct {
+	lastActive int64 // Unix nanoseconds, accessed atomically; first for alignment
+	inflight   int32 // requests being served
+
 	rx  chan []byte
 	tx  chan []byte
 	ded chan bool
 	buf *bytes.Buffer
 
+	version int
+	frontIP string
+
+	// v2 servers number frames here; v2 clients keep their own
+	up   *receiver
+	down *sender
+
 	readDeadline  *time.Timer
 	writeDeadline *time.Timer
 
@@ -27,7 +38,29 @@ func newSession() *session {
 		tx:  make(chan []byte),
 		ded: make(chan bool),
 		buf: new(bytes.Buffer),
+
+		version:    1,
+		lastActive: time.Now().UnixNano(),
+	}
+}
+
+// begin notes that a request for the session is being served. end notes that it's done.
+func (sess *session) begin() {
+	atomic.AddInt32(&sess.inflight, 1)
+	atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+}
+
+func (sess *session) end() {
+	atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+	atomic.AddInt32(&sess.inflight, -1)
+}
+
+// idleFor returns how long the session hasn't had any requests.
+func (sess *session) idleFor() time.Duration {
+	if atomic.LoadInt32(&sess.inflight) > 0 {
+		return 0
 	}
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&sess.lastActive))
 }
 
 func (sess *session) readDeadlineCh() <-chan time.Time {
@@ -0,0 +1,351 @@
+package warpfront
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected failure")
+
+// flakyTransport fails data requests at random, the ways a CDN might: before the request reaches the server, after the server handled it, or halfway through the response. While down is set, it fails everything.
+type flakyTransport struct {
+	base     http.RoundTripper
+	failRate float64
+	down     int32
+
+	lock sync.Mutex
+	rng  *mrand.Rand
+}
+
+func newFlakyTransport(failRate float64) *flakyTransport {
+	return &flakyTransport{
+		base:     &http.Transport{MaxIdleConnsPerHost: 16},
+		failRate: failRate,
+		rng:      mrand.New(mrand.NewSource(1)),
+	}
+}
+
+func (ft *flakyTransport) roll() (float64, int) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	return ft.rng.Float64(), ft.rng.Intn(3)
+}
+
+func (ft *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	control := strings.HasSuffix(req.URL.Path, "/register") || strings.HasSuffix(req.URL.Path, "/delete")
+	if control {
+		return ft.base.RoundTrip(req)
+	}
+	if atomic.LoadInt32(&ft.down) == 1 {
+		return nil, errInjected
+	}
+	p, how := ft.roll()
+	if p >= ft.failRate {
+		return ft.base.RoundTrip(req)
+	}
+	switch how {
+	case 0:
+		return nil, errInjected
+	case 1:
+		resp, err := ft.base.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, errInjected
+	default:
+		resp, err := ft.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = &truncatedBody{ReadCloser: resp.Body, left: 20}
+		return resp, nil
+	}
+}
+
+type truncatedBody struct {
+	io.ReadCloser
+	left int
+}
+
+func (tb *truncatedBody) Read(p []byte) (int, error) {
+	if tb.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > tb.left {
+		p = p[:tb.left]
+	}
+	n, err := tb.ReadCloser.Read(p)
+	tb.left -= n
+	return n, err
+}
+
+// echoServer runs a warpfront server that echoes every session.
+func echoServer(handler func(*Server) http.Handler) *httptest.Server {
+	return echoServerWith(NewServer(ServerConfig{}), handler)
+}
+
+func echoServerWith(srv *Server, handler func(*Server) http.Handler) *httptest.Server {
+	go echo(srv)
+	if handler == nil {
+		return httptest.NewServer(srv)
+	}
+	return httptest.NewServer(handler(srv))
+}
+
+// echo echoes every session a server accepts.
+func echo(srv *Server) {
+	for {
+		conn, err := srv.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// echoTest sends size bytes through an echoing session, checking that they come back intact.
+func echoTest(t *testing.T, conn net.Conn, size int, during func()) {
+	payload := make([]byte, size)
+	rand.Read(payload)
+	go func() {
+		for i := 0; i < len(payload); i += 10000 {
+			end := i + 10000
+			if end > len(payload) {
+				end = len(payload)
+			}
+			conn.Write(payload[i:end])
+			if i == len(payload)/2 && during != nil {
+				during()
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+	got := make([]byte, size)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload corrupted")
+	}
+}
+
+func TestV2SurvivesFailures(t *testing.T) {
+	ts := echoServer(nil)
+	defer ts.Close()
+	ft := newFlakyTransport(0.3)
+	conn, err := Connect(&http.Client{Transport: ft}, ts.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.(*session).version != 2 {
+		t.Fatal("didn't negotiate v2")
+	}
+	echoTest(t, conn, 1000000, nil)
+}
+
+func TestV2Resumes(t *testing.T) {
+	ts := echoServer(nil)
+	defer ts.Close()
+	ft := newFlakyTransport(0)
+	conn, err := Connect(&http.Client{Transport: ft}, ts.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a two-second outage halfway through, as when a CDN resets all connections
+	echoTest(t, conn, 200000, func() {
+		atomic.StoreInt32(&ft.down, 1)
+		time.AfterFunc(time.Second*2, func() { atomic.StoreInt32(&ft.down, 0) })
+	})
+}
+
+func TestV1Fallback(t *testing.T) {
+	// an old server ignores the version in registrations
+	ts := echoServer(func(srv *Server) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			q.Del("v")
+			r.URL.RawQuery = q.Encode()
+			srv.ServeHTTP(w, r)
+		})
+	})
+	defer ts.Close()
+	conn, err := Connect(&http.Client{}, ts.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.(*session).version != 1 {
+		t.Fatal("negotiated v2 with a v1 server")
+	}
+	echoTest(t, conn, 50000, nil)
+}
+
+func TestServerLimits(t *testing.T) {
+	secret := []byte("secret")
+	srv := NewServer(ServerConfig{Secret: secret, IdleTimeout: time.Second, MaxSessionsPerIP: 2})
+	defer srv.Close()
+	ts := echoServerWith(srv, nil)
+	defer ts.Close()
+	if _, err := Connect(&http.Client{}, ts.URL, "", "bad"); err == nil {
+		t.Fatal("registered with a bad token")
+	}
+	token := Token(secret, time.Now())
+	conn, err := Connect(&http.Client{}, ts.URL, "", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(t, conn, 1000, nil)
+	// an abandoned session, which never polls
+	resp, err := http.Get(ts.URL + "/register?id=abandoned&token=" + token)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("can't register", err)
+	}
+	resp.Body.Close()
+	if _, err := Connect(&http.Client{}, ts.URL, "", token); err == nil {
+		t.Fatal("went over the per-IP limit")
+	}
+	if stats := srv.Stats(); stats.Sessions != 2 || stats.Rejected != 2 || stats.BytesUp != 1000 {
+		t.Fatalf("wrong stats %+v", stats)
+	}
+	// the abandoned session gets collected, while the live one keeps going
+	time.Sleep(time.Second * 2)
+	if stats := srv.Stats(); stats.Sessions != 1 {
+		t.Fatal("idle session not collected", stats.Sessions)
+	}
+	echoTest(t, conn, 1000, nil)
+}
+
+func TestWebSocketCarrier(t *testing.T) {
+	ts := echoServer(nil)
+	defer ts.Close()
+	conn, err := Dial(&http.Client{}, ts.URL, "", "", []string{CarrierWebSocket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(t, conn, 1000000, nil)
+}
+
+func TestHTTP2Carrier(t *testing.T) {
+	srv := NewServer(ServerConfig{})
+	defer srv.Close()
+	go echo(srv)
+	ts := httptest.NewUnstartedServer(srv)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	conn, err := Dial(ts.Client(), ts.URL, "", "", []string{CarrierHTTP2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(t, conn, 1000000, nil)
+	if stats := srv.Stats(); stats.BytesUp != 1000000 || stats.Polls != 0 {
+		t.Fatalf("not streamed: %+v", stats)
+	}
+}
+
+func TestCarrierFallback(t *testing.T) {
+	// a front that passes neither WebSockets nor HTTP/2
+	ts := echoServer(func(srv *Server) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			srv.ServeHTTP(w, r)
+		})
+	})
+	defer ts.Close()
+	conn, err := Dial(&http.Client{}, ts.URL, "", "", []string{CarrierWebSocket, CarrierHTTP2, CarrierPoll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.(*session).version != 2 {
+		t.Fatal("didn't fall back to polling")
+	}
+	echoTest(t, conn, 50000, nil)
+}
+
+func TestWebSocketDialsThroughTransport(t *testing.T) {
+	ts := echoServer(nil)
+	defer ts.Close()
+	// the front's name doesn't resolve, so only the transport's dialer can reach it
+	dialed := int32(0)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+		},
+	}}
+	conn, err := Dial(client, "http://front.invalid", "real.invalid", "", []string{CarrierWebSocket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(t, conn, 10000, nil)
+	if atomic.LoadInt32(&dialed) != 1 {
+		t.Fatal("transport's dialer not used")
+	}
+	// and through the transport's proxy
+	var connected int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&connected, 1)
+		upstream, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		down, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			defer down.Close()
+			io.Copy(down, upstream)
+		}()
+		go func() {
+			defer upstream.Close()
+			io.Copy(upstream, down)
+		}()
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	conn, err = Dial(client, "http://front.invalid", "real.invalid", "", []string{CarrierWebSocket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoTest(t, conn, 10000, nil)
+	if atomic.LoadInt32(&connected) != 1 {
+		t.Fatal("transport's proxy not used")
+	}
+}